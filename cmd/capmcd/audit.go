@@ -0,0 +1,712 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+// Every call which changes, or tries to change, the power of components is
+// recorded in the audit log: who made it, from where, why, what it was made
+// for and how it went for each component. So are the power caps CAPMC sets
+// by itself, for schedules and reconciliation. Records are written to each
+// of the configured sinks, and the audit API returns them from the first
+// file sink, or from memory when there is none.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/syslog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+const (
+	// Defaults for the rotation of file audit sinks, the size in
+	// megabytes a file is rotated at and the rotated files kept.
+	defaultAuditMaxSize    = 100
+	defaultAuditMaxBackups = 10
+	// defaultAuditTag tags the records sent to syslog.
+	defaultAuditTag = "capmc-audit"
+	// auditMemoryRecords are kept for the audit API when there is no
+	// file sink.
+	auditMemoryRecords = 1000
+	// defaultAuditLimit is the most records the audit API returns when
+	// the caller doesn't give a limit.
+	defaultAuditLimit = 100
+	// maxRecordSize is the longest audit record or operation read back
+	// from a file.
+	maxRecordSize = 16 * 1024 * 1024
+	// auditQueueSize records are queued for each sink before recording
+	// waits for the sink to catch up.
+	auditQueueSize = 1000
+	// auditSyslogDialTimeout bounds connecting to a remote syslog.
+	auditSyslogDialTimeout = 10 * time.Second
+	// auditSystemCaller is the caller of the changes CAPMC makes by
+	// itself, such as applying power cap schedules.
+	auditSystemCaller = "capmc"
+)
+
+// auditSink is a destination of audit records.
+type auditSink interface {
+	// write writes rec, the JSON encoding of the record with ID id.
+	write(id string, rec []byte) error
+	close() error
+}
+
+// auditLog writes audit records to the audit sinks and answers queries
+// for them. Each sink is written in the background from its own queue, so a
+// slow or unreachable sink holds up neither the calls being recorded nor
+// the other sinks.
+type auditLog struct {
+	sinks   []auditSink
+	file    *auditFileSink
+	writers []*auditWriter
+	// pending counts the records queued and not yet written.
+	pending sync.WaitGroup
+
+	// closing is held to queue records, and exclusively to close the
+	// queues.
+	closing sync.RWMutex
+	closed  bool
+
+	mu     sync.Mutex // guards recent
+	recent []capmc.AuditRecord
+}
+
+// auditWriter writes the records queued for a sink.
+type auditWriter struct {
+	sink  auditSink
+	queue chan auditEntry
+	done  chan struct{}
+}
+
+type auditEntry struct {
+	id  string
+	rec []byte
+}
+
+// newAuditLog creates an audit log writing to sinks, ignoring those which
+// are not valid. HTTP sinks without their own secret are signed with secret,
+// and deliveries to them retried as webhooks are.
+func newAuditLog(sinks []AuditSink, secret string, retries int, delay time.Duration) *auditLog {
+	a := &auditLog{}
+	for _, s := range sinks {
+		sink, err := newAuditSink(s, secret, retries, delay)
+		if err != nil {
+			log.Printf("Warning: ignoring audit sink: %s", err)
+			continue
+		}
+		if fs, ok := sink.(*auditFileSink); ok && a.file == nil {
+			a.file = fs
+		}
+		a.sinks = append(a.sinks, sink)
+	}
+	a.start()
+
+	return a
+}
+
+// start starts writing to the sinks.
+func (a *auditLog) start() {
+	for _, sink := range a.sinks {
+		w := &auditWriter{
+			sink:  sink,
+			queue: make(chan auditEntry, auditQueueSize),
+			done:  make(chan struct{}),
+		}
+		a.writers = append(a.writers, w)
+		go w.run(&a.pending)
+	}
+}
+
+func (w *auditWriter) run(pending *sync.WaitGroup) {
+	defer close(w.done)
+
+	for e := range w.queue {
+		if err := w.sink.write(e.id, e.rec); err != nil {
+			log.Printf("Error: writing audit record %s: %s", e.id, err)
+		}
+		pending.Done()
+	}
+}
+
+func newAuditSink(s AuditSink, secret string, retries int, delay time.Duration) (auditSink, error) {
+	switch strings.ToLower(s.Type) {
+	case "file":
+		if s.Path == "" {
+			return nil, errors.New("file audit sink without a Path")
+		}
+		return newAuditFileSink(s.Path, s.MaxSize, s.MaxBackups), nil
+	case "syslog":
+		tag := s.Tag
+		if tag == "" {
+			tag = defaultAuditTag
+		}
+		return &auditSyslogSink{network: s.Network, address: s.Address,
+			tag: tag}, nil
+	case "http":
+		if checkCallbackURL(s.URL) != nil {
+			return nil, fmt.Errorf("invalid audit sink URL '%s'", s.URL)
+		}
+		if s.Secret != "" {
+			secret = s.Secret
+		}
+		return &auditHTTPSink{url: s.URL, secret: secret,
+			notifier: newWebhookNotifier(nil, nil, "", retries, delay)}, nil
+	}
+
+	return nil, fmt.Errorf("unknown audit sink type '%s'", s.Type)
+}
+
+// record queues rec to be written to every sink. A sink failing doesn't
+// fail the call being recorded, it is logged.
+func (a *auditLog) record(ctx context.Context, rec capmc.AuditRecord) {
+	if a == nil {
+		return
+	}
+
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		requestLog(ctx).Errorf("can't encode audit record %s: %s", rec.ID, err)
+		return
+	}
+
+	if a.file == nil {
+		a.mu.Lock()
+		a.recent = append(a.recent, rec)
+		if len(a.recent) > auditMemoryRecords {
+			a.recent = a.recent[len(a.recent)-auditMemoryRecords:]
+		}
+		a.mu.Unlock()
+	}
+
+	a.closing.RLock()
+	defer a.closing.RUnlock()
+
+	if a.closed {
+		requestLog(ctx).Errorf("audit log closed, dropping audit record %s",
+			rec.ID)
+		return
+	}
+	for _, w := range a.writers {
+		a.pending.Add(1)
+		w.queue <- auditEntry{id: rec.ID, rec: buf}
+	}
+}
+
+// flush waits for the records queued to be written.
+func (a *auditLog) flush() {
+	if a == nil {
+		return
+	}
+
+	a.pending.Wait()
+}
+
+// query returns the most recent records matching f, oldest first. Records
+// still queued for the file sink are not returned.
+func (a *auditLog) query(f auditFilter) ([]capmc.AuditRecord, error) {
+	records := []capmc.AuditRecord{}
+	if a == nil {
+		return records, nil
+	}
+
+	add := func(rec capmc.AuditRecord) {
+		if !f.match(&rec) {
+			return
+		}
+		records = append(records, rec)
+		if len(records) > f.limit {
+			records = records[1:]
+		}
+	}
+
+	if a.file != nil {
+		if err := a.file.each(add); err != nil {
+			return nil, err
+		}
+	} else {
+		a.mu.Lock()
+		for _, rec := range a.recent {
+			add(rec)
+		}
+		a.mu.Unlock()
+	}
+
+	return records, nil
+}
+
+// close writes the records queued and closes the sinks, waiting for the
+// records being sent to be delivered. Records made after close are dropped.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+
+	a.closing.Lock()
+	if a.closed {
+		a.closing.Unlock()
+		return
+	}
+	a.closed = true
+	for _, w := range a.writers {
+		close(w.queue)
+	}
+	a.closing.Unlock()
+
+	for _, w := range a.writers {
+		<-w.done
+		if err := w.sink.close(); err != nil {
+			log.Printf("Warning: closing audit sink: %s", err)
+		}
+	}
+}
+
+// auditFileSink appends records to a file, one JSON record per line. The
+// file is renamed path.1, and earlier rotated files renumbered, when it
+// reaches its maximum size. Reading the files only waits for rotation, not
+// for records being appended.
+type auditFileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+	// rotating is held exclusively to rotate the files.
+	rotating sync.RWMutex
+}
+
+func newAuditFileSink(path string, maxSize, maxBackups int) *auditFileSink {
+	if maxSize <= 0 {
+		maxSize = defaultAuditMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = defaultAuditMaxBackups
+	}
+
+	return &auditFileSink{
+		path:       path,
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		maxBackups: maxBackups,
+	}
+}
+
+func (s *auditFileSink) write(id string, rec []byte) error {
+	if err := s.open(); err != nil {
+		return err
+	}
+
+	line := append(append(make([]byte, 0, len(rec)+1), rec...), '\n')
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	return s.f.Sync()
+}
+
+// open opens the file to append to, if it isn't open already.
+func (s *auditFileSink) open() error {
+	if s.f != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, fi.Size()
+
+	return nil
+}
+
+// backup returns the name of the nth rotated file.
+func (s *auditFileSink) backup(n int) string {
+	return s.path + "." + strconv.Itoa(n)
+}
+
+func (s *auditFileSink) rotate() error {
+	s.rotating.Lock()
+	defer s.rotating.Unlock()
+
+	s.f.Close()
+	s.f = nil
+
+	os.Remove(s.backup(s.maxBackups))
+	for n := s.maxBackups - 1; n >= 1; n-- {
+		err := os.Rename(s.backup(n), s.backup(n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return os.Rename(s.path, s.backup(1))
+}
+
+// each calls fn for every record in the rotated files and the file, oldest
+// first. Lines which aren't records, such as one cut short by a crash, are
+// skipped.
+func (s *auditFileSink) each(fn func(capmc.AuditRecord)) error {
+	s.rotating.RLock()
+	defer s.rotating.RUnlock()
+
+	for n := s.maxBackups; n >= 0; n-- {
+		name := s.path
+		if n > 0 {
+			name = s.backup(n)
+		}
+
+		f, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+		for scanner.Scan() {
+			var rec capmc.AuditRecord
+			if json.Unmarshal(scanner.Bytes(), &rec) == nil {
+				fn(rec)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *auditFileSink) close() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+
+	return err
+}
+
+// auditSyslogSink logs records to syslog as notices. The connection is made
+// when the first record is written, and retried with each record until it
+// is made. A remote syslog is checked to be reachable within
+// auditSyslogDialTimeout first, as syslog.Dial has no timeout of its own.
+type auditSyslogSink struct {
+	network string
+	address string
+	tag     string
+	w       *syslog.Writer
+}
+
+func (s *auditSyslogSink) write(id string, rec []byte) error {
+	if s.w == nil {
+		if s.network != "" {
+			c, err := net.DialTimeout(s.network, s.address,
+				auditSyslogDialTimeout)
+			if err != nil {
+				return err
+			}
+			c.Close()
+		}
+		w, err := syslog.Dial(s.network, s.address,
+			syslog.LOG_NOTICE|syslog.LOG_DAEMON, s.tag)
+		if err != nil {
+			return err
+		}
+		s.w = w
+	}
+
+	return s.w.Notice(string(rec))
+}
+
+func (s *auditSyslogSink) close() error {
+	if s.w == nil {
+		return nil
+	}
+
+	return s.w.Close()
+}
+
+// auditHTTPSink POSTs records to a URL in the background, as webhooks are
+// sent.
+type auditHTTPSink struct {
+	url      string
+	secret   string
+	notifier *webhookNotifier
+}
+
+func (s *auditHTTPSink) write(id string, rec []byte) error {
+	s.notifier.wg.Add(1)
+	go func() {
+		defer s.notifier.wg.Done()
+		s.notifier.deliver(s.url, s.secret, rec, id)
+	}()
+
+	return nil
+}
+
+func (s *auditHTTPSink) close() error {
+	s.notifier.wg.Wait()
+
+	return nil
+}
+
+// sourceIP returns the address the request came from. Any X-Forwarded-For
+// header is set by the client or the proxies in between and can't be
+// trusted, so it is recorded apart, as the forwarded for addresses.
+func sourceIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// newAuditRecord starts the audit record of the operation with ID id, made
+// by the call r to run command between start and end.
+func newAuditRecord(r *http.Request, id, command string, start, end time.Time) capmc.AuditRecord {
+	return capmc.AuditRecord{
+		ID:           id,
+		RequestID:    requestIDFrom(r.Context()),
+		API:          path.Base(r.URL.Path),
+		Command:      command,
+		Caller:       requester(r),
+		SourceIP:     sourceIP(r),
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		UserAgent:    r.UserAgent(),
+		StartTime:    start.UTC().Format(time.RFC3339),
+		EndTime:      end.UTC().Format(time.RFC3339),
+	}
+}
+
+// newSystemAuditRecord starts the audit record of a change CAPMC made by
+// itself, through api, running command between start and end.
+func newSystemAuditRecord(api, command string, start, end time.Time) capmc.AuditRecord {
+	return capmc.AuditRecord{
+		ID:        newOperationID(),
+		API:       api,
+		Command:   command,
+		Caller:    auditSystemCaller,
+		StartTime: start.UTC().Format(time.RFC3339),
+		EndTime:   end.UTC().Format(time.RFC3339),
+	}
+}
+
+// auditResults gives the outcome of a call for each of the components
+// targets: failure for those in failed, otherwise success if the call went
+// on to change them or skipped if it didn't. Components in failed which are
+// not targets are reported as failures.
+func auditResults(targets []string, failed map[string]capmc.ErrResponse, changed bool) []capmc.PowerOperationResult {
+	results := []capmc.PowerOperationResult{}
+	seen := make(map[string]bool)
+
+	for _, xname := range targets {
+		if seen[xname] {
+			continue
+		}
+		seen[xname] = true
+
+		result := capmc.PowerOperationResult{Xname: xname, Result: "skipped"}
+		if e, ok := failed[xname]; ok {
+			result.Result = "failure"
+			result.E = e.E
+			result.ErrMsg = e.ErrMsg
+		} else if changed {
+			result.Result = "success"
+		}
+		results = append(results, result)
+	}
+
+	for xname, e := range failed {
+		if !seen[xname] {
+			results = append(results, capmc.PowerOperationResult{
+				Xname:  xname,
+				Result: "failure",
+				E:      e.E,
+				ErrMsg: e.ErrMsg,
+			})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Xname < results[j].Xname
+	})
+
+	return results
+}
+
+// nidAuditResults gives the outcome of a call for each of the nodes, from
+// the errors reported for their NIDs.
+func nidAuditResults(nodes []*NodeInfo, nids []capmc.PowerCapNid, changed bool) []capmc.PowerOperationResult {
+	xnames := make(map[int]string)
+	var targets []string
+	for _, node := range nodes {
+		xnames[node.Nid] = node.Hostname
+		targets = append(targets, node.Hostname)
+	}
+
+	failed := make(map[string]capmc.ErrResponse)
+	for _, nid := range nids {
+		if xname, ok := xnames[nid.Nid]; ok && nid.E != 0 {
+			failed[xname] = capmc.ErrResponse{E: nid.E, ErrMsg: nid.ErrMsg}
+		}
+	}
+
+	return auditResults(targets, failed, changed)
+}
+
+// auditFilter selects the records returned by the audit API.
+type auditFilter struct {
+	xnames  []string
+	api     string
+	command string
+	caller  string
+	start   time.Time
+	end     time.Time
+	limit   int
+}
+
+// parseAuditFilter parses the query parameters of the audit API.
+func parseAuditFilter(params url.Values) (auditFilter, error) {
+	f := auditFilter{
+		xnames: stringSliceMap(splitQueryList(params["xname"]),
+			xnametypes.NormalizeHMSCompID),
+		api:     params.Get("api"),
+		command: params.Get("command"),
+		caller:  params.Get("caller"),
+		limit:   defaultAuditLimit,
+	}
+
+	var err error
+	if f.start, err = parseQueryTime(params, "start_time"); err != nil {
+		return f, err
+	}
+	if f.end, err = parseQueryTime(params, "end_time"); err != nil {
+		return f, err
+	}
+	if s := params.Get("limit"); s != "" {
+		if f.limit, err = strconv.Atoi(s); err != nil || f.limit <= 0 {
+			return f, fmt.Errorf("invalid limit '%s'", s)
+		}
+	}
+
+	return f, nil
+}
+
+// match checks rec was made for one of the xnames, if any, through the API
+// and command, and by the caller, when given, and started within the time
+// range.
+func (f auditFilter) match(rec *capmc.AuditRecord) bool {
+	if (f.api != "" && !strings.EqualFold(rec.API, f.api)) ||
+		(f.command != "" && !strings.EqualFold(rec.Command, f.command)) ||
+		(f.caller != "" && rec.Caller != f.caller) {
+		return false
+	}
+
+	if !f.start.IsZero() || !f.end.IsZero() {
+		start, err := time.Parse(time.RFC3339, rec.StartTime)
+		if err != nil || (!f.start.IsZero() && start.Before(f.start)) ||
+			(!f.end.IsZero() && start.After(f.end)) {
+			return false
+		}
+	}
+
+	if len(f.xnames) == 0 {
+		return true
+	}
+	for _, result := range rec.Xnames {
+		if stringInSlice(result.Xname, f.xnames) {
+			return true
+		}
+	}
+	for _, target := range rec.Targets {
+		if stringInSlice(xnametypes.NormalizeHMSCompID(target), f.xnames) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// doAudit is the HTTP handler for the audit API. It returns the records of
+// the power operations matching the query parameters xname, api, command,
+// caller, start_time and end_time, up to limit of the most recent.
+func (d *CapmcD) doAudit(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	f, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		sendJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	records, err := d.audit.query(f)
+	if err != nil {
+		requestLog(r.Context()).Errorf("reading audit log: %s", err)
+		sendJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	SendResponseJSON(w, http.StatusOK, capmc.AuditResponse{Records: records})
+}
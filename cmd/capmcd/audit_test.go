@@ -0,0 +1,495 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestSourceIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"10.1.1.1:41234", "", "10.1.1.1"},
+		{"[fd00::1]:41234", "", "fd00::1"},
+		{"10.1.1.1:41234", "192.168.0.7, 10.2.2.2", "10.1.1.1"},
+		{"pipe", "", "pipe"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, capmc.XnameOffV1, nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if ip := sourceIP(r); ip != test.expected {
+			t.Errorf("%s %s: expected %s, got %s", test.remoteAddr,
+				test.forwarded, test.expected, ip)
+		}
+	}
+}
+
+func TestAuditResults(t *testing.T) {
+	failed := map[string]capmc.ErrResponse{
+		"x0c0s2b0n0": {E: 52, ErrMsg: "Error setting power cap for xname"},
+		"x0c0s9b0n0": {E: 22, ErrMsg: "Undefined xname"},
+	}
+	targets := []string{"x0c0s2b0n0", "x0c0s1b0n0", "x0c0s1b0n0"}
+
+	tests := []struct {
+		name     string
+		changed  bool
+		expected []capmc.PowerOperationResult
+	}{
+		{
+			name:    "Changed",
+			changed: true,
+			expected: []capmc.PowerOperationResult{
+				{Xname: "x0c0s1b0n0", Result: "success"},
+				{Xname: "x0c0s2b0n0", Result: "failure", E: 52, ErrMsg: "Error setting power cap for xname"},
+				{Xname: "x0c0s9b0n0", Result: "failure", E: 22, ErrMsg: "Undefined xname"},
+			},
+		}, {
+			name: "Not changed",
+			expected: []capmc.PowerOperationResult{
+				{Xname: "x0c0s1b0n0", Result: "skipped"},
+				{Xname: "x0c0s2b0n0", Result: "failure", E: 52, ErrMsg: "Error setting power cap for xname"},
+				{Xname: "x0c0s9b0n0", Result: "failure", E: 22, ErrMsg: "Undefined xname"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		results := auditResults(targets, failed, test.changed)
+		if !reflect.DeepEqual(results, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name,
+				test.expected, results)
+		}
+	}
+}
+
+func TestAuditFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	newLog := func() *auditLog {
+		a := &auditLog{}
+		a.file = &auditFileSink{path: path, maxSize: 300, maxBackups: 2}
+		a.sinks = []auditSink{a.file}
+		a.start()
+		return a
+	}
+	a := newLog()
+
+	var ids []string
+	for i := 0; i < 12; i++ {
+		id := newOperationID()
+		ids = append(ids, id)
+		a.record(context.Background(), capmc.AuditRecord{ID: id, API: "xname_off",
+			Command: bmcCmdPowerOff})
+	}
+	a.close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 300 {
+			t.Errorf("%s: expected at most 300 bytes, got %d", name, fi.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files, got %s.3", path)
+	}
+
+	records, err := a.query(auditFilter{limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) == 0 || len(records) >= len(ids) {
+		t.Fatalf("expected the records of the kept files, got %d", len(records))
+	}
+	kept := ids[len(ids)-len(records):]
+	for i, rec := range records {
+		if rec.ID != kept[i] {
+			t.Errorf("record %d: expected %s, got %s", i, kept[i], rec.ID)
+		}
+	}
+
+	// Records made after close are dropped.
+	a.record(context.Background(), capmc.AuditRecord{ID: "closed"})
+	records, _ = a.query(auditFilter{limit: 1})
+	if len(records) != 1 || records[0].ID != ids[len(ids)-1] {
+		t.Errorf("expected the record written before close, got %+v", records)
+	}
+
+	// Records written after a restart are appended.
+	a = newLog()
+	a.record(context.Background(), capmc.AuditRecord{ID: "restarted"})
+	a.flush()
+	records, _ = a.query(auditFilter{limit: 1})
+	if len(records) != 1 || records[0].ID != "restarted" {
+		t.Errorf("expected the record written after the restart, got %+v",
+			records)
+	}
+	a.close()
+}
+
+// blockedSink is an audit sink whose writes wait until it is released.
+type blockedSink struct {
+	release chan struct{}
+}
+
+func (s *blockedSink) write(id string, rec []byte) error {
+	<-s.release
+	return nil
+}
+
+func (s *blockedSink) close() error { return nil }
+
+func TestAuditBlockedSink(t *testing.T) {
+	blocked := &blockedSink{release: make(chan struct{})}
+	a := &auditLog{}
+	a.file = newAuditFileSink(filepath.Join(t.TempDir(), "audit.jsonl"), 0, 0)
+	a.sinks = []auditSink{blocked, a.file}
+	a.start()
+
+	// Neither recording nor the file sink waits for the blocked sink.
+	recorded := make(chan struct{})
+	go func() {
+		a.record(context.Background(), capmc.AuditRecord{ID: "1"})
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording waited for the blocked sink")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records, err := a.query(auditFilter{limit: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 1 && records[0].ID == "1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the file sink to have the record, got %+v",
+				records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	close(blocked.release)
+	a.close()
+}
+
+func TestAuditQuery(t *testing.T) {
+	a := newAuditLog(nil, "", 0, 0)
+	a.record(context.Background(), capmc.AuditRecord{ID: "1", API: "xname_off",
+		Command: bmcCmdPowerForceOff, Caller: "cray-power",
+		Targets:   []string{"x1000c0"},
+		StartTime: "2026-10-19T10:00:00Z",
+		Xnames: []capmc.PowerOperationResult{
+			{Xname: "x1000c0s0b0n0", Result: "success"},
+		}})
+	a.record(context.Background(), capmc.AuditRecord{ID: "2", API: "set_power_cap",
+		Command: bmcCmdSetPowerCap, Caller: "cray-capmc",
+		StartTime: "2026-10-19T11:00:00Z",
+		Xnames: []capmc.PowerOperationResult{
+			{Xname: "x1000c0s1b0n0", Result: "success"},
+		}})
+	a.record(context.Background(), capmc.AuditRecord{ID: "3", API: "xname_on",
+		Command: bmcCmdPowerOn, Caller: "cray-power",
+		Targets:   []string{"x1000c0s0b0n0"},
+		StartTime: "2026-10-19T12:00:00Z",
+		Xnames: []capmc.PowerOperationResult{
+			{Xname: "x1000c0s0b0n0", Result: "success"},
+		}})
+
+	tests := []struct {
+		name     string
+		query    string
+		expected []string
+	}{
+		{"All", "", []string{"1", "2", "3"}},
+		{"Xname", "xname=x1000c0s0b0n0", []string{"1", "3"}},
+		{"Target", "xname=x1000c0", []string{"1"}},
+		{"Xnames", "xname=x1000c0s1b0n0,x1000c0s9b0n0", []string{"2"}},
+		{"API", "api=set_power_cap", []string{"2"}},
+		{"Command", "command=forceoff", []string{"1"}},
+		{"Caller", "caller=cray-power", []string{"1", "3"}},
+		{"Start", "start_time=2026-10-19T11:00:00Z", []string{"2", "3"}},
+		{"End", "end_time=2026-10-19T11:00:00Z", []string{"1", "2"}},
+		{"Limit", "limit=2", []string{"2", "3"}},
+		{"None", "xname=x3000c0s0b0n0", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := &CapmcD{audit: a}
+			req := httptest.NewRequest(http.MethodGet,
+				capmc.AuditV1+"?"+test.query, nil)
+			w := httptest.NewRecorder()
+
+			svc.doAudit(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d %s", w.Code, w.Body.String())
+			}
+
+			var rsp capmc.AuditResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, rec := range rsp.Records {
+				ids = append(ids, rec.ID)
+			}
+			if !reflect.DeepEqual(ids, test.expected) {
+				t.Errorf("expected records %v, got %v", test.expected, ids)
+			}
+		})
+	}
+}
+
+func TestDoAuditErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		code   int
+		body   string
+	}{
+		{
+			name:   "Post",
+			method: http.MethodPost,
+			code:   http.StatusMethodNotAllowed,
+			body:   `{"e":405,"err_msg":"(POST) Not Allowed"}`,
+		}, {
+			name:   "Bad start_time",
+			method: http.MethodGet,
+			query:  "?start_time=yesterday",
+			code:   http.StatusBadRequest,
+			body:   `{"e":400,"err_msg":"invalid start_time 'yesterday'"}`,
+		}, {
+			name:   "Bad limit",
+			method: http.MethodGet,
+			query:  "?limit=0",
+			code:   http.StatusBadRequest,
+			body:   `{"e":400,"err_msg":"invalid limit '0'"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := &CapmcD{}
+			req := httptest.NewRequest(test.method,
+				capmc.AuditV1+test.query, nil)
+			w := httptest.NewRecorder()
+
+			svc.doAudit(w, req)
+
+			if w.Code != test.code ||
+				strings.TrimSpace(w.Body.String()) != test.body {
+				t.Errorf("expected %d %s, got %d %s", test.code,
+					test.body, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestNewAuditLogIgnoresInvalidSinks(t *testing.T) {
+	a := newAuditLog([]AuditSink{
+		{Type: "file"},
+		{Type: "http", URL: "audit"},
+		{Type: "kafka"},
+		{Type: "File", Path: filepath.Join(t.TempDir(), "audit.jsonl")},
+		{Type: "syslog"},
+	}, "", 0, 0)
+	defer a.close()
+
+	if len(a.sinks) != 2 || a.file == nil {
+		t.Errorf("expected the file and syslog sinks, got %+v", a.sinks)
+	}
+	if a.file.maxSize != defaultAuditMaxSize*1024*1024 ||
+		a.file.maxBackups != defaultAuditMaxBackups {
+		t.Errorf("expected the default rotation, got %d bytes, %d backups",
+			a.file.maxSize, a.file.maxBackups)
+	}
+}
+
+func TestAuditHTTPSink(t *testing.T) {
+	wr := &webhookReceiver{codes: []int{http.StatusServiceUnavailable}}
+	ts := httptest.NewServer(wr)
+	defer ts.Close()
+
+	a := newAuditLog([]AuditSink{{Type: "http", URL: ts.URL}}, "default",
+		2, time.Millisecond)
+	rec := capmc.AuditRecord{ID: "0123456789abcdef", Reason: "maintenance"}
+	body, _ := json.Marshal(rec)
+
+	a.record(context.Background(), rec)
+	a.close()
+
+	if len(wr.bodies) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(wr.bodies))
+	}
+	if wr.bodies[1] != string(body) {
+		t.Errorf("expected body %s, got %s", body, wr.bodies[1])
+	}
+	if sig := signWebhook(body, "default"); wr.signatures[1] != sig {
+		t.Errorf("expected signature %s, got %s", sig, wr.signatures[1])
+	}
+}
+
+func TestAuditSyslogSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+
+	a := newAuditLog([]AuditSink{
+		{Type: "syslog", Network: "udp", Address: conn.LocalAddr().String()},
+	}, "", 0, 0)
+	a.record(context.Background(), capmc.AuditRecord{ID: "0123456789abcdef"})
+	defer a.close()
+
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// <29> is the daemon facility at notice severity.
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<29>") ||
+		!strings.Contains(msg, defaultAuditTag) ||
+		!strings.Contains(msg, `"id":"0123456789abcdef"`) {
+		t.Errorf("unexpected syslog message %s", msg)
+	}
+}
+
+func TestDoXnamePowerCapSetAudit(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		rfStatus int
+		e        int
+		xnames   []capmc.PowerOperationResult
+	}{
+		{
+			name:     "Capped",
+			body:     `{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":500}]}]}`,
+			rfStatus: http.StatusOK,
+			xnames: []capmc.PowerOperationResult{
+				{Xname: "x9000c1s2b0n0", Result: "success"},
+			},
+		}, {
+			name:     "BMC failure",
+			body:     `{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":500}]}]}`,
+			rfStatus: http.StatusInternalServerError,
+			e:        52,
+			xnames: []capmc.PowerOperationResult{
+				{Xname: "x9000c1s2b0n0", Result: "failure", E: -1, ErrMsg: "Error setting power cap for xname"},
+			},
+		}, {
+			name:     "Out of range",
+			body:     `{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":100}]}]}`,
+			rfStatus: http.StatusOK,
+			e:        22,
+			xnames: []capmc.PowerOperationResult{
+				{Xname: "x9000c1s2b0n0", Result: "failure", E: 22, ErrMsg: "Control (Node Power Limit) value (100) is less than minimum (400)"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newXnamePowerCapTestSvc(olympusHSM,
+				rfStatusMock(test.rfStatus))
+			svc.audit = newAuditLog(nil, "", 0, 0)
+
+			req := httptest.NewRequest(http.MethodPost,
+				capmc.XnamePowerCapSetV1, bytes.NewBufferString(test.body))
+			req.Header.Set("User-Agent", "cray-power")
+			req.Header.Set("X-Forwarded-For", "192.168.0.7")
+			req = req.WithContext(withRequestID(req.Context(), "req-1"))
+			w := httptest.NewRecorder()
+
+			svc.doXnamePowerCapSet(w, req)
+
+			records, _ := svc.audit.query(auditFilter{limit: 10})
+			if len(records) != 1 {
+				t.Fatalf("expected 1 audit record, got %d", len(records))
+			}
+			rec := records[0]
+
+			if rec.API != "set_xname_power_cap" ||
+				rec.Command != bmcCmdSetPowerCap ||
+				rec.Caller != "192.0.2.1" ||
+				rec.UserAgent != "cray-power" ||
+				rec.SourceIP != "192.0.2.1" ||
+				rec.ForwardedFor != "192.168.0.7" ||
+				rec.RequestID != "req-1" || rec.ID == "" || rec.E != test.e ||
+				!reflect.DeepEqual(rec.Targets, []string{"x9000c1s2b0n0"}) {
+				t.Errorf("unexpected audit record %+v", rec)
+			}
+			if !reflect.DeepEqual(rec.Xnames, test.xnames) {
+				t.Errorf("expected results %+v, got %+v", test.xnames,
+					rec.Xnames)
+			}
+		})
+	}
+}
@@ -0,0 +1,579 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// permission is an operation a caller may be allowed to carry out.
+type permission string
+
+const (
+	// permStatus allows the read-only APIs: power status, power caps,
+	// schedules, reservations, the audit log and the operation history.
+	permStatus permission = "status"
+	// permNodePower allows power operations on nodes.
+	permNodePower permission = "node-power"
+	// permInfraPower allows power operations on everything else, such as
+	// chassis, blades and PDUs, and recursive and prereq operations,
+	// which can reach them.
+	permInfraPower permission = "infra-power"
+	// permPowerCap allows setting power caps, power budgets and power cap
+	// schedules.
+	permPowerCap permission = "power-cap"
+	// permAdmin allows changing the log level and forcing the release of
+	// reservations.
+	permAdmin permission = "admin"
+)
+
+// permissions lists every permission.
+var permissions = []permission{
+	permStatus,
+	permNodePower,
+	permInfraPower,
+	permPowerCap,
+	permAdmin,
+}
+
+const (
+	// authScopePrefix starts the names of the scopes and roles which grant
+	// a single permission, e.g. "capmc:node-power".
+	authScopePrefix = "capmc:"
+	// authAdminRole grants every permission unless an AuthRole table
+	// says otherwise.
+	authAdminRole = "admin"
+	// authTimeout bounds fetching the JWKS.
+	authTimeout = 10 * time.Second
+	// authRefetchDelay is the least time between fetches of the JWKS
+	// prompted by tokens signed with unknown keys.
+	authRefetchDelay = 30 * time.Second
+	// authLeeway allows for clock skew checking token lifetimes.
+	authLeeway = time.Minute
+)
+
+// authAlgorithms are the signature algorithms accepted on tokens.
+var authAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// apiPermission gives the permissions needed for an API, read for GET
+// requests and write for any other method. An empty write permission
+// leaves the check to the handler, which knows the targets.
+type apiPermission struct {
+	read  permission
+	write permission
+}
+
+// publicAPIs are open to all, for the Kubernetes probes and Prometheus.
+var publicAPIs = map[string]bool{
+	capmc.HealthV1:    true,
+	capmc.LivenessV1:  true,
+	capmc.Metrics:     true,
+	capmc.ReadinessV1: true,
+}
+
+// apiPermissions gives the permissions needed for each API which is not
+// public. An API missing from both needs the admin permission.
+var apiPermissions = map[string]apiPermission{
+	capmc.AuditV1:                {permStatus, permStatus},
+	capmc.LogLevelV1:             {permStatus, permAdmin},
+	capmc.OperationsV1:           {permStatus, permStatus},
+	capmc.PowerCapCapabilitiesV1: {permStatus, permStatus},
+	capmc.PowerCapDriftV1:        {permStatus, permPowerCap},
+	capmc.PowerCapGetV1:          {permStatus, permStatus},
+	capmc.PowerCapSchedulesV1:    {permStatus, permPowerCap},
+	capmc.PowerCapSetV1:          {permPowerCap, permPowerCap},
+	capmc.ReservationsV1:         {permStatus, permAdmin},
+	capmc.SystemPowerBudgetSetV1: {permPowerCap, permPowerCap},
+	capmc.XnameOffV1:             {permStatus, ""},
+	capmc.XnameOnV1:              {permStatus, ""},
+	capmc.XnamePowerCapGetV1:     {permStatus, permStatus},
+	capmc.XnamePowerCapSetV1:     {permPowerCap, permPowerCap},
+	capmc.XnameReinitV1:          {permStatus, ""},
+	capmc.XnameStatusV1:          {permStatus, permStatus},
+	capmc.XnameStatusStreamV1:    {permStatus, permStatus},
+}
+
+// principal is the authenticated caller of a request.
+type principal struct {
+	subject string
+	perms   map[permission]bool
+}
+
+// allows reports whether the caller has perm. The empty permission is
+// always allowed.
+func (p *principal) allows(perm permission) bool {
+	return perm == "" || p.perms[perm]
+}
+
+// principalKey is the context key of the caller of a request.
+type principalKey struct{}
+
+// withPrincipal returns a copy of ctx carrying the caller p.
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFrom returns the caller carried by ctx, if authenticated.
+func principalFrom(ctx context.Context) *principal {
+	if ctx == nil {
+		return nil
+	}
+	p, _ := ctx.Value(principalKey{}).(*principal)
+
+	return p
+}
+
+// authorized reports whether the caller of the request in ctx has perm.
+// Everything is allowed when authentication is off.
+func authorized(ctx context.Context, perm permission) bool {
+	p := principalFrom(ctx)
+
+	return p == nil || p.allows(perm)
+}
+
+// xnamePowerPermission returns the permission needed for a power operation
+// on xnames. Anything other than a node needs the infrastructure power
+// permission, as do recursive and prereq operations.
+func xnamePowerPermission(xnames []string, recursive, prereq bool) permission {
+	if recursive || prereq {
+		return permInfraPower
+	}
+	for _, xname := range xnames {
+		if xnametypes.GetHMSType(xname) != xnametypes.Node {
+			return permInfraPower
+		}
+	}
+
+	return permNodePower
+}
+
+// tokenClaims are the claims, besides the registered ones, roles and
+// scopes are taken from: a space separated scope, a roles list and the
+// Keycloak realm and client roles.
+type tokenClaims struct {
+	Scope       string   `json:"scope"`
+	Roles       []string `json:"roles"`
+	RealmAccess struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"`
+	ResourceAccess map[string]struct {
+		Roles []string `json:"roles"`
+	} `json:"resource_access"`
+}
+
+// names returns the roles and scopes of the claims.
+func (c *tokenClaims) names() []string {
+	names := strings.Fields(c.Scope)
+	names = append(names, c.Roles...)
+	names = append(names, c.RealmAccess.Roles...)
+	for _, access := range c.ResourceAccess {
+		names = append(names, access.Roles...)
+	}
+
+	return names
+}
+
+// authenticator validates the bearer tokens sent with requests, signed by
+// one of the keys of a JWKS fetched from a URL or read from a file, and
+// works out the permissions of their callers.
+type authenticator struct {
+	mu       sync.Mutex
+	keys     []jose.JSONWebKey
+	loaded   time.Time
+	fetching chan struct{} // closed when the JWKS fetch in flight ends
+	url      string
+	file     string
+	refresh  time.Duration
+	client   *http.Client
+	issuer   string
+	audience string
+	roles    map[string][]permission
+}
+
+// newAuthenticator creates an authenticator checking tokens against the
+// JWKS at conf.AuthJWKSURL or the keys in conf.AuthKeyFile, with the
+// permissions of roles. It returns nil when neither is set, as
+// authentication is off.
+func newAuthenticator(conf CapmcConfiguration, roles []AuthRole) (*authenticator, error) {
+	if conf.AuthJWKSURL == "" && conf.AuthKeyFile == "" {
+		return nil, nil
+	}
+
+	a := &authenticator{
+		url:      conf.AuthJWKSURL,
+		file:     conf.AuthKeyFile,
+		refresh:  time.Duration(conf.AuthKeyRefresh) * time.Second,
+		client:   &http.Client{Timeout: authTimeout},
+		issuer:   conf.AuthIssuer,
+		audience: conf.AuthAudience,
+		roles: map[string][]permission{
+			authAdminRole: permissions,
+		},
+	}
+	for _, perm := range permissions {
+		a.roles[authScopePrefix+string(perm)] = []permission{perm}
+	}
+
+	for _, role := range roles {
+		if role.Name == "" {
+			return nil, errors.New("AuthRole without a Name")
+		}
+		perms := make([]permission, 0, len(role.Permissions))
+		for _, name := range role.Permissions {
+			perm, err := parsePermission(name)
+			if err != nil {
+				return nil, fmt.Errorf("AuthRole %s: %s", role.Name, err)
+			}
+			perms = append(perms, perm)
+		}
+		a.roles[role.Name] = perms
+	}
+
+	// Tokens can't be checked without keys, so the file must be good. A
+	// JWKS server which isn't up yet is tried again for each token.
+	if err := a.load(); err != nil {
+		if a.file != "" {
+			return nil, err
+		}
+		log.Printf("Warning: %s", err)
+	}
+
+	return a, nil
+}
+
+// parsePermission parses the name of one of the permissions.
+func parsePermission(name string) (permission, error) {
+	for _, perm := range permissions {
+		if permission(name) == perm {
+			return perm, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid permission '%s', must be one of %v",
+		name, permissions)
+}
+
+// load reads the keys from the key file or fetches them from the JWKS URL.
+// It is only called before the authenticator is in use.
+func (a *authenticator) load() error {
+	keys, err := a.readKeys()
+	if err != nil {
+		return err
+	}
+
+	a.keys = keys
+	a.loaded = time.Now()
+
+	return nil
+}
+
+// readKeys reads the keys from the key file or fetches them from the JWKS
+// URL, without touching the keys in use.
+func (a *authenticator) readKeys() ([]jose.JSONWebKey, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if a.file != "" {
+		data, err = os.ReadFile(a.file)
+		if err != nil {
+			return nil, fmt.Errorf("reading auth key file: %s", err)
+		}
+	} else {
+		data, err = a.fetch()
+		if err != nil {
+			return nil, fmt.Errorf("fetching JWKS from %s: %s", a.url, err)
+		}
+	}
+
+	return parseKeys(data)
+}
+
+// reload fetches the JWKS again, without holding the lock, then swaps in
+// the new keys and closes done.
+func (a *authenticator) reload(done chan struct{}) {
+	keys, err := a.readKeys()
+
+	a.mu.Lock()
+	if err != nil {
+		log.Printf("Warning: %s", err)
+	} else {
+		a.keys = keys
+	}
+	// After a failure, try again with a later token.
+	a.loaded = time.Now()
+	a.fetching = nil
+	a.mu.Unlock()
+
+	close(done)
+}
+
+// fetch gets the JWKS from its URL.
+func (a *authenticator) fetch() ([]byte, error) {
+	rsp, err := a.client.Get(a.url)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s", rsp.Status)
+	}
+
+	return io.ReadAll(rsp.Body)
+}
+
+// parseKeys parses the public keys in data, either a JWKS or PEM encoded
+// public keys and certificates.
+func parseKeys(data []byte) ([]jose.JSONWebKey, error) {
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &jwks); err == nil {
+		if len(jwks.Keys) == 0 {
+			return nil, errors.New("no keys in JWKS")
+		}
+		return jwks.Keys, nil
+	}
+
+	var keys []jose.JSONWebKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var (
+			key interface{}
+			err error
+		)
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", block.Type, err)
+		}
+		keys = append(keys, jose.JSONWebKey{Key: key})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no JWKS or PEM public keys found")
+	}
+
+	return keys, nil
+}
+
+// verificationKeys returns the keys which may have signed a token with the
+// key ID kid, all of them if it has none. The JWKS is fetched again when
+// it is due a refresh or has no key kid, at most every authRefetchDelay.
+// One fetch runs at a time, in the background; only callers with no key
+// kid wait for it, for at most authTimeout.
+func (a *authenticator) verificationKeys(kid string) []jose.JSONWebKey {
+	a.mu.Lock()
+	keys := a.matchKeys(kid)
+	since := time.Since(a.loaded)
+	if a.url == "" || !((a.refresh > 0 && since >= a.refresh) ||
+		(len(keys) == 0 && since >= authRefetchDelay)) {
+		a.mu.Unlock()
+		return keys
+	}
+
+	fetching := a.fetching
+	if fetching == nil {
+		fetching = make(chan struct{})
+		a.fetching = fetching
+		go a.reload(fetching)
+	}
+	a.mu.Unlock()
+
+	// Keys due a refresh are still good meanwhile.
+	if len(keys) > 0 {
+		return keys
+	}
+	<-fetching
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.matchKeys(kid)
+}
+
+// matchKeys returns the keys with ID kid, or all of them if kid is empty.
+// Keys without an ID, such as those read from PEM, match any kid.
+func (a *authenticator) matchKeys(kid string) []jose.JSONWebKey {
+	if kid == "" {
+		return a.keys
+	}
+
+	var keys []jose.JSONWebKey
+	for _, key := range a.keys {
+		if key.KeyID == "" || key.KeyID == kid {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// authenticate validates the bearer token of r and returns its caller.
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return nil, errors.New("missing bearer token")
+	}
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errors.New("invalid Authorization header, expected a bearer token")
+	}
+
+	tok, err := jwt.ParseSigned(strings.TrimSpace(token), authAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+
+	var (
+		claims jwt.Claims
+		extra  tokenClaims
+	)
+	err = errors.New("no key to verify token")
+	for _, key := range a.verificationKeys(kid) {
+		if err = tok.Claims(key.Key, &claims, &extra); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+
+	expected := jwt.Expected{Issuer: a.issuer, Time: time.Now()}
+	if a.audience != "" {
+		expected.AnyAudience = jwt.Audience{a.audience}
+	}
+	if err := claims.ValidateWithLeeway(expected, authLeeway); err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid token: no subject")
+	}
+
+	p := &principal{
+		subject: claims.Subject,
+		perms:   make(map[permission]bool),
+	}
+	for _, name := range extra.names() {
+		for _, perm := range a.roles[name] {
+			p.perms[perm] = true
+		}
+	}
+
+	return p, nil
+}
+
+// authorize wraps the handler of the API at pattern, checking the caller
+// is allowed to use it when authentication is on. Public APIs let anyone
+// through, but still identify callers sending a valid token so they can be
+// told more.
+func (d *CapmcD) authorize(pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	if publicAPIs[pattern] {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if d.auth != nil && r.Header.Get("Authorization") != "" {
+				if p, err := d.auth.authenticate(r); err == nil {
+					r = r.WithContext(withPrincipal(r.Context(), p))
+				}
+			}
+			handler(w, r)
+		}
+	}
+	access, ok := apiPermissions[pattern]
+	if !ok {
+		access = apiPermission{permAdmin, permAdmin}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if d.auth == nil {
+			handler(w, r)
+			return
+		}
+
+		p, err := d.auth.authenticate(r)
+		if err != nil {
+			requestLog(r.Context()).Warnf("Unauthenticated %s %s from %s: %s",
+				r.Method, r.URL.Path, sourceIP(r), err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			sendJsonError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		r = r.WithContext(withPrincipal(r.Context(), p))
+
+		perm := access.write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			perm = access.read
+		}
+		if !p.allows(perm) {
+			requestLog(r.Context()).Warnf("Forbidden %s %s, no %s permission",
+				r.Method, r.URL.Path, perm)
+			sendJsonError(w, http.StatusForbidden,
+				fmt.Sprintf("Forbidden: %s permission required", perm))
+			return
+		}
+
+		handler(w, r)
+	}
+}
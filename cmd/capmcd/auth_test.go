@@ -0,0 +1,600 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	jose "github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// testAuthKey returns a new RSA key for signing test tokens.
+func testAuthKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// testJWKS returns the JWKS holding the public part of key as kid.
+func testJWKS(t *testing.T, key *rsa.PrivateKey, kid string) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{{
+			Key:       &key.PublicKey,
+			KeyID:     kid,
+			Algorithm: string(jose.RS256),
+			Use:       "sig",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// testToken returns a token signed by key as kid with claims.
+func testToken(t *testing.T, key *rsa.PrivateKey, kid string, claims ...interface{}) string {
+	t.Helper()
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	builder := jwt.Signed(signer)
+	for _, c := range claims {
+		builder = builder.Claims(c)
+	}
+	token, err := builder.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// testStdClaims returns valid registered claims for subject.
+func testStdClaims(subject string) jwt.Claims {
+	now := time.Now()
+
+	return jwt.Claims{
+		Subject:  subject,
+		Issuer:   "https://keycloak/realms/shasta",
+		Audience: jwt.Audience{"capmc"},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key := testAuthKey(t)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	tests := []struct {
+		name string
+		data []byte
+		keys int
+		err  bool
+	}{
+		{"JWKS", testJWKS(t, key, "k1"), 1, false},
+		{"PEM public key", pemKey, 1, false},
+		{"Two PEM public keys", append(pemKey, pemKey...), 2, false},
+		{"Empty JWKS", []byte(`{"keys":[]}`), 0, true},
+		{"Garbage", []byte("not a key"), 0, true},
+		{"Bad PEM", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("x")}), 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseKeys(tt.data)
+			if (err != nil) != tt.err {
+				t.Fatalf("Expected error %t, got %v", tt.err, err)
+			}
+			if len(keys) != tt.keys {
+				t.Errorf("Expected %d keys, got %d", tt.keys, len(keys))
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	key := testAuthKey(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, testJWKS(t, key, "k1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		conf  CapmcConfiguration
+		roles []AuthRole
+		nil   bool
+		err   bool
+	}{
+		{"Off", CapmcConfiguration{}, nil, true, false},
+		{"Key file", CapmcConfiguration{AuthKeyFile: file}, nil, false, false},
+		{"Missing key file", CapmcConfiguration{AuthKeyFile: file + ".missing"}, nil, true, true},
+		{"Role", CapmcConfiguration{AuthKeyFile: file},
+			[]AuthRole{{Name: "operator", Permissions: []string{"status", "node-power"}}},
+			false, false},
+		{"Role without name", CapmcConfiguration{AuthKeyFile: file},
+			[]AuthRole{{Permissions: []string{"status"}}}, true, true},
+		{"Invalid permission", CapmcConfiguration{AuthKeyFile: file},
+			[]AuthRole{{Name: "operator", Permissions: []string{"power"}}}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := newAuthenticator(tt.conf, tt.roles)
+			if (err != nil) != tt.err {
+				t.Fatalf("Expected error %t, got %v", tt.err, err)
+			}
+			if (a == nil) != tt.nil {
+				t.Errorf("Expected nil authenticator %t, got %v", tt.nil, a)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	key := testAuthKey(t)
+	other := testAuthKey(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, testJWKS(t, key, "k1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := CapmcConfiguration{
+		AuthKeyFile:  file,
+		AuthIssuer:   "https://keycloak/realms/shasta",
+		AuthAudience: "capmc",
+	}
+	roles := []AuthRole{
+		{Name: "operator", Permissions: []string{"status", "node-power"}},
+	}
+
+	var tSvc CapmcD
+	var err error
+	tSvc.auth, err = newAuthenticator(conf, roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var caller string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		caller = requester(r)
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	expired := testStdClaims("alice")
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongAudience := testStdClaims("alice")
+	wrongAudience.Audience = jwt.Audience{"pcs"}
+
+	tests := []struct {
+		name   string
+		path   string
+		method string
+		token  string
+		rc     int
+		caller string
+	}{
+		{
+			"Open API needs no token",
+			capmc.HealthV1, http.MethodGet, "",
+			http.StatusNoContent, "",
+		},
+		{
+			"Open API identifies a caller with a token",
+			capmc.HealthV1, http.MethodGet,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "capmc:admin"}),
+			http.StatusNoContent, "alice",
+		},
+		{
+			"Open API ignores a bad token",
+			capmc.HealthV1, http.MethodGet, "Bearer nonsense",
+			http.StatusNoContent, "",
+		},
+		{
+			"No token",
+			capmc.XnameStatusV1, http.MethodPost, "",
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Not a token",
+			capmc.XnameStatusV1, http.MethodPost, "Bearer nonsense",
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Not a bearer token",
+			capmc.XnameStatusV1, http.MethodPost, "Basic YWxpY2U6c2VjcmV0",
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Signed by unknown key",
+			capmc.XnameStatusV1, http.MethodPost,
+			"Bearer " + testToken(t, other, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Expired",
+			capmc.XnameStatusV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", expired,
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Wrong audience",
+			capmc.XnameStatusV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", wrongAudience,
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Status scope reads status",
+			capmc.XnameStatusV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "openid capmc:status"}),
+			http.StatusNoContent, "alice",
+		},
+		{
+			"No permissions",
+			capmc.XnameStatusV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice")),
+			http.StatusForbidden, "",
+		},
+		{
+			"Status scope can't set power caps",
+			capmc.PowerCapSetV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusForbidden, "",
+		},
+		{
+			"Status scope lists schedules",
+			capmc.PowerCapSchedulesV1, http.MethodGet,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusNoContent, "alice",
+		},
+		{
+			"Status scope can't create schedules",
+			capmc.PowerCapSchedulesV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusForbidden, "",
+		},
+		{
+			"Power cap client role sets power caps",
+			capmc.PowerCapSetV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("bob"),
+				map[string]interface{}{"resource_access": map[string]interface{}{
+					"capmc": map[string][]string{"roles": {"capmc:power-cap"}},
+				}}),
+			http.StatusNoContent, "bob",
+		},
+		{
+			"Configured realm role reaches xname power APIs",
+			capmc.XnameOffV1, http.MethodPost,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("carol"),
+				map[string]interface{}{"realm_access": map[string][]string{
+					"roles": {"operator"},
+				}}),
+			http.StatusNoContent, "carol",
+		},
+		{
+			"Configured role can't change the log level",
+			capmc.LogLevelV1, http.MethodPut,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("carol"),
+				map[string]interface{}{"roles": []string{"operator"}}),
+			http.StatusForbidden, "",
+		},
+		{
+			"Admin changes the log level",
+			capmc.LogLevelV1, http.MethodPut,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("dave"),
+				map[string]interface{}{"roles": []string{"admin"}}),
+			http.StatusNoContent, "dave",
+		},
+		{
+			"Unlisted API needs a token",
+			"/capmc/v1/unlisted", http.MethodGet, "",
+			http.StatusUnauthorized, "",
+		},
+		{
+			"Unlisted API needs admin",
+			"/capmc/v1/unlisted", http.MethodGet,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("alice"),
+				map[string]interface{}{"scope": "capmc:status"}),
+			http.StatusForbidden, "",
+		},
+		{
+			"Admin reaches an unlisted API",
+			"/capmc/v1/unlisted", http.MethodGet,
+			"Bearer " + testToken(t, key, "k1", testStdClaims("dave"),
+				map[string]interface{}{"roles": []string{"admin"}}),
+			http.StatusNoContent, "dave",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caller = ""
+			req, err := http.NewRequest(tt.method, tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			rr := httptest.NewRecorder()
+			tSvc.authorize(tt.path, handler).ServeHTTP(rr, req)
+			if tt.rc != rr.Code {
+				t.Errorf("Expected return code: %d, got: %d %s",
+					tt.rc, rr.Code, rr.Body.String())
+			}
+			if tt.caller != caller {
+				t.Errorf("Expected caller %q, got %q", tt.caller, caller)
+			}
+			if rr.Code == http.StatusUnauthorized &&
+				rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Expected WWW-Authenticate header")
+			}
+		})
+	}
+
+	// Without an authenticator every caller is let through.
+	tSvc.auth = nil
+	req, _ := http.NewRequest(http.MethodPost, capmc.XnameOffV1, nil)
+	rr := httptest.NewRecorder()
+	tSvc.authorize(capmc.XnameOffV1, handler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("Expected return code: %d, got: %d", http.StatusNoContent, rr.Code)
+	}
+}
+
+func TestAPIPermissionsCoverRoutes(t *testing.T) {
+	for _, vers := range capmcAPIs {
+		for _, api := range vers {
+			_, listed := apiPermissions[api.pattern]
+			if publicAPIs[api.pattern] == listed {
+				t.Errorf("%s must be either public or in apiPermissions",
+					api.pattern)
+			}
+		}
+	}
+}
+
+func TestAuthJWKSURL(t *testing.T) {
+	old := testAuthKey(t)
+	key := testAuthKey(t)
+
+	var (
+		fetches int32
+		jwks    atomic.Value
+	)
+	jwks.Store(testJWKS(t, old, "old"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write(jwks.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	a, err := newAuthenticator(CapmcConfiguration{AuthJWKSURL: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticate := func(k *rsa.PrivateKey, kid string) error {
+		req, _ := http.NewRequest(http.MethodGet, capmc.OperationsV1, nil)
+		req.Header.Set("Authorization",
+			"Bearer "+testToken(t, k, kid, testStdClaims("alice")))
+		_, err := a.authenticate(req)
+		return err
+	}
+
+	if err := authenticate(old, "old"); err != nil {
+		t.Errorf("Expected token signed by the old key to be valid: %s", err)
+	}
+
+	// The keys were rotated: the new key is only fetched once the
+	// refetch delay has passed.
+	jwks.Store(testJWKS(t, key, "new"))
+	if err := authenticate(key, "new"); err == nil {
+		t.Errorf("Expected token signed by the new key to be refused before the refetch delay")
+	}
+
+	a.loaded = time.Now().Add(-authRefetchDelay)
+	if err := authenticate(key, "new"); err != nil {
+		t.Errorf("Expected token signed by the new key to be valid: %s", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Expected 2 JWKS fetches, got %d", n)
+	}
+}
+
+func TestAuthJWKSSlowFetch(t *testing.T) {
+	old := testAuthKey(t)
+	key := testAuthKey(t)
+
+	var (
+		fetches int32
+		jwks    atomic.Value
+		release = make(chan struct{})
+	)
+	jwks.Store(testJWKS(t, old, "old"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every fetch but the first hangs until released.
+		if atomic.AddInt32(&fetches, 1) > 1 {
+			<-release
+		}
+		w.Write(jwks.Load().([]byte))
+	}))
+	defer srv.Close()
+
+	a, err := newAuthenticator(CapmcConfiguration{AuthJWKSURL: srv.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys were rotated. Tokens signed by the new key wait for the
+	// one fetch of the JWKS, while those with a known key go on.
+	jwks.Store(testJWKS(t, key, "new"))
+	a.loaded = time.Now().Add(-authRefetchDelay)
+
+	var wg sync.WaitGroup
+	found := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found <- len(a.verificationKeys("new"))
+		}()
+	}
+
+	for atomic.LoadInt32(&fetches) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		a.verificationKeys("old")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Known key blocked by the JWKS fetch")
+	}
+
+	close(release)
+	wg.Wait()
+	close(found)
+	for n := range found {
+		if n != 1 {
+			t.Errorf("Expected the new key after the fetch, got %d keys", n)
+		}
+	}
+	if n := atomic.LoadInt32(&fetches); n != 2 {
+		t.Errorf("Expected 2 JWKS fetches, got %d", n)
+	}
+}
+
+func TestXnamePowerPermission(t *testing.T) {
+	tests := []struct {
+		name      string
+		xnames    []string
+		recursive bool
+		prereq    bool
+		perm      permission
+	}{
+		{"Nodes", []string{"x1000c0s0b0n0", "x1000c0s0b0n1"}, false, false, permNodePower},
+		{"Recursive node", []string{"x1000c0s0b0n0"}, true, false, permInfraPower},
+		{"Prereq node", []string{"x1000c0s0b0n0"}, false, true, permInfraPower},
+		{"Chassis", []string{"x1000c0"}, false, false, permInfraPower},
+		{"Blade and node", []string{"x1000c0s0b0n0", "x1000c0s1"}, false, false, permInfraPower},
+		{"PDU outlet", []string{"x3000m0p0v1"}, false, false, permInfraPower},
+		{"Whole system", []string{"s0"}, false, false, permInfraPower},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perm := xnamePowerPermission(tt.xnames, tt.recursive, tt.prereq)
+			if perm != tt.perm {
+				t.Errorf("Expected %s, got %s", tt.perm, perm)
+			}
+		})
+	}
+}
+
+func TestXnameOffForbidden(t *testing.T) {
+	var tSvc CapmcD
+	tSvc.config = loadConfig("")
+
+	ctx := withPrincipal(context.Background(), &principal{
+		subject: "alice",
+		perms:   map[permission]bool{permNodePower: true},
+	})
+
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"Chassis", `{"xnames":["x1000c0"]}`},
+		{"Recursive", `{"xnames":["x1000c0s0b0n0"],"recursive":true}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+				capmc.XnameOffV1, bytes.NewBufferString(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			tSvc.doXnameOff(rr, req)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("Expected return code: %d, got: %d %s",
+					http.StatusForbidden, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), string(permInfraPower)) {
+				t.Errorf("Expected %s in %s", permInfraPower, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,466 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	rf "github.com/Cray-HPE/hms-smd/v2/pkg/redfish"
+)
+
+// Configuration values for PowerBackend
+const (
+	backendPCS     = "pcs"
+	backendRedfish = "redfish"
+)
+
+// PowerBackend performs power operations and status queries for the
+// components CAPMC controls.
+type PowerBackend interface {
+	// Name identifies the backend.
+	Name() string
+	// Transition performs the tReq operation ("on", "off" or
+	// "force-off") on its components as part of the CAPMC command. nodes
+	// holds the component information by xname. It returns the number of
+	// components which failed along with data updated with their errors.
+	Transition(ctx context.Context, tReq PCSTransition, nodes map[string]*NodeInfo, data capmc.XnameControlResponse, command string) (int, capmc.XnameControlResponse)
+	// Status reports the power state of the components in nl, as
+	// selected by filter.
+	Status(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse
+}
+
+// newPowerBackend returns the backend called name.
+func newPowerBackend(name string, d *CapmcD) (PowerBackend, error) {
+	switch strings.ToLower(name) {
+	case backendPCS:
+		if d.config == nil || d.config.CapmcConf.PCSBreakerThreshold <= 0 {
+			return &pcsBackend{d: d}, nil
+		}
+		conf := d.config.CapmcConf
+		return &failoverBackend{
+			pcs:     &pcsBackend{d: d},
+			redfish: &redfishBackend{d: d},
+			breaker: newCircuitBreaker(conf.PCSBreakerThreshold,
+				time.Duration(conf.PCSBreakerCooldown)*time.Second),
+			powerOps: conf.PCSFailoverPowerOps,
+		}, nil
+	case backendRedfish:
+		return &redfishBackend{d: d}, nil
+	}
+
+	return nil, fmt.Errorf("unknown power backend '%s'", name)
+}
+
+// powerBackend returns the configured backend, PCS if there isn't one.
+func (d *CapmcD) powerBackend() PowerBackend {
+	if d.backend == nil {
+		return &pcsBackend{d: d}
+	}
+
+	return d.backend
+}
+
+// pcsBackend performs power operations through the Power Control Service.
+type pcsBackend struct {
+	d *CapmcD
+}
+
+func (b *pcsBackend) Name() string {
+	return backendPCS
+}
+
+func (b *pcsBackend) Transition(ctx context.Context, tReq PCSTransition, nodes map[string]*NodeInfo, data capmc.XnameControlResponse, command string) (int, capmc.XnameControlResponse) {
+	return powerFunction(ctx, tReq, data, b.d, command, 0)
+}
+
+func (b *pcsBackend) Status(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+	return b.d.pcsCompStatus(ctx, nl, command, filter)
+}
+
+// redfishBackend performs power operations by talking to the BMCs
+// directly.
+type redfishBackend struct {
+	d *CapmcD
+}
+
+func (b *redfishBackend) Name() string {
+	return backendRedfish
+}
+
+// transitionCmds maps PCS transition operations to BMC commands.
+var transitionCmds = map[string]string{
+	"on":        bmcCmdPowerOn,
+	"off":       bmcCmdPowerOff,
+	"force-off": bmcCmdPowerForceOff,
+}
+
+func (b *redfishBackend) Transition(ctx context.Context, tReq PCSTransition, nodes map[string]*NodeInfo, data capmc.XnameControlResponse, command string) (int, capmc.XnameControlResponse) {
+	cmd, ok := transitionCmds[tReq.Operation]
+	if !ok {
+		errstr := fmt.Sprintf("Error: Unsupported power operation %s.", tReq.Operation)
+		log.Printf("%s", errstr)
+		data.ErrResponse.E = -1
+		data.ErrResponse.ErrMsg = errstr
+		return 0, data
+	}
+
+	// Components are powered in the configured sequence, each type
+	// only once all those before it have completed. Types not in the
+	// sequence go last.
+	seq, _ := b.d.cmdCompPowerSeq(cmd)
+	order := make(map[string]int)
+	for i, t := range seq {
+		order[t] = i
+	}
+
+	stages := make(map[int][]*NodeInfo)
+	var failures int
+	for _, loc := range tReq.Location {
+		ni, ok := nodes[loc.Xname]
+		if !ok {
+			failures++
+			data.Xnames = append(data.Xnames,
+				capmc.MakeXnameError(loc.Xname, -1, "Unknown component"))
+			continue
+		}
+
+		pos, ok := order[ni.Type]
+		if !ok {
+			pos = len(seq)
+		}
+		stages[pos] = append(stages[pos], ni)
+	}
+
+	positions := make([]int, 0, len(stages))
+	for pos := range stages {
+		positions = append(positions, pos)
+	}
+	sort.Ints(positions)
+
+	var powered []*NodeInfo
+	for _, pos := range positions {
+		if ctx.Err() != nil {
+			errstr := fmt.Sprintf("Error: Power operation %s cancelled.", command)
+			log.Printf("%s", errstr)
+			data.ErrResponse.E = 125 // ECANCELED
+			data.ErrResponse.ErrMsg = errstr
+			return failures, data
+		}
+
+		waitNum, waitChan := b.d.queueBmcCmd(ctx, bmcCmd{cmd: cmd}, stages[pos])
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 {
+				failures++
+				data.Xnames = append(data.Xnames,
+					capmc.MakeXnameError(result.ni.Hostname, result.rc, result.msg))
+				continue
+			}
+			powered = append(powered, result.ni)
+		}
+	}
+
+	// The off portion of a reinit must complete before the on
+	if (command == bmcCmdPowerRestart || command == bmcCmdPowerForceRestart) &&
+		cmd != bmcCmdPowerOn {
+		var xerrs []*capmc.XnameControlErr
+		xerrs, data = b.waitForOff(ctx, powered, data, command)
+		failures += len(xerrs)
+		data.Xnames = append(data.Xnames, xerrs...)
+	}
+
+	return failures, data
+}
+
+// waitForOff polls the power state of nodes until they are all off,
+// returning an error for each node still on after the configured number of
+// retries.
+func (b *redfishBackend) waitForOff(ctx context.Context, nodes []*NodeInfo, data capmc.XnameControlResponse, command string) ([]*capmc.XnameControlErr, capmc.XnameControlResponse) {
+	retries := defaultWaitForOffRetries
+	sleep := defaultWaitForOffSleep
+	if b.d.config != nil {
+		retries = b.d.config.CapmcConf.WaitForOffRetries
+		sleep = b.d.config.CapmcConf.WaitForOffSleep
+	}
+
+	for try := 0; len(nodes) > 0 && try < retries; try++ {
+		if !sleepCtx(ctx, time.Duration(sleep)*time.Second) {
+			errstr := fmt.Sprintf("Error: Power operation %s cancelled.", command)
+			log.Printf("%s", errstr)
+			data.ErrResponse.E = 125 // ECANCELED
+			data.ErrResponse.ErrMsg = errstr
+			return nil, data
+		}
+
+		var on []*NodeInfo
+		waitNum, waitChan := b.d.queueBmcCmd(ctx, bmcCmd{cmd: bmcCmdPowerStatus}, nodes)
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 || result.state != rf.POWER_STATE_OFF {
+				on = append(on, result.ni)
+			}
+		}
+		nodes = on
+	}
+
+	var xerrs []*capmc.XnameControlErr
+	for _, ni := range nodes {
+		xerrs = append(xerrs, capmc.MakeXnameError(ni.Hostname, -1,
+			"Timed out waiting for component to power off"))
+	}
+
+	return xerrs, data
+}
+
+func (b *redfishBackend) Status(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+	var data capmc.XnameStatusResponse
+	data.On = make([]string, 0, 1)
+	data.Off = make([]string, 0, 1)
+	data.Undefined = make([]string, 0, 1)
+
+	var failures int
+	waitNum, waitChan := b.d.queueBmcCmd(ctx, bmcCmd{cmd: bmcCmdPowerStatus}, nl)
+	for i := 0; i < waitNum; i++ {
+		result := <-waitChan
+		xname := result.ni.Hostname
+		detail := capmc.XnamePowerStatus{
+			Xname:                     xname,
+			PowerState:                "undefined",
+			ManagementState:           "available",
+			SupportedPowerTransitions: result.ni.RfResetTypes,
+			LastUpdated:               time.Now().UTC().Format(time.RFC3339),
+		}
+		if result.rc != 0 {
+			detail.ManagementState = "unavailable"
+			detail.Error = result.msg
+			data.Details = append(data.Details, detail)
+			data.Undefined = append(data.Undefined, xname)
+			failures++
+			continue
+		}
+		if result.state == rf.POWER_STATE_ON || result.state == rf.POWER_STATE_OFF {
+			detail.PowerState = strings.ToLower(result.state)
+		}
+		data.Details = append(data.Details, detail)
+
+		switch result.state {
+		case rf.POWER_STATE_ON:
+			if filter&capmc.FilterShowOnBit != 0 {
+				data.On = append(data.On, xname)
+			}
+		case rf.POWER_STATE_OFF:
+			if filter&capmc.FilterShowOffBit != 0 {
+				data.Off = append(data.Off, xname)
+			}
+		// Other hardware states are not implemented
+		default:
+			data.Undefined = append(data.Undefined, xname)
+		}
+	}
+
+	if failures > 0 {
+		data.ErrResponse.E = -1
+		data.ErrResponse.ErrMsg =
+			fmt.Sprintf("Errors encountered with %d/%d Xnames for %s",
+				failures, waitNum, command)
+	}
+
+	// Sorting is mostly for convenience; not strictly needed for capmc.
+	sort.Sort(xnameSlice{&data.On})
+	sort.Sort(xnameSlice{&data.Off})
+	sort.Sort(xnameSlice{&data.Undefined})
+	sort.Slice(data.Details, func(i, j int) bool {
+		return data.Details[i].Xname < data.Details[j].Xname
+	})
+
+	return data
+}
+
+// circuitBreaker tracks the health of PCS. It opens after threshold
+// consecutive failures, after which PCS is not used until cooldown has
+// passed. A single request is then let through to probe PCS, closing the
+// breaker if it succeeds and reopening it if it fails.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	open      bool
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether a request may be sent to PCS. Every allowed request
+// must be followed by a call to success or failure.
+func (cb *circuitBreaker) allow(now time.Time) bool {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if !cb.open {
+		return true
+	}
+	if !cb.probing && now.Sub(cb.openedAt) >= cb.cooldown {
+		cb.probing = true
+		return true
+	}
+
+	return false
+}
+
+// success records a successful PCS request, closing the breaker.
+func (cb *circuitBreaker) success() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if cb.open {
+		log.Printf("Info: PCS available again, circuit breaker closed")
+	}
+	cb.failures = 0
+	cb.open = false
+	cb.probing = false
+}
+
+// failure records a failed PCS request, opening the breaker once the
+// threshold is reached or a probe fails.
+func (cb *circuitBreaker) failure(now time.Time) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.failures++
+	if cb.probing || (!cb.open && cb.failures >= cb.threshold) {
+		if !cb.open {
+			log.Printf("Notice: PCS circuit breaker opened after %d failures",
+				cb.failures)
+		}
+		cb.open = true
+		cb.openedAt = now
+		cb.probing = false
+	}
+}
+
+// abandon records a PCS request whose outcome says nothing about PCS,
+// letting another request probe it.
+func (cb *circuitBreaker) abandon() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	cb.probing = false
+}
+
+// pcsFailed reports whether a PCS backend response failed because of PCS
+// itself rather than the components. The PCS calls report those failures,
+// and only those, as an internal server error.
+func pcsFailed(e capmc.ErrResponse) bool {
+	return e.E == http.StatusInternalServerError
+}
+
+// failoverBackend uses PCS while it is healthy and falls back to talking to
+// the BMCs directly when the circuit breaker on PCS is open. Status queries
+// always fall back; power operations only if powerOps is set. Responses
+// record which backend served each component.
+type failoverBackend struct {
+	pcs      PowerBackend
+	redfish  PowerBackend
+	breaker  *circuitBreaker
+	powerOps bool
+}
+
+func (b *failoverBackend) Name() string {
+	return b.pcs.Name()
+}
+
+func (b *failoverBackend) Transition(ctx context.Context, tReq PCSTransition, nodes map[string]*NodeInfo, data capmc.XnameControlResponse, command string) (int, capmc.XnameControlResponse) {
+	var failures int
+
+	backend := b.pcs
+	if b.powerOps && !b.breaker.allow(time.Now()) {
+		requestLog(ctx).Warnf("PCS unavailable, sending %s directly to the BMCs",
+			command)
+		backend = b.redfish
+		failures, data = b.redfish.Transition(ctx, tReq, nodes, data, command)
+	} else {
+		failures, data = b.pcs.Transition(ctx, tReq, nodes, data, command)
+		b.record(data.ErrResponse)
+	}
+
+	if data.Backends == nil {
+		data.Backends = make(map[string]string)
+	}
+	for _, loc := range tReq.Location {
+		data.Backends[loc.Xname] = backend.Name()
+	}
+
+	return failures, data
+}
+
+func (b *failoverBackend) Status(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+	var data capmc.XnameStatusResponse
+
+	backend := b.redfish
+	if b.breaker.allow(time.Now()) {
+		data = b.pcs.Status(ctx, nl, command, filter)
+		b.record(data.ErrResponse)
+		if !pcsFailed(data.ErrResponse) {
+			backend = b.pcs
+		} else {
+			requestLog(ctx).Warnf("PCS status query failed, querying the BMCs directly")
+		}
+	}
+	if backend == b.redfish {
+		data = b.redfish.Status(ctx, nl, command, filter)
+	}
+
+	data.Backends = make(map[string]string, len(nl))
+	for _, ni := range nl {
+		data.Backends[ni.Hostname] = backend.Name()
+	}
+
+	return data
+}
+
+// record updates the circuit breaker with the outcome of a PCS request.
+// Cancelled requests say nothing about PCS.
+func (b *failoverBackend) record(e capmc.ErrResponse) {
+	switch {
+	case pcsFailed(e):
+		b.breaker.failure(time.Now())
+	case e.E == 125: // ECANCELED
+		b.breaker.abandon()
+	default:
+		b.breaker.success()
+	}
+}
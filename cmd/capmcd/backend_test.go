@@ -0,0 +1,453 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	rf "github.com/Cray-HPE/hms-smd/v2/pkg/redfish"
+)
+
+// bmcPowerMock simulates the power state of BMC managed components.
+// Components whose state is unset fail every request.
+type bmcPowerMock struct {
+	sync.Mutex
+	states map[string]string // power state by BMC FQDN
+	resets []string          // BMC FQDNs in the order they were reset
+	stuck  bool              // ignore requests to power off
+}
+
+func (m *bmcPowerMock) roundTrip(r *http.Request) (*http.Response, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	code := http.StatusOK
+	body := ""
+	state, ok := m.states[r.URL.Host]
+	switch {
+	case !ok:
+		code = http.StatusInternalServerError
+	case r.Method == http.MethodPost:
+		var reset struct{ ResetType string }
+		json.NewDecoder(r.Body).Decode(&reset)
+		m.resets = append(m.resets, r.URL.Host)
+		switch reset.ResetType {
+		case "On":
+			m.states[r.URL.Host] = rf.POWER_STATE_ON
+		default:
+			if !m.stuck {
+				m.states[r.URL.Host] = rf.POWER_STATE_OFF
+			}
+		}
+	default:
+		body = fmt.Sprintf(`{"PowerState":"%s"}`, state)
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(body)),
+		Header:     make(http.Header),
+		Request:    r,
+	}, nil
+}
+
+func newBackendTestNode(xname, hmsType, rfType string) *NodeInfo {
+	return &NodeInfo{
+		Hostname:     xname,
+		Type:         hmsType,
+		BmcFQDN:      xname,
+		BmcPath:      "/redfish/v1/Systems/1",
+		RfActionURI:  "/redfish/v1/Systems/1/Actions/ComputerSystem.Reset",
+		RfResetTypes: []string{"On", "ForceOff", "GracefulShutdown"},
+		RfType:       rfType,
+	}
+}
+
+func newBackendTestSvc(mock *bmcPowerMock) *CapmcD {
+	config := *loadConfig("")
+	config.CapmcConf.WaitForOffRetries = 2
+	config.CapmcConf.WaitForOffSleep = 0
+
+	svc := &CapmcD{
+		rfClient: NewTestClient(mock.roundTrip),
+		config:   &config,
+		WPool:    base.NewWorkerPool(10, 10*10),
+	}
+	svc.WPool.Run()
+
+	return svc
+}
+
+func TestNewPowerBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		wantErr bool
+	}{
+		{"pcs", "pcs", false},
+		{"redfish", "redfish", false},
+		{"Redfish", "redfish", false},
+		{"ipmi", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := newPowerBackend(test.name, &CapmcD{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newPowerBackend() error = %v, wantErr %v",
+					err, test.wantErr)
+			}
+			if err == nil && b.Name() != test.backend {
+				t.Errorf("newPowerBackend() = %s, want %s",
+					b.Name(), test.backend)
+			}
+		})
+	}
+
+	if b := (&CapmcD{}).powerBackend(); b.Name() != backendPCS {
+		t.Errorf("default power backend = %s, want %s", b.Name(), backendPCS)
+	}
+}
+
+func TestRedfishBackendStatus(t *testing.T) {
+	mock := &bmcPowerMock{
+		states: map[string]string{
+			"x0c0s1b0n0": rf.POWER_STATE_ON,
+			"x0c0s2b0n0": rf.POWER_STATE_OFF,
+		},
+	}
+	svc := newBackendTestSvc(mock)
+	nl := []*NodeInfo{
+		newBackendTestNode("x0c0s2b0n0", "Node", rf.ComputerSystemType),
+		newBackendTestNode("x0c0s1b0n0", "Node", rf.ComputerSystemType),
+		newBackendTestNode("x0c0s3b0n0", "Node", rf.ComputerSystemType),
+	}
+
+	tests := []struct {
+		name   string
+		filter uint
+		want   capmc.XnameStatusResponse
+	}{
+		{
+			name:   "All",
+			filter: capmc.FilterShowAllBit,
+			want: capmc.XnameStatusResponse{
+				ErrResponse: capmc.ErrResponse{
+					E:      -1,
+					ErrMsg: "Errors encountered with 1/3 Xnames for Status",
+				},
+				On:        []string{"x0c0s1b0n0"},
+				Off:       []string{"x0c0s2b0n0"},
+				Undefined: []string{"x0c0s3b0n0"},
+			},
+		}, {
+			name:   "Off",
+			filter: capmc.FilterShowOffBit,
+			want: capmc.XnameStatusResponse{
+				ErrResponse: capmc.ErrResponse{
+					E:      -1,
+					ErrMsg: "Errors encountered with 1/3 Xnames for Status",
+				},
+				On:        []string{},
+				Off:       []string{"x0c0s2b0n0"},
+				Undefined: []string{"x0c0s3b0n0"},
+			},
+		},
+	}
+
+	// Details are reported whatever the filter
+	wantDetails := []string{
+		"x0c0s1b0n0 on available",
+		"x0c0s2b0n0 off available",
+		"x0c0s3b0n0 undefined unavailable",
+	}
+
+	b := &redfishBackend{d: svc}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := b.Status(context.Background(), nl, bmcCmdPowerStatus, test.filter)
+			var details []string
+			for _, detail := range got.Details {
+				details = append(details, fmt.Sprintf("%s %s %s",
+					detail.Xname, detail.PowerState, detail.ManagementState))
+			}
+			if !reflect.DeepEqual(details, wantDetails) {
+				t.Errorf("Status() details = %v, want %v", details, wantDetails)
+			}
+
+			got.Details = nil
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Status() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRedfishBackendTransition(t *testing.T) {
+	tests := []struct {
+		name      string
+		operation string
+		command   string
+		stuck     bool
+		resets    []string
+		failures  int
+		errMsg    string
+	}{
+		{
+			name:      "Off sequenced",
+			operation: "off",
+			command:   bmcCmdPowerOff,
+			resets:    []string{"x0c0s1b0n0", "x0c0s1"},
+		}, {
+			name:      "On sequenced",
+			operation: "on",
+			command:   bmcCmdPowerOn,
+			resets:    []string{"x0c0s1", "x0c0s1b0n0"},
+		}, {
+			name:      "Reinit waits for off",
+			operation: "off",
+			command:   bmcCmdPowerRestart,
+			stuck:     true,
+			resets:    []string{"x0c0s1b0n0", "x0c0s1"},
+			failures:  2,
+			errMsg:    "Timed out waiting for component to power off",
+		}, {
+			name:      "Unsupported operation",
+			operation: "soft-restart",
+			command:   bmcCmdPowerRestart,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := &bmcPowerMock{
+				states: map[string]string{
+					"x0c0s1b0n0": rf.POWER_STATE_ON,
+					"x0c0s1":     rf.POWER_STATE_ON,
+				},
+				stuck: test.stuck,
+			}
+			svc := newBackendTestSvc(mock)
+			nodes := map[string]*NodeInfo{
+				"x0c0s1b0n0": newBackendTestNode("x0c0s1b0n0", "Node", rf.ComputerSystemType),
+				"x0c0s1":     newBackendTestNode("x0c0s1", "ComputeModule", rf.ChassisType),
+			}
+			tReq := PCSTransition{
+				Operation: test.operation,
+				Location: []PCSLocation{
+					{Xname: "x0c0s1"},
+					{Xname: "x0c0s1b0n0"},
+				},
+			}
+
+			b := &redfishBackend{d: svc}
+			failures, data := b.Transition(context.Background(), tReq,
+				nodes, capmc.XnameControlResponse{}, test.command)
+
+			if failures != test.failures {
+				t.Errorf("Transition() failures = %d, want %d",
+					failures, test.failures)
+			}
+			if !reflect.DeepEqual(mock.resets, test.resets) {
+				t.Errorf("Transition() reset %v, want %v",
+					mock.resets, test.resets)
+			}
+			for _, xerr := range data.Xnames {
+				if xerr.ErrMsg != test.errMsg {
+					t.Errorf("Transition() %s error = %s, want %s",
+						xerr.Xname, xerr.ErrMsg, test.errMsg)
+				}
+			}
+			if test.resets == nil && !strings.Contains(data.ErrMsg, test.operation) {
+				t.Errorf("Transition() error = %q, want unsupported %s",
+					data.ErrMsg, test.operation)
+			}
+		})
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	start := time.Now()
+	cb := newCircuitBreaker(2, time.Minute)
+
+	steps := []struct {
+		name    string
+		now     time.Time
+		failed  bool
+		allowed bool
+	}{
+		{"First failure", start, true, true},
+		{"Threshold reached", start, true, true},
+		{"Open", start.Add(time.Second), false, false},
+		{"Probe fails", start.Add(time.Minute), true, true},
+		{"Reopened", start.Add(90 * time.Second), false, false},
+		{"Probe succeeds", start.Add(2 * time.Minute), false, true},
+		{"Closed", start.Add(2 * time.Minute), false, true},
+		{"Failure after close", start.Add(2 * time.Minute), true, true},
+		{"Still closed", start.Add(2 * time.Minute), false, true},
+	}
+
+	for _, step := range steps {
+		allowed := cb.allow(step.now)
+		if allowed != step.allowed {
+			t.Fatalf("%s: allow() = %t, want %t",
+				step.name, allowed, step.allowed)
+		}
+		if !allowed {
+			continue
+		}
+		if step.failed {
+			cb.failure(step.now)
+		} else {
+			cb.success()
+		}
+	}
+}
+
+// stubBackend is a PowerBackend which fails with its errno, if set.
+type stubBackend struct {
+	name  string
+	errno int
+	calls int
+}
+
+func (b *stubBackend) Name() string {
+	return b.name
+}
+
+func (b *stubBackend) Transition(ctx context.Context, tReq PCSTransition, nodes map[string]*NodeInfo, data capmc.XnameControlResponse, command string) (int, capmc.XnameControlResponse) {
+	b.calls++
+	data.E = b.errno
+	return 0, data
+}
+
+func (b *stubBackend) Status(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+	b.calls++
+	var data capmc.XnameStatusResponse
+	data.E = b.errno
+	return data
+}
+
+func TestFailoverBackend(t *testing.T) {
+	nl := []*NodeInfo{{Hostname: "x0c0s1b0n0"}, {Hostname: "x0c0s2b0n0"}}
+	nodes := map[string]*NodeInfo{
+		"x0c0s1b0n0": nl[0],
+		"x0c0s2b0n0": nl[1],
+	}
+	tReq := PCSTransition{
+		Operation: "on",
+		Location:  []PCSLocation{{Xname: "x0c0s1b0n0"}, {Xname: "x0c0s2b0n0"}},
+	}
+
+	tests := []struct {
+		name     string
+		pcsErrno int
+		powerOps bool
+		status   string // backend serving the status queries
+		power    string // backend serving the power operation
+	}{
+		{
+			name:   "PCS healthy",
+			status: backendPCS,
+			power:  backendPCS,
+		}, {
+			name:     "PCS down",
+			pcsErrno: http.StatusInternalServerError,
+			status:   backendRedfish,
+			power:    backendPCS,
+		}, {
+			name:     "PCS down with power failover",
+			pcsErrno: http.StatusInternalServerError,
+			powerOps: true,
+			status:   backendRedfish,
+			power:    backendRedfish,
+		}, {
+			name:     "Component errors",
+			pcsErrno: -1,
+			powerOps: true,
+			status:   backendPCS,
+			power:    backendPCS,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pcs := &stubBackend{name: backendPCS, errno: test.pcsErrno}
+			redfish := &stubBackend{name: backendRedfish}
+			b := &failoverBackend{
+				pcs:      pcs,
+				redfish:  redfish,
+				breaker:  newCircuitBreaker(1, time.Hour),
+				powerOps: test.powerOps,
+			}
+
+			// The first status query opens the breaker if PCS is down
+			for i := 0; i < 2; i++ {
+				data := b.Status(context.Background(), nl, bmcCmdPowerStatus, capmc.FilterShowAllBit)
+				for _, ni := range nl {
+					if data.Backends[ni.Hostname] != test.status {
+						t.Errorf("Status() %d %s backend = %s, want %s",
+							i, ni.Hostname, data.Backends[ni.Hostname],
+							test.status)
+					}
+				}
+			}
+
+			_, data := b.Transition(context.Background(), tReq, nodes,
+				capmc.XnameControlResponse{}, bmcCmdPowerOn)
+			for _, loc := range tReq.Location {
+				if data.Backends[loc.Xname] != test.power {
+					t.Errorf("Transition() %s backend = %s, want %s",
+						loc.Xname, data.Backends[loc.Xname], test.power)
+				}
+			}
+
+			// Once open, the breaker keeps status queries off PCS
+			wantCalls := 3
+			if test.pcsErrno == http.StatusInternalServerError {
+				wantCalls = 1
+				if !test.powerOps {
+					wantCalls++
+				}
+			}
+			if pcs.calls != wantCalls {
+				t.Errorf("PCS called %d times, want %d", pcs.calls, wantCalls)
+			}
+		})
+	}
+}
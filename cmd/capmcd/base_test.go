@@ -56,13 +56,13 @@ const (
 	hsmReservationPath        = "/hsm/v2/locks/service/reservations"
 	hsmReservationReleasePath = "/hsm/v2/locks/service/reservations/release"
 	hsmReservationRenewPath   = "/hsm/v2/locks/service/reservations/renew"
+	hsmReservationCheckPath   = "/hsm/v2/locks/service/reservations/check"
 )
 
 var prod = &svcres.Production{}
 var smServer *httptest.Server
 var initDone = false
 var failAquire = false
-var logger = logrus.New()
 
 //Storage of our fake reservations
 
@@ -191,6 +191,46 @@ func smReservationReleaseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(ba)
 }
 
+// Deputy keys with this prefix are considered valid, simulating reservations
+// held by some other service.
+const heldDeputyKeyPrefix = "HELDKey_"
+
+func smReservationCheckHandler(w http.ResponseWriter, r *http.Request) {
+	var inData svcres.ReservationCheckParameters
+	var retData svcres.ReservationCheckResponse
+	fname := "smReservationCheckHandler()"
+
+	body, _ := ioutil.ReadAll(r.Body)
+	err := json.Unmarshal(body, &inData)
+	if err != nil {
+		logger.Errorf("%s: Error unmarshalling req data: %v", fname, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	for _, key := range inData.DeputyKeys {
+		if strings.HasPrefix(key.Key, heldDeputyKeyPrefix) {
+			retData.Success = append(retData.Success,
+				svcres.ReservationCheckSuccessResponse{ID: key.ID,
+					DeputyKey: key.Key})
+		} else {
+			retData.Failure = append(retData.Failure,
+				svcres.FailureResponse{ID: key.ID, Reason: "Invalid deputy key."})
+		}
+	}
+
+	ba, baerr := json.Marshal(&retData)
+	if baerr != nil {
+		logger.Errorf("%s: Error marshalling response data: %v", fname, baerr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ba)
+}
+
 // Insure various stuff is initialized.  Needed since we don't know which
 // test will be run when.
 
@@ -203,6 +243,8 @@ func checkInit() {
 			http.HandlerFunc(smReservationReleaseHandler))
 		mux.HandleFunc(hsmReservationRenewPath,
 			http.HandlerFunc(smReservationRenewHandler))
+		mux.HandleFunc(hsmReservationCheckPath,
+			http.HandlerFunc(smReservationCheckHandler))
 		smServer = httptest.NewServer(mux)
 		//logger.SetLevel(logrus.TraceLevel)
 		prod.InitInstance(smServer.URL, "", 1, logger, "RSVTest")
@@ -426,7 +468,7 @@ func runTest(t *testing.T, hsm string, testReq *testData, rlist *[]testData, vau
 	svc.OnUnsupportedAction = svc.config.CapmcConf.OnUnsupportedAction
 	svc.ReinitActionSeq = svc.config.CapmcConf.ReinitActionSeq
 	svc.reservationsEnabled = true
-	svc.reservation = *prod
+	svc.reservation = prod
 	if svc.pcsURL, err = url.Parse("https://fake-system.us.cray.com/apis/power-control/v1"); err != nil {
 		log.Fatalf("Invalid PCS URI specified: %s", err)
 	}
@@ -470,7 +512,9 @@ func TestMain(m *testing.M) {
 	ccs := compcreds.NewCompCredStore("secret/hms-cred", ss)
 	svc.ss = ss
 	svc.ccs = ccs
-	svc.debug = debug
+	if debug {
+		logger.SetLevel(logrus.DebugLevel)
+	}
 	mockVault = adapter
 	hsm := "https://localhost:27779/hsm/v2"
 	if svc.hsmURL, err = url.Parse(hsm); err != nil {
@@ -484,10 +528,12 @@ func TestMain(m *testing.M) {
 
 	if enableLog {
 		// setup logger as it is in non-test main
-		log.SetFlags(log.Lshortfile | log.LstdFlags)
+		log.SetFlags(log.Lshortfile)
+		log.SetOutput(stdLogWriter{})
 	} else {
 		// discard all log output
 		log.SetOutput(ioutil.Discard)
+		logger.SetOutput(ioutil.Discard)
 	}
 	excode := m.Run()
 	os.Exit(excode)
@@ -28,6 +28,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -158,12 +159,12 @@ func (d *CapmcD) queueBmcCall(call bmcCall) {
 
 // queueBmcCmd queues up a command that will concurrently make the same
 // Redfish API call to each component by workers in the global worker pool.
-func (d *CapmcD) queueBmcCmd(cmd bmcCmd, nodes []*NodeInfo) (int, <-chan bmcPowerRc) {
+func (d *CapmcD) queueBmcCmd(ctx context.Context, cmd bmcCmd, nodes []*NodeInfo) (int, <-chan bmcPowerRc) {
 	waiters := len(nodes)
 	rspChan := make(chan bmcPowerRc, waiters)
 
 	for _, node := range nodes {
-		var call = bmcCall{bmcCmd: cmd, ni: node, rspChan: rspChan}
+		var call = bmcCall{bmcCmd: cmd, ni: node, rspChan: rspChan, ctx: ctx}
 		d.queueBmcCall(call)
 	}
 
@@ -172,35 +173,59 @@ func (d *CapmcD) queueBmcCmd(cmd bmcCmd, nodes []*NodeInfo) (int, <-chan bmcPowe
 
 // queueBmcCmds queues up commands that will concurrently make the Redfish API
 // calls to each component by workers in the global worker pool.
-func (d *CapmcD) queueBmcCmds(cmds map[*NodeInfo]bmcCmd, nodes []*NodeInfo) (int, <-chan bmcPowerRc) {
+func (d *CapmcD) queueBmcCmds(ctx context.Context, cmds map[*NodeInfo]bmcCmd, nodes []*NodeInfo) (int, <-chan bmcPowerRc) {
 	waiters := len(nodes)
 	rspChan := make(chan bmcPowerRc, waiters)
 
 	for _, node := range nodes {
 		cmd, ok := cmds[node]
 		if !ok {
-			log.Printf("Error: no BMC command for %s", node.Hostname)
+			requestLog(ctx).Errorf("no BMC command for %s", node.Hostname)
 			continue
 		}
-		var call = bmcCall{bmcCmd: cmd, ni: node, rspChan: rspChan}
+		var call = bmcCall{bmcCmd: cmd, ni: node, rspChan: rspChan, ctx: ctx}
 		d.queueBmcCall(call)
 	}
 
 	return waiters, rspChan
 }
 
+// doBmcRequest sends req to the BMC of ni, recording the latency of the
+// call by BMC type and tracing it as part of the request in ctx.
+func (d *CapmcD) doBmcRequest(ctx context.Context, ni *NodeInfo, req *http.Request) (*http.Response, error) {
+	_, sp := startClientSpan(ctx, "BMC "+req.Method)
+	sp.setAttr("http.request.method", req.Method)
+	sp.setAttr("url.full", req.URL.String())
+	sp.setAttr("capmc.xname", ni.Hostname)
+	sp.setAttr("capmc.bmc_type", ni.BmcType)
+
+	start := time.Now()
+	rfClientLock.RLock()
+	rsp, err := d.rfClient.Do(req)
+	rfClientLock.RUnlock()
+	metrics.observeBmc(ni.BmcType, start, err)
+
+	if err == nil {
+		sp.setAttr("http.response.status_code", rsp.StatusCode)
+	}
+	sp.setError(err)
+	sp.finish()
+
+	return rsp, err
+}
+
 // doBmcStatusCall - Handle the specific action of getting power status via
 // Redfish for a target node identified by a NodeInfo structure. Returns a
 // response that includes the NodeInfo structure, an error code, a message, and
 // the power state of the node requested.
-func (d *CapmcD) doBmcStatusCall(ni *NodeInfo) bmcPowerRc {
+func (d *CapmcD) doBmcStatusCall(ctx context.Context, ni *NodeInfo) bmcPowerRc {
 	var res = bmcPowerRc{ni: ni, rc: -1, state: "Unknown"}
 
 	nodePath := "https://" + ni.BmcFQDN + ni.BmcPath
 
 	// check for simulation only
 	if d.simulationOnly {
-		log.Printf("SIMULATION_ONLY: doBmcStatusCall with: GET %s", nodePath)
+		requestLog(ctx).Infof("SIMULATION_ONLY: doBmcStatusCall with: GET %s", nodePath)
 		res.state = "Simulation only - request not sent to hardware"
 		return res
 	}
@@ -212,12 +237,10 @@ func (d *CapmcD) doBmcStatusCall(ni *NodeInfo) bmcPowerRc {
 	req.Close = true
 
 	// execute the reqest
-	rfClientLock.RLock()
-	rsp, err := d.rfClient.Do(req)
-	rfClientLock.RUnlock()
+	rsp, err := d.doBmcRequest(ctx, ni, req)
 	defer base.DrainAndCloseResponseBody(rsp)
 	if err != nil {
-		log.Printf("GET %s\n %s Network Error: %s",
+		requestLog(ctx).Errorf("GET %s\n %s Network Error: %s",
 			nodePath, ni.BmcType, err)
 		res.msg = fmt.Sprintf("%s Communication Error", ni.BmcType)
 		return res
@@ -225,14 +248,14 @@ func (d *CapmcD) doBmcStatusCall(ni *NodeInfo) bmcPowerRc {
 
 	stsBody, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		log.Printf("Error: reading response body: %s\n", err)
+		requestLog(ctx).Errorf("reading response body: %s", err)
 		res.msg = "Internal Server Error"
 		return res
 	}
 
 	if rsp.StatusCode >= http.StatusBadRequest {
 		rsp.Body = ioutil.NopCloser(bytes.NewBuffer(stsBody))
-		log.Printf("Error: HTTP %s GET %s", rsp.Status, nodePath)
+		requestLog(ctx).Errorf("HTTP %s GET %s", rsp.Status, nodePath)
 		res.msg = d.decodeBmcResponse(ni, rsp)
 		res.rc = rsp.StatusCode
 		return res
@@ -248,7 +271,7 @@ func (d *CapmcD) doBmcStatusCall(ni *NodeInfo) bmcPowerRc {
 			if info.PowerState != "" {
 				powerState = info.PowerState
 			} else {
-				log.Printf("Info: no power state for (%s/%s) %s %s; assuming 'On'",
+				requestLog(ctx).Infof("no power state for (%s/%s) %s %s; assuming 'On'",
 					ni.RfType, ni.RfSubtype, ni.Type, ni.Hostname)
 				powerState = rf.POWER_STATE_ON
 			}
@@ -269,21 +292,19 @@ func (d *CapmcD) doBmcStatusCall(ni *NodeInfo) bmcPowerRc {
 		var info rf.Manager
 		err = json.Unmarshal(stsBody, &info)
 		if err == nil {
-			if d.debug {
-				log.Printf("Debug: Status: %v\n", info.Status)
-			}
+			requestLog(ctx).Debugf("Status: %v", info.Status)
 			// Managers don't really have a power state so
 			// we'll assume any reponse means 'On'
 			powerState = rf.POWER_STATE_ON
 		}
 	default:
-		log.Printf("Error: %s: unknown Redfish Type\n", ni.RfType)
+		requestLog(ctx).Errorf("%s: unknown Redfish Type", ni.RfType)
 		// punt
 		return res
 	}
 
 	if err != nil {
-		log.Printf("Error: decoding response body: %s\n", err)
+		requestLog(ctx).Errorf("decoding response body: %s", err)
 		res.msg = fmt.Sprintf("%s Response Decode Error", ni.BmcType)
 		return res
 	}
@@ -291,7 +312,7 @@ func (d *CapmcD) doBmcStatusCall(ni *NodeInfo) bmcPowerRc {
 	res.rc = 0
 	res.state = powerState
 
-	log.Printf("Info: %s %s [%s %s] Power State: %s\n",
+	requestLog(ctx).Infof("%s %s [%s %s] Power State: %s",
 		ni.Type, ni.Hostname, ni.BmcType, ni.BmcFQDN, res.state)
 
 	return res
@@ -307,9 +328,9 @@ func (d *CapmcD) doBmcPowerCall(call bmcCall) bmcPowerRc {
 
 	resetType, err := d.cmdToResetType(call.cmd, ni.RfResetTypes)
 	if err != nil {
-		log.Printf("failed converting %s to Redfish ResetType: %s",
+		requestLog(call.ctx).Errorf("failed converting %s to Redfish ResetType: %s",
 			call.cmd, err)
-		log.Printf("%s %s: AllowableVaules: %s\n",
+		requestLog(call.ctx).Errorf("%s %s: AllowableVaules: %s",
 			ni.BmcType, ni.BmcFQDN, ni.RfResetTypes)
 		res.msg = fmt.Sprintf("%s %s: %s", ni.BmcType, ni.BmcFQDN, err)
 		return res
@@ -331,7 +352,7 @@ func (d *CapmcD) doBmcPowerCall(call bmcCall) bmcPowerRc {
 		if HPEPDU {
 			outletNum := strings.Split(ni.Hostname, "v")
 			if len(outletNum) < 2 {
-				log.Printf("ERROR: Could not get outlet number")
+				requestLog(call.ctx).Errorf("Could not get outlet number")
 				// Just return because it will not work
 				return res
 			}
@@ -349,14 +370,14 @@ func (d *CapmcD) doBmcPowerCall(call bmcCall) bmcPowerRc {
 
 	// check for simulation only
 	if d.simulationOnly {
-		log.Printf("SIMULATION_ONLY: doBmcPowerCall with: POST %s, Data: %s", actionPath, body)
+		requestLog(call.ctx).Infof("SIMULATION_ONLY: doBmcPowerCall with: POST %s, Data: %s", actionPath, body)
 		res.state = "Simulation only - request not sent to hardware"
 		return res
 	}
 
 	if resetType == "PushPowerButton" {
 		// Check current power state against requested power state
-		status := d.doBmcStatusCall(ni)
+		status := d.doBmcStatusCall(call.ctx, ni)
 		// If we are already in the desired power state, do nothing
 		if status.state == call.cmd {
 			res.rc = 0
@@ -371,19 +392,17 @@ func (d *CapmcD) doBmcPowerCall(call bmcCall) bmcPowerRc {
 		req.Header.Set("Accept", "*/*")
 		req.Header.Set("Content-Type", "application/json")
 		// execute the request
-		rfClientLock.RLock()
-		rsp, err := d.rfClient.Do(req)
-		rfClientLock.RUnlock()
+		rsp, err := d.doBmcRequest(call.ctx, ni, req)
 		defer base.DrainAndCloseResponseBody(rsp)
 		if err != nil {
-			log.Printf("POST %s\n%s Network Error: %s",
+			requestLog(call.ctx).Errorf("POST %s\n%s Network Error: %s",
 				sessionAuthPath, ni.BmcType, err)
 			res.msg = fmt.Sprintf("%s Communication Error", ni.BmcType)
 			return res
 		}
 		sessionAuthToken = rsp.Header.Get("X-Auth-Token")
 	}
-	log.Printf("doBmcPowerCall with: POST %s, Data: %s", actionPath, body)
+	requestLog(call.ctx).Infof("doBmcPowerCall with: POST %s, Data: %s", actionPath, body)
 	// create the request
 	req, err := http.NewRequest("POST", actionPath, bytes.NewBuffer([]byte(body)))
 	req.SetBasicAuth(ni.BmcUser, ni.BmcPass)
@@ -394,12 +413,10 @@ func (d *CapmcD) doBmcPowerCall(call bmcCall) bmcPowerRc {
 	}
 
 	// execute the request
-	rfClientLock.RLock()
-	rsp, err := d.rfClient.Do(req)
-	rfClientLock.RUnlock()
+	rsp, err := d.doBmcRequest(call.ctx, ni, req)
 	defer base.DrainAndCloseResponseBody(rsp)
 	if err != nil {
-		log.Printf("POST %s\n Body           --> %s\n %s Network Error: %s",
+		requestLog(call.ctx).Errorf("POST %s\n Body           --> %s\n %s Network Error: %s",
 			actionPath, body, ni.BmcType, err)
 		res.msg = fmt.Sprintf("%s Communication Error", ni.BmcType)
 		return res
@@ -407,7 +424,7 @@ func (d *CapmcD) doBmcPowerCall(call bmcCall) bmcPowerRc {
 
 	cmdBody, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		log.Printf("Error: reading response body: %s\n", err)
+		requestLog(call.ctx).Errorf("reading response body: %s", err)
 		res.msg = "Internal Server Error"
 		return res
 	}
@@ -439,12 +456,12 @@ func (d *CapmcD) doBmcGetCall(call bmcCall) bmcPowerRc {
 		}
 	default:
 		res.msg = fmt.Sprintf("Invalid command %s", call.cmd)
-		log.Printf("Error: %s", res.msg)
+		requestLog(call.ctx).Errorf("%s", res.msg)
 		return res
 	}
 
 	if oid == "" {
-		log.Printf("Error: missing URI path for %s", call.cmd)
+		requestLog(call.ctx).Errorf("missing URI path for %s", call.cmd)
 		res.msg = fmt.Sprintf("Internal service error: no URI")
 		return res
 	}
@@ -453,7 +470,7 @@ func (d *CapmcD) doBmcGetCall(call bmcCall) bmcPowerRc {
 
 	// check for simulation only
 	if d.simulationOnly {
-		log.Printf("SIMULATION_ONLY: doBmcGetCall with: GET %s", bmcURI)
+		requestLog(call.ctx).Infof("SIMULATION_ONLY: doBmcGetCall with: GET %s", bmcURI)
 		res.state = "Simulation only - request not sent to hardware"
 		return res
 	}
@@ -464,19 +481,17 @@ func (d *CapmcD) doBmcGetCall(call bmcCall) bmcPowerRc {
 	req.Header.Set("Accept", "*/*")
 
 	// execute the request
-	rfClientLock.RLock()
-	rsp, err := d.rfClient.Do(req)
-	rfClientLock.RUnlock()
+	rsp, err := d.doBmcRequest(call.ctx, call.ni, req)
 	defer base.DrainAndCloseResponseBody(rsp)
 	if err != nil {
 		res.msg = fmt.Sprintf("%s Communication Error", call.ni.BmcType)
-		log.Printf("GET %s\n %s: %s", bmcURI, res.msg, err)
+		requestLog(call.ctx).Errorf("GET %s\n %s: %s", bmcURI, res.msg, err)
 		return res
 	}
 
 	stsBody, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		log.Printf("Error: reading response body: %s\n", err)
+		requestLog(call.ctx).Errorf("reading response body: %s", err)
 		res.msg = "Internal Server Error"
 		return res
 	}
@@ -498,7 +513,7 @@ func (d *CapmcD) doBmcPatchCall(call bmcCall) bmcPowerRc {
 	var (
 		oid    string
 		res    = bmcPowerRc{ni: call.ni, rc: -1, state: "Unknown"}
-		pcCall = bmcCall{bmcCmd: bmcCmd{cmd: bmcCmdGetPowerCap}, ni: call.ni}
+		pcCall = bmcCall{bmcCmd: bmcCmd{cmd: bmcCmdGetPowerCap}, ni: call.ni, ctx: call.ctx}
 	)
 	// NOTE The res.state isn't that important at this point. It is
 	//      only used with the "status" command.
@@ -513,12 +528,12 @@ func (d *CapmcD) doBmcPatchCall(call bmcCall) bmcPowerRc {
 		}
 	default:
 		res.msg = fmt.Sprintf("Invalid command %s", call.cmd)
-		log.Printf("Error: %s", res.msg)
+		requestLog(call.ctx).Errorf("%s", res.msg)
 		return res
 	}
 
 	if oid == "" {
-		log.Printf("Error: missing URI path for %s", call.cmd)
+		requestLog(call.ctx).Errorf("missing URI path for %s", call.cmd)
 		res.msg = fmt.Sprintf("Internal service error: no URI")
 		return res
 	}
@@ -527,7 +542,7 @@ func (d *CapmcD) doBmcPatchCall(call bmcCall) bmcPowerRc {
 
 	// check for simulation only
 	if d.simulationOnly {
-		log.Printf("SIMULATION_ONLY: doBmcPatchCall with: PATCH %s, DATA: %s", bmcURI, string(call.payload))
+		requestLog(call.ctx).Infof("SIMULATION_ONLY: doBmcPatchCall with: PATCH %s, DATA: %s", bmcURI, string(call.payload))
 		res.state = "Simulation only - request not sent to hardware"
 		return res
 	}
@@ -551,19 +566,17 @@ func (d *CapmcD) doBmcPatchCall(call bmcCall) bmcPowerRc {
 		if err != nil {
 			res.msg = fmt.Sprintf("%s unable to unmarshal status request",
 				call.bmcCmd)
-			log.Printf("%s", res.msg)
+			requestLog(call.ctx).Errorf("%s", res.msg)
 			return res
 		}
 		req.Header.Set("If-Match", rfPower.Oetag)
 	}
 
 	// execute the request
-	rfClientLock.RLock()
-	rsp, err := d.rfClient.Do(req)
-	rfClientLock.RUnlock()
+	rsp, err := d.doBmcRequest(call.ctx, call.ni, req)
 	defer base.DrainAndCloseResponseBody(rsp)
 	if err != nil {
-		log.Printf("PATCH %s\n Body           --> %s\n %s Network Error: %s",
+		requestLog(call.ctx).Errorf("PATCH %s\n Body           --> %s\n %s Network Error: %s",
 			bmcURI, call.payload, call.ni.BmcType, err)
 		res.msg = fmt.Sprintf("%s Communication Error", call.ni.BmcType)
 		return res
@@ -571,7 +584,7 @@ func (d *CapmcD) doBmcPatchCall(call bmcCall) bmcPowerRc {
 
 	cmdBody, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		log.Printf("Error: reading response body: %s\n", err)
+		requestLog(call.ctx).Errorf("reading response body: %s", err)
 		res.msg = "Internal Server Error"
 		return res
 	}
@@ -601,7 +614,7 @@ func (d *CapmcD) doBmcPostCall(call bmcCall, path string) bmcPowerRc {
 
 	// check for simulation only
 	if d.simulationOnly {
-		log.Printf("SIMULATION_ONLY: doBmcPostCall with: POST %s, Data: %s", actionPath, call.payload)
+		requestLog(call.ctx).Infof("SIMULATION_ONLY: doBmcPostCall with: POST %s, Data: %s", actionPath, call.payload)
 		res.state = "Simulation only - request not sent to hardware"
 		return res
 	}
@@ -614,12 +627,10 @@ func (d *CapmcD) doBmcPostCall(call bmcCall, path string) bmcPowerRc {
 	req.Header.Set("Content-Type", "application/json")
 
 	// execute the request
-	rfClientLock.RLock()
-	rsp, err := d.rfClient.Do(req)
-	rfClientLock.RUnlock()
+	rsp, err := d.doBmcRequest(call.ctx, ni, req)
 	defer base.DrainAndCloseResponseBody(rsp)
 	if err != nil {
-		log.Printf("POST %s\n Body           --> %s\n %s Network Error: %s",
+		requestLog(call.ctx).Errorf("POST %s\n Body           --> %s\n %s Network Error: %s",
 			actionPath, call.payload, ni.BmcType, err)
 		res.msg = fmt.Sprintf("%s Communication Error", ni.BmcType)
 		return res
@@ -627,7 +638,7 @@ func (d *CapmcD) doBmcPostCall(call bmcCall, path string) bmcPowerRc {
 
 	cmdBody, err := ioutil.ReadAll(rsp.Body)
 	if err != nil {
-		log.Printf("Error: reading response body: %s\n", err)
+		requestLog(call.ctx).Errorf("reading response body: %s", err)
 		res.msg = "Internal Server Error"
 		return res
 	}
@@ -648,14 +659,14 @@ func (d *CapmcD) doBmcPostCall(call bmcCall, path string) bmcPowerRc {
 // probably be generalized for fanning out other types of requests to the BMCs.
 func (d *CapmcD) doBmcCall(call bmcCall) {
 	ni := call.ni
-	log.Printf("Info: %s: '%s', %s: '%s', Command: '%s'\n",
+	requestLog(call.ctx).Infof("%s: '%s', %s: '%s', Command: '%s'",
 		ni.Type, ni.Hostname, ni.BmcType, ni.BmcFQDN, call.cmd)
 
 	var res = bmcPowerRc{ni: ni, rc: -1, state: "Unknown"}
 
 	if ni.BmcFQDN == "" {
 		// No BMC defined
-		log.Printf("Error: %s %s no FQDN defined for %s\n",
+		requestLog(call.ctx).Errorf("%s %s no FQDN defined for %s",
 			ni.Type, ni.Hostname, ni.BmcType)
 		res.msg = fmt.Sprintf("Unknown %s (%s Controller)",
 			ni.BmcType, ni.Type)
@@ -670,7 +681,7 @@ func (d *CapmcD) doBmcCall(call bmcCall) {
 		//      "status" should be the logical status of the node not power
 		//      state. Reporting the Redfish PowerState of the node, if
 		//      desired, should be an extension to the Shasta CAPMC API.
-		res = d.doBmcStatusCall(ni)
+		res = d.doBmcStatusCall(call.ctx, ni)
 	case bmcCmdGetPowerCap:
 		res = d.doBmcGetCall(call)
 	case bmcCmdSetPowerCap:
@@ -0,0 +1,320 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-smd/v2/pkg/sm"
+)
+
+// hwInventoryQueryWorkers is the most per node hardware inventory queries
+// made to HSM at once.
+const hwInventoryQueryWorkers = 16
+
+// capabilitiesCache caches what get_power_cap_capabilities derives from the
+// HSM hardware inventory: the moniker group of each node, and the power cap
+// group built for each moniker group. Once its TTL expires HSM is asked for
+// hardware inventory changes, and it is emptied if there were any.
+type capabilitiesCache struct {
+	sync.Mutex
+	ttl      time.Duration
+	checked  time.Time // when the cache was last emptied or checked
+	complete bool      // monikers holds every node in the inventory
+	monikers map[string]string
+	order    map[string]int // position of each node in the full inventory
+	types    map[string]PowerCapCapabilityMonikerType
+	groups   map[string]capmc.PowerCapGroup
+}
+
+// newCapabilitiesCache creates a cache which checks for hardware inventory
+// changes once its entries are older than ttl. A ttl of zero disables
+// caching.
+func newCapabilitiesCache(ttl time.Duration) *capabilitiesCache {
+	c := &capabilitiesCache{ttl: ttl}
+	c.reset(time.Now())
+	return c
+}
+
+// reset empties the cache. The caller must hold the lock.
+func (c *capabilitiesCache) reset(now time.Time) {
+	c.checked = now
+	c.complete = false
+	c.monikers = make(map[string]string)
+	c.order = make(map[string]int)
+	c.types = make(map[string]PowerCapCapabilityMonikerType)
+	c.groups = make(map[string]capmc.PowerCapGroup)
+}
+
+// addInventory records the moniker group of every node in hwInventory.
+// The caller must hold the lock.
+func (c *capabilitiesCache) addInventory(hwInventory sm.SystemHWInventory) {
+	if hwInventory.Nodes == nil {
+		return
+	}
+
+	for _, mg := range convertSystemHWInventoryToUniqueMonikerGroups(hwInventory) {
+		c.types[mg.Name] = mg.MonikerType
+		for _, xname := range mg.Xnames {
+			c.monikers[xname] = mg.Name
+		}
+	}
+}
+
+// addFullInventory records the moniker group and position of every node in
+// the full hardware inventory. The caller must hold the lock.
+func (c *capabilitiesCache) addFullInventory(hwInventory sm.SystemHWInventory) {
+	c.addInventory(hwInventory)
+	if hwInventory.Nodes != nil {
+		for _, node := range *hwInventory.Nodes {
+			if _, ok := c.order[node.ID]; !ok {
+				c.order[node.ID] = len(c.order)
+			}
+		}
+	}
+	c.complete = true
+}
+
+// missing returns those of xnames whose inventory isn't cached. The caller
+// must hold the lock.
+func (c *capabilitiesCache) missing(xnames []string) []string {
+	var missing []string
+	for _, xname := range xnames {
+		if _, ok := c.monikers[xname]; !ok {
+			missing = append(missing, xname)
+		}
+	}
+
+	return missing
+}
+
+// hwInventoryChanged reports whether HSM has recorded any hardware inventory
+// events since the given time.
+func (d *CapmcD) hwInventoryChanged(ctx context.Context, since time.Time) (bool, error) {
+	var hist sm.HWInvHistResp
+
+	params := url.Values{}
+	params.Add("starttime", since.UTC().Format(time.RFC3339))
+	err := d.GetFromHSM(ctx, "/Inventory/Hardware/History", params.Encode(), &hist)
+	if err != nil {
+		return false, err
+	}
+
+	for _, comp := range hist.Components {
+		if len(comp.History) > 0 {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// validateCapabilitiesCache checks, once the TTL of c has expired, whether
+// the HSM hardware inventory has changed since c was last checked, and
+// empties c if it has. The caller must hold the lock.
+func (d *CapmcD) validateCapabilitiesCache(ctx context.Context, c *capabilitiesCache) {
+	now := time.Now()
+
+	if c.ttl <= 0 {
+		c.reset(now)
+		return
+	}
+	if now.Sub(c.checked) < c.ttl {
+		return
+	}
+
+	changed, err := d.hwInventoryChanged(ctx, c.checked)
+	if err != nil {
+		log.Printf("Notice: unable to check for hardware inventory changes, emptying capabilities cache: %s", err)
+		c.reset(now)
+		return
+	}
+	if changed {
+		log.Printf("Info: hardware inventory changed, emptying capabilities cache")
+		c.reset(now)
+		return
+	}
+
+	c.checked = now
+}
+
+// getNodeHWInventories fetches the hardware inventory of each of xnames
+// from HSM, several at a time.
+func (d *CapmcD) getNodeHWInventories(ctx context.Context, xnames []string) ([]sm.SystemHWInventory, error) {
+	var (
+		wg       sync.WaitGroup
+		firstErr error
+		errOnce  sync.Once
+	)
+
+	inventories := make([]sm.SystemHWInventory, len(xnames))
+	workers := make(chan struct{}, hwInventoryQueryWorkers)
+	for i, xname := range xnames {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(i int, xname string) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			hwInventory, err := d.GetHWInventoryQuery(ctx, xname)
+			if err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			inventories[i] = hwInventory
+		}(i, xname)
+	}
+	wg.Wait()
+
+	return inventories, firstErr
+}
+
+// powerCapCapabilitiesGroups returns the power cap groups of the nodes
+// xnames, in the order given, or of every node in the hardware inventory,
+// in inventory order, if xnames is empty. Only the inventory of nodes
+// missing from the cache is fetched from HSM, one query per node unless
+// the whole inventory is needed.
+func (d *CapmcD) powerCapCapabilitiesGroups(ctx context.Context, xnames []string, xnameNidInfoLookup map[string]*capmc.NidInfo, xnameComponentLookup map[string]*sm.ComponentEndpoint) ([]capmc.PowerCapGroup, error) {
+	c := d.capCache
+	if c == nil {
+		c = newCapabilitiesCache(0)
+	}
+
+	c.Lock()
+	d.validateCapabilitiesCache(ctx, c)
+	complete := c.complete
+	missing := c.missing(xnames)
+	c.Unlock()
+
+	// Query HSM without holding the lock so requests for nodes which
+	// are cached aren't held up behind it.
+	if len(xnames) == 0 && !complete {
+		hwInventory, err := d.GetHWInventoryQuery(ctx, "all")
+		if err != nil {
+			requestLog(ctx).Errorf("CAPMC GetHWInventoryQuery failed: %s", err.Error())
+			return nil, err
+		}
+
+		c.Lock()
+		c.addFullInventory(hwInventory)
+		c.Unlock()
+	} else if len(xnames) > 0 && !complete && len(missing) > 0 {
+		inventories, err := d.getNodeHWInventories(ctx, missing)
+		if err != nil {
+			requestLog(ctx).Errorf("CAPMC GetHWInventoryQuery failed: %s", err.Error())
+			return nil, err
+		}
+
+		c.Lock()
+		for _, hwInventory := range inventories {
+			c.addInventory(hwInventory)
+		}
+		// Remember nodes without inventory so they aren't queried
+		// again.
+		for _, xname := range c.missing(missing) {
+			c.monikers[xname] = ""
+		}
+		c.Unlock()
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if len(xnames) == 0 {
+		for xname, moniker := range c.monikers {
+			if moniker != "" {
+				xnames = append(xnames, xname)
+			}
+		}
+		sort.Slice(xnames, func(i, j int) bool {
+			return c.order[xnames[i]] < c.order[xnames[j]]
+		})
+	}
+
+	var names []string
+	monikerGroups := make(map[string]*PowerCapCapabilityMonikerGroup)
+	for _, xname := range xnames {
+		name := c.monikers[xname]
+		if name == "" {
+			continue
+		}
+
+		mg, ok := monikerGroups[name]
+		if !ok {
+			mg = &PowerCapCapabilityMonikerGroup{
+				Name:        name,
+				Desc:        name,
+				MonikerType: c.types[name],
+			}
+			monikerGroups[name] = mg
+			names = append(names, name)
+		}
+		mg.Xnames = append(mg.Xnames, xname)
+
+		//create the Nids array in this moniker group from the Xnames list
+		if nidInfo, ok := xnameNidInfoLookup[xname]; ok {
+			mg.Nids = append(mg.Nids, int(nidInfo.Nid))
+		}
+	}
+
+	var powerCapGroups []capmc.PowerCapGroup
+	for _, name := range names {
+		mg := monikerGroups[name]
+
+		group, ok := c.groups[name]
+		if !ok {
+			var err error
+			group, err = buildPowerCapCapabilitiesGroup(*mg, xnameComponentLookup)
+			if err != nil {
+				requestLog(ctx).Errorf("CAPMC Get Power Cap Capabilities failed: %s", err.Error())
+				return nil, err
+			}
+			if group.Name != "" && d.config != nil {
+				applyPowerProfile(&group, mg.MonikerType, d.config.PowerProfiles)
+			}
+
+			// Only cache groups whose representative node had a
+			// ComponentEndpoint to build them from.
+			if group.Name != "" {
+				cached := group
+				cached.Nids = nil
+				c.groups[name] = cached
+			}
+		}
+
+		group.Nids = mg.Nids
+		powerCapGroups = append(powerCapGroups, group)
+	}
+
+	return powerCapGroups, nil
+}
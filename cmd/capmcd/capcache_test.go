@@ -0,0 +1,171 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestCapabilitiesCache(t *testing.T) {
+	const (
+		noHistory = `{"Components":[]}`
+		history   = `{"Components":[{"ID":"x2014c0s27b1n0","History":[{"ID":"x2014c0s27b1n0","FRUID":"fru","Timestamp":"2026-10-19T12:00:00Z","EventType":"Added"}]}]}`
+	)
+
+	var (
+		queries  int32 // the per node queries are made concurrently
+		checks   int
+		histBody string
+	)
+	capabilities := DoPowerCapCapabilitiesTestFunc(t)
+	mock := func(req *http.Request) (*http.Response, error) {
+		switch {
+		case req.URL.Path == "/Inventory/Hardware/History":
+			checks++
+			return &http.Response{
+				Status:     "200 OK",
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewBufferString(histBody)),
+				Header:     make(http.Header),
+				Request:    req,
+			}, nil
+		case path.Dir(req.URL.Path) == "/Inventory/Hardware/Query":
+			atomic.AddInt32(&queries, 1)
+		}
+		return capabilities(req)
+	}
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		body    string
+		history string
+		expire  bool // expire the TTL before each request after the first
+		queries []int32
+		checks  []int
+	}{
+		{
+			name:    "Cached by xname",
+			ttl:     time.Hour,
+			body:    `{"nids":[1,2,3,4,9,1002,1003,1004,1005]}`,
+			history: noHistory,
+			queries: []int32{10, 0},
+			checks:  []int{0, 0},
+		}, {
+			name:    "Cached inventory",
+			ttl:     time.Hour,
+			body:    `{"nids":[]}`,
+			history: noHistory,
+			queries: []int32{1, 0},
+			checks:  []int{0, 0},
+		}, {
+			name:    "Inventory unchanged",
+			ttl:     time.Hour,
+			body:    `{"nids":[1,2,3,4,9,1002,1003,1004,1005]}`,
+			history: noHistory,
+			expire:  true,
+			queries: []int32{10, 0},
+			checks:  []int{0, 1},
+		}, {
+			name:    "Inventory changed",
+			ttl:     time.Hour,
+			body:    `{"nids":[1,2,3,4,9,1002,1003,1004,1005]}`,
+			history: history,
+			expire:  true,
+			queries: []int32{10, 10},
+			checks:  []int{0, 1},
+		}, {
+			name:    "Changed before TTL expired",
+			ttl:     time.Hour,
+			body:    `{"nids":[1,2,3,4,9,1002,1003,1004,1005]}`,
+			history: history,
+			queries: []int32{10, 0},
+			checks:  []int{0, 0},
+		}, {
+			name:    "Disabled",
+			body:    `{"nids":[1,2,3,4,9,1002,1003,1004,1005]}`,
+			history: noHistory,
+			queries: []int32{10, 10},
+			checks:  []int{0, 0},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var err error
+			svc := &CapmcD{
+				config:   loadConfig(""),
+				capCache: newCapabilitiesCache(test.ttl),
+			}
+			svc.hsmURL, err = url.Parse("http://localhost:27779")
+			if err != nil {
+				t.Fatal(err)
+			}
+			svc.smClient = NewTestClient(mock)
+			histBody = test.history
+
+			for i, want := range test.queries {
+				atomic.StoreInt32(&queries, 0)
+				checks = 0
+				if i > 0 && test.expire {
+					svc.capCache.checked = svc.capCache.checked.Add(-test.ttl)
+				}
+
+				req, err := http.NewRequest(http.MethodPost,
+					capmc.PowerCapCapabilitiesV1,
+					bytes.NewBufferString(test.body))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				w := httptest.NewRecorder()
+				svc.doPowerCapCapabilities(w, req)
+
+				if w.Code != http.StatusOK {
+					t.Fatalf("Request %d returned wrong status code: got %v want %v",
+						i, w.Code, http.StatusOK)
+				}
+				if queries := atomic.LoadInt32(&queries); queries != want {
+					t.Errorf("Request %d made wrong number of inventory queries: got %d want %d",
+						i, queries, want)
+				}
+				if checks != test.checks[i] {
+					t.Errorf("Request %d made wrong number of inventory history checks: got %d want %d",
+						i, checks, test.checks[i])
+				}
+			}
+		})
+	}
+}
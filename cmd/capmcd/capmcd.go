@@ -25,7 +25,6 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
@@ -49,6 +48,8 @@ import (
 	base "github.com/Cray-HPE/hms-base/v2"
 	compcreds "github.com/Cray-HPE/hms-compcredentials"
 	sstorage "github.com/Cray-HPE/hms-securestorage"
+	reservation "github.com/Cray-HPE/hms-smd/v2/pkg/service-reservations"
+	"github.com/sirupsen/logrus"
 )
 
 const clientTimeout = time.Duration(180) * time.Second
@@ -73,16 +74,27 @@ var rfClientLock sync.RWMutex
 var capmcAPIs = []APIs{
 
 	{
+		API{capmc.AuditV1, svc.doAudit},
 		API{capmc.HealthV1, svc.doHealth},
 		API{capmc.LivenessV1, svc.doLiveness},
+		API{capmc.LogLevelV1, svc.doLogLevel},
+		API{capmc.Metrics, svc.doMetrics},
+		API{capmc.OperationsV1, svc.doOperations},
 		API{capmc.PowerCapCapabilitiesV1, svc.doPowerCapCapabilities},
+		API{capmc.PowerCapDriftV1, svc.doPowerCapDrift},
 		API{capmc.PowerCapGetV1, svc.doPowerCapGet},
+		API{capmc.PowerCapSchedulesV1, svc.doPowerCapSchedules},
 		API{capmc.PowerCapSetV1, svc.doPowerCapSet},
 		API{capmc.ReadinessV1, svc.doReadiness},
+		API{capmc.ReservationsV1, svc.doReservations},
+		API{capmc.SystemPowerBudgetSetV1, svc.doSystemPowerBudgetSet},
 		API{capmc.XnameOffV1, svc.doXnameOff},
 		API{capmc.XnameOnV1, svc.doXnameOn},
+		API{capmc.XnamePowerCapGetV1, svc.doXnamePowerCapGet},
+		API{capmc.XnamePowerCapSetV1, svc.doXnamePowerCapSet},
 		API{capmc.XnameReinitV1, svc.doXnameReinit},
 		API{capmc.XnameStatusV1, svc.doXnameStatus},
+		API{capmc.XnameStatusStreamV1, svc.doXnameStatusStream},
 	},
 }
 
@@ -105,7 +117,7 @@ func (w *ResponseWriter) WriteHeader(status int) {
 // Write wrapps HTTP calls, as a server, to enable logging of requests and
 // responses.
 func (w *ResponseWriter) Write(b []byte) (int, error) {
-	if svc.debug && svc.debugLevel > 1 {
+	if logger.IsLevelEnabled(logrus.TraceLevel) {
 		// This is simpler than using httptest.NewRecorder in the
 		// middleware logger for a response to and incoming request.
 		w.data = string(b)
@@ -117,6 +129,13 @@ func (w *ResponseWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Flush sends any buffered data to the client, for streamed responses.
+func (w *ResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 var suppressLogPaths map[string]bool
 
 // Add a path to the list suppress for logging
@@ -146,17 +165,6 @@ func isPathSuppressed(p string) bool {
 // inbound requests and outbound responses.
 func logRequest(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var (
-			sendFmts = []string{
-				"Debug: --> Response %s:\n%s\n",
-				"Debug: --> Response %s: %q\n", // "safe"
-			}
-			recvFmts = []string{
-				"Debug: <-- Request %s:\n%s\n",
-				"Debug: <-- Request %s: %q\n", // "safe"
-			}
-		)
-
 		rw := &ResponseWriter{
 			status:         http.StatusOK,
 			ResponseWriter: w,
@@ -166,41 +174,52 @@ func logRequest(handler http.Handler) http.Handler {
 		suppressLog := isPathSuppressed(r.URL.Path)
 
 		start := time.Now()
+		r = startRequest(rw, r)
+		rlog := requestLog(r.Context())
 		if !suppressLog {
-			log.Printf("Info: <-- %s HTTP %s %s\n",
-				r.RemoteAddr, r.Method, r.URL)
+			rlog.Infof("<-- %s HTTP %s %s", r.RemoteAddr, r.Method, r.URL)
 		}
 
-		if svc.debug && svc.debugLevel > 1 {
-			sendFmt := sendFmts[svc.debugLevel%2]
+		if logger.IsLevelEnabled(logrus.TraceLevel) {
 			dump, err := httputil.DumpRequest(r, true)
 			if err != nil {
-				log.Printf("Debug: failed to dump request: %s",
-					err)
+				rlog.Tracef("failed to dump request: %s", err)
 				http.Error(w, fmt.Sprint(err),
 					http.StatusInternalServerError)
 				return
 			}
+			rlog.WithField("dump", string(dump)).Trace("<-- Request")
+		}
 
-			s := bytes.SplitAfterN(dump, []byte("\r\n\r\n"), 2)
-			if svc.debugLevel > 3 {
-				log.Printf(sendFmt, "Header", s[0])
-			}
-			log.Printf(sendFmt, "Body", dump)
+		// The probes and metrics scrapes are no more worth tracing than
+		// logging.
+		var sp *span
+		if !suppressLog {
+			var ctx context.Context
+			ctx, sp = startServerSpan(r, r.Method+" "+apiLabel(r.URL.Path))
+			r = r.WithContext(ctx)
+			sp.setAttr("http.request.method", r.Method)
+			sp.setAttr("url.path", r.URL.Path)
 		}
 
 		handler.ServeHTTP(rw, r)
+		metrics.observeRequest(r.URL.Path, rw.status, start)
+
+		sp.setAttr("http.response.status_code", rw.status)
+		if rw.status >= http.StatusInternalServerError {
+			sp.setError(fmt.Errorf("%s", http.StatusText(rw.status)))
+		}
+		sp.finish()
 
 		if !suppressLog {
-			log.Printf("Info: --> %s HTTP %d %s %s %s (%s)",
+			requestLog(r.Context()).Infof("--> %s HTTP %d %s %s %s (%s)",
 				r.RemoteAddr, rw.status, http.StatusText(rw.status),
 				r.Method, r.URL.String(), time.Since(start))
 		}
-		if svc.debug && svc.debugLevel > 1 {
+		if logger.IsLevelEnabled(logrus.TraceLevel) {
 			// Capturing the reponse headers requires more
 			// work using httptest.NewRecorder. Skip for now.
-			recvFmt := recvFmts[svc.debugLevel%2]
-			log.Printf(recvFmt, "Body", rw.data)
+			rlog.WithField("body", rw.data).Trace("--> Response")
 		}
 	})
 }
@@ -214,29 +233,15 @@ type Transport struct {
 // RoundTrip wraps HTTP calls, as a client, to enable logging of requests and
 // responses.
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
-	var (
-		sendFmts = []string{
-			"Debug: --> Request %s:\n%s\n",
-			"Debug: --> Request %s: %q\n", // "safe"
-		}
-		recvFmts = []string{
-			"Debug: <-- Response %s:\n%s\n",
-			"Debug: <-- Response %s: %q\n", // "safe"
-		}
-	)
+	rlog := requestLog(r.Context())
 
-	log.Printf("Info: --> HTTP %s %s\n", r.Method, r.URL)
-	if svc.debug && svc.debugLevel > 1 {
-		sendFmt := sendFmts[svc.debugLevel%2]
+	rlog.Infof("--> HTTP %s %s", r.Method, r.URL)
+	if logger.IsLevelEnabled(logrus.TraceLevel) {
 		dump, err := httputil.DumpRequestOut(r, true)
 		if err != nil {
-			log.Printf("Debug: failed to dump request: %s", err)
+			rlog.Tracef("failed to dump request: %s", err)
 		} else {
-			s := bytes.SplitAfterN(dump, []byte("\r\n\r\n"), 2)
-			if svc.debugLevel > 3 {
-				log.Printf(sendFmt, "Header", s[0])
-			}
-			log.Printf(sendFmt, "Body", s[1])
+			rlog.WithField("dump", string(dump)).Trace("--> Request")
 		}
 	}
 
@@ -246,20 +251,15 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		return resp, err
 	}
 
-	log.Printf("Info: <-- HTTP %s %s %s (%s)\n",
+	rlog.Infof("<-- HTTP %s %s %s (%s)",
 		resp.Status, resp.Request.Method, resp.Request.URL,
 		time.Since(start))
-	if svc.debug && svc.debugLevel > 1 {
-		recvFmt := recvFmts[svc.debugLevel%2]
+	if logger.IsLevelEnabled(logrus.TraceLevel) {
 		dump, err := httputil.DumpResponse(resp, true)
-		s := bytes.SplitAfterN(dump, []byte("\r\n\r\n"), 2)
 		if err != nil {
-			log.Printf("Debug: failed to dump response: %s", err)
+			rlog.Tracef("failed to dump response: %s", err)
 		} else {
-			if svc.debugLevel > 3 {
-				log.Printf(recvFmt, "Header", s[0])
-			}
-			log.Printf(recvFmt, "Body", s[1])
+			rlog.WithField("dump", string(dump)).Trace("<-- Response")
 		}
 	}
 
@@ -364,12 +364,28 @@ func main() {
 		configFile string
 		hsm        string
 		pcs        string
+		logLevel   string
 		err        error
 	)
 
-	// TODO Add debug levels at some point
-	flag.BoolVar(&svc.debug, "debug", false, "enable debug messages")
-	flag.IntVar(&svc.debugLevel, "debug-level", 0, "increase debug verbosity")
+	// The log level can also be changed while the service runs through the
+	// log_level API.
+	defaultLogLevel := "info"
+	if envstr := os.Getenv("LOG_LEVEL"); envstr != "" {
+		defaultLogLevel = envstr
+	}
+	flag.StringVar(&logLevel, "log-level", defaultLogLevel,
+		"log level: error, warning, info, debug or trace (default from LOG_LEVEL)")
+
+	// Deprecated, replaced by -log-level
+	var (
+		debug      bool
+		debugLevel int
+	)
+	flag.BoolVar(&debug, "debug", false,
+		"deprecated, use -log-level debug")
+	flag.IntVar(&debugLevel, "debug-level", 0,
+		"deprecated, use -log-level trace for a debug level above 1")
 
 	// Simulation only
 	//  NOTE: if this is set to 'true' then all of the calls to BMC's will only
@@ -402,7 +418,29 @@ func main() {
 		"Capture client traffic for test case using TAG")
 	flag.Parse()
 
-	log.SetFlags(log.Lshortfile | log.LstdFlags)
+	// Everything logged goes out as JSON through the service logger,
+	// which adds the time.
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(stdLogWriter{})
+
+	// -log-level wins over the deprecated flags.
+	explicitLevel := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "log-level":
+			explicitLevel = true
+		case "debug", "debug-level":
+			log.Printf("Warning: -%s is deprecated, use -log-level", f.Name)
+		}
+	})
+	if !explicitLevel {
+		logLevel = debugLogLevel(logLevel, debug, debugLevel)
+	}
+	level, err := parseLogLevel(logLevel)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	logger.SetLevel(level)
 
 	serviceName, err = base.GetServiceInstanceName()
 	if err != nil {
@@ -421,10 +459,117 @@ func main() {
 	log.Printf("\tReinit seq: %v\n", conf.ReinitActionSeq)
 	log.Printf("\tWait for off retries: %d\n", conf.WaitForOffRetries)
 	log.Printf("\tWait for off sleep: %d\n", conf.WaitForOffSleep)
+	log.Printf("\tMax MinOffTime wait: %d\n", conf.MaxMinOffWait)
+	log.Printf("\tOff time state file: %s\n", conf.OffTimeStateFile)
+	log.Printf("\tPower backend: %s\n", conf.PowerBackend)
+	log.Printf("\tPCS breaker threshold: %d\n", conf.PCSBreakerThreshold)
+	log.Printf("\tPCS breaker cooldown: %d\n", conf.PCSBreakerCooldown)
+	log.Printf("\tPCS failover for power operations: %t\n", conf.PCSFailoverPowerOps)
+	log.Printf("\tPower cap state file: %s\n", conf.PowerCapStateFile)
+	log.Printf("\tPower cap reconcile interval: %d\n", conf.PowerCapReconcileInterval)
+	log.Printf("\tPower cap capabilities cache TTL: %d\n", conf.PowerCapCapabilitiesCacheTTL)
+	log.Printf("\tPower profiles: %d\n", len(svc.config.PowerProfiles))
+	log.Printf("\tPower cap schedule state file: %s\n", conf.PowerCapScheduleStateFile)
+	log.Printf("\tPower cap schedule interval: %d\n", conf.PowerCapScheduleInterval)
+	log.Printf("\tStatus stream interval: %d\n", conf.StatusStreamInterval)
+	log.Printf("\tStatus stream heartbeat: %d\n", conf.StatusStreamHeartbeat)
+	log.Printf("\tWebhooks: %d\n", len(svc.config.Webhooks))
+	log.Printf("\tCallback allowlist: %v\n", conf.CallbackAllowlist)
+	log.Printf("\tWebhook retries: %d\n", conf.WebhookRetries)
+	log.Printf("\tWebhook retry delay: %d\n", conf.WebhookRetryDelay)
+	log.Printf("\tAudit sinks: %d\n", len(svc.config.AuditSinks))
+	log.Printf("\tOperation history file: %s\n", conf.OperationHistoryFile)
+	log.Printf("\tOperation history retention: %d\n", conf.OperationHistoryRetention)
+	log.Printf("\tOperation history max operations: %d\n", conf.OperationHistoryMaxOperations)
+	log.Printf("\tTracing endpoint: %s\n", conf.TracingEndpoint)
+	log.Printf("\tTracing sample ratio: %g\n", conf.TracingSampleRatio)
+	log.Printf("\tHealth check interval: %d\n", conf.HealthCheckInterval)
+	log.Printf("\tAuth JWKS URL: %s\n", conf.AuthJWKSURL)
+	log.Printf("\tAuth key file: %s\n", conf.AuthKeyFile)
+	log.Printf("\tAuth key refresh: %d\n", conf.AuthKeyRefresh)
+	log.Printf("\tAuth issuer: %s\n", conf.AuthIssuer)
+	log.Printf("\tAuth audience: %s\n", conf.AuthAudience)
+	log.Printf("\tAuth roles: %d\n", len(svc.config.AuthRoles))
+	log.Printf("\tState store URL: %s\n", conf.StateStoreURL)
+	log.Printf("\tState store prefix: %s\n", conf.StateStorePrefix)
+	log.Printf("\tLeader lease timeout: %d\n", conf.LeaderLeaseTimeout)
 
 	svc.ActionMaxWorkers = conf.ActionMaxWorkers
 	svc.OnUnsupportedAction = conf.OnUnsupportedAction
 	svc.ReinitActionSeq = conf.ReinitActionSeq
+	svc.offTimes = newOffTimeTracker(conf.OffTimeStateFile)
+
+	// State shared by the replicas is kept in etcd when there is a state
+	// store; otherwise each replica keeps its own, so only one may run.
+	stateStoreURL := conf.StateStoreURL
+	if envstr := os.Getenv("CAPMC_STATE_STORE_URL"); envstr != "" {
+		stateStoreURL = envstr
+	}
+	var state *etcdStateStore
+	if stateStoreURL != "" {
+		leaseTimeout := conf.LeaderLeaseTimeout
+		if leaseTimeout < 3 {
+			log.Printf("Warning: invalid leader lease timeout %d, using %d",
+				leaseTimeout, defaultLeaderLeaseTimeout)
+			leaseTimeout = defaultLeaderLeaseTimeout
+		}
+		state = newEtcdStateStore(stateStoreURL, conf.StateStorePrefix)
+		svc.leader = newLeaderElection(state,
+			time.Duration(leaseTimeout)*time.Second)
+		svc.powerCaps = newSharedPowerCapStore(state)
+		svc.capSchedules = newSharedPowerCapScheduler(state)
+	} else {
+		log.Printf("Warning: no StateStoreURL, CAPMC state is kept by this replica, only one replica may run")
+		svc.powerCaps = newPowerCapStore(conf.PowerCapStateFile)
+		svc.capSchedules = newPowerCapScheduler(conf.PowerCapScheduleStateFile)
+	}
+	svc.capCache = newCapabilitiesCache(
+		time.Duration(conf.PowerCapCapabilitiesCacheTTL) * time.Second)
+	svc.backend, err = newPowerBackend(conf.PowerBackend, &svc)
+	if err != nil {
+		log.Fatalf("Invalid PowerBackend configured: %s", err)
+	}
+
+	// The webhook secret is better kept in a Kubernetes Secret than in
+	// the configuration file.
+	webhookSecret := conf.WebhookSecret
+	if envstr := os.Getenv("CAPMC_WEBHOOK_SECRET"); envstr != "" {
+		webhookSecret = envstr
+	}
+	svc.webhooks = newWebhookNotifier(svc.config.Webhooks,
+		conf.CallbackAllowlist, webhookSecret,
+		conf.WebhookRetries,
+		time.Duration(conf.WebhookRetryDelay)*time.Second)
+	historyRetention := time.Duration(conf.OperationHistoryRetention) * 24 * time.Hour
+	if state != nil {
+		svc.history = newSharedOperationHistory(state, historyRetention,
+			conf.OperationHistoryMaxOperations)
+	} else {
+		svc.history = newOperationHistory(conf.OperationHistoryFile,
+			historyRetention, conf.OperationHistoryMaxOperations)
+	}
+	svc.audit = newAuditLog(svc.config.AuditSinks, webhookSecret,
+		conf.WebhookRetries,
+		time.Duration(conf.WebhookRetryDelay)*time.Second)
+	svc.auth, err = newAuthenticator(conf, svc.config.AuthRoles)
+	if err != nil {
+		log.Fatalf("Invalid authentication configuration: %s", err)
+	}
+	if svc.auth == nil {
+		log.Printf("Warning: no AuthJWKSURL or AuthKeyFile, API callers are not authenticated")
+	}
+
+	// Tracing is usually set up for all the services of a deployment
+	// through the standard OpenTelemetry environment variable.
+	tracingEndpoint := conf.TracingEndpoint
+	if envstr := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); envstr != "" {
+		tracingEndpoint = envstr
+	}
+	if tracingEndpoint != "" {
+		log.Printf("Info: Exporting traces to %s", tracingEndpoint)
+		tracing = newTracer(tracingEndpoint, "capmc",
+			conf.TracingSampleRatio)
+	}
 
 	// log the hostname of this instance - mostly useful for pod name in
 	// multi-replica k8s envinronment
@@ -512,9 +657,9 @@ func main() {
 			hms_certs.ConfigParams.LogInsecureFailover = false
 		}
 	}
-	hms_certs.InitInstance(nil, serviceName)
+	hms_certs.InitInstance(logger, serviceName)
 
-	log.Printf("CAPMC serivce starting (debug=%v)\n", svc.debug)
+	log.Printf("CAPMC serivce starting (log level %s)\n", logger.GetLevel())
 
 	// set up a channel to wait for the os to tell us to stop
 	// NOTE - must be set up before initializing anything that needs
@@ -524,8 +669,13 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 
 	//initialize the service-reservation pkg
-	svc.reservation.Init(svc.hsmURL.Scheme+"://"+svc.hsmURL.Host, "", 3, nil)
+	svc.reservation = &reservation.Production{}
+	svc.reservation.Init(svc.hsmURL.Scheme+"://"+svc.hsmURL.Host, "", 3, logger)
 	svc.reservationsEnabled = true
+	svc.resOwners = newReservationOwners()
+
+	// Track the services CAPMC depends on for the health API.
+	svc.health = newDependencyMonitor()
 
 	// Spin a thread for connecting to Vault
 	go func() {
@@ -541,6 +691,7 @@ func main() {
 			// Start a connection to Vault
 			if svc.ss, err = sstorage.NewVaultAdapter(""); err != nil {
 				log.Printf("Info: Secure Store connection failed - %s", err)
+				svc.health.failure(depVault, err)
 				time.Sleep(backoff * time.Second)
 			} else {
 				log.Printf("Info: Connection to secure store (Vault) succeeded")
@@ -549,6 +700,7 @@ func main() {
 					vaultKeypath = "secret/hms-creds"
 				}
 				svc.ccs = compcreds.NewCompCredStore(vaultKeypath, svc.ss)
+				svc.health.success(depVault)
 				break
 			}
 			if backoff < maxBackoff {
@@ -584,9 +736,12 @@ func main() {
 			err := setupRedfishHTTPClients(captureTag)
 			if err == nil {
 				log.Printf("Info: Success creating Redfish HTTP clients.")
+				svc.health.success(depRedfish)
 				break
 			} else {
 				log.Printf("Redfish HTTP client creation error: %v", err)
+				svc.health.failure(depRedfish, err)
+				time.Sleep(backoff * time.Second)
 			}
 			if backoff < maxBackoff {
 				backoff += backoff
@@ -601,9 +756,11 @@ func main() {
 	for _, vers := range capmcAPIs {
 		for _, api := range vers {
 			if captureTag == "" {
-				http.HandleFunc(api.pattern, api.handler)
+				http.HandleFunc(api.pattern,
+					svc.authorize(api.pattern, api.handler))
 			} else {
-				captureHandleFunc(api.pattern, api.handler)
+				captureHandleFunc(api.pattern,
+					svc.authorize(api.pattern, api.handler))
 			}
 		}
 	}
@@ -611,11 +768,75 @@ func main() {
 	// Do not log the calls for liveness/readiness
 	suppressLoggingForPath(capmc.LivenessV1)
 	suppressLoggingForPath(capmc.ReadinessV1)
+	suppressLoggingForPath(capmc.Metrics)
 
 	// Spin up our global worker goroutine pool.
 	svc.WPool = base.NewWorkerPool(svc.ActionMaxWorkers, svc.ActionMaxWorkers*10)
 	svc.WPool.Run()
 
+	// Power operations run until they finish or we shut down.
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	svc.shutdown = shutdownCtx
+
+	reconcileCtx, stopReconcile := context.WithCancel(context.Background())
+
+	// Elect the replica which runs the background work that must only run
+	// once until we shut down.
+	if svc.leader != nil {
+		go svc.leader.run(reconcileCtx, svc.leader.ttl/3)
+	}
+
+	// Reapply power caps lost by BMCs until we shut down.
+	if conf.PowerCapReconcileInterval > 0 {
+		go svc.powerCapReconciler(reconcileCtx,
+			time.Duration(conf.PowerCapReconcileInterval)*time.Second)
+	}
+
+	// Apply and end power cap schedules until we shut down.
+	scheduleInterval := conf.PowerCapScheduleInterval
+	if scheduleInterval <= 0 {
+		log.Printf("Warning: invalid power cap schedule interval %d, using %d",
+			scheduleInterval, defaultPowerCapScheduleInterval)
+		scheduleInterval = defaultPowerCapScheduleInterval
+	}
+	go svc.powerCapScheduleRunner(reconcileCtx,
+		time.Duration(scheduleInterval)*time.Second)
+
+	// Poll the power state of the components watched through the
+	// xname_status stream until we shut down.
+	streamInterval := conf.StatusStreamInterval
+	if streamInterval <= 0 {
+		log.Printf("Warning: invalid status stream interval %d, using %d",
+			streamInterval, defaultStatusStreamInterval)
+		streamInterval = defaultStatusStreamInterval
+	}
+	streamHeartbeat := conf.StatusStreamHeartbeat
+	if streamHeartbeat <= 0 {
+		log.Printf("Warning: invalid status stream heartbeat %d, using %d",
+			streamHeartbeat, defaultStatusStreamHeartbeat)
+		streamHeartbeat = defaultStatusStreamHeartbeat
+	}
+	svc.statusStream = newStatusStream(
+		time.Duration(streamHeartbeat) * time.Second)
+	go svc.statusStreamPoller(reconcileCtx,
+		time.Duration(streamInterval)*time.Second)
+
+	// Check the services CAPMC depends on until we shut down.
+	healthInterval := conf.HealthCheckInterval
+	if healthInterval <= 0 {
+		log.Printf("Warning: invalid health check interval %d, using %d",
+			healthInterval, defaultHealthCheckInterval)
+		healthInterval = defaultHealthCheckInterval
+	}
+	go svc.dependencyChecker(reconcileCtx,
+		time.Duration(healthInterval)*time.Second)
+
+	// Export trace spans until everything traced has finished.
+	traceCtx, stopTracing := context.WithCancel(context.Background())
+	if tracing != nil {
+		go tracing.run(traceCtx)
+	}
+
 	// The following thread talks about limiting the max post body size...
 	// https://stackoverflow.com/questions/28282370/is-it-advisable-to-further-limit-the-size-of-forms-when-using-golang
 
@@ -639,6 +860,13 @@ func main() {
 	// wait here for a signal from the os that we are shutting down
 	sig := <-sigs
 	log.Printf("Info: Detected signal to close service: %s", sig)
+	stopReconcile()
+	shutdown()
+
+	// Give up the leadership so another replica takes over straight away.
+	if svc.leader != nil {
+		<-svc.leader.done
+	}
 
 	// The service is being killed, so release all active locks in hsm
 	// NOTE: this happens when k8s kills a pod
@@ -668,6 +896,15 @@ func main() {
 	// this waits until currently running jobs are complete before exiting
 	svc.WPool.Stop()
 
+	// finish writing and sending the audit records of the operations
+	svc.audit.close()
+
+	// export the spans of the requests which have now finished
+	stopTracing()
+	if tracing != nil {
+		<-tracing.flushed
+	}
+
 	// NOTE: This is where we should terminate our connection to the
 	//  vault, but it looks like there is no way to do so at this time.
 
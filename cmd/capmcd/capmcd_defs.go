@@ -29,6 +29,7 @@
 package main
 
 import (
+	"context"
 	"net/url"
 	"time"
 
@@ -116,6 +117,55 @@ var (
 	defaultReinitActionSeq     = []string{bmcCmdPowerOff, bmcCmdPowerForceOff, bmcCmdPowerRestart, bmcCmdPowerForceRestart, bmcCmdPowerOn, bmcCmdPowerForceOn, bmcCmdNMI}
 	defaultWaitForOffRetries   = 60
 	defaultWaitForOffSleep     = 15
+	// Most seconds a power on waits for components to satisfy the
+	// NodeRules MinOffTime. Components needing longer are rejected.
+	defaultMaxMinOffWait = 300
+	// Seconds between checks that the reservations held by a power
+	// operation have not been lost.
+	defaultReservationCheckInterval = 30
+	// Seconds between passes reapplying power caps that have drifted from
+	// the values set through CAPMC. Zero disables reconciliation.
+	defaultPowerCapReconcileInterval = 300
+	// Seconds the hardware inventory derived by get_power_cap_capabilities
+	// is used before checking HSM for changes. Zero disables caching.
+	defaultPowerCapCapabilitiesCacheTTL = 300
+	// Seconds between passes applying and ending power cap schedules.
+	defaultPowerCapScheduleInterval = 60
+	// Seconds between polls of the power state of the components watched
+	// through the xname_status stream.
+	defaultStatusStreamInterval = 10
+	// Seconds without events after which a heartbeat is sent to the
+	// xname_status stream subscribers.
+	defaultStatusStreamHeartbeat = 15
+	// Times delivery of a power operation webhook is retried, and the
+	// seconds before the first retry, doubled for each further retry.
+	defaultWebhookRetries    = 5
+	defaultWebhookRetryDelay = 2
+	// Fraction of the traces started by CAPMC which are sampled.
+	defaultTracingSampleRatio = 1.0
+	// Days the operations API keeps the history of a power operation, and
+	// the most operations it keeps.
+	defaultOperationHistoryRetention     = 30
+	defaultOperationHistoryMaxOperations = 10000
+	// Seconds between checks of the services CAPMC depends on.
+	defaultHealthCheckInterval = 30
+	// Seconds between fetches of the JWKS bearer tokens are checked
+	// against.
+	defaultAuthKeyRefresh = 3600
+	// Prefix of the keys CAPMC keeps in the shared state store.
+	defaultStateStorePrefix = "/capmc/"
+	// TTL in seconds of the lease through which the leader of the CAPMC
+	// replicas sharing a state store holds the leadership. Each replica
+	// keeps its lease alive every third of this.
+	defaultLeaderLeaseTimeout = 30
+	// How power operations and status queries reach the hardware: through
+	// PCS, or directly to the BMCs over Redfish.
+	defaultPowerBackend = backendPCS
+	// Consecutive PCS failures after which the PCS backend falls back to
+	// talking to the BMCs directly. Zero disables failover.
+	defaultPCSBreakerThreshold = 3
+	// Seconds to wait before trying PCS again after falling back.
+	defaultPCSBreakerCooldown = 60
 	// CompSeq:
 	// The power sequencing list based on comments in CASMHMS-836
 	// consists only of the following components:
@@ -189,9 +239,38 @@ var (
 	defaultCapmcConfiguration = CapmcConfiguration{
 		ActionMaxWorkers:    defaultActionMaxWorkers,
 		OnUnsupportedAction: defaultOnUnsupportedAction,
+		PowerBackend:        defaultPowerBackend,
+		PCSBreakerThreshold: defaultPCSBreakerThreshold,
+		PCSBreakerCooldown:  defaultPCSBreakerCooldown,
 		ReinitActionSeq:     defaultReinitActionSeq,
 		WaitForOffRetries:   defaultWaitForOffRetries,
 		WaitForOffSleep:     defaultWaitForOffSleep,
+		MaxMinOffWait:       defaultMaxMinOffWait,
+
+		ReservationCheckInterval:  defaultReservationCheckInterval,
+		PowerCapReconcileInterval: defaultPowerCapReconcileInterval,
+
+		PowerCapCapabilitiesCacheTTL: defaultPowerCapCapabilitiesCacheTTL,
+
+		PowerCapScheduleInterval: defaultPowerCapScheduleInterval,
+
+		StatusStreamInterval:  defaultStatusStreamInterval,
+		StatusStreamHeartbeat: defaultStatusStreamHeartbeat,
+
+		WebhookRetries:    defaultWebhookRetries,
+		WebhookRetryDelay: defaultWebhookRetryDelay,
+
+		TracingSampleRatio: defaultTracingSampleRatio,
+
+		OperationHistoryRetention:     defaultOperationHistoryRetention,
+		OperationHistoryMaxOperations: defaultOperationHistoryMaxOperations,
+
+		HealthCheckInterval: defaultHealthCheckInterval,
+
+		AuthKeyRefresh: defaultAuthKeyRefresh,
+
+		StateStorePrefix:   defaultStateStorePrefix,
+		LeaderLeaseTimeout: defaultLeaderLeaseTimeout,
 	}
 )
 
@@ -214,6 +293,9 @@ type bmcCall struct {
 	bmcCmd
 	ni      *NodeInfo
 	rspChan chan bmcPowerRc
+	// ctx carries the trace and request ID of the request the call is
+	// made for. It doesn't cancel the call.
+	ctx context.Context
 }
 
 type nodeRsp struct {
@@ -230,8 +312,6 @@ type CapmcD struct {
 	rfClient            *hms_certs.HTTPClientPair // HTTP Client for talking to BMCs
 	smClient            *hms_certs.HTTPClientPair
 	simulationOnly      bool // If true NO COMMANDS WILL BE SENT TO BMC's (defaults to false)
-	debug               bool
-	debugLevel          int
 	hsmURL              *url.URL
 	pcsURL              *url.URL
 	config              *Config
@@ -241,8 +321,22 @@ type CapmcD struct {
 	WPool               *base.WorkerPool
 	ss                  sstorage.SecureStorage
 	ccs                 *compcreds.CompCredStore
-	reservation         reservation.Production
+	reservation         *reservation.Production
 	reservationsEnabled bool
+	offTimes            *offTimeTracker
+	resOwners           *reservationOwners
+	powerCaps           *powerCapStore
+	capCache            *capabilitiesCache
+	capSchedules        *powerCapScheduler
+	backend             PowerBackend
+	statusStream        *statusStream
+	webhooks            *webhookNotifier
+	audit               *auditLog
+	history             *operationHistory
+	health              *dependencyMonitor
+	auth                *authenticator
+	shutdown            context.Context // Done once the service is shutting down
+	leader              *leaderElection // nil without a shared state store
 }
 
 // TODO This maybe sub-optimal but it will do for now.  This is mainly
@@ -263,6 +357,7 @@ type NodeInfo struct {
 	Nid           int
 	Role          string
 	State         string
+	Flag          string
 	Enabled       bool
 	BmcFQDN       string
 	BmcPath       string
@@ -369,6 +464,52 @@ type CapmcConfiguration struct {
 	ReinitActionSeq     []string
 	WaitForOffRetries   int
 	WaitForOffSleep     int
+	// MaxMinOffWait is the most seconds a power on waits for MinOffTime.
+	MaxMinOffWait       int
+	OffTimeStateFile    string
+	PowerBackend        string
+	PCSBreakerThreshold int
+	PCSBreakerCooldown  int
+	PCSFailoverPowerOps bool
+
+	ReservationCheckInterval  int
+	PowerCapStateFile         string
+	PowerCapReconcileInterval int
+
+	PowerCapCapabilitiesCacheTTL int
+
+	PowerCapScheduleStateFile string
+	PowerCapScheduleInterval  int
+
+	StatusStreamInterval  int
+	StatusStreamHeartbeat int
+
+	WebhookSecret     string
+	WebhookRetries    int
+	WebhookRetryDelay int
+	// CallbackAllowlist holds the hosts, and URL prefixes, the callback
+	// URLs given with power operations may use. No callback URL is
+	// allowed when empty.
+	CallbackAllowlist []string
+
+	TracingEndpoint    string
+	TracingSampleRatio float64
+
+	OperationHistoryFile          string
+	OperationHistoryRetention     int
+	OperationHistoryMaxOperations int
+
+	HealthCheckInterval int
+
+	AuthJWKSURL    string
+	AuthKeyFile    string
+	AuthKeyRefresh int
+	AuthIssuer     string
+	AuthAudience   string
+
+	StateStoreURL      string
+	StateStorePrefix   string
+	LeaderLeaseTimeout int
 }
 
 //PowerCapCapabilityMonikerType is consistent with the V3 XC moniker schema
@@ -389,8 +530,66 @@ type PowerCapCapabilityMonikerType struct {
 //PowerCapCapabilityMonikerGroup is used to represent a grouping of nodes by
 //blade type, and is dynamically generated by the doPowerCapCabilities handler
 type PowerCapCapabilityMonikerGroup struct {
-	Name   string   `json:"name"`
-	Desc   string   `json:"desc"`
-	Xnames []string `json:"xnames"`
-	Nids   []int    `json:"nids"`
+	Name        string                        `json:"name"`
+	Desc        string                        `json:"desc"`
+	Xnames      []string                      `json:"xnames"`
+	Nids        []int                         `json:"nids"`
+	MonikerType PowerCapCapabilityMonikerType `json:"-"`
+}
+
+// PowerProfile defines the power characteristics of a type of node hardware
+// for the values Redfish does not report. A profile applies to every moniker
+// group whose moniker fields match all of the non-empty fields of the
+// profile, compared without the trailing '_' separator, e.g.
+// NumCores = "10c" or MemSizeGiB = "64GiB". When several profiles apply the
+// one with the most non-empty fields is used.
+type PowerProfile struct {
+	PowerCapCapabilityMonikerType
+	// Static is the power, in watts, drawn by the node hardware which is
+	// not reported by the node controller
+	Static int
+	// Supply is the power, in watts, the node power supply can deliver
+	Supply int
+	// Powerup is the power, in watts, drawn while the node powers up
+	Powerup int
+	// HostLimitMax is the maximum host power cap, in watts
+	HostLimitMax int
+	// HostLimitMin is the minimum host power cap, in watts
+	HostLimitMin int
+}
+
+// Webhook is a URL sent a summary of every power operation when it
+// finishes.
+type Webhook struct {
+	URL string
+	// Secret signs the summaries sent to the URL. The CapmcConfiguration
+	// WebhookSecret is used when empty.
+	Secret string
+}
+
+// AuditSink is a destination of the audit log of power operations. Type is
+// one of:
+//   - file: Path, a file of JSON records, one per line, rotated when it
+//     reaches MaxSize megabytes, keeping MaxBackups rotated files
+//   - syslog: Address, a syslog daemon reached over Network, or the local
+//     daemon when empty, logging the records with Tag
+//   - http: URL, POSTed each record, signed with Secret or the
+//     CapmcConfiguration WebhookSecret when empty
+type AuditSink struct {
+	Type       string
+	Path       string
+	MaxSize    int
+	MaxBackups int
+	Network    string
+	Address    string
+	Tag        string
+	URL        string
+	Secret     string
+}
+
+// AuthRole grants the callers whose token has the role or scope Name the
+// Permissions, any of status, node-power, infra-power, power-cap and admin.
+type AuthRole struct {
+	Name        string
+	Permissions []string
 }
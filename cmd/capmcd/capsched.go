@@ -0,0 +1,1181 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	// Schedule timezones are looked up in the zoneinfo built into the
+	// binary, as the container image has none.
+	_ "time/tzdata"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// Power cap schedule states
+const (
+	scheduleStatePending   = "pending"
+	scheduleStateActive    = "active"
+	scheduleStateCompleted = "completed"
+	// A deleted schedule whose caps are still to be restored
+	scheduleStateRestoring = "restoring"
+)
+
+// Commands of the audit records of schedules being added and deleted
+const (
+	auditCmdAddPowerCapSchedule    = "AddPowerCapSchedule"
+	auditCmdDeletePowerCapSchedule = "DeletePowerCapSchedule"
+)
+
+// scheduleDeletedPrefix prefixes the state store key marking a schedule as
+// deleted. The mark is kept apart from the schedule so the scheduler
+// updating a schedule never loses it.
+const scheduleDeletedPrefix = "deleted/"
+
+// powerCapScheduleEntry is a power cap schedule along with the caps it
+// replaced on each node while it is applied.
+type powerCapScheduleEntry struct {
+	capmc.PowerCapSchedule
+	Created  time.Time                 `json:"created"`
+	Applied  bool                      `json:"applied,omitempty"`
+	Previous map[string]map[string]int `json:"previous,omitempty"` // xname -> control name -> watts
+	Deleted  bool                      `json:"-"`
+}
+
+// powerCapScheduler holds the power cap schedules submitted to CAPMC, so
+// schedules, and the caps to restore when they end, survive a restart. They
+// are kept in the shared state store when there is one. Otherwise they are
+// kept in memory, and persisted when a state file is configured.
+type powerCapScheduler struct {
+	run    sync.Mutex // serializes applying and restoring schedules
+	adding sync.Mutex // serializes checking and adding schedules
+	store  stateStore // schedule ID -> powerCapScheduleEntry
+	wake   chan struct{}
+}
+
+// newPowerCapScheduler creates a scheduler, loading any previously
+// persisted schedules from stateFile. An empty stateFile keeps the
+// schedules in memory only.
+func newPowerCapScheduler(stateFile string) *powerCapScheduler {
+	return &powerCapScheduler{
+		store: newMemStateStore(stateFile),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// newSharedPowerCapScheduler creates a scheduler whose schedules are kept
+// in the shared state store.
+func newSharedPowerCapScheduler(state *etcdStateStore) *powerCapScheduler {
+	return &powerCapScheduler{
+		store: state.sub("power_cap_schedules/"),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// notify lets the scheduler run now rather than on its next pass.
+func (s *powerCapScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// put saves e.
+func (s *powerCapScheduler) put(ctx context.Context, e powerCapScheduleEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return s.store.put(ctx, e.ID, buf)
+}
+
+// add stores a new schedule, returning it with its ID and state assigned.
+func (s *powerCapScheduler) add(ctx context.Context, sched capmc.PowerCapSchedule, now time.Time) (capmc.PowerCapSchedule, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return sched, err
+	}
+	sched.ID = hex.EncodeToString(id)
+	sched.State = scheduleStatePending
+
+	err := s.put(ctx, powerCapScheduleEntry{
+		PowerCapSchedule: sched,
+		Created:          now,
+	})
+	if err != nil {
+		return sched, err
+	}
+
+	s.notify()
+
+	return sched, nil
+}
+
+// entries returns every schedule in the order they were created. Deleted
+// schedules are reported as restoring until they are removed.
+func (s *powerCapScheduler) entries(ctx context.Context) ([]powerCapScheduleEntry, error) {
+	var entries []powerCapScheduleEntry
+	if s == nil {
+		return entries, nil
+	}
+
+	vals, err := s.store.list(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for key, buf := range vals {
+		if strings.HasPrefix(key, scheduleDeletedPrefix) {
+			continue
+		}
+
+		var e powerCapScheduleEntry
+		if err := json.Unmarshal(buf, &e); err != nil {
+			log.Printf("Warning: ignoring power cap schedule %s: %s", key, err)
+			continue
+		}
+		if _, ok := vals[scheduleDeletedPrefix+e.ID]; ok {
+			e.Deleted = true
+			e.State = scheduleStateRestoring
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Created.Equal(entries[j].Created) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+
+	return entries, nil
+}
+
+// get returns the schedule id.
+func (s *powerCapScheduler) get(ctx context.Context, id string) (powerCapScheduleEntry, bool, error) {
+	var e powerCapScheduleEntry
+
+	buf, ok, err := s.store.get(ctx, id)
+	if err != nil || !ok {
+		return e, false, err
+	}
+	if err = json.Unmarshal(buf, &e); err != nil {
+		return e, false, err
+	}
+
+	_, e.Deleted, err = s.store.get(ctx, scheduleDeletedPrefix+id)
+	if e.Deleted {
+		e.State = scheduleStateRestoring
+	}
+
+	return e, true, err
+}
+
+// update replaces a schedule unless it has been removed.
+func (s *powerCapScheduler) update(ctx context.Context, e powerCapScheduleEntry) error {
+	_, ok, err := s.store.get(ctx, e.ID)
+	if err != nil || !ok {
+		return err
+	}
+
+	return s.put(ctx, e)
+}
+
+// markDeleted marks the schedule id as deleted. The scheduler removes it
+// once the caps it set have been restored.
+func (s *powerCapScheduler) markDeleted(ctx context.Context, id string) error {
+	return s.store.put(ctx, scheduleDeletedPrefix+id, []byte("true"))
+}
+
+// remove deletes the schedule id.
+func (s *powerCapScheduler) remove(ctx context.Context, id string) error {
+	return s.store.remove(ctx, id, scheduleDeletedPrefix+id)
+}
+
+// powerCapScheduleTimes are the parsed times of a power cap schedule.
+type powerCapScheduleTimes struct {
+	start  time.Time
+	end    time.Time
+	window bool
+	days   map[time.Weekday]bool // nil for every day
+	from   int                   // window start, minutes after midnight
+	to     int                   // window end, minutes after midnight
+	loc    *time.Location        // timezone of the window
+}
+
+// weekdays maps the full and abbreviated lower case day names to their
+// time.Weekday.
+var weekdays = func() map[string]time.Weekday {
+	days := make(map[string]time.Weekday)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		days[name] = d
+		days[name[:3]] = d
+	}
+	return days
+}()
+
+// parseWindowTime parses a "HH:MM" window time into minutes after
+// midnight.
+func parseWindowTime(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid window time %q, expected HH:MM", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parsePowerCapScheduleTimes parses and checks the start, end, window and
+// timezone of sched. The window is in UTC unless a timezone is given.
+func parsePowerCapScheduleTimes(sched capmc.PowerCapSchedule) (powerCapScheduleTimes, error) {
+	var (
+		t   powerCapScheduleTimes
+		err error
+	)
+
+	// "Local" would make the window depend on the timezone of the
+	// replica running the scheduler.
+	t.loc = time.UTC
+	if sched.Timezone != "" {
+		t.loc, err = time.LoadLocation(sched.Timezone)
+		if err != nil || sched.Timezone == "Local" {
+			return t, fmt.Errorf("invalid timezone %q, expected an IANA time zone name",
+				sched.Timezone)
+		}
+	}
+
+	if sched.Start != "" {
+		t.start, err = time.Parse(time.RFC3339, sched.Start)
+		if err != nil {
+			return t, fmt.Errorf("invalid start time %q", sched.Start)
+		}
+	}
+	if sched.End != "" {
+		t.end, err = time.Parse(time.RFC3339, sched.End)
+		if err != nil {
+			return t, fmt.Errorf("invalid end time %q", sched.End)
+		}
+	}
+	if !t.start.IsZero() && !t.end.IsZero() && !t.end.After(t.start) {
+		return t, errors.New("end time must be after start time")
+	}
+
+	if sched.Window == nil {
+		if t.end.IsZero() {
+			return t, errors.New("end time or window required")
+		}
+		return t, nil
+	}
+
+	t.window = true
+	if t.from, err = parseWindowTime(sched.Window.Start); err != nil {
+		return t, err
+	}
+	if t.to, err = parseWindowTime(sched.Window.End); err != nil {
+		return t, err
+	}
+	if t.from == t.to {
+		return t, errors.New("window start and end must differ")
+	}
+
+	if len(sched.Window.Days) > 0 {
+		t.days = make(map[time.Weekday]bool)
+		for _, name := range sched.Window.Days {
+			day, ok := weekdays[strings.ToLower(name)]
+			if !ok {
+				return t, fmt.Errorf("invalid window day %q", name)
+			}
+			t.days[day] = true
+		}
+	}
+
+	return t, nil
+}
+
+// onDay reports whether the window starts on day.
+func (t powerCapScheduleTimes) onDay(day time.Weekday) bool {
+	return t.days == nil || t.days[day]
+}
+
+// active reports whether the schedule applies at now.
+func (t powerCapScheduleTimes) active(now time.Time) bool {
+	if !t.start.IsZero() && now.Before(t.start) {
+		return false
+	}
+	if t.finished(now) {
+		return false
+	}
+	if !t.window {
+		return true
+	}
+
+	local := now.In(t.loc)
+	mins := local.Hour()*60 + local.Minute()
+	day := local.Weekday()
+
+	if t.from < t.to {
+		return t.onDay(day) && mins >= t.from && mins < t.to
+	}
+
+	// The window ends the day after it starts.
+	return (t.onDay(day) && mins >= t.from) ||
+		(t.onDay((day+6)%7) && mins < t.to)
+}
+
+// finished reports whether the schedule will never apply again after now.
+func (t powerCapScheduleTimes) finished(now time.Time) bool {
+	return !t.end.IsZero() && !now.Before(t.end)
+}
+
+// weekMinutes returns the minutes of the week, from midnight on Sunday,
+// during which the window applies.
+func (t powerCapScheduleTimes) weekMinutes() []bool {
+	const day = 24 * 60
+	mins := make([]bool, 7*day)
+
+	to := t.to
+	if to < t.from {
+		to += day
+	}
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if !t.onDay(d) {
+			continue
+		}
+		for m := t.from; m < to; m++ {
+			mins[(int(d)*day+m)%len(mins)] = true
+		}
+	}
+
+	return mins
+}
+
+// overlaps reports whether the schedule may apply at the same time as o.
+// Windows in different timezones are taken to overlap.
+func (t powerCapScheduleTimes) overlaps(o powerCapScheduleTimes) bool {
+	if (!t.end.IsZero() && !o.start.IsZero() && !t.end.After(o.start)) ||
+		(!o.end.IsZero() && !t.start.IsZero() && !o.end.After(t.start)) {
+		return false
+	}
+	if !t.window || !o.window || t.loc.String() != o.loc.String() {
+		return true
+	}
+
+	tm, om := t.weekMinutes(), o.weekMinutes()
+	for m := range tm {
+		if tm[m] && om[m] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validatePowerCapSchedule checks a schedule submitted by a client,
+// normalizing its targets.
+func validatePowerCapSchedule(sched *capmc.PowerCapSchedule) error {
+	sched.ID = ""
+	sched.State = ""
+	sched.E = 0
+	sched.ErrMsg = ""
+
+	if len(sched.Nids) == 0 && len(sched.Xnames) == 0 && len(sched.Groups) == 0 {
+		return errors.New("no nids, xnames or groups")
+	}
+
+	if len(sched.Nids) > 0 {
+		var badNids []int
+		sched.Nids, badNids = validateNIDs(false, sched.Nids)
+		if len(badNids) > 0 {
+			return fmt.Errorf("invalid nids: %v", badNids)
+		}
+	}
+
+	if len(sched.Xnames) > 0 {
+		var badXnames []string
+		sched.Xnames = stringSliceMap(sched.Xnames,
+			xnametypes.NormalizeHMSCompID)
+		sched.Xnames, badXnames = xnametypes.ValidateCompIDs(sched.Xnames, false)
+		if len(badXnames) > 0 {
+			return fmt.Errorf("invalid xnames: %v", badXnames)
+		}
+	}
+
+	for _, g := range sched.Groups {
+		if g == "" {
+			return errors.New("empty group name")
+		}
+	}
+
+	if len(sched.Controls) == 0 {
+		return errors.New("no controls")
+	}
+	seen := make(map[string]bool)
+	for i, c := range sched.Controls {
+		switch {
+		case c.Name == "":
+			return errors.New("control has no name")
+		case seen[c.Name]:
+			return fmt.Errorf("Duplicate control (%s)", c.Name)
+		case c.Val == nil:
+			return fmt.Errorf("Control (%s) has no value", c.Name)
+		case *c.Val < 0:
+			return fmt.Errorf("Control (%s) value (%d) is negative",
+				c.Name, *c.Val)
+		}
+		seen[c.Name] = true
+		sched.Controls[i].Readings = nil
+	}
+
+	_, err := parsePowerCapScheduleTimes(*sched)
+
+	return err
+}
+
+// powerCapScheduleNodes resolves the targets of sched to nodes. Targets
+// HSM does not know are reported as problems rather than an error so the
+// rest of the schedule can be applied.
+func (d *CapmcD) powerCapScheduleNodes(sched capmc.PowerCapSchedule) ([]*NodeInfo, []string, error) {
+	var (
+		nodes    []*NodeInfo
+		problems []string
+	)
+
+	if len(sched.Nids) > 0 {
+		query := HSMQuery{NIDs: append([]int(nil), sched.Nids...)}
+		nidNodes, err := d.GetNodesByNID(query)
+		if err != nil {
+			var nidErr *InvalidNIDsError
+			if !errors.As(err, &nidErr) {
+				return nil, nil, err
+			}
+			problems = append(problems, err.Error())
+		}
+		nodes = append(nodes, nidNodes...)
+	}
+
+	if len(sched.Xnames) > 0 {
+		query := HSMQuery{
+			ComponentIDs: sched.Xnames,
+			Types:        []string{"node"},
+		}
+		xnameNodes, err := d.GetNodesByXname(query)
+		if err != nil {
+			var compIDError *InvalidCompIDsError
+			if !errors.As(err, &compIDError) {
+				return nil, nil, err
+			}
+			problems = append(problems, err.Error())
+		}
+		nodes = append(nodes, xnameNodes...)
+	}
+
+	if len(sched.Groups) > 0 {
+		groupNodes, err := d.getGroupPowerCapNodes(context.Background(), sched.Groups)
+		if err != nil {
+			var groupsError *InvalidGroupsError
+			if !errors.As(err, &groupsError) {
+				return nil, nil, err
+			}
+			problems = append(problems, err.Error())
+		}
+		nodes = append(nodes, groupNodes...)
+	}
+
+	// A node may be targeted more than once.
+	seen := make(map[string]bool)
+	unique := nodes[:0]
+	for _, node := range nodes {
+		if seen[node.Hostname] {
+			continue
+		}
+		seen[node.Hostname] = true
+		unique = append(unique, node)
+	}
+
+	return unique, problems, nil
+}
+
+// powerCapScheduleConflicts describes the schedules, not yet finished as of
+// now, which may cap some of the nodes of sched at the same time as it. Such
+// overlapping schedules are rejected, as each restores the caps the nodes
+// had when it started.
+func (d *CapmcD) powerCapScheduleConflicts(ctx context.Context, sched capmc.PowerCapSchedule, now time.Time) ([]string, error) {
+	t, err := parsePowerCapScheduleTimes(sched)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := d.capSchedules.entries(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		nodes     map[string]bool
+		conflicts []string
+	)
+	for _, e := range entries {
+		if e.Deleted {
+			continue
+		}
+		et, err := parsePowerCapScheduleTimes(e.PowerCapSchedule)
+		if err != nil || et.finished(now) || !t.overlaps(et) {
+			continue
+		}
+
+		// Only look the nodes up when the times overlap.
+		if nodes == nil {
+			nl, _, err := d.powerCapScheduleNodes(sched)
+			if err != nil {
+				return nil, err
+			}
+			nodes = make(map[string]bool)
+			for _, node := range nl {
+				nodes[node.Hostname] = true
+			}
+		}
+
+		nl, _, err := d.powerCapScheduleNodes(e.PowerCapSchedule)
+		if err != nil {
+			return nil, err
+		}
+		var shared []string
+		for _, node := range nl {
+			if nodes[node.Hostname] {
+				shared = append(shared, node.Hostname)
+			}
+		}
+		if len(shared) > 0 {
+			sort.Strings(shared)
+			conflicts = append(conflicts, fmt.Sprintf("schedule %s on %s",
+				e.ID, strings.Join(shared, ",")))
+		}
+	}
+
+	return conflicts, nil
+}
+
+// setScheduleProblems records the problems encountered applying or
+// restoring a schedule.
+func setScheduleProblems(e *powerCapScheduleEntry, problems []string) {
+	if len(problems) == 0 {
+		e.E = 0
+		e.ErrMsg = ""
+		return
+	}
+
+	sort.Strings(problems)
+	e.E = -1
+	e.ErrMsg = strings.Join(problems, "; ")
+}
+
+// applyPowerCapSchedule sets the controls of e on its nodes, remembering
+// the caps they replace. Nodes capped by another schedule, as given by
+// capping, are left alone. Nodes which could not be capped are reported in
+// the schedule's error message; if no node could be capped the schedule is
+// tried again on the next pass.
+func (d *CapmcD) applyPowerCapSchedule(e *powerCapScheduleEntry, capping map[string]string) {
+	start := time.Now()
+	nodes, problems, err := d.powerCapScheduleNodes(e.PowerCapSchedule)
+	if err != nil {
+		log.Printf("Notice: power cap schedule %s: %s", e.ID, err)
+		setScheduleProblems(e, []string{err.Error()})
+		return
+	}
+
+	var ready []*NodeInfo
+	for _, node := range nodes {
+		if id, ok := capping[node.Hostname]; ok && id != e.ID {
+			problems = append(problems,
+				fmt.Sprintf("%s: capped by power cap schedule %s",
+					node.Hostname, id))
+			continue
+		}
+		if !node.Enabled || node.State != string(base.StateReady) {
+			problems = append(problems,
+				fmt.Sprintf("%s: Invalid state, xname is not 'ready'",
+					node.Hostname))
+			continue
+		}
+		ready = append(ready, node)
+	}
+
+	actual, unread := d.readPowerCaps(ready)
+
+	previous := make(map[string]map[string]int)
+	bmcCmds := make(map[*NodeInfo]bmcCmd)
+	var cmdNodes, capNodes []*NodeInfo
+	for _, node := range ready {
+		xname := node.Hostname
+		if emsg, ok := unread[xname]; ok {
+			problems = append(problems, fmt.Sprintf("%s: %s", xname, emsg))
+			continue
+		}
+
+		cmds, err := d.powerCapSetCmds(node, e.Controls, "xname")
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", xname, err))
+			continue
+		}
+
+		caps := make(map[string]int)
+		for _, c := range e.Controls {
+			if val, ok := actualPowerCap(node, c.Name, actual[xname]); ok {
+				caps[c.Name] = val
+			}
+		}
+		previous[xname] = caps
+
+		for n, cmd := range cmds {
+			cmdNodes = append(cmdNodes, n)
+			bmcCmds[n] = cmd
+		}
+		capNodes = append(capNodes, node)
+	}
+
+	failed := make(map[string]bool)
+	if len(bmcCmds) > 0 {
+		waitNum, waitChan := d.queueBmcCmds(context.Background(), bmcCmds, cmdNodes)
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 {
+				log.Printf("Notice: power cap schedule %s: set power cap failed: %s",
+					e.ID, result.msg)
+				failed[result.ni.Hostname] = true
+			}
+		}
+	}
+
+	for _, node := range capNodes {
+		if failed[node.Hostname] {
+			problems = append(problems, fmt.Sprintf("%s: %s",
+				node.Hostname, "Error setting power cap for xname"))
+			delete(previous, node.Hostname)
+			continue
+		}
+		d.powerCaps.record(node, e.Controls)
+	}
+	d.auditPowerCapSchedule(e, "applied", start, capNodes, failed,
+		"Error setting power cap for xname")
+
+	setScheduleProblems(e, problems)
+
+	if len(previous) > 0 {
+		log.Printf("Info: power cap schedule %s: applied power caps %v to %d nodes",
+			e.ID, e.Controls, len(previous))
+		e.Applied = true
+		e.Previous = previous
+	}
+}
+
+// restorePowerCapSchedule sets the nodes capped by e back to the caps they
+// had before it was applied. Nodes which could not be restored are tried
+// again on the next pass.
+func (d *CapmcD) restorePowerCapSchedule(e *powerCapScheduleEntry) {
+	start := time.Now()
+	var (
+		xnames   []string
+		problems []string
+	)
+	for xname := range e.Previous {
+		xnames = append(xnames, xname)
+	}
+	sort.Strings(xnames)
+
+	query := HSMQuery{
+		ComponentIDs: xnames,
+		Types:        []string{"node"},
+	}
+	nodes, err := d.GetNodesByXname(query)
+	if err != nil {
+		var compIDError *InvalidCompIDsError
+		if !errors.As(err, &compIDError) {
+			log.Printf("Notice: power cap schedule %s: %s", e.ID, err)
+			setScheduleProblems(e, []string{err.Error()})
+			return
+		}
+
+		// Nodes removed from HSM can't be restored.
+		log.Printf("Notice: power cap schedule %s: not restoring %s", e.ID, err)
+		for _, xname := range compIDError.CompIDs {
+			delete(e.Previous, xname)
+		}
+	}
+
+	bmcCmds := make(map[*NodeInfo]bmcCmd)
+	restored := make(map[string][]capmc.PowerCapControl)
+	var cmdNodes, capNodes []*NodeInfo
+	for _, node := range nodes {
+		xname := node.Hostname
+		if !node.Enabled || node.State != string(base.StateReady) {
+			problems = append(problems,
+				fmt.Sprintf("%s: Invalid state, xname is not 'ready'", xname))
+			continue
+		}
+
+		var controls []capmc.PowerCapControl
+		for name, val := range e.Previous[xname] {
+			val := val
+			controls = append(controls,
+				capmc.PowerCapControl{Name: name, Val: &val})
+		}
+		if len(controls) == 0 {
+			delete(e.Previous, xname)
+			continue
+		}
+		sort.Slice(controls, func(i, j int) bool {
+			return controls[i].Name < controls[j].Name
+		})
+
+		cmds, err := d.powerCapSetCmds(node, controls, "xname")
+		if err != nil {
+			// The node no longer accepts its old caps, don't keep
+			// trying.
+			problems = append(problems, fmt.Sprintf("%s: %s", xname, err))
+			delete(e.Previous, xname)
+			continue
+		}
+
+		for n, cmd := range cmds {
+			cmdNodes = append(cmdNodes, n)
+			bmcCmds[n] = cmd
+		}
+		restored[xname] = controls
+		capNodes = append(capNodes, node)
+	}
+
+	failed := make(map[string]bool)
+	if len(bmcCmds) > 0 {
+		waitNum, waitChan := d.queueBmcCmds(context.Background(), bmcCmds, cmdNodes)
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 {
+				log.Printf("Notice: power cap schedule %s: restore power cap failed: %s",
+					e.ID, result.msg)
+				failed[result.ni.Hostname] = true
+			}
+		}
+	}
+
+	for _, node := range capNodes {
+		if failed[node.Hostname] {
+			problems = append(problems, fmt.Sprintf("%s: %s",
+				node.Hostname, "Error restoring power cap for xname"))
+			continue
+		}
+		d.powerCaps.record(node, restored[node.Hostname])
+		delete(e.Previous, node.Hostname)
+	}
+	d.auditPowerCapSchedule(e, "restored", start, capNodes, failed,
+		"Error restoring power cap for xname")
+
+	setScheduleProblems(e, problems)
+
+	if len(e.Previous) == 0 {
+		log.Printf("Info: power cap schedule %s: restored power caps", e.ID)
+		e.Applied = false
+		e.Previous = nil
+	}
+}
+
+// auditPowerCapSchedule records the caps of nodes being applied or
+// restored for e, as given by what, from start. Those in failed could not be
+// set and are reported with emsg. Nothing is recorded when no node was
+// tried.
+func (d *CapmcD) auditPowerCapSchedule(e *powerCapScheduleEntry, what string, start time.Time, nodes []*NodeInfo, failed map[string]bool, emsg string) {
+	if len(nodes) == 0 {
+		return
+	}
+
+	var targets []string
+	errs := make(map[string]capmc.ErrResponse)
+	for _, node := range nodes {
+		targets = append(targets, node.Hostname)
+		if failed[node.Hostname] {
+			errs[node.Hostname] = capmc.ErrResponse{E: -1, ErrMsg: emsg}
+		}
+	}
+
+	rec := newSystemAuditRecord(path.Base(capmc.PowerCapSchedulesV1),
+		bmcCmdSetPowerCap, start, time.Now())
+	rec.Reason = fmt.Sprintf("power cap schedule %s %s", e.ID, what)
+	if len(errs) > 0 {
+		rec.E = 52 // EBADE ?
+		rec.ErrMsg = "Invalid exchange"
+	}
+	rec.Targets = e.Xnames
+	rec.Groups = e.Groups
+	rec.Nids = e.Nids
+	rec.Xnames = auditResults(targets, errs, true)
+	d.audit.record(context.Background(), rec)
+}
+
+// auditPowerCapScheduleRequest records the call r adding or deleting, as
+// given by command and what, the schedule sched, with the outcome result.
+// The caps the schedule sets and restores are recorded as they are.
+func (d *CapmcD) auditPowerCapScheduleRequest(r *http.Request, sched capmc.PowerCapSchedule, command, what string, start time.Time, result capmc.ErrResponse) {
+	rec := newAuditRecord(r, newOperationID(), command, start, time.Now())
+	rec.ErrResponse = result
+	rec.Reason = fmt.Sprintf("power cap schedule %s %s", sched.ID, what)
+	rec.Targets = sched.Xnames
+	rec.Groups = sched.Groups
+	rec.Nids = sched.Nids
+	rec.Xnames = auditResults(nil, nil, false)
+	d.audit.record(r.Context(), rec)
+}
+
+// finishDeletedPowerCapSchedule restores the caps set by the deleted
+// schedule e, removing it once they have all been restored. It reports
+// whether e was removed.
+func (d *CapmcD) finishDeletedPowerCapSchedule(ctx context.Context, e *powerCapScheduleEntry) bool {
+	s := d.capSchedules
+
+	if e.Applied {
+		d.restorePowerCapSchedule(e)
+	}
+	if e.Applied {
+		e.State = scheduleStateRestoring
+		if err := s.update(ctx, *e); err != nil {
+			log.Printf("Error: failed to save power cap schedule %s: %s", e.ID, err)
+		}
+		return false
+	}
+
+	if err := s.remove(ctx, e.ID); err != nil {
+		log.Printf("Error: failed to remove power cap schedule %s: %s", e.ID, err)
+		return false
+	}
+	log.Printf("Info: power cap schedule %s removed", e.ID)
+
+	return true
+}
+
+// runPowerCapSchedules applies the schedules which have started and
+// restores the caps of those which have ended, or been deleted, as of now.
+func (d *CapmcD) runPowerCapSchedules(now time.Time) {
+	ctx := context.Background()
+	s := d.capSchedules
+	s.run.Lock()
+	defer s.run.Unlock()
+
+	entries, err := s.entries(ctx)
+	if err != nil {
+		log.Printf("Error: failed to read power cap schedules: %s", err)
+		return
+	}
+
+	// A node is capped by one schedule at a time, so that each schedule
+	// restores the caps the node had before it.
+	capping := make(map[string]string) // xname -> schedule ID
+	for _, e := range entries {
+		for xname := range e.Previous {
+			capping[xname] = e.ID
+		}
+	}
+	track := func(e *powerCapScheduleEntry) {
+		for xname, id := range capping {
+			if _, ok := e.Previous[xname]; id == e.ID && !ok {
+				delete(capping, xname)
+			}
+		}
+		for xname := range e.Previous {
+			capping[xname] = e.ID
+		}
+	}
+
+	for _, e := range entries {
+		if e.Deleted {
+			d.finishDeletedPowerCapSchedule(ctx, &e)
+			track(&e)
+			continue
+		}
+
+		t, err := parsePowerCapScheduleTimes(e.PowerCapSchedule)
+		if err != nil {
+			// Checked when the schedule was submitted
+			log.Printf("Error: power cap schedule %s: %s", e.ID, err)
+			continue
+		}
+
+		active := t.active(now)
+		switch {
+		case active && !e.Applied:
+			d.applyPowerCapSchedule(&e, capping)
+		case !active && e.Applied:
+			d.restorePowerCapSchedule(&e)
+		}
+		track(&e)
+
+		switch {
+		case e.Applied:
+			e.State = scheduleStateActive
+		case t.finished(now):
+			e.State = scheduleStateCompleted
+		default:
+			e.State = scheduleStatePending
+		}
+
+		if err := s.update(ctx, e); err != nil {
+			log.Printf("Error: failed to save power cap schedule %s: %s", e.ID, err)
+		}
+	}
+}
+
+// powerCapScheduleRunner runs runPowerCapSchedules every interval, and
+// whenever a schedule is added or deleted, while this replica is the
+// leader, until ctx is done.
+func (d *CapmcD) powerCapScheduleRunner(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Catch up on anything which started or ended while we were down.
+	if d.leading() {
+		d.runPowerCapSchedules(time.Now())
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.capSchedules.wake:
+		}
+		if d.leading() {
+			d.runPowerCapSchedules(time.Now())
+		}
+	}
+}
+
+// doPowerCapSchedules is the HTTP handler for the power_cap_schedules API.
+// It lists the power cap schedules (GET), adds a schedule (POST) or deletes
+// schedules (DELETE). The caps of deleted schedules which are active are
+// restored before they are removed, by the scheduler if not right away.
+func (d *CapmcD) doPowerCapSchedules(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		d.doPowerCapSchedulesList(w, r)
+	case http.MethodPost:
+		d.doPowerCapScheduleAdd(w, r)
+	case http.MethodDelete:
+		d.doPowerCapScheduleDelete(w, r)
+	default:
+		w.Header().Set("Allow", "GET,POST,DELETE")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+	}
+}
+
+func (d *CapmcD) doPowerCapSchedulesList(w http.ResponseWriter, r *http.Request) {
+	data := capmc.PowerCapSchedulesResponse{
+		Schedules: make([]capmc.PowerCapSchedule, 0),
+	}
+
+	entries, err := d.capSchedules.entries(r.Context())
+	if err != nil {
+		sendJsonError(w, http.StatusInternalServerError,
+			fmt.Sprintf("Failed to read power cap schedules: %s", err))
+		return
+	}
+
+	for _, e := range entries {
+		data.Schedules = append(data.Schedules, e.PowerCapSchedule)
+	}
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
+
+func (d *CapmcD) doPowerCapScheduleAdd(w http.ResponseWriter, r *http.Request) {
+	var sched capmc.PowerCapSchedule
+
+	start := time.Now()
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&sched); err != nil {
+		if err == io.EOF {
+			sendJsonError(w, http.StatusBadRequest, "no request")
+		} else {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if err := validatePowerCapSchedule(&sched); err != nil {
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad Request: %s", err))
+		return
+	}
+
+	// Check for overlaps and add the schedule in one go.
+	d.capSchedules.adding.Lock()
+	defer d.capSchedules.adding.Unlock()
+
+	conflicts, err := d.powerCapScheduleConflicts(r.Context(), sched, time.Now())
+	if err != nil {
+		sendJsonError(w, http.StatusInternalServerError,
+			fmt.Sprintf("Failed to check for overlapping power cap schedules: %s", err))
+		return
+	}
+	if len(conflicts) > 0 {
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad Request: overlaps power cap %s",
+				strings.Join(conflicts, "; ")))
+		return
+	}
+
+	sched, err = d.capSchedules.add(r.Context(), sched, time.Now())
+	if err != nil {
+		sendJsonError(w, http.StatusInternalServerError,
+			fmt.Sprintf("Failed to add power cap schedule: %s", err))
+		return
+	}
+
+	log.Printf("Info: CAPMC Power Cap Schedule %s added - nids: %v, xnames: %v, groups: %v, controls: %v",
+		sched.ID, sched.Nids, sched.Xnames, sched.Groups, sched.Controls)
+	d.auditPowerCapScheduleRequest(r, sched, auditCmdAddPowerCapSchedule,
+		"added", start, capmc.ErrResponse{})
+
+	data := capmc.PowerCapSchedulesResponse{
+		Schedules: []capmc.PowerCapSchedule{sched},
+	}
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
+
+func (d *CapmcD) doPowerCapScheduleDelete(w http.ResponseWriter, r *http.Request) {
+	var args capmc.PowerCapScheduleDelete
+
+	start := time.Now()
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&args); err != nil {
+		if err == io.EOF {
+			sendJsonError(w, http.StatusBadRequest, "no request")
+		} else {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if len(args.IDs) == 0 {
+		sendJsonError(w, http.StatusBadRequest,
+			"Bad Request: Required ids list is empty")
+		return
+	}
+
+	// Only the leader applies and restores schedules. Other replicas
+	// leave the deleted schedules to it.
+	ctx := r.Context()
+	s := d.capSchedules
+	leading := d.leading()
+	if leading {
+		s.run.Lock()
+		defer s.run.Unlock()
+	}
+
+	var unknown []string
+	for _, id := range args.IDs {
+		_, ok, err := s.get(ctx, id)
+		if err != nil {
+			sendJsonError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Failed to read power cap schedule %s: %s", id, err))
+			return
+		}
+		if !ok {
+			unknown = append(unknown, id)
+		}
+	}
+	if len(unknown) > 0 {
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad Request: unknown schedules: %v", unknown))
+		return
+	}
+
+	data := capmc.PowerCapSchedulesResponse{
+		Schedules: make([]capmc.PowerCapSchedule, 0, len(args.IDs)),
+	}
+
+	var failed int
+	deleted := make(map[string]bool)
+	for _, id := range args.IDs {
+		if deleted[id] {
+			continue
+		}
+		deleted[id] = true
+
+		e, ok, err := s.get(ctx, id)
+		if err == nil && ok {
+			err = s.markDeleted(ctx, id)
+		}
+		if err != nil {
+			sendJsonError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Failed to delete power cap schedule %s: %s", id, err))
+			return
+		}
+		if !ok {
+			// Removed since it was checked
+			continue
+		}
+		log.Printf("Info: CAPMC Power Cap Schedule %s deleted", id)
+
+		var result capmc.ErrResponse
+		switch {
+		case !leading:
+			e.State = scheduleStateRestoring
+		case !d.finishDeletedPowerCapSchedule(ctx, &e):
+			// The scheduler keeps trying to restore the caps.
+			failed++
+			result = capmc.ErrResponse{E: e.E, ErrMsg: e.ErrMsg}
+		}
+		d.auditPowerCapScheduleRequest(r, e.PowerCapSchedule,
+			auditCmdDeletePowerCapSchedule, "deleted", start, result)
+		data.Schedules = append(data.Schedules, e.PowerCapSchedule)
+	}
+
+	// The caps of some nodes are still those set by a deleted schedule.
+	if failed > 0 {
+		data.E = 52 // EBADE ?
+		data.ErrMsg = "Invalid exchange"
+	}
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,865 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestPowerCapScheduleTimes(t *testing.T) {
+	const timezone = "America/Chicago"
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Monday 19 October 2026
+	day := func(d, h, m int) time.Time {
+		return time.Date(2026, time.October, d, h, m, 0, 0, loc)
+	}
+	utc := func(d, h, m int) time.Time {
+		return time.Date(2026, time.October, d, h, m, 0, 0, time.UTC)
+	}
+	rfc := func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name   string
+		sched  capmc.PowerCapSchedule
+		err    bool
+		active map[time.Time]bool
+	}{
+		{
+			name:  "No end",
+			sched: capmc.PowerCapSchedule{Start: rfc(day(19, 9, 0))},
+			err:   true,
+		}, {
+			name: "End before start",
+			sched: capmc.PowerCapSchedule{
+				Start: rfc(day(19, 9, 0)),
+				End:   rfc(day(19, 8, 0)),
+			},
+			err: true,
+		}, {
+			name: "Bad window time",
+			sched: capmc.PowerCapSchedule{
+				Window: &capmc.PowerCapScheduleWindow{Start: "9am", End: "17:00"},
+			},
+			err: true,
+		}, {
+			name: "Bad window day",
+			sched: capmc.PowerCapSchedule{
+				Window: &capmc.PowerCapScheduleWindow{
+					Days:  []string{"Funday"},
+					Start: "09:00",
+					End:   "17:00",
+				},
+			},
+			err: true,
+		}, {
+			name: "Bad timezone",
+			sched: capmc.PowerCapSchedule{
+				Window:   &capmc.PowerCapScheduleWindow{Start: "09:00", End: "17:00"},
+				Timezone: "Mars/Olympus_Mons",
+			},
+			err: true,
+		}, {
+			name: "Local timezone",
+			sched: capmc.PowerCapSchedule{
+				Window:   &capmc.PowerCapScheduleWindow{Start: "09:00", End: "17:00"},
+				Timezone: "Local",
+			},
+			err: true,
+		}, {
+			name: "One shot",
+			sched: capmc.PowerCapSchedule{
+				Start: rfc(day(19, 9, 0)),
+				End:   rfc(day(19, 17, 0)),
+			},
+			active: map[time.Time]bool{
+				day(19, 8, 59): false,
+				day(19, 9, 0):  true,
+				day(19, 16, 0): true,
+				day(19, 17, 0): false,
+			},
+		}, {
+			name: "Weekday window",
+			sched: capmc.PowerCapSchedule{
+				Window: &capmc.PowerCapScheduleWindow{
+					Days:  []string{"Mon", "tuesday"},
+					Start: "09:00",
+					End:   "17:00",
+				},
+				Timezone: timezone,
+			},
+			active: map[time.Time]bool{
+				day(19, 8, 0):  false,
+				day(19, 12, 0): true,
+				day(20, 12, 0): true,
+				day(21, 12, 0): false,
+				day(19, 17, 0): false,
+			},
+		}, {
+			name: "Overnight window",
+			sched: capmc.PowerCapSchedule{
+				End: rfc(day(21, 0, 0)),
+				Window: &capmc.PowerCapScheduleWindow{
+					Days:  []string{"Mon"},
+					Start: "22:00",
+					End:   "06:00",
+				},
+				Timezone: timezone,
+			},
+			active: map[time.Time]bool{
+				day(18, 23, 0): false,
+				day(19, 5, 0):  false,
+				day(19, 23, 0): true,
+				day(20, 5, 0):  true,
+				day(20, 6, 0):  false,
+				day(20, 23, 0): false,
+			},
+		}, {
+			name: "UTC window",
+			sched: capmc.PowerCapSchedule{
+				Window: &capmc.PowerCapScheduleWindow{
+					Days:  []string{"Mon"},
+					Start: "09:00",
+					End:   "17:00",
+				},
+			},
+			active: map[time.Time]bool{
+				utc(19, 9, 0):  true,
+				utc(19, 16, 0): true,
+				day(19, 9, 0):  true,  // 14:00 UTC
+				day(19, 12, 0): false, // 17:00 UTC
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			times, err := parsePowerCapScheduleTimes(test.sched)
+			if test.err {
+				if err == nil {
+					t.Fatalf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for now, want := range test.active {
+				if got := times.active(now); got != want {
+					t.Errorf("Wrong active at %s: got %v want %v",
+						now, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPowerCapScheduleOverlaps(t *testing.T) {
+	start := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	rfc := func(d time.Duration) string {
+		return start.Add(d).Format(time.RFC3339)
+	}
+	window := func(days []string, from, to, tz string) capmc.PowerCapSchedule {
+		return capmc.PowerCapSchedule{
+			Window:   &capmc.PowerCapScheduleWindow{Days: days, Start: from, End: to},
+			Timezone: tz,
+		}
+	}
+
+	tests := []struct {
+		name string
+		a, b capmc.PowerCapSchedule
+		want bool
+	}{
+		{
+			name: "Periods overlap",
+			a:    capmc.PowerCapSchedule{Start: rfc(0), End: rfc(2 * time.Hour)},
+			b:    capmc.PowerCapSchedule{Start: rfc(time.Hour), End: rfc(3 * time.Hour)},
+			want: true,
+		}, {
+			name: "Periods adjoin",
+			a:    capmc.PowerCapSchedule{Start: rfc(0), End: rfc(time.Hour)},
+			b:    capmc.PowerCapSchedule{Start: rfc(time.Hour), End: rfc(2 * time.Hour)},
+			want: false,
+		}, {
+			name: "Window in period",
+			a:    capmc.PowerCapSchedule{End: rfc(time.Hour)},
+			b:    window(nil, "14:00", "18:00", ""),
+			want: true,
+		}, {
+			name: "Separate windows",
+			a:    window(nil, "08:00", "12:00", ""),
+			b:    window(nil, "14:00", "18:00", ""),
+			want: false,
+		}, {
+			name: "Overlapping windows",
+			a:    window(nil, "08:00", "15:00", ""),
+			b:    window(nil, "14:00", "18:00", ""),
+			want: true,
+		}, {
+			name: "Separate days",
+			a:    window([]string{"Mon"}, "08:00", "18:00", ""),
+			b:    window([]string{"Tue"}, "08:00", "18:00", ""),
+			want: false,
+		}, {
+			name: "Overnight window into the next day",
+			a:    window([]string{"Mon"}, "22:00", "02:00", ""),
+			b:    window([]string{"Tue"}, "01:00", "03:00", ""),
+			want: true,
+		}, {
+			name: "Different timezones",
+			a:    window(nil, "08:00", "12:00", "UTC"),
+			b:    window(nil, "14:00", "18:00", "America/Chicago"),
+			want: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, err := parsePowerCapScheduleTimes(test.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parsePowerCapScheduleTimes(test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := a.overlaps(b); got != test.want {
+				t.Errorf("Wrong overlap: got %v want %v", got, test.want)
+			}
+			if got := b.overlaps(a); got != test.want {
+				t.Errorf("Wrong reverse overlap: got %v want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPowerCapScheduler(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "schedules.json")
+
+	val := 500
+	sched := capmc.PowerCapSchedule{
+		Xnames:   []string{"x9000c1s2b0n0"},
+		Controls: []capmc.PowerCapControl{{Name: "Node Power Limit", Val: &val}},
+		End:      time.Now().Add(time.Hour).Format(time.RFC3339),
+	}
+
+	ctx := context.Background()
+	s := newPowerCapScheduler(stateFile)
+	first, err := s.add(ctx, sched, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.add(ctx, sched, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == "" || first.ID == second.ID {
+		t.Errorf("Bad schedule IDs: %q %q", first.ID, second.ID)
+	}
+	if first.State != scheduleStatePending {
+		t.Errorf("Wrong state: got %s want %s", first.State,
+			scheduleStatePending)
+	}
+
+	e, ok, err := s.get(ctx, first.ID)
+	if err != nil || !ok {
+		t.Fatalf("Schedule %s missing: %v", first.ID, err)
+	}
+	if err = s.markDeleted(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Updating a schedule keeps its deletion mark.
+	e.Applied = true
+	e.Previous = map[string]map[string]int{
+		"x9000c1s2b0n0": {"Node Power Limit": 750},
+	}
+	if err = s.update(ctx, e); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.remove(ctx, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Removed schedules aren't brought back by an update.
+	if err = s.update(ctx, powerCapScheduleEntry{PowerCapSchedule: second}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The schedules survive a restart.
+	entries, err := newPowerCapScheduler(stateFile).entries(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ID != first.ID ||
+		!entries[0].Applied || !entries[0].Deleted ||
+		!reflect.DeepEqual(entries[0].Previous, e.Previous) {
+		t.Errorf("Wrong persisted schedules: %+v", entries)
+	}
+}
+
+func TestRunPowerCapSchedules(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+	olympusRF := &rfMock{
+		PowerControl: []clientMock{
+			{
+				Body:       []byte(olympusPowerControl),
+				StatusCode: http.StatusOK,
+			},
+		},
+	}
+
+	var (
+		mu      sync.Mutex
+		patches []string
+	)
+	get := rfTestMock(olympusRF)
+	patch := rfStatusMock(http.StatusOK)
+	svc := newXnamePowerCapTestSvc(olympusHSM,
+		func(r *http.Request) (*http.Response, error) {
+			if r.Method == http.MethodPatch {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				patches = append(patches, string(body))
+				mu.Unlock()
+				return patch(r)
+			}
+			return get(r)
+		})
+	svc.powerCaps = newPowerCapStore("")
+	svc.capSchedules = newPowerCapScheduler("")
+	svc.audit = newAuditLog(nil, "", 0, 0)
+
+	start := time.Now().Truncate(time.Second)
+	val := 500
+	sched, err := svc.capSchedules.add(context.Background(), capmc.PowerCapSchedule{
+		Xnames:   []string{"x9000c1s2b0n0"},
+		Controls: []capmc.PowerCapControl{{Name: "Node Power Limit", Val: &val}},
+		Start:    start.Format(time.RFC3339),
+		End:      start.Add(time.Hour).Format(time.RFC3339),
+	}, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name    string
+		now     time.Time
+		state   string
+		patch   string
+		desired int
+		audited string
+	}{
+		{
+			name:  "Not started",
+			now:   start.Add(-time.Minute),
+			state: scheduleStatePending,
+		}, {
+			name:    "Applied",
+			now:     start.Add(time.Minute),
+			state:   scheduleStateActive,
+			patch:   `"SetPoint":500}`,
+			desired: 500,
+			audited: "power cap schedule " + sched.ID + " applied",
+		}, {
+			name:    "Still applied",
+			now:     start.Add(2 * time.Minute),
+			state:   scheduleStateActive,
+			desired: 500,
+		}, {
+			name:    "Restored",
+			now:     start.Add(time.Hour),
+			state:   scheduleStateCompleted,
+			patch:   `"SetPoint":750}`,
+			desired: 750,
+			audited: "power cap schedule " + sched.ID + " restored",
+		},
+	}
+
+	for _, step := range steps {
+		patches = nil
+		before, _ := svc.audit.query(auditFilter{limit: 10})
+		svc.runPowerCapSchedules(step.now)
+
+		e, ok, err := svc.capSchedules.get(context.Background(), sched.ID)
+		if err != nil || !ok {
+			t.Fatalf("%s: schedule missing: %v", step.name, err)
+		}
+		if e.State != step.state {
+			t.Errorf("%s: wrong state: got %s want %s (%s)",
+				step.name, e.State, step.state, e.ErrMsg)
+		}
+
+		switch {
+		case step.patch == "" && len(patches) != 0:
+			t.Errorf("%s: unexpected power cap set: %v", step.name, patches)
+		case step.patch != "" && (len(patches) != 1 ||
+			!bytes.Contains([]byte(patches[0]), []byte(step.patch))):
+			t.Errorf("%s: wrong power cap set: got %v want %s",
+				step.name, patches, step.patch)
+		}
+
+		if step.desired != 0 {
+			desired, err := svc.powerCaps.desiredCaps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := desired["x9000c1s2b0n0"]["Node Power Limit"]
+			if got != step.desired {
+				t.Errorf("%s: wrong desired cap: got %d want %d",
+					step.name, got, step.desired)
+			}
+		}
+
+		records, _ := svc.audit.query(auditFilter{limit: 10})
+		records = records[len(before):]
+		switch {
+		case step.audited == "" && len(records) != 0:
+			t.Errorf("%s: unexpected audit records %+v", step.name, records)
+		case step.audited != "" && (len(records) != 1 ||
+			records[0].Caller != auditSystemCaller ||
+			records[0].Reason != step.audited ||
+			!reflect.DeepEqual(records[0].Xnames, []capmc.PowerOperationResult{
+				{Xname: "x9000c1s2b0n0", Result: "success"},
+			})):
+			t.Errorf("%s: wrong audit records: got %+v want %s",
+				step.name, records, step.audited)
+		}
+	}
+}
+
+func TestDeletePowerCapSchedule(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+	olympusRF := &rfMock{
+		PowerControl: []clientMock{
+			{
+				Body:       []byte(olympusPowerControl),
+				StatusCode: http.StatusOK,
+			},
+		},
+	}
+
+	var (
+		mu          sync.Mutex
+		patches     int
+		patchStatus = http.StatusOK
+	)
+	get := rfTestMock(olympusRF)
+	svc := newXnamePowerCapTestSvc(olympusHSM,
+		func(r *http.Request) (*http.Response, error) {
+			if r.Method == http.MethodPatch {
+				mu.Lock()
+				defer mu.Unlock()
+				patches++
+				return rfStatusMock(patchStatus)(r)
+			}
+			return get(r)
+		})
+	svc.powerCaps = newPowerCapStore("")
+	svc.capSchedules = newPowerCapScheduler("")
+	setStatus := func(status int) {
+		mu.Lock()
+		patchStatus = status
+		mu.Unlock()
+	}
+	notLeading := newLeaderElection(newEtcdStateStore("http://localhost:2379", "/capmc/"),
+		time.Minute)
+
+	ctx := context.Background()
+	start := time.Now().Truncate(time.Second)
+	val := 500
+	sched := capmc.PowerCapSchedule{
+		Xnames:   []string{"x9000c1s2b0n0"},
+		Controls: []capmc.PowerCapControl{{Name: "Node Power Limit", Val: &val}},
+		Start:    start.Format(time.RFC3339),
+		End:      start.Add(time.Hour).Format(time.RFC3339),
+	}
+
+	steps := []struct {
+		name    string
+		leader  *leaderElection
+		status  int
+		e       int
+		patches []int // by delete and each scheduler pass after it
+		removed []bool
+	}{
+		{
+			name:    "Restored",
+			status:  http.StatusOK,
+			patches: []int{1},
+			removed: []bool{true},
+		}, {
+			name:    "Restore failed",
+			status:  http.StatusInternalServerError,
+			e:       52,
+			patches: []int{1, 1, 1},
+			removed: []bool{false, false, true},
+		}, {
+			name:    "Not leading",
+			leader:  notLeading,
+			status:  http.StatusOK,
+			patches: []int{0, 1},
+			removed: []bool{false, true},
+		},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			added, err := svc.capSchedules.add(ctx, sched, start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			svc.leader = nil
+			setStatus(http.StatusOK)
+			svc.runPowerCapSchedules(start.Add(time.Minute))
+			if e, _, _ := svc.capSchedules.get(ctx, added.ID); !e.Applied {
+				t.Fatalf("Schedule not applied: %s", e.ErrMsg)
+			}
+
+			svc.leader = step.leader
+			setStatus(step.status)
+			for i, want := range step.patches {
+				mu.Lock()
+				patches = 0
+				mu.Unlock()
+				if i == 0 {
+					req, err := http.NewRequest(http.MethodDelete,
+						capmc.PowerCapSchedulesV1,
+						bytes.NewBufferString(`{"ids":["`+added.ID+`"]}`))
+					if err != nil {
+						t.Fatal(err)
+					}
+					w := httptest.NewRecorder()
+					svc.doPowerCapSchedules(w, req)
+
+					var response capmc.PowerCapSchedulesResponse
+					if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+						t.Fatal(err)
+					}
+					if response.E != step.e || len(response.Schedules) != 1 {
+						t.Errorf("Wrong delete response: %s", w.Body.String())
+					}
+					if !step.removed[i] && len(response.Schedules) == 1 &&
+						response.Schedules[0].State != scheduleStateRestoring {
+						t.Errorf("Wrong state: got %s want %s",
+							response.Schedules[0].State, scheduleStateRestoring)
+					}
+				} else {
+					// Later passes restore the caps.
+					svc.leader = nil
+					if i == len(step.patches)-1 {
+						setStatus(http.StatusOK)
+					}
+					svc.runPowerCapSchedules(start.Add(2 * time.Minute))
+				}
+
+				mu.Lock()
+				if patches != want {
+					t.Errorf("Step %d set wrong number of power caps: got %d want %d",
+						i, patches, want)
+				}
+				mu.Unlock()
+				e, ok, err := svc.capSchedules.get(ctx, added.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok == step.removed[i] {
+					t.Fatalf("Step %d: schedule removed %v, want %v",
+						i, !ok, step.removed[i])
+				}
+				if ok && (!e.Deleted || e.State != scheduleStateRestoring) {
+					t.Errorf("Step %d: wrong deleted schedule: %+v", i, e)
+				}
+			}
+
+			desired, err := svc.powerCaps.desiredCaps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := desired["x9000c1s2b0n0"]["Node Power Limit"]; got != 750 {
+				t.Errorf("Wrong desired cap: got %d want %d", got, 750)
+			}
+		})
+	}
+}
+
+func TestOverlappingPowerCapSchedules(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+	olympusRF := &rfMock{
+		PowerControl: []clientMock{
+			{
+				Body:       []byte(olympusPowerControl),
+				StatusCode: http.StatusOK,
+			},
+		},
+	}
+
+	var (
+		mu      sync.Mutex
+		patches []string
+	)
+	get := rfTestMock(olympusRF)
+	patch := rfStatusMock(http.StatusOK)
+	svc := newXnamePowerCapTestSvc(olympusHSM,
+		func(r *http.Request) (*http.Response, error) {
+			if r.Method == http.MethodPatch {
+				body, _ := ioutil.ReadAll(r.Body)
+				mu.Lock()
+				patches = append(patches, string(body))
+				mu.Unlock()
+				return patch(r)
+			}
+			return get(r)
+		})
+	svc.powerCaps = newPowerCapStore("")
+	svc.capSchedules = newPowerCapScheduler("")
+	svc.audit = newAuditLog(nil, "", 0, 0)
+
+	start := time.Now().Truncate(time.Second)
+	rfc := func(d time.Duration) string {
+		return start.Add(d).Format(time.RFC3339)
+	}
+	add := func(from, to time.Duration) int {
+		body := `{"xnames":["X9000c1s2b0n0"],"controls":[{"name":"Node Power Limit","val":500}],` +
+			`"start":"` + rfc(from) + `","end":"` + rfc(to) + `"}`
+		req, err := http.NewRequest(http.MethodPost, capmc.PowerCapSchedulesV1,
+			bytes.NewBufferString(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		svc.doPowerCapSchedules(w, req)
+		return w.Code
+	}
+
+	if code := add(0, time.Hour); code != http.StatusOK {
+		t.Fatalf("First schedule: got %d want %d", code, http.StatusOK)
+	}
+	if code := add(30*time.Minute, 2*time.Hour); code != http.StatusBadRequest {
+		t.Errorf("Overlapping schedule: got %d want %d", code, http.StatusBadRequest)
+	}
+	if code := add(time.Hour, 2*time.Hour); code != http.StatusOK {
+		t.Errorf("Following schedule: got %d want %d", code, http.StatusOK)
+	}
+
+	// An overlapping schedule added through another replica at the same
+	// time leaves the node to the schedule capping it.
+	val := 400
+	other, err := svc.capSchedules.add(context.Background(), capmc.PowerCapSchedule{
+		Xnames:   []string{"x9000c1s2b0n0"},
+		Controls: []capmc.PowerCapControl{{Name: "Node Power Limit", Val: &val}},
+		Start:    rfc(0),
+		End:      rfc(time.Hour),
+	}, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc.runPowerCapSchedules(start.Add(time.Minute))
+	if len(patches) != 1 || !strings.Contains(patches[0], `"SetPoint":500}`) {
+		t.Errorf("Wrong power caps set: %v", patches)
+	}
+	e, _, err := svc.capSchedules.get(context.Background(), other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Applied || !strings.Contains(e.ErrMsg, "capped by power cap schedule") {
+		t.Errorf("Overlapping schedule applied: %+v", e)
+	}
+}
+
+func TestDoPowerCapSchedules(t *testing.T) {
+	svc := &CapmcD{
+		capSchedules: newPowerCapScheduler(""),
+		audit:        newAuditLog(nil, "", 0, 0),
+	}
+
+	end := time.Now().Add(time.Hour).Format(time.RFC3339)
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		ret    int
+		count  int
+	}{
+		{
+			name:   "Put",
+			method: http.MethodPut,
+			ret:    http.StatusMethodNotAllowed,
+		}, {
+			name:   "Add no targets",
+			method: http.MethodPost,
+			body:   `{"controls":[{"name":"node","val":400}],"end":"` + end + `"}`,
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Add no controls",
+			method: http.MethodPost,
+			body:   `{"nids":[1],"end":"` + end + `"}`,
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Add bad xname",
+			method: http.MethodPost,
+			body:   `{"xnames":["foo"],"controls":[{"name":"node","val":400}],"end":"` + end + `"}`,
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Add",
+			method: http.MethodPost,
+			body:   `{"nids":[1],"groups":["peak"],"controls":[{"name":"node","val":400}],"window":{"days":["Mon"],"start":"14:00","end":"18:00"}}`,
+			ret:    http.StatusOK,
+			count:  1,
+		}, {
+			name:   "List",
+			method: http.MethodGet,
+			ret:    http.StatusOK,
+			count:  1,
+		}, {
+			name:   "Delete unknown",
+			method: http.MethodDelete,
+			body:   `{"ids":["nope"]}`,
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Delete none",
+			method: http.MethodDelete,
+			body:   `{"ids":[]}`,
+			ret:    http.StatusBadRequest,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method,
+				capmc.PowerCapSchedulesV1, bytes.NewBufferString(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			svc.doPowerCapSchedules(w, req)
+
+			if w.Code != test.ret {
+				t.Fatalf("Returned wrong status code: got %v want %v (%s)",
+					w.Code, test.ret, w.Body.String())
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response capmc.PowerCapSchedulesResponse
+			if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if len(response.Schedules) != test.count {
+				t.Errorf("Returned wrong number of schedules: got %d want %d",
+					len(response.Schedules), test.count)
+			}
+		})
+	}
+
+	// Delete what was added
+	entries, err := svc.capSchedules.entries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Wrong number of schedules: %d", len(entries))
+	}
+
+	id := entries[0].ID
+	req, err := http.NewRequest(http.MethodDelete, capmc.PowerCapSchedulesV1,
+		bytes.NewBufferString(`{"ids":["`+id+`"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	svc.doPowerCapSchedules(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Delete returned wrong status code: got %v want %v",
+			w.Code, http.StatusOK)
+	}
+	if entries, _ = svc.capSchedules.entries(context.Background()); len(entries) != 0 {
+		t.Errorf("Schedule not deleted: %d remain", len(entries))
+	}
+
+	records, _ := svc.audit.query(auditFilter{limit: 10})
+	var commands []string
+	for _, rec := range records {
+		if rec.API != "power_cap_schedules" ||
+			!reflect.DeepEqual(rec.Nids, []int{1}) ||
+			!strings.HasPrefix(rec.Reason, "power cap schedule "+id) {
+			t.Errorf("Wrong audit record %+v", rec)
+		}
+		commands = append(commands, rec.Command)
+	}
+	want := []string{auditCmdAddPowerCapSchedule, auditCmdDeletePowerCapSchedule}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("Wrong audit records: got %v want %v", commands, want)
+	}
+}
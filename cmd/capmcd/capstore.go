@@ -0,0 +1,557 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// Keys of the power cap drift state
+const (
+	driftXnamePrefix = "xnames/"
+	driftLastCheck   = "last_check"
+)
+
+const (
+	// auditReconcileAPI is the API of the audit records of power caps
+	// reapplied by reconciliation.
+	auditReconcileAPI = "power_cap_reconciliation"
+	// auditCmdClearDesiredPowerCap is the command of the audit records
+	// of desired power caps being cleared.
+	auditCmdClearDesiredPowerCap = "ClearDesiredPowerCap"
+)
+
+// powerCapStore records the power caps most recently set through CAPMC so
+// they can be reapplied when a BMC loses them, e.g. on AC loss or a firmware
+// update, along with the drift found by the last reconciliation pass. Both
+// are kept in the shared state store when there is one. Otherwise they are
+// kept in memory, with the desired caps persisted when a state file is
+// configured.
+type powerCapStore struct {
+	sync.Mutex            // serializes updates of the desired caps of a node
+	desired    stateStore // xname -> control name -> watts
+	drift      stateStore
+}
+
+// newPowerCapStore creates a store, loading any previously persisted desired
+// caps from stateFile. An empty stateFile keeps the caps in memory only.
+func newPowerCapStore(stateFile string) *powerCapStore {
+	return &powerCapStore{
+		desired: newMemStateStore(stateFile),
+		drift:   newMemStateStore(""),
+	}
+}
+
+// newSharedPowerCapStore creates a store kept in the shared state store.
+func newSharedPowerCapStore(state *etcdStateStore) *powerCapStore {
+	return &powerCapStore{
+		desired: state.sub("power_caps/"),
+		drift:   state.sub("power_cap_drift/"),
+	}
+}
+
+// record saves the controls successfully set on node as its desired caps.
+// Controls the node does not have are ignored, as they were when set.
+func (s *powerCapStore) record(node *NodeInfo, controls []capmc.PowerCapControl) {
+	if s == nil || len(controls) == 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	ctx := context.Background()
+	caps := make(map[string]int)
+	buf, ok, err := s.desired.get(ctx, node.Hostname)
+	if err == nil && ok {
+		err = json.Unmarshal(buf, &caps)
+	}
+	if err != nil {
+		log.Printf("Warning: desired power caps of %s: %s", node.Hostname, err)
+	}
+
+	var changed bool
+	for _, c := range controls {
+		if _, ok := node.PowerCaps[c.Name]; !ok || c.Val == nil {
+			continue
+		}
+		caps[c.Name] = *c.Val
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	if buf, err = json.Marshal(caps); err == nil {
+		err = s.desired.put(ctx, node.Hostname, buf)
+	}
+	if err != nil {
+		log.Printf("Error: failed to save desired power caps of %s: %s",
+			node.Hostname, err)
+	}
+}
+
+// desiredCaps returns the desired caps by xname.
+func (s *powerCapStore) desiredCaps() (map[string]map[string]int, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	vals, err := s.desired.list(context.Background(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make(map[string]map[string]int, len(vals))
+	for xname, buf := range vals {
+		var caps map[string]int
+		if err := json.Unmarshal(buf, &caps); err != nil {
+			log.Printf("Warning: ignoring desired power caps of %s: %s",
+				xname, err)
+			continue
+		}
+		desired[xname] = caps
+	}
+
+	return desired, nil
+}
+
+// clear forgets the desired caps of xnames, and any drift found on them, so
+// they are no longer reapplied.
+func (s *powerCapStore) clear(ctx context.Context, xnames []string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.desired.remove(ctx, xnames...); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(xnames))
+	for _, xname := range xnames {
+		keys = append(keys, driftXnamePrefix+xname)
+	}
+
+	return s.drift.remove(ctx, keys...)
+}
+
+// setDrift records the drift found on xname at time now.
+func (s *powerCapStore) setDrift(xname string, controls []capmc.PowerCapDriftControl, reapplied bool, ecode int, emsg string, now time.Time) {
+	if s == nil {
+		return
+	}
+
+	ctx := context.Background()
+	key := driftXnamePrefix + xname
+	d := capmc.PowerCapDriftXname{
+		Xname:     xname,
+		FirstSeen: now.Format(time.RFC3339),
+	}
+	buf, ok, err := s.drift.get(ctx, key)
+	if err == nil && ok {
+		err = json.Unmarshal(buf, &d)
+	}
+	if err != nil {
+		log.Printf("Warning: power cap drift of %s: %s", xname, err)
+	}
+
+	d.Controls = controls
+	d.LastSeen = now.Format(time.RFC3339)
+	d.Reapplied = reapplied
+	d.E = ecode
+	d.ErrMsg = emsg
+
+	if buf, err = json.Marshal(d); err == nil {
+		err = s.drift.put(ctx, key, buf)
+	}
+	if err != nil {
+		log.Printf("Error: failed to save power cap drift of %s: %s", xname, err)
+	}
+}
+
+// clearDrift forgets any drift on xname now that it matches its desired caps.
+func (s *powerCapStore) clearDrift(xname string) {
+	if s == nil {
+		return
+	}
+
+	err := s.drift.remove(context.Background(), driftXnamePrefix+xname)
+	if err != nil {
+		log.Printf("Error: failed to clear power cap drift of %s: %s", xname, err)
+	}
+}
+
+// checked records the time of the last reconciliation pass.
+func (s *powerCapStore) checked(now time.Time) {
+	if s == nil {
+		return
+	}
+
+	buf, err := json.Marshal(now)
+	if err == nil {
+		err = s.drift.put(context.Background(), driftLastCheck, buf)
+	}
+	if err != nil {
+		log.Printf("Error: failed to save power cap reconciliation time: %s", err)
+	}
+}
+
+// driftReport returns the time of the last reconciliation pass and the drift
+// it found on xnames, or on all nodes if xnames is empty, sorted by xname.
+func (s *powerCapStore) driftReport(ctx context.Context, xnames []string) (time.Time, []capmc.PowerCapDriftXname, error) {
+	var lastCheck time.Time
+	report := []capmc.PowerCapDriftXname{}
+	if s == nil {
+		return lastCheck, report, nil
+	}
+
+	buf, ok, err := s.drift.get(ctx, driftLastCheck)
+	if err != nil {
+		return lastCheck, report, err
+	}
+	if ok {
+		if err = json.Unmarshal(buf, &lastCheck); err != nil {
+			log.Printf("Warning: ignoring power cap reconciliation time: %s", err)
+		}
+	}
+
+	vals, err := s.drift.list(ctx, driftXnamePrefix)
+	if err != nil {
+		return lastCheck, report, err
+	}
+
+	for key, buf := range vals {
+		var d capmc.PowerCapDriftXname
+		if err := json.Unmarshal(buf, &d); err != nil {
+			log.Printf("Warning: ignoring power cap drift %s: %s", key, err)
+			continue
+		}
+		if len(xnames) == 0 || stringInSlice(d.Xname, xnames) {
+			report = append(report, d)
+		}
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Xname < report[j].Xname
+	})
+
+	return lastCheck, report, nil
+}
+
+// actualPowerCap finds the value of the control name in the power caps read
+// from node. HPE servers report their node control as "Node Power Limit"
+// though it is set as "Node Power Control".
+func actualPowerCap(node *NodeInfo, name string, actual map[string]int) (int, bool) {
+	if val, ok := actual[name]; ok {
+		return val, true
+	}
+
+	if isHpeServer(node) || isHpeApollo6500(node) {
+		val, ok := actual["Node Power Limit"]
+		return val, ok
+	}
+
+	return 0, false
+}
+
+// readPowerCaps reads the power caps of nodes from their BMCs, returning
+// the value of each control by xname and control name, and an error message
+// for each xname whose caps could not be read.
+func (d *CapmcD) readPowerCaps(nodes []*NodeInfo) (map[string]map[string]int, map[string]string) {
+	actual := make(map[string]map[string]int)
+	unread := make(map[string]string)
+	if len(nodes) == 0 {
+		return actual, unread
+	}
+
+	nodes = expandNodeListForControlStruct(nodes)
+	waitNum, waitChan := d.queueBmcCmd(context.Background(), bmcCmd{cmd: bmcCmdGetPowerCap}, nodes)
+	for i := 0; i < waitNum; i++ {
+		result := <-waitChan
+		xname := result.ni.Hostname
+		if result.rc != 0 {
+			log.Printf("Notice: get power cap failed: %s", result.msg)
+			unread[xname] = "Error getting power cap for xname"
+			continue
+		}
+
+		controls, ecode, emsg := d.powerCapControls(context.Background(), result, "xname", false)
+		if ecode != 0 {
+			unread[xname] = emsg
+			continue
+		}
+
+		if actual[xname] == nil {
+			actual[xname] = make(map[string]int)
+		}
+		for _, c := range controls {
+			actual[xname][c.Name] = *c.Val
+		}
+	}
+
+	// A node read through several BMC calls is only usable if all of
+	// them succeeded.
+	for xname := range unread {
+		delete(actual, xname)
+	}
+
+	return actual, unread
+}
+
+// reconcilePowerCaps reads the power caps of every node with desired caps
+// and re-PATCHes any control whose value has drifted.
+func (d *CapmcD) reconcilePowerCaps() {
+	desired, err := d.powerCaps.desiredCaps()
+	if err != nil {
+		log.Printf("Error: power cap reconciliation: %s", err)
+		return
+	}
+	if len(desired) == 0 {
+		d.powerCaps.checked(time.Now())
+		return
+	}
+
+	var xnames []string
+	for xname := range desired {
+		xnames = append(xnames, xname)
+	}
+	sort.Strings(xnames)
+
+	query := HSMQuery{
+		ComponentIDs: xnames,
+		Types:        []string{"node"},
+	}
+	nodes, err := d.GetNodesByXname(query)
+	if err != nil {
+		var compIDError *InvalidCompIDsError
+
+		if !errors.As(err, &compIDError) {
+			log.Printf("Error: power cap reconciliation: %s", err)
+			return
+		}
+		log.Printf("Notice: power cap reconciliation skipping %s", err)
+	}
+
+	// Nodes which aren't ready can't be capped; they will be checked
+	// again once they are.
+	targets := make(map[string]*NodeInfo)
+	var readNodes []*NodeInfo
+	for _, node := range nodes {
+		if !node.Enabled || node.State != string(base.StateReady) {
+			continue
+		}
+		targets[node.Hostname] = node
+		readNodes = append(readNodes, node)
+	}
+
+	actual, unread := d.readPowerCaps(readNodes)
+	for xname, emsg := range unread {
+		log.Printf("Notice: power cap reconciliation: %s: %s", xname, emsg)
+	}
+
+	now := time.Now()
+	drifted := make(map[string][]capmc.PowerCapDriftControl)
+	bmcCmds := make(map[*NodeInfo]bmcCmd)
+	var cmdNodes []*NodeInfo
+	for xname, node := range targets {
+		// Leave any earlier drift report alone until the caps can be read.
+		if _, ok := unread[xname]; ok {
+			continue
+		}
+
+		var (
+			drift    []capmc.PowerCapDriftControl
+			controls []capmc.PowerCapControl
+		)
+		for name, want := range desired[xname] {
+			got, ok := actualPowerCap(node, name, actual[xname])
+			if !ok || got == want {
+				continue
+			}
+			val := want
+			drift = append(drift, capmc.PowerCapDriftControl{
+				Name:    name,
+				Desired: want,
+				Actual:  got,
+			})
+			controls = append(controls,
+				capmc.PowerCapControl{Name: name, Val: &val})
+		}
+
+		if len(drift) == 0 {
+			d.powerCaps.clearDrift(xname)
+			continue
+		}
+
+		sort.Slice(drift, func(i, j int) bool {
+			return drift[i].Name < drift[j].Name
+		})
+
+		cmds, err := d.powerCapSetCmds(node, controls, "xname")
+		if err != nil {
+			log.Printf("Notice: power cap reconciliation: %s: %s", xname, err)
+			d.powerCaps.setDrift(xname, drift, false, 22, err.Error(), now)
+			continue
+		}
+
+		drifted[xname] = drift
+		for n, cmd := range cmds {
+			cmdNodes = append(cmdNodes, n)
+			bmcCmds[n] = cmd
+		}
+	}
+
+	failed := make(map[string]int)
+	if len(bmcCmds) > 0 {
+		waitNum, waitChan := d.queueBmcCmds(context.Background(), bmcCmds, cmdNodes)
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 {
+				log.Printf("Notice: power cap reconciliation: set power cap failed: %s",
+					result.msg)
+				failed[result.ni.Hostname] = result.rc
+			}
+		}
+	}
+
+	var reapplied []string
+	errs := make(map[string]capmc.ErrResponse)
+	for xname, drift := range drifted {
+		reapplied = append(reapplied, xname)
+		if rc, ok := failed[xname]; ok {
+			d.powerCaps.setDrift(xname, drift, false, rc,
+				"Error setting power cap for xname", now)
+			errs[xname] = capmc.ErrResponse{E: rc,
+				ErrMsg: "Error setting power cap for xname"}
+			continue
+		}
+		log.Printf("Info: power cap reconciliation: reapplied power caps %v to %s",
+			drift, xname)
+		d.powerCaps.setDrift(xname, drift, true, 0, "", now)
+	}
+
+	if len(reapplied) > 0 {
+		rec := newSystemAuditRecord(auditReconcileAPI, bmcCmdSetPowerCap,
+			now, time.Now())
+		rec.Reason = "power caps drifted from those set through CAPMC"
+		if len(errs) > 0 {
+			rec.E = 52 // EBADE ?
+			rec.ErrMsg = "Invalid exchange"
+		}
+		sort.Strings(reapplied)
+		rec.Targets = reapplied
+		rec.Xnames = auditResults(reapplied, errs, true)
+		d.audit.record(context.Background(), rec)
+	}
+
+	d.powerCaps.checked(now)
+}
+
+// powerCapReconciler runs reconcilePowerCaps every interval, while this
+// replica is the leader, until ctx is done.
+func (d *CapmcD) powerCapReconciler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if d.leading() {
+				d.reconcilePowerCaps()
+			}
+		}
+	}
+}
+
+// doPowerCapDrift is the HTTP handler for the power_cap_drift API. It
+// reports the power cap drift found by the last reconciliation pass (GET),
+// or forgets the desired caps of nodes so they are no longer reapplied
+// (DELETE). Both are restricted to, and DELETE requires, the nodes given by
+// xname query parameters.
+func (d *CapmcD) doPowerCapDrift(w http.ResponseWriter, r *http.Request) {
+
+	defer base.DrainAndCloseRequestBody(r)
+
+	xnames := stringSliceMap(r.URL.Query()["xname"],
+		xnametypes.NormalizeHMSCompID)
+
+	switch r.Method {
+	case http.MethodGet:
+		var data capmc.PowerCapDriftResponse
+
+		lastCheck, report, err := d.powerCaps.driftReport(r.Context(), xnames)
+		if err != nil {
+			sendJsonError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Failed to read power cap drift: %s", err))
+			return
+		}
+		if !lastCheck.IsZero() {
+			data.LastCheck = lastCheck.Format(time.RFC3339)
+		}
+		data.Xnames = report
+
+		SendResponseJSON(w, http.StatusOK, data)
+	case http.MethodDelete:
+		if len(xnames) == 0 {
+			sendJsonError(w, http.StatusBadRequest,
+				"Bad Request: Required xname list is empty")
+			return
+		}
+
+		start := time.Now()
+		if err := d.powerCaps.clear(r.Context(), xnames); err != nil {
+			sendJsonError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Failed to clear desired power caps: %s", err))
+			return
+		}
+		requestLog(r.Context()).Infof("Cleared desired power caps of %v", xnames)
+
+		// No cap is changed, but they are no longer reapplied.
+		rec := newAuditRecord(r, newOperationID(),
+			auditCmdClearDesiredPowerCap, start, time.Now())
+		rec.Targets = xnames
+		rec.Xnames = auditResults(xnames, nil, true)
+		d.audit.record(r.Context(), rec)
+
+		SendResponseJSON(w, http.StatusOK, capmc.ErrResponse{})
+	default:
+		w.Header().Set("Allow", "GET,DELETE")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+	}
+}
@@ -0,0 +1,380 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestPowerCapStore(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "powercaps.json")
+
+	node := &NodeInfo{
+		Hostname: "x9000c1s2b0n0",
+		PowerCaps: map[string]PowerCap{
+			"Node Power Limit": {Name: "Node Power Limit", Min: 400, Max: 1200},
+		},
+	}
+
+	five, six := 500, 600
+	s := newPowerCapStore(stateFile)
+	s.record(node, []capmc.PowerCapControl{
+		{Name: "Node Power Limit", Val: &five},
+		{Name: "Accelerator0 Power Limit", Val: &six},
+	})
+
+	want := map[string]map[string]int{
+		"x9000c1s2b0n0": {"Node Power Limit": 500},
+	}
+	if got, _ := s.desiredCaps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong desired caps: got %v want %v", got, want)
+	}
+
+	// The desired caps survive a restart.
+	if got, _ := newPowerCapStore(stateFile).desiredCaps(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Wrong persisted caps: got %v want %v", got, want)
+	}
+
+	now := time.Now()
+	drift := []capmc.PowerCapDriftControl{
+		{Name: "Node Power Limit", Desired: 500, Actual: 750},
+	}
+	s.setDrift("x9000c1s2b0n0", drift, true, 0, "", now)
+	s.checked(now)
+
+	ctx := context.Background()
+	lastCheck, report, err := s.driftReport(ctx, []string{"x9000c1s2b0n1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastCheck.Equal(now) {
+		t.Errorf("Wrong last check: got %v want %v", lastCheck, now)
+	}
+	if len(report) != 0 {
+		t.Errorf("Unexpected drift report: %v", report)
+	}
+
+	_, report, _ = s.driftReport(ctx, nil)
+	if len(report) != 1 || !report[0].Reapplied ||
+		!reflect.DeepEqual(report[0].Controls, drift) {
+		t.Errorf("Wrong drift report: %v", report)
+	}
+
+	s.clearDrift("x9000c1s2b0n0")
+	if _, report, _ = s.driftReport(ctx, nil); len(report) != 0 {
+		t.Errorf("Drift not cleared: %v", report)
+	}
+
+	// A nil store does nothing.
+	var ns *powerCapStore
+	ns.record(node, []capmc.PowerCapControl{{Name: "Node Power Limit", Val: &five}})
+	if got, _ := ns.desiredCaps(); got != nil {
+		t.Errorf("Unexpected desired caps from nil store: %v", got)
+	}
+}
+
+func TestReconcilePowerCaps(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+	olympusRF := &rfMock{
+		PowerControl: []clientMock{
+			{
+				Body:       []byte(olympusPowerControl),
+				StatusCode: http.StatusOK,
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		desired     int
+		patchStatus int
+		drift       []capmc.PowerCapDriftXname
+		audited     []capmc.PowerOperationResult
+	}{
+		{
+			name:        "In sync",
+			desired:     750,
+			patchStatus: http.StatusOK,
+			drift:       []capmc.PowerCapDriftXname{},
+		}, {
+			name:        "Reapplied",
+			desired:     500,
+			patchStatus: http.StatusOK,
+			drift: []capmc.PowerCapDriftXname{
+				{
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapDriftControl{
+						{Name: "Node Power Limit", Desired: 500, Actual: 750},
+					},
+					Reapplied: true,
+				},
+			},
+			audited: []capmc.PowerOperationResult{
+				{Xname: "x9000c1s2b0n0", Result: "success"},
+			},
+		}, {
+			name:        "Reapply failed",
+			desired:     500,
+			patchStatus: http.StatusInternalServerError,
+			drift: []capmc.PowerCapDriftXname{
+				{
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapDriftControl{
+						{Name: "Node Power Limit", Desired: 500, Actual: 750},
+					},
+					E:      1,
+					ErrMsg: "Error setting power cap for xname",
+				},
+			},
+			audited: []capmc.PowerOperationResult{
+				{Xname: "x9000c1s2b0n0", Result: "failure", E: 1,
+					ErrMsg: "Error setting power cap for xname"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			get := rfTestMock(olympusRF)
+			patch := rfStatusMock(test.patchStatus)
+			svc := newXnamePowerCapTestSvc(olympusHSM,
+				func(r *http.Request) (*http.Response, error) {
+					if r.Method == http.MethodPatch {
+						return patch(r)
+					}
+					return get(r)
+				})
+			svc.powerCaps = newPowerCapStore("")
+			svc.powerCaps.desired.put(context.Background(), "x9000c1s2b0n0",
+				[]byte(fmt.Sprintf(`{"Node Power Limit": %d}`, test.desired)))
+			svc.audit = newAuditLog(nil, "", 0, 0)
+
+			svc.reconcilePowerCaps()
+
+			lastCheck, report, err := svc.powerCaps.driftReport(context.Background(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lastCheck.IsZero() {
+				t.Errorf("Last check not recorded")
+			}
+
+			// The times and BMC return codes vary.
+			for i := range report {
+				report[i].FirstSeen = ""
+				report[i].LastSeen = ""
+				if report[i].E != 0 {
+					report[i].E = 1
+				}
+			}
+
+			got, _ := json.Marshal(report)
+			want, _ := json.Marshal(test.drift)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Wrong drift report: got %s want %s", got, want)
+			}
+
+			records, _ := svc.audit.query(auditFilter{limit: 10})
+			var audited []capmc.PowerOperationResult
+			if len(records) == 1 && records[0].API == auditReconcileAPI &&
+				records[0].Caller == auditSystemCaller {
+				audited = records[0].Xnames
+				for i := range audited {
+					if audited[i].E != 0 {
+						audited[i].E = 1
+					}
+				}
+			}
+			if len(records) > 1 || !reflect.DeepEqual(audited, test.audited) {
+				t.Errorf("Wrong audit records: got %+v want %+v", records,
+					test.audited)
+			}
+		})
+	}
+}
+
+func TestDoPowerCapDrift(t *testing.T) {
+	now := time.Now()
+	store := newPowerCapStore("")
+	for _, xname := range []string{"x9000c1s2b0n1", "x9000c1s2b0n0"} {
+		store.setDrift(xname, []capmc.PowerCapDriftControl{
+			{Name: "Node Power Limit", Desired: 500, Actual: 750},
+		}, true, 0, "", now)
+	}
+	store.checked(now)
+
+	tests := []struct {
+		name   string
+		method string
+		query  string
+		ret    int
+		xnames []string
+	}{
+		{
+			name:   "Post",
+			method: http.MethodPost,
+			ret:    http.StatusMethodNotAllowed,
+		}, {
+			name:   "All",
+			method: http.MethodGet,
+			ret:    http.StatusOK,
+			xnames: []string{"x9000c1s2b0n0", "x9000c1s2b0n1"},
+		}, {
+			name:   "Filtered",
+			method: http.MethodGet,
+			query:  "?xname=X9000C1S2B0N1&xname=x9000c1s2b0n2",
+			ret:    http.StatusOK,
+			xnames: []string{"x9000c1s2b0n1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := &CapmcD{powerCaps: store}
+
+			req, err := http.NewRequest(test.method,
+				capmc.PowerCapDriftV1+test.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			svc.doPowerCapDrift(w, req)
+
+			if test.ret != w.Code {
+				t.Fatalf("Returned wrong status code: got %v want %v",
+					w.Code, test.ret)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response capmc.PowerCapDriftResponse
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.LastCheck != now.Format(time.RFC3339) {
+				t.Errorf("Returned wrong last check: got %s want %s",
+					response.LastCheck, now.Format(time.RFC3339))
+			}
+
+			var xnames []string
+			for _, x := range response.Xnames {
+				xnames = append(xnames, x.Xname)
+			}
+			if !reflect.DeepEqual(xnames, test.xnames) {
+				t.Errorf("Returned wrong xnames: got %v want %v",
+					xnames, test.xnames)
+			}
+		})
+	}
+}
+
+func TestDoPowerCapDriftDelete(t *testing.T) {
+	node := &NodeInfo{
+		Hostname: "x9000c1s2b0n0",
+		PowerCaps: map[string]PowerCap{
+			"Node Power Limit": {Name: "Node Power Limit", Min: 400, Max: 1200},
+		},
+	}
+
+	five := 500
+	store := newPowerCapStore("")
+	store.record(node, []capmc.PowerCapControl{{Name: "Node Power Limit", Val: &five}})
+	store.setDrift(node.Hostname, []capmc.PowerCapDriftControl{
+		{Name: "Node Power Limit", Desired: 500, Actual: 750},
+	}, true, 0, "", time.Now())
+	svc := &CapmcD{powerCaps: store}
+
+	tests := []struct {
+		name    string
+		query   string
+		ret     int
+		desired int
+	}{
+		{
+			name:    "No xnames",
+			ret:     http.StatusBadRequest,
+			desired: 1,
+		}, {
+			name:    "Other node",
+			query:   "?xname=x9000c1s2b0n1",
+			ret:     http.StatusOK,
+			desired: 1,
+		}, {
+			name:    "Node",
+			query:   "?xname=X9000C1S2B0N0",
+			ret:     http.StatusOK,
+			desired: 0,
+		},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodDelete,
+			capmc.PowerCapDriftV1+test.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		svc.doPowerCapDrift(w, req)
+
+		if test.ret != w.Code {
+			t.Errorf("%s: returned wrong status code: got %v want %v",
+				test.name, w.Code, test.ret)
+		}
+
+		desired, _ := store.desiredCaps()
+		if len(desired) != test.desired {
+			t.Errorf("%s: wrong desired caps: %v", test.name, desired)
+		}
+		_, report, _ := store.driftReport(context.Background(), nil)
+		if len(report) != test.desired {
+			t.Errorf("%s: wrong drift report: %v", test.name, report)
+		}
+	}
+}
@@ -26,6 +26,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -34,6 +35,7 @@ import (
 	"strings"
 	"time"
 
+	base "github.com/Cray-HPE/hms-base/v2"
 	"github.com/Cray-HPE/hms-capmc/internal/capmc"
 
 	rf "github.com/Cray-HPE/hms-smd/v2/pkg/redfish"
@@ -107,7 +109,7 @@ type PCSPowerStatus struct {
 	PowerState                string   `json:"powerState"`
 	ManagementState           string   `json:"managementState"`
 	Error                     string   `json:"error"`
-	SupportedPowerTransitions []string `json:"suportedPowerTransitions"`
+	SupportedPowerTransitions []string `json:"supportedPowerTransitions"`
 	LastUpdated               string   `json:"lastUpdated"`
 }
 
@@ -115,7 +117,37 @@ type PCSStatusGet struct {
 	Status []PCSPowerStatus `json:"status"`
 }
 
-func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameControlResponse {
+// compCtrlOpts carries the optional request parameters for doCompOnOffCtrl.
+type compCtrlOpts struct {
+	// waitMinOff delays, rather than rejects, power on until the NodeRules
+	// MinOffTime has elapsed.
+	waitMinOff bool
+	// deputyKeys are caller supplied HSM reservation deputy keys, keyed by
+	// xname. Components with a key are not reserved by CAPMC.
+	deputyKeys map[string]string
+	// operation identifies the power operation, e.g. as the owner of the
+	// reservations it holds.
+	operation string
+}
+
+// operationContext returns the context to run a power operation requested
+// with context ctx on. It keeps the values of ctx, for logging and tracing,
+// but is only cancelled when the service shuts down, not when the client
+// disconnects, so an operation is never abandoned part way through.
+func (d *CapmcD) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	opCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if d.shutdown == nil {
+		return opCtx, cancel
+	}
+
+	stop := context.AfterFunc(d.shutdown, cancel)
+	return opCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+func (d *CapmcD) doCompOnOffCtrl(ctx context.Context, nl []*NodeInfo, command string, opts compCtrlOpts) capmc.XnameControlResponse {
 	var data capmc.XnameControlResponse
 	data.Xnames = make([]*capmc.XnameControlErr, 0, 1)
 	var failures int
@@ -126,7 +158,7 @@ func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameCont
 		if err != nil {
 			failures++
 			msg := fmt.Sprintf("%s", err)
-			log.Printf("Error: %s.", msg)
+			requestLog(ctx).Errorf("%s.", msg)
 			xnameErr := capmc.MakeXnameError(v.Hostname, -1, msg)
 			data.Xnames = append(data.Xnames, xnameErr)
 			continue
@@ -134,7 +166,7 @@ func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameCont
 		if !supported {
 			// Skip components not in the power action sequencing list.
 			msg := fmt.Sprintf("Skipping %s: Type, '%s', not defined in power sequence for '%s'", v.Hostname, v.Type, command)
-			log.Printf("Info: %s.", msg)
+			requestLog(ctx).Infof("%s.", msg)
 			failures++
 			xnameErr := capmc.MakeXnameError(v.Hostname, -1, msg)
 			data.Xnames = append(data.Xnames, xnameErr)
@@ -150,19 +182,48 @@ func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameCont
 
 		return data
 	}
+	// Operate under any reservations the caller already holds
+	keyErrs, err := d.checkDeputyKeys(ctx, opts.deputyKeys)
+	if err != nil || len(keyErrs) > 0 {
+		errstr := fmt.Sprintf("Failed to validate deputy keys while performing a %s.", command)
+		if err != nil {
+			requestLog(ctx).Errorf("%s %s", errstr, err)
+		}
+		data.Xnames = append(data.Xnames, keyErrs...)
+		data.ErrResponse.E = 37 // ENOLCK
+		data.ErrResponse.ErrMsg = errstr
+		return data
+	}
+
 	// Grab the new list just in case a power off was done on a chassis
 	// or compute module
-	targetedXname, err := d.reserveComponents(targetedXname, command)
+	targetedXname, err = d.reserveComponents(targetedXname, command, opts.deputyKeys)
 	defer d.releaseComponents(targetedXname)
 
 	if err != nil {
-		errstr := fmt.Sprintf("Error: Failed to reserve components while performing a %s.", command)
-		log.Printf("%s", errstr)
+		errstr := fmt.Sprintf("Failed to reserve components while performing a %s.", command)
+		requestLog(ctx).Errorf("%s", errstr)
 		data.ErrResponse.E = 37 // ENOLCK
 		data.ErrResponse.ErrMsg = errstr
 		return data
 	}
 
+	// Watch the reservations CAPMC acquired for the whole operation.
+	// Reservations held by the caller are theirs to keep.
+	var reserved []string
+	for _, x := range targetedXname {
+		if _, ok := opts.deputyKeys[x]; !ok {
+			reserved = append(reserved, x)
+		}
+	}
+	d.resOwners.set(reserved, reservationOwner{
+		operation: opts.operation,
+		command:   command,
+		acquired:  time.Now(),
+	})
+	watcher := d.startReservationWatcher(ctx, reserved)
+	defer watcher.stop()
+
 	// Get lock status information
 	res := d.reservation.Status()
 
@@ -174,12 +235,21 @@ func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameCont
 			Xname:     x,
 			DeputyKey: res[x].DeputyKey,
 		}
+		if key, ok := opts.deputyKeys[x]; ok {
+			comp.DeputyKey = key
+		}
 		tReq.Location = append(tReq.Location, comp)
 	}
 
 	totalWait := len(tReq.Location)
 
-	// If Off or Reinit, call PCS Off
+	backend := d.powerBackend()
+	nodes := make(map[string]*NodeInfo, len(nl))
+	for _, ni := range nl {
+		nodes[ni.Hostname] = ni
+	}
+
+	// If Off or Reinit, power off
 	if command == bmcCmdPowerOff || command == bmcCmdPowerRestart ||
 		command == bmcCmdPowerForceOff || command == bmcCmdPowerForceRestart {
 		tReq.Operation = "off"
@@ -187,16 +257,34 @@ func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameCont
 			tReq.Operation = "force-off"
 		}
 
-		failures, data = powerFunction(tReq, data, d, command, failures)
+		failures, data = backend.Transition(ctx, tReq, nodes, data, command)
+		d.recordTransition(tReq, data)
 	}
 
-	// If On or Reinit, call PCS On
+	// If On or Reinit, power on
 	if (command == bmcCmdPowerOn || command == bmcCmdPowerRestart ||
 		command == bmcCmdPowerForceOn || command == bmcCmdPowerForceRestart) &&
 		data.E == 0 {
 		tReq.Operation = "on"
 
-		failures, data = powerFunction(tReq, data, d, command, failures)
+		// A reinit always waits out MinOffTime between its off and on
+		wait := opts.waitMinOff || command == bmcCmdPowerRestart ||
+			command == bmcCmdPowerForceRestart
+
+		var rejected int
+		tReq.Location, rejected, data = d.enforceMinOffTime(ctx, tReq.Location, data, wait)
+
+		if len(tReq.Location) > 0 {
+			failures, data = backend.Transition(ctx, tReq, nodes, data, command)
+			d.recordTransition(tReq, data)
+		}
+		failures += rejected
+	}
+
+	// Report any reservations that could not be kept for the operation
+	if lostErrs := watcher.stop(); len(lostErrs) > 0 {
+		failures += len(lostErrs)
+		data.Xnames = append(data.Xnames, lostErrs...)
 	}
 
 	if failures > 0 {
@@ -208,7 +296,7 @@ func (d *CapmcD) doCompOnOffCtrl(nl []*NodeInfo, command string) capmc.XnameCont
 	return data
 }
 
-func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *CapmcD, command string, failures int) (int, capmc.XnameControlResponse) {
+func powerFunction(ctx context.Context, tReq PCSTransition, data capmc.XnameControlResponse, d *CapmcD, command string, failures int) (int, capmc.XnameControlResponse) {
 	payload, err := json.Marshal(tReq)
 	if err != nil {
 		errstr := fmt.Sprintf("Error: Failed to marshal power request for PCS.")
@@ -219,7 +307,7 @@ func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *Capmc
 	}
 
 	url := d.pcsURL.String() + "/transitions"
-	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer([]byte(payload)))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer([]byte(payload)))
 	if err != nil {
 		errstr := fmt.Sprintf("Error: Failed to create new request for power operation.")
 		log.Printf("%s", errstr)
@@ -244,9 +332,10 @@ func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *Capmc
 	err = json.Unmarshal(body, &tRsp)
 
 	tID := tRsp.TransitionID
+	addTransitionID(ctx, tID)
 
 	url = d.pcsURL.String() + "/transitions/" + tID
-	httpReq, err = http.NewRequest(http.MethodGet, url, nil)
+	httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		errstr := fmt.Sprintf("Error: Failed to create new request for power operation.")
 		log.Printf("%s", errstr)
@@ -258,7 +347,13 @@ func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *Capmc
 	httpReq.Header.Set("Accept", "application/json")
 
 	// Arbitrary delay of 2 seconds
-	time.Sleep(2 * time.Second)
+	if !sleepCtx(ctx, 2*time.Second) {
+		errstr := fmt.Sprintf("Error: Power operation %s cancelled.", command)
+		log.Printf("%s", errstr)
+		data.ErrResponse.E = 125 // ECANCELED
+		data.ErrResponse.ErrMsg = errstr
+		return 0, data
+	}
 
 	var tGet PCSTransitionGet
 
@@ -288,7 +383,13 @@ func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *Capmc
 			retry = false
 		} else {
 			// Arbitrary delay of 2 seconds
-			time.Sleep(2 * time.Second)
+			if !sleepCtx(ctx, 2*time.Second) {
+				errstr := fmt.Sprintf("Error: Power operation %s cancelled.", command)
+				log.Printf("%s", errstr)
+				data.ErrResponse.E = 125 // ECANCELED
+				data.ErrResponse.ErrMsg = errstr
+				return 0, data
+			}
 		}
 	}
 
@@ -324,7 +425,13 @@ func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *Capmc
 				retry = false
 			} else {
 				// Arbitrary delay of 2 seconds
-				time.Sleep(2 * time.Second)
+				if !sleepCtx(ctx, 2*time.Second) {
+					errstr := fmt.Sprintf("Error: Power operation %s cancelled.", command)
+					log.Printf("%s", errstr)
+					data.ErrResponse.E = 125 // ECANCELED
+					data.ErrResponse.ErrMsg = errstr
+					return 0, data
+				}
 			}
 
 		}
@@ -343,7 +450,69 @@ func powerFunction(tReq PCSTransition, data capmc.XnameControlResponse, d *Capmc
 	return failures, data
 }
 
-func (d *CapmcD) doCompStatus(nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+// sleepCtx pauses for d, returning false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (d *CapmcD) doCompStatus(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+	return d.powerBackend().Status(ctx, nl, command, filter)
+}
+
+// mergeHSMStatus combines the hardware power state in data with the HSM
+// state of the components in nl. Components which are powered on are also
+// reported as ready, standby or halt by their HSM state. data must hold the
+// on and off components whatever the filter; those lists are then emptied if
+// filter doesn't select them. Components whose power state is undefined are
+// always reported.
+func mergeHSMStatus(data *capmc.XnameStatusResponse, nl []*NodeInfo, filter uint) {
+	var flags capmc.XnameStatusFlags
+	nodes := make(map[string]*NodeInfo, len(nl))
+	for _, ni := range nl {
+		nodes[ni.Hostname] = ni
+		addStatusFlags(&flags, ni.Hostname, ni.Flag, ni.Enabled, filter)
+	}
+
+	for _, xname := range data.On {
+		ni, ok := nodes[xname]
+		if !ok {
+			continue
+		}
+		switch ni.State {
+		case string(base.StateReady):
+			if filter&capmc.FilterShowReadyBit != 0 {
+				data.Ready = append(data.Ready, xname)
+			}
+		case string(base.StateStandby):
+			if filter&capmc.FilterShowStandbyBit != 0 {
+				data.Standby = append(data.Standby, xname)
+			}
+		case string(base.StateHalt):
+			if filter&capmc.FilterShowHaltBit != 0 {
+				data.Halt = append(data.Halt, xname)
+			}
+		}
+	}
+
+	if filter&capmc.FilterShowOnBit == 0 {
+		data.On = make([]string, 0, 1)
+	}
+	if filter&capmc.FilterShowOffBit == 0 {
+		data.Off = make([]string, 0, 1)
+	}
+
+	setStatusFlags(data, flags)
+}
+
+// pcsCompStatus gets the power state of the components in nl from PCS.
+func (d *CapmcD) pcsCompStatus(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
 	// The JSON encoder omits empty lists. The Cascade CAPMC API response
 	// contains more lists than this, but at this time these are the only
 	// ones that are reported.
@@ -380,7 +549,10 @@ func (d *CapmcD) doCompStatus(nl []*NodeInfo, command string, filter uint) capmc
 	// And create the request
 
 	url := d.pcsURL.String() + "/power-status"
-	httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer([]byte(postBody)))
+	// ctx carries the trace of the request; the status isn't cancelled
+	// with it.
+	httpReq, err := http.NewRequestWithContext(context.WithoutCancel(ctx),
+		http.MethodPost, url, bytes.NewBuffer([]byte(postBody)))
 	if err != nil {
 		errstr := fmt.Sprintf("Error: Failed to create new request for power operation.")
 		log.Printf("%s", errstr)
@@ -416,6 +588,14 @@ func (d *CapmcD) doCompStatus(nl []*NodeInfo, command string, filter uint) capmc
 
 	var failures int
 	for _, s := range sGet.Status {
+		data.Details = append(data.Details, capmc.XnamePowerStatus{
+			Xname:                     s.Xname,
+			PowerState:                s.PowerState,
+			ManagementState:           s.ManagementState,
+			SupportedPowerTransitions: s.SupportedPowerTransitions,
+			LastUpdated:               s.LastUpdated,
+			Error:                     s.Error,
+		})
 		if s.Error != "" {
 			data.Undefined = append(data.Undefined, s.Xname)
 			failures++
@@ -450,6 +630,9 @@ func (d *CapmcD) doCompStatus(nl []*NodeInfo, command string, filter uint) capmc
 	sort.Sort(xnameSlice{&data.On})
 	sort.Sort(xnameSlice{&data.Off})
 	sort.Sort(xnameSlice{&data.Undefined})
+	sort.Slice(data.Details, func(i, j int) bool {
+		return data.Details[i].Xname < data.Details[j].Xname
+	})
 
 	return data
 }
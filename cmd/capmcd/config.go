@@ -40,6 +40,10 @@ type Config struct {
 	PowerControls map[string]PowerCtl `toml:"PowerControls"`
 	SystemParams  SystemParameters    `toml:"SystemParameters"`
 	CapmcConf     CapmcConfiguration  `toml:"CapmcConfiguration"`
+	PowerProfiles []PowerProfile      `toml:"PowerProfile"`
+	Webhooks      []Webhook           `toml:"Webhook"`
+	AuditSinks    []AuditSink         `toml:"AuditSink"`
+	AuthRoles     []AuthRole          `toml:"AuthRole"`
 }
 
 // PowerCtl holds the list of blocked roles, component sequences, and reset
@@ -55,6 +59,10 @@ var config = Config{
 	defaultPowerControl,
 	defaultSystemParameters,
 	defaultCapmcConfiguration,
+	nil,
+	nil,
+	nil,
+	nil,
 }
 
 const (
@@ -88,9 +96,7 @@ func loadConfigFile(file string, config *Config) bool {
 	undecodedKeys := md.Undecoded()
 	if len(undecodedKeys) > 0 {
 		log.Printf("Info: %s: unexpected configuration keys", file)
-		if svc.debug {
-			log.Printf("DEBUG: Undecoded: keys: %q", undecodedKeys)
-		}
+		log.Printf("DEBUG: Undecoded: keys: %q", undecodedKeys)
 	}
 
 	return true
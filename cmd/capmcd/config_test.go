@@ -56,6 +56,23 @@ func TestLoadConfigFile(t *testing.T) {
 // Yes this is silly as loadConfig can't fail
 func TestLoadConfig(t *testing.T) {
 
+	// Loading a file changes the service configuration, and the default
+	// power controls it starts with, which later tests rely on.
+	saved := config
+	controls := make(map[string]PowerCtl, len(defaultPowerControl))
+	for cmd, pc := range defaultPowerControl {
+		controls[cmd] = pc
+	}
+	defer func() {
+		for cmd := range defaultPowerControl {
+			delete(defaultPowerControl, cmd)
+		}
+		for cmd, pc := range controls {
+			defaultPowerControl[cmd] = pc
+		}
+		config = saved
+	}()
+
 	loadConfig("")
 	loadConfig("no-such-config.toml")
 	loadConfig(configFile)
@@ -25,19 +25,267 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"sync"
+	"time"
 
 	base "github.com/Cray-HPE/hms-base/v2"
 )
 
+// Services watched by the dependency monitor.
+const (
+	depHSM     = "hsm"
+	depPCS     = "pcs"
+	depVault   = "vault"
+	depRedfish = "redfish"
+)
+
+// dependencies lists the watched services in the order they are reported.
+var dependencies = []string{depHSM, depPCS, depVault, depRedfish}
+
+// Dependency states reported by the health API.
+const (
+	depStatusOK      = "ok"
+	depStatusError   = "error"
+	depStatusUnknown = "unknown"
+)
+
+// DependencyHealth is the last known state of a service CAPMC depends on.
+type DependencyHealth struct {
+	Name          string     `json:"name"`
+	Status        string     `json:"status"`
+	LastCheck     *time.Time `json:"last_check,omitempty"`
+	LastSuccess   *time.Time `json:"last_success,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Errors        int        `json:"errors"`
+}
+
+// HealthConfig summarises the configuration of the service.
+type HealthConfig struct {
+	HSMURL              string `json:"hsm_url"`
+	PCSURL              string `json:"pcs_url"`
+	PowerBackend        string `json:"power_backend"`
+	ActionMaxWorkers    int    `json:"action_max_workers"`
+	ReservationsEnabled bool   `json:"reservations_enabled"`
+	SimulationOnly      bool   `json:"simulation_only"`
+	HealthCheckInterval int    `json:"health_check_interval"`
+	Webhooks            int    `json:"webhooks"`
+	AuditSinks          int    `json:"audit_sinks"`
+	TracingEnabled      bool   `json:"tracing_enabled"`
+}
+
+// WorkerPoolHealth reports the use of the worker pool.
+type WorkerPoolHealth struct {
+	Workers   int `json:"workers"`
+	Active    int `json:"active"`
+	Queued    int `json:"queued"`
+	QueueSize int `json:"queue_size"`
+}
+
 // HealthResponse - used to report service health stats
 type HealthResponse struct {
-	Readiness     string `json:"readiness"`
-	Vault         string `json:"vault"`
-	HSMConnection string `json:"hsm"`
+	Readiness     string             `json:"readiness"`
+	Vault         string             `json:"vault"`
+	HSMConnection string             `json:"hsm"`
+	PCSConnection string             `json:"pcs"`
+	Redfish       string             `json:"redfish"`
+	StartTime     time.Time          `json:"start_time"`
+	Uptime        string             `json:"uptime"`
+	UptimeSeconds int64              `json:"uptime_seconds"`
+	Dependencies  []DependencyHealth `json:"dependencies"`
+	Config        HealthConfig       `json:"config"`
+	WorkerPool    WorkerPoolHealth   `json:"worker_pool"`
+}
+
+// DependencyStatus is the status alone of a service CAPMC depends on.
+type DependencyStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// HealthStatus is the health reported to callers without the admin
+// permission, leaving out errors, addresses and configuration.
+type HealthStatus struct {
+	Readiness    string             `json:"readiness"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// dependencyMonitor caches the outcome of the checks of the services CAPMC
+// depends on, so the health API doesn't have to contact them itself.
+type dependencyMonitor struct {
+	mu    sync.Mutex
+	start time.Time
+	deps  map[string]*DependencyHealth
+}
+
+// newDependencyMonitor returns a monitor with every dependency unchecked.
+func newDependencyMonitor() *dependencyMonitor {
+	m := &dependencyMonitor{
+		start: time.Now(),
+		deps:  make(map[string]*DependencyHealth),
+	}
+	for _, name := range dependencies {
+		m.deps[name] = &DependencyHealth{
+			Name:   name,
+			Status: depStatusUnknown,
+		}
+	}
+
+	return m
+}
+
+// success records a successful check of the dependency name.
+func (m *dependencyMonitor) success(name string) {
+	if m == nil {
+		return
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dep := m.deps[name]
+	dep.Status = depStatusOK
+	dep.LastCheck = &now
+	dep.LastSuccess = &now
+}
+
+// failure records a failed check of the dependency name.
+func (m *dependencyMonitor) failure(name string, err error) {
+	if m == nil {
+		return
+	}
+
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dep := m.deps[name]
+	dep.Status = depStatusError
+	dep.LastCheck = &now
+	dep.LastErrorTime = &now
+	dep.LastError = err.Error()
+	dep.Errors++
+}
+
+// ready reports whether the dependency name has been checked successfully
+// since CAPMC started. The Vault connection and the Redfish clients are set
+// up in the background and only recorded as successful once they are, so
+// they may be used once they are ready.
+func (m *dependencyMonitor) ready(name string) bool {
+	if m == nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deps[name].LastSuccess != nil
+}
+
+// list returns the state of each dependency.
+func (m *dependencyMonitor) list() []DependencyHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deps := make([]DependencyHealth, 0, len(dependencies))
+	for _, name := range dependencies {
+		deps = append(deps, *m.deps[name])
+	}
+
+	return deps
+}
+
+// checkDependencies checks HSM and PCS, and Vault once connected, and
+// records the outcome in m. The Vault and Redfish client initialisation
+// report their own failures until they succeed.
+func (d *CapmcD) checkDependencies(ctx context.Context, m *dependencyMonitor) {
+	var hsmR struct {
+		Code    int
+		Message string
+	}
+	err := d.GetFromHSM(ctx, "/service/ready", "", &hsmR)
+	if err == nil && hsmR.Code != 0 {
+		err = fmt.Errorf("HSM not ready: %d, %s", hsmR.Code, hsmR.Message)
+	}
+	if err != nil {
+		m.failure(depHSM, err)
+	} else {
+		m.success(depHSM)
+	}
+
+	if d.pcsURL != nil {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			d.pcsURL.String()+"/readiness", nil)
+		if err == nil {
+			_, err = d.doRequest(req)
+		}
+		if err != nil {
+			m.failure(depPCS, err)
+		} else {
+			m.success(depPCS)
+		}
+	}
+
+	// Listing the credential keys shows Vault answers without reading
+	// every credential.
+	if m.ready(depVault) {
+		start := time.Now()
+		_, err := d.ss.LookupKeys(d.ccs.CCPath)
+		metrics.observeDependency("vault", start, err)
+		if err != nil {
+			m.failure(depVault, err)
+		} else {
+			m.success(depVault)
+		}
+	}
+}
+
+// dependencyChecker checks the dependencies every interval until ctx is
+// cancelled.
+func (d *CapmcD) dependencyChecker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d.checkDependencies(ctx, d.health)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.checkDependencies(ctx, d.health)
+		}
+	}
+}
+
+// workerPoolStats returns the number of jobs waiting in the worker pool
+// queue and the number being run.
+func (d *CapmcD) workerPoolStats() (queued, active int) {
+	if d.WPool == nil {
+		return 0, 0
+	}
+
+	// Idle workers wait in the pool, so the rest are running jobs.
+	return len(d.WPool.JobQueue), len(d.WPool.Workers) - len(d.WPool.Pool)
+}
+
+// describeDependency returns a human-readable description of dep.
+func describeDependency(dep DependencyHealth, service, ok string) string {
+	switch dep.Status {
+	case depStatusOK:
+		return ok
+	case depStatusError:
+		return fmt.Sprintf("%s error: %s", service, dep.LastError)
+	}
+
+	return fmt.Sprintf("%s not checked yet", service)
 }
 
 // doHealth - returns useful information about the service to the user
@@ -57,67 +305,108 @@ func (d *CapmcD) doHealth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// NOTE: this is a very rough first version.  It just does a quick check
-	//  of the dependent services.  It is possible to add a lot more information
-	//  here including:
-	//  1) Regular polling of dependents with 'last known connection' time/date
-	//  2) Log real usage stats and just report here
-	//  3) Service uptime, usage stats
-	//  4) Add config information to the health report???
+	// Report what the dependency monitor last saw. Without one, check
+	// the dependencies now.
+	m := d.health
+	if m == nil {
+		m = newDependencyMonitor()
+		d.checkDependencies(r.Context(), m)
+	}
 
-	// collect health information
-	var stats HealthResponse
+	now := time.Now()
+	stats := HealthResponse{
+		StartTime:     m.start,
+		Uptime:        now.Sub(m.start).Round(time.Second).String(),
+		UptimeSeconds: int64(now.Sub(m.start).Seconds()),
+		Dependencies:  m.list(),
+	}
 
-	// d.ss / d.css - vault connection
-	numDep := 0
-	if d.ss == nil || d.ccs == nil {
-		stats.Vault = "No connection established to vault"
-	} else {
-		// now test that the connection does something
-		creds, cerr := d.ccs.GetAllCompCreds()
-		if cerr != nil {
-			stats.Vault = fmt.Sprintf("Error retrieving credentials:%s", cerr.Error())
-		} else {
-			stats.Vault = fmt.Sprintf("Vault connection established with %d credentials loaded", len(creds))
-			numDep++
+	// Count the dependencies in use which are working. PCS isn't needed
+	// when going to the BMCs directly.
+	var numDep, numUsed int
+	for _, dep := range stats.Dependencies {
+		switch dep.Name {
+		case depHSM:
+			stats.HSMConnection = describeDependency(dep, "HSM", "HSM Ready")
+		case depPCS:
+			stats.PCSConnection = describeDependency(dep, "PCS", "PCS Ready")
+			if d.pcsURL == nil {
+				stats.PCSConnection = "PCS not configured"
+				continue
+			}
+			if d.config != nil && d.config.CapmcConf.PowerBackend == backendRedfish {
+				continue
+			}
+		case depVault:
+			stats.Vault = describeDependency(dep, "Vault",
+				"Vault connection established")
+			if dep.Status == depStatusUnknown {
+				stats.Vault = "No connection established to vault"
+			}
+		case depRedfish:
+			stats.Redfish = describeDependency(dep, "Redfish",
+				"Redfish HTTP clients ready")
 		}
-	}
 
-	// d.svc.hsmURL - is there another connection mechanism?
-	var hsmR struct {
-		Code    int
-		Message string
-	}
-	err := d.GetFromHSM("/service/ready", "", &hsmR)
-	if err != nil {
-		log.Printf("Health hsm query error:%s", err.Error())
-		stats.HSMConnection = "HSM queries result in error"
-	} else if hsmR.Code != 0 {
-		log.Printf("Health hsm query return: %d, %s", hsmR.Code, hsmR.Message)
-		stats.HSMConnection = "HSM not ready"
-	} else {
-		stats.HSMConnection = "HSM Ready"
-		numDep++
+		numUsed++
+		if dep.Status == depStatusOK {
+			numDep++
+		}
 	}
 
 	// Look at the overall readiness of the service.  If all dependencies are
 	// good, call it 'Ready', if some are OK and others not, call it
 	// 'Degraded', and if none are ok reply 'Not Ready'
-	const (
-		DependenciesAll  = 2
-		DependenciesNone = 0
-	)
-	if numDep == DependenciesAll {
+	if numDep == numUsed {
 		stats.Readiness = "Ready"
-	} else if numDep > DependenciesNone {
+	} else if numDep > 0 {
 		stats.Readiness = "Service Degraded"
 	} else {
 		stats.Readiness = "Not Ready"
 	}
 
+	// The health API is public, but errors, addresses and configuration
+	// are for administrators only.
+	if p := principalFrom(r.Context()); d.auth != nil && (p == nil || !p.allows(permAdmin)) {
+		status := HealthStatus{
+			Readiness:    stats.Readiness,
+			Dependencies: make([]DependencyStatus, 0, len(stats.Dependencies)),
+		}
+		for _, dep := range stats.Dependencies {
+			status.Dependencies = append(status.Dependencies,
+				DependencyStatus{Name: dep.Name, Status: dep.Status})
+		}
+		SendResponseJSON(w, http.StatusOK, status)
+		return
+	}
+
+	if d.hsmURL != nil {
+		stats.Config.HSMURL = d.hsmURL.String()
+	}
+	if d.pcsURL != nil {
+		stats.Config.PCSURL = d.pcsURL.String()
+	}
+	if d.config != nil {
+		conf := d.config.CapmcConf
+		stats.Config.PowerBackend = conf.PowerBackend
+		stats.Config.ActionMaxWorkers = conf.ActionMaxWorkers
+		stats.Config.HealthCheckInterval = conf.HealthCheckInterval
+		stats.Config.Webhooks = len(d.config.Webhooks)
+		stats.Config.AuditSinks = len(d.config.AuditSinks)
+	}
+	stats.Config.ReservationsEnabled = d.reservationsEnabled
+	stats.Config.SimulationOnly = d.simulationOnly
+	stats.Config.TracingEnabled = tracing != nil
+
+	if d.WPool != nil {
+		stats.WorkerPool.Workers = len(d.WPool.Workers)
+		stats.WorkerPool.QueueSize = cap(d.WPool.JobQueue)
+	}
+	stats.WorkerPool.Queued, stats.WorkerPool.Active = d.workerPoolStats()
+
 	// write the output
-	w.WriteHeader(http.StatusOK)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(stats)
 	return
 }
@@ -141,9 +430,19 @@ func (d *CapmcD) doReadiness(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// NOTE: at this time there are no dependent connections that would
-	//  benefit from a restart, so always return good.  There is no concept
-	//  of degraded but still partly functional at this point.
+	// No power operation can be carried out until the BMC credentials
+	// can be read from Vault and the Redfish clients exist, as their
+	// initialisation records in the dependency monitor.
+	var err error
+	if !d.health.ready(depVault) {
+		err = errors.New("No connection established to vault")
+	} else if !d.health.ready(depRedfish) {
+		err = errors.New("Redfish HTTP clients not initialised")
+	}
+	if err != nil {
+		sendJsonError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 	return
@@ -26,6 +26,8 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -123,6 +125,9 @@ func TestCapmcdReadiness(t *testing.T) {
 	tSvc.ss = ss
 	tSvc.ccs = ccs
 	adapter.LookupData = ssDataLiveness
+	tSvc.health = newDependencyMonitor()
+	tSvc.health.success(depVault)
+	tSvc.health.success(depRedfish)
 
 	// set up liveness request
 	handler := http.HandlerFunc(tSvc.doReadiness)
@@ -238,6 +243,253 @@ func TestCapmcdHealth(t *testing.T) {
 	}
 }
 
+func TestCapmcdReadinessUnavailable(t *testing.T) {
+	tests := []struct {
+		name       string
+		vault      bool
+		rf         bool
+		vaultError bool
+		rc         int
+	}{
+		{
+			"Ready",
+			true,
+			true,
+			false,
+			http.StatusNoContent,
+		},
+		{
+			"Vault failing once connected",
+			true,
+			true,
+			true,
+			http.StatusNoContent,
+		},
+		{
+			"No Vault connection",
+			false,
+			true,
+			true,
+			http.StatusServiceUnavailable,
+		},
+		{
+			"No Redfish clients",
+			true,
+			false,
+			false,
+			http.StatusServiceUnavailable,
+		},
+		{
+			"Nothing initialised",
+			false,
+			false,
+			false,
+			http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tSvc CapmcD
+			tSvc.health = newDependencyMonitor()
+			if tt.vault {
+				tSvc.health.success(depVault)
+			}
+			if tt.vaultError {
+				tSvc.health.failure(depVault, errors.New("connection refused"))
+			}
+			if tt.rf {
+				tSvc.health.success(depRedfish)
+			}
+
+			req, err := http.NewRequest(http.MethodGet, capmc.ReadinessV1, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(tSvc.doReadiness).ServeHTTP(rr, req)
+			if tt.rc != rr.Code {
+				t.Errorf("Expected return code: %d, got: %d", tt.rc, rr.Code)
+			}
+		})
+	}
+}
+
+func TestDependencyMonitor(t *testing.T) {
+	m := newDependencyMonitor()
+
+	deps := m.list()
+	if len(deps) != len(dependencies) {
+		t.Fatalf("Expected %d dependencies, got %d", len(dependencies), len(deps))
+	}
+	for _, dep := range deps {
+		if dep.Status != depStatusUnknown || dep.LastCheck != nil {
+			t.Errorf("Expected %s to be unchecked, got %+v", dep.Name, dep)
+		}
+	}
+
+	m.failure(depHSM, errors.New("connection refused"))
+	m.failure(depHSM, errors.New("timeout"))
+	m.success(depVault)
+	m.success(depHSM)
+	m.failure(depPCS, errors.New("503"))
+
+	tests := []struct {
+		name    string
+		status  string
+		lastErr string
+		errors  int
+		success bool
+	}{
+		{depHSM, depStatusOK, "timeout", 2, true},
+		{depPCS, depStatusError, "503", 1, false},
+		{depVault, depStatusOK, "", 0, true},
+		{depRedfish, depStatusUnknown, "", 0, false},
+	}
+
+	for i, dep := range m.list() {
+		tt := tests[i]
+		if dep.Name != tt.name {
+			t.Errorf("Expected dependency %d to be %s, got %s", i, tt.name, dep.Name)
+		}
+		if dep.Status != tt.status {
+			t.Errorf("%s: expected status %s, got %s", tt.name, tt.status, dep.Status)
+		}
+		if dep.LastError != tt.lastErr {
+			t.Errorf("%s: expected last error %q, got %q", tt.name, tt.lastErr, dep.LastError)
+		}
+		if dep.Errors != tt.errors {
+			t.Errorf("%s: expected %d errors, got %d", tt.name, tt.errors, dep.Errors)
+		}
+		if (dep.LastSuccess != nil) != tt.success {
+			t.Errorf("%s: expected last success %t, got %v", tt.name, tt.success, dep.LastSuccess)
+		}
+	}
+
+	if !m.ready(depHSM) || m.ready(depPCS) || m.ready(depRedfish) {
+		t.Errorf("Expected only HSM and Vault to be ready")
+	}
+
+	// A nil monitor ignores checks.
+	var nm *dependencyMonitor
+	nm.success(depHSM)
+	nm.failure(depHSM, errors.New("ignored"))
+	if nm.ready(depHSM) {
+		t.Errorf("Expected a nil monitor not to be ready")
+	}
+}
+
+func TestCapmcdHealthReport(t *testing.T) {
+	var tSvc CapmcD
+	var err error
+	tSvc.hsmURL, err = url.Parse("http://localhost:27779/hsm/v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tSvc.pcsURL, err = url.Parse("http://localhost:28007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every request fails, so the report must come from the monitor.
+	tSvc.smClient = NewTestClient(func(req *http.Request) (*http.Response, error) {
+		t.Errorf("Unexpected request %s %s", req.Method, req.URL)
+		return nil, errors.New("unexpected request")
+	})
+	tSvc.rfClient = tSvc.smClient
+	tSvc.config = loadConfig("")
+	ss, _ := sstorage.NewMockAdapter()
+	tSvc.ss = ss
+	tSvc.ccs = compcreds.NewCompCredStore("secret/hms-cred", ss)
+
+	tSvc.health = newDependencyMonitor()
+	tSvc.health.success(depHSM)
+	tSvc.health.success(depPCS)
+	tSvc.health.failure(depVault, errors.New("permission denied"))
+	tSvc.health.success(depRedfish)
+
+	req, err := http.NewRequest(http.MethodGet, capmc.HealthV1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(tSvc.doHealth).ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected return code: %d, got: %d", http.StatusOK, rr.Code)
+	}
+
+	var stats HealthResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Readiness != "Service Degraded" {
+		t.Errorf("Expected readiness Service Degraded, got %s", stats.Readiness)
+	}
+	if stats.HSMConnection != "HSM Ready" {
+		t.Errorf("Expected HSM Ready, got %s", stats.HSMConnection)
+	}
+	if stats.Vault != "Vault error: permission denied" {
+		t.Errorf("Expected Vault error, got %s", stats.Vault)
+	}
+	if len(stats.Dependencies) != len(dependencies) {
+		t.Errorf("Expected %d dependencies, got %d", len(dependencies), len(stats.Dependencies))
+	}
+	if stats.Config.HSMURL != tSvc.hsmURL.String() {
+		t.Errorf("Expected HSM URL %s, got %s", tSvc.hsmURL, stats.Config.HSMURL)
+	}
+	if stats.Config.HealthCheckInterval != defaultHealthCheckInterval {
+		t.Errorf("Expected health check interval %d, got %d",
+			defaultHealthCheckInterval, stats.Config.HealthCheckInterval)
+	}
+	if stats.StartTime.IsZero() || stats.Uptime == "" {
+		t.Errorf("Expected start time and uptime, got %v and %q",
+			stats.StartTime, stats.Uptime)
+	}
+
+	// With authentication on, only administrators get the details.
+	tSvc.auth = &authenticator{}
+	for _, tt := range []struct {
+		name    string
+		p       *principal
+		details bool
+	}{
+		{"Anonymous", nil, false},
+		{"Operator", &principal{subject: "bob",
+			perms: map[permission]bool{permStatus: true}}, false},
+		{"Administrator", &principal{subject: "alice",
+			perms: map[permission]bool{permAdmin: true}}, true},
+	} {
+		req, err := http.NewRequest(http.MethodGet, capmc.HealthV1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.p != nil {
+			req = req.WithContext(withPrincipal(req.Context(), tt.p))
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(tSvc.doHealth).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s: Expected return code: %d, got: %d", tt.name,
+				http.StatusOK, rr.Code)
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(rr.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["config"]; ok != tt.details {
+			t.Errorf("%s: Expected details %t, got %s", tt.name, tt.details,
+				rr.Body.String())
+		}
+		if bytes.Contains(rr.Body.Bytes(), []byte("permission denied")) != tt.details {
+			t.Errorf("%s: Wrong dependency errors: %s", tt.name, rr.Body.String())
+		}
+		if string(fields["readiness"]) != `"Service Degraded"` {
+			t.Errorf("%s: Wrong readiness %s", tt.name, fields["readiness"])
+		}
+	}
+}
+
 // hsmHealthSynthTestFunc - provides simplest implementation of synthetic state manager
 func hsmHealthSynthTestFunc() RoundTripFunc {
 	return func(req *http.Request) (*http.Response, error) {
@@ -0,0 +1,528 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// defaultOperationsLimit is the most operations the operations API returns
+// when the caller doesn't give a limit.
+const defaultOperationsLimit = 100
+
+// operationHistory keeps the history of the xname power operations for the
+// operations API, for a retention period and up to a maximum number of
+// operations. With a shared state store the history is kept there, so each
+// replica returns the operations run by all of them. Otherwise it is kept in
+// memory, and when a history file is configured each operation is appended
+// to it as it finishes, and the file is rewritten without the operations
+// which have been dropped once they make up half of it.
+type operationHistory struct {
+	sync.Mutex
+	ops       []capmc.Operation // oldest first
+	file      string
+	retention time.Duration
+	maxOps    int
+	// stale counts the lines of the file holding dropped operations.
+	stale int
+	// store is the shared state store, keyed by operationKey.
+	store stateStore
+}
+
+// newOperationHistory creates a history, loading the operations kept in
+// file. An empty file keeps the history in memory only.
+func newOperationHistory(file string, retention time.Duration, maxOps int) *operationHistory {
+	h := &operationHistory{
+		file:      file,
+		retention: retention,
+		maxOps:    maxOps,
+	}
+
+	if file == "" {
+		return h
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: %s: %s", file, err)
+		}
+		return h
+	}
+	defer f.Close()
+
+	// Lines which aren't operations, such as one cut short by a crash,
+	// are dropped when the file is next rewritten.
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var op capmc.Operation
+		if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+			h.stale++
+			continue
+		}
+		h.ops = append(h.ops, op)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Warning: %s: ignoring the rest of the operation history: %s",
+			file, err)
+	}
+
+	h.prune(time.Now())
+	if h.stale > 0 {
+		h.compact()
+	}
+
+	return h
+}
+
+// newSharedOperationHistory creates a history kept in the shared state
+// store.
+func newSharedOperationHistory(state *etcdStateStore, retention time.Duration, maxOps int) *operationHistory {
+	return &operationHistory{
+		retention: retention,
+		maxOps:    maxOps,
+		store:     state.sub("operations/"),
+	}
+}
+
+// operationKey is the state store key of the operation with ID id which
+// ended at end. The keys sort in the order the operations ended.
+func operationKey(end time.Time, id string) string {
+	return fmt.Sprintf("%020d-%s", end.UnixNano(), id)
+}
+
+// record adds op to the history.
+func (h *operationHistory) record(op capmc.Operation) {
+	if h == nil {
+		return
+	}
+	if h.store != nil {
+		h.recordShared(context.Background(), op)
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.ops = append(h.ops, op)
+	h.prune(time.Now())
+	if h.file == "" {
+		return
+	}
+
+	if h.stale > 0 && h.stale >= len(h.ops) {
+		h.compact()
+	} else {
+		h.append(op)
+	}
+}
+
+// prune drops the operations which ended before the retention period or
+// are over the maximum number kept. The caller must hold the lock.
+func (h *operationHistory) prune(now time.Time) {
+	drop := 0
+	if h.maxOps > 0 && len(h.ops) > h.maxOps {
+		drop = len(h.ops) - h.maxOps
+	}
+	if h.retention > 0 {
+		cutoff := now.Add(-h.retention)
+		for drop < len(h.ops) {
+			end, err := time.Parse(time.RFC3339, h.ops[drop].EndTime)
+			if err == nil && !end.Before(cutoff) {
+				break
+			}
+			drop++
+		}
+	}
+
+	if drop > 0 {
+		h.ops = append([]capmc.Operation(nil), h.ops[drop:]...)
+		h.stale += drop
+	}
+}
+
+// recordShared adds op to the shared history, dropping the operations
+// which ended before the retention period or are over the maximum number
+// kept.
+func (h *operationHistory) recordShared(ctx context.Context, op capmc.Operation) {
+	buf, err := json.Marshal(op)
+	if err != nil {
+		log.Printf("Error: failed to marshal operation %s: %s", op.ID, err)
+		return
+	}
+	end, err := time.Parse(time.RFC3339, op.EndTime)
+	if err != nil {
+		log.Printf("Error: operation %s: %s", op.ID, err)
+		return
+	}
+	if err = h.store.put(ctx, operationKey(end, op.ID), buf); err != nil {
+		log.Printf("Error: failed to record operation %s: %s", op.ID, err)
+		return
+	}
+
+	keys, err := h.store.keys(ctx, "")
+	if err != nil {
+		log.Printf("Error: failed to prune the operation history: %s", err)
+		return
+	}
+	drop := 0
+	if h.maxOps > 0 && len(keys) > h.maxOps {
+		drop = len(keys) - h.maxOps
+	}
+	if h.retention > 0 {
+		cutoff := operationKey(time.Now().Add(-h.retention), "")
+		for drop < len(keys) && keys[drop] < cutoff {
+			drop++
+		}
+	}
+	if drop == 0 {
+		return
+	}
+	if err = h.store.remove(ctx, keys[:drop]...); err != nil {
+		log.Printf("Error: failed to prune the operation history: %s", err)
+	}
+}
+
+// append appends op to the history file. The caller must hold the lock.
+func (h *operationHistory) append(op capmc.Operation) {
+	buf, err := json.Marshal(op)
+	if err != nil {
+		log.Printf("Error: failed to marshal operation %s: %s", op.ID, err)
+		return
+	}
+
+	f, err := os.OpenFile(h.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Printf("Error: %s: %s", h.file, err)
+		return
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(buf, '\n')); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		log.Printf("Error: %s: %s", h.file, err)
+	}
+}
+
+// compact rewrites the history file with only the operations kept. The
+// caller must hold the lock.
+func (h *operationHistory) compact() {
+	var buf []byte
+	for _, op := range h.ops {
+		line, err := json.Marshal(op)
+		if err != nil {
+			log.Printf("Error: failed to marshal operation %s: %s", op.ID, err)
+			continue
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a
+	// partially written history behind.
+	tmp := filepath.Join(filepath.Dir(h.file), "."+filepath.Base(h.file)+".tmp")
+	if err := os.WriteFile(tmp, buf, 0644); err != nil {
+		log.Printf("Error: %s: %s", tmp, err)
+		return
+	}
+	if err := os.Rename(tmp, h.file); err != nil {
+		log.Printf("Error: %s: %s", h.file, err)
+		return
+	}
+	h.stale = 0
+}
+
+// query returns the most recent operations matching f, oldest first.
+func (h *operationHistory) query(ctx context.Context, f operationFilter) ([]capmc.Operation, error) {
+	ops := []capmc.Operation{}
+	if h == nil {
+		return ops, nil
+	}
+	if h.store != nil {
+		return h.queryShared(ctx, f)
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.prune(time.Now())
+	for i := len(h.ops) - 1; i >= 0 && len(ops) < f.limit; i-- {
+		if f.match(&h.ops[i]) {
+			ops = append(ops, h.ops[i])
+		}
+	}
+	reverseOperations(ops)
+
+	return ops, nil
+}
+
+// queryShared returns the most recent operations of the shared history
+// matching f, oldest first. Operations which ended before the retention
+// period are left for the next record to drop.
+func (h *operationHistory) queryShared(ctx context.Context, f operationFilter) ([]capmc.Operation, error) {
+	vals, err := h.store.list(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(vals))
+	for key := range vals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var cutoff string
+	if h.retention > 0 {
+		cutoff = operationKey(time.Now().Add(-h.retention), "")
+	}
+
+	ops := []capmc.Operation{}
+	for i := len(keys) - 1; i >= 0 && len(ops) < f.limit; i-- {
+		if keys[i] < cutoff {
+			break
+		}
+
+		var op capmc.Operation
+		if err := json.Unmarshal(vals[keys[i]], &op); err != nil {
+			log.Printf("Warning: ignoring operation %s: %s", keys[i], err)
+			continue
+		}
+		if f.match(&op) {
+			ops = append(ops, op)
+		}
+	}
+	reverseOperations(ops)
+
+	return ops, nil
+}
+
+// reverseOperations reverses ops in place.
+func reverseOperations(ops []capmc.Operation) {
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+}
+
+// operationFilter selects the operations returned by the operations API.
+type operationFilter struct {
+	xnames  []string
+	command string
+	outcome string
+	start   time.Time
+	end     time.Time
+	limit   int
+}
+
+// parseOperationFilter parses the query parameters of the operations API.
+func parseOperationFilter(params url.Values) (operationFilter, error) {
+	f := operationFilter{
+		xnames: stringSliceMap(splitQueryList(params["xname"]),
+			xnametypes.NormalizeHMSCompID),
+		command: params.Get("command"),
+		outcome: params.Get("outcome"),
+		limit:   defaultOperationsLimit,
+	}
+
+	switch f.outcome {
+	case "", "success", "failure":
+	default:
+		return f, fmt.Errorf("invalid outcome '%s'", f.outcome)
+	}
+
+	var err error
+	if f.start, err = parseQueryTime(params, "start_time"); err != nil {
+		return f, err
+	}
+	if f.end, err = parseQueryTime(params, "end_time"); err != nil {
+		return f, err
+	}
+	if s := params.Get("limit"); s != "" {
+		if f.limit, err = strconv.Atoi(s); err != nil || f.limit <= 0 {
+			return f, fmt.Errorf("invalid limit '%s'", s)
+		}
+	}
+
+	return f, nil
+}
+
+// parseQueryTime parses the RFC 3339 time given by the query parameter
+// name, returning the zero time if it isn't given.
+func parseQueryTime(params url.Values, name string) (time.Time, error) {
+	s := params.Get(name)
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid %s '%s'", name, s)
+	}
+
+	return t, nil
+}
+
+// match checks op ran command, when given, and started within the time
+// range. With xnames, op must have operated on one of them, and with an
+// outcome, that must be the outcome for one of them, or for one of the
+// components op operated on without xnames.
+func (f operationFilter) match(op *capmc.Operation) bool {
+	if f.command != "" && !strings.EqualFold(op.Command, f.command) {
+		return false
+	}
+
+	if !f.start.IsZero() || !f.end.IsZero() {
+		start, err := time.Parse(time.RFC3339, op.StartTime)
+		if err != nil || (!f.start.IsZero() && start.Before(f.start)) ||
+			(!f.end.IsZero() && start.After(f.end)) {
+			return false
+		}
+	}
+
+	if len(f.xnames) == 0 && f.outcome == "" {
+		return true
+	}
+	for _, result := range op.Xnames {
+		if (len(f.xnames) == 0 || stringInSlice(result.Xname, f.xnames)) &&
+			(f.outcome == "" || result.Result == f.outcome) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type transitionIDsKey struct{}
+
+// transitionIDs collects the IDs of the PCS transitions made for an
+// operation.
+type transitionIDs struct {
+	sync.Mutex
+	ids []string
+}
+
+// withTransitionIDs returns a copy of ctx collecting the IDs of the PCS
+// transitions made with it.
+func withTransitionIDs(ctx context.Context) (context.Context, *transitionIDs) {
+	t := &transitionIDs{}
+
+	return context.WithValue(ctx, transitionIDsKey{}, t), t
+}
+
+// addTransitionID adds id to the transition IDs collected by ctx, if any.
+func addTransitionID(ctx context.Context, id string) {
+	t, ok := ctx.Value(transitionIDsKey{}).(*transitionIDs)
+	if !ok || id == "" {
+		return
+	}
+
+	t.Lock()
+	t.ids = append(t.ids, id)
+	t.Unlock()
+}
+
+// list returns the IDs collected.
+func (t *transitionIDs) list() []string {
+	t.Lock()
+	defer t.Unlock()
+
+	return append([]string(nil), t.ids...)
+}
+
+// newOperation creates the history of the operation with ID id, which ran
+// command between start and end for the request args, operating on the
+// components nl with the outcome given by event.
+func newOperation(id, command, requester string, args capmc.XnameControl, start, end time.Time, nl []*NodeInfo, transitions []string, event capmc.PowerOperationEvent) capmc.Operation {
+	// Deputy keys let their holder operate on reserved components, and
+	// callback URLs may hold credentials; neither is kept.
+	args.DeputyKeys = nil
+	args.CallbackURL = ""
+
+	op := capmc.Operation{
+		ErrResponse:   event.ErrResponse,
+		ID:            id,
+		Command:       command,
+		Requester:     requester,
+		Request:       args,
+		Targets:       []string{},
+		TransitionIDs: transitions,
+		StartTime:     start.UTC().Format(time.RFC3339),
+		EndTime:       end.UTC().Format(time.RFC3339),
+		Xnames:        event.Xnames,
+	}
+	for _, ni := range nl {
+		op.Targets = append(op.Targets, ni.Hostname)
+	}
+
+	return op
+}
+
+// doOperations is the HTTP handler for the operations API. It returns the
+// history of the xname power operations matching the query parameters
+// xname, command, outcome, start_time and end_time, up to limit of the
+// most recent.
+func (d *CapmcD) doOperations(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	f, err := parseOperationFilter(r.URL.Query())
+	if err != nil {
+		sendJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ops, err := d.history.query(r.Context(), f)
+	if err != nil {
+		sendJsonError(w, http.StatusInternalServerError,
+			fmt.Sprintf("Failed to read the operation history: %s", err))
+		return
+	}
+
+	SendResponseJSON(w, http.StatusOK,
+		capmc.OperationsResponse{Operations: ops})
+}
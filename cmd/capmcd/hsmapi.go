@@ -24,6 +24,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,6 +34,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	base "github.com/Cray-HPE/hms-base/v2"
 	"github.com/Cray-HPE/hms-capmc/internal/capmc"
@@ -51,6 +53,18 @@ type HSMQuery struct {
 	States       []string
 	Types        []string
 	Enabled      []bool
+	// ctx is the context of the request the query is made for, which
+	// carries its trace to HSM and Vault.
+	ctx context.Context
+}
+
+// Context returns the context of the request the query is made for.
+func (q HSMQuery) Context() context.Context {
+	if q.ctx == nil {
+		return context.Background()
+	}
+
+	return q.ctx
 }
 
 type InvalidCompIDsError struct {
@@ -81,12 +95,15 @@ func (e *InvalidNIDsError) Error() string {
 }
 
 // GetFromHSM makes a request to the Hardware State Manager and unpacks the results.
-func (d *CapmcD) GetFromHSM(path, restrict string, v interface{}) error {
+func (d *CapmcD) GetFromHSM(ctx context.Context, path, restrict string, v interface{}) error {
 	URI := d.hsmURL.String() + path
 	if restrict != "" {
 		URI += "?" + restrict
 	}
-	req, err := http.NewRequest(http.MethodGet, URI, nil)
+	// ctx carries the trace of the request; HSM calls aren't cancelled
+	// with it.
+	req, err := http.NewRequestWithContext(context.WithoutCancel(ctx),
+		http.MethodGet, URI, nil)
 	if err != nil {
 		return err
 	}
@@ -107,53 +124,53 @@ func (d *CapmcD) GetFromHSM(path, restrict string, v interface{}) error {
 }
 
 // GetComponents retrieves Components from the Hardware State Manager.
-func (d *CapmcD) GetComponents(restrict string) ([]*base.Component, error) {
+func (d *CapmcD) GetComponents(ctx context.Context, restrict string) ([]*base.Component, error) {
 	var components base.ComponentArray
-	err := d.GetFromHSM("/State/Components", restrict, &components)
+	err := d.GetFromHSM(ctx, "/State/Components", restrict, &components)
 	return components.Components, err
 }
 
 // GetComponentEndpoints retrieves ComponentEndpoints from the Hardware State
 // Manager.
-func (d *CapmcD) GetComponentEndpoints(restrict string) ([]*sm.ComponentEndpoint, error) {
+func (d *CapmcD) GetComponentEndpoints(ctx context.Context, restrict string) ([]*sm.ComponentEndpoint, error) {
 	var componentEndpoints sm.ComponentEndpointArray
-	err := d.GetFromHSM("/Inventory/ComponentEndpoints", restrict, &componentEndpoints)
+	err := d.GetFromHSM(ctx, "/Inventory/ComponentEndpoints", restrict, &componentEndpoints)
 	return componentEndpoints.ComponentEndpoints, err
 }
 
 // GetRedfishEndpoints retrieves RedfishEndpoints from the
 // Hardware State Manager.
-func (d *CapmcD) GetRedfishEndpoints(restrict string) ([]*sm.RedfishEndpoint, error) {
+func (d *CapmcD) GetRedfishEndpoints(ctx context.Context, restrict string) ([]*sm.RedfishEndpoint, error) {
 	var redfishEndpoints sm.RedfishEndpointArray
-	err := d.GetFromHSM("/Inventory/RedfishEndpoints", restrict, &redfishEndpoints)
+	err := d.GetFromHSM(ctx, "/Inventory/RedfishEndpoints", restrict, &redfishEndpoints)
 	return redfishEndpoints.RedfishEndpoints, err
 }
 
 // GetGroups retrieves a the requested group info from the Hardware State Manager.
-func (d *CapmcD) GetGroups(groups []string) ([]sm.Group, error) {
+func (d *CapmcD) GetGroups(ctx context.Context, groups []string) ([]sm.Group, error) {
 	var resp []sm.Group
 	params := url.Values{}
 	for _, group := range groups {
 		params.Add("group", group)
 	}
-	err := d.GetFromHSM("/groups", params.Encode(), &resp)
+	err := d.GetFromHSM(ctx, "/groups", params.Encode(), &resp)
 	return resp, err
 }
 
 // GetComponentsQuery retrives specific Components from the Hardware Stage Manager.
-func (d *CapmcD) GetComponentsQuery(xname, restrict string) ([]*base.Component, error) {
+func (d *CapmcD) GetComponentsQuery(ctx context.Context, xname, restrict string) ([]*base.Component, error) {
 	var components base.ComponentArray
 	URI := fmt.Sprintf("/State/Components/Query/%s", xname)
-	err := d.GetFromHSM(URI, restrict, &components)
+	err := d.GetFromHSM(ctx, URI, restrict, &components)
 	return components.Components, err
 }
 
 //GetHWInventory retrieves SystemHWInventory data from the
 //Hardware State Manager.
-func (d *CapmcD) GetHWInventoryQuery(xname string) (sm.SystemHWInventory, error) {
+func (d *CapmcD) GetHWInventoryQuery(ctx context.Context, xname string) (sm.SystemHWInventory, error) {
 	var hwInventory sm.SystemHWInventory
 	var restrict = ""
-	err := d.GetFromHSM(fmt.Sprintf("/Inventory/Hardware/Query/%s", xname), restrict, &hwInventory)
+	err := d.GetFromHSM(ctx, fmt.Sprintf("/Inventory/Hardware/Query/%s", xname), restrict, &hwInventory)
 	return hwInventory, err
 }
 
@@ -311,7 +328,7 @@ func (d *CapmcD) GetNodes(query HSMQuery) ([]*NodeInfo, error) {
 		restrict := getRestrictStr(query)
 
 		// Get requested Components from HSM
-		newComponents, err := d.GetComponents(restrict)
+		newComponents, err := d.GetComponents(query.Context(), restrict)
 		if err != nil {
 			log.Printf("Error requesting components\n")
 			return nil, err
@@ -354,7 +371,7 @@ func (d *CapmcD) GetNodes(query HSMQuery) ([]*NodeInfo, error) {
 			restrict = getRestrictStr(cepQuery)
 
 			// Get requested ComponentEndpoinots from HSM
-			newComponentEndpoints, err := d.GetComponentEndpoints(restrict)
+			newComponentEndpoints, err := d.GetComponentEndpoints(query.Context(), restrict)
 			if err != nil {
 				log.Printf("Error requesting component endpoints\n")
 				return nil, err
@@ -366,7 +383,13 @@ func (d *CapmcD) GetNodes(query HSMQuery) ([]*NodeInfo, error) {
 
 			// Use the secure store.
 			// TODO: Consider doing the Vault call in parallel with GetComponentEndpoints()
+			start := time.Now()
+			_, sp := startClientSpan(query.Context(), "Vault GetCompCreds")
+			sp.setAttr("capmc.xname_count", len(cepQuery.ComponentIDs))
 			newCredentials, err := d.ccs.GetCompCreds(cepQuery.ComponentIDs)
+			metrics.observeDependency("vault", start, err)
+			sp.setError(err)
+			sp.finish()
 			if err != nil {
 				log.Printf("Error requesting credentials")
 				return nil, err
@@ -395,6 +418,7 @@ func (d *CapmcD) GetNodes(query HSMQuery) ([]*NodeInfo, error) {
 		ni.Nid = int(nid)
 		ni.Role = component.Role
 		ni.State = component.State
+		ni.Flag = component.Flag
 		ni.Type = component.Type
 		// HSM should never return nil but just in case...
 		if component.Enabled != nil {
@@ -669,7 +693,10 @@ func (d *CapmcD) GetNodesByXname(query HSMQuery) ([]*NodeInfo, error) {
 func (d *CapmcD) GetNodesByGroup(query HSMQuery) ([]*NodeInfo, error) {
 	var bad []string
 
-	groups, err := d.GetGroups(query.Groups)
+	groups, err := d.GetGroups(query.Context(), query.Groups)
+	if err != nil {
+		return nil, err
+	}
 
 	groupMap := make(map[string]sm.Group)
 	for _, group := range groups {
@@ -690,6 +717,11 @@ func (d *CapmcD) GetNodesByGroup(query HSMQuery) ([]*NodeInfo, error) {
 		return nil, err
 	}
 
+	// An empty query would match every component; empty groups match none.
+	if len(query.ComponentIDs) == 0 {
+		return []*NodeInfo{}, nil
+	}
+
 	groupNodes, err := d.GetNodes(query)
 	if err != nil {
 		return nil, err
@@ -713,7 +745,7 @@ func (d *CapmcD) GetNidInfo(query HSMQuery) ([]*capmc.NidInfo, error) {
 	}
 	restrict := getRestrictStr(query)
 
-	nodes, err := d.GetComponents(restrict)
+	nodes, err := d.GetComponents(query.Context(), restrict)
 	if err != nil {
 		return nil, err
 	}
@@ -767,7 +799,7 @@ func (d *CapmcD) GetComponentStatus(query HSMQuery, filter uint) (capmc.XnameSta
 		csFlags capmc.XnameStatusFlags
 	)
 
-	components, err := d.GetComponents(getRestrictStr(query))
+	components, err := d.GetComponents(query.Context(), getRestrictStr(query))
 	if err != nil {
 		return cs, err
 	}
@@ -782,39 +814,8 @@ func (d *CapmcD) GetComponentStatus(query HSMQuery, filter uint) (capmc.XnameSta
 	}
 
 	for _, component := range components {
-		switch component.Flag {
-		case string(base.FlagAlert):
-			if filter&capmc.FilterShowAlertBit != 0 {
-				csFlags.Alert = append(csFlags.Alert, component.ID)
-			}
-		case string(base.FlagLocked):
-			if filter&capmc.FilterShowLockedBit != 0 {
-				csFlags.Locked = append(csFlags.Locked, component.ID)
-			}
-		case string(base.FlagOK), "":
-			if filter&capmc.FilterShowOKBit != 0 {
-				csFlags.OK = append(csFlags.OK, component.ID)
-			}
-		case string(base.FlagUnknown):
-			if filter&capmc.FilterShowUnknownBit != 0 {
-				csFlags.Unknown = append(csFlags.Unknown, component.ID)
-			}
-		case string(base.FlagWarning):
-			if filter&capmc.FilterShowWarningBit != 0 {
-				csFlags.Warning = append(csFlags.Warning, component.ID)
-			}
-		default:
-			// This indicates that a new HMSFlag was added and
-			// CAPMC is out of sync with HSM
-			log.Printf("Error: unknown flag '%s'; skipping\n", component.Flag)
-		}
-
-		if component.Enabled != nil && *component.Enabled == false {
-			// count as a 'flag'
-			if filter&capmc.FilterShowDisabledBit != 0 {
-				csFlags.Disabled = append(csFlags.Disabled, component.ID)
-			}
-		}
+		enabled := component.Enabled == nil || *component.Enabled
+		addStatusFlags(&csFlags, component.ID, component.Flag, enabled, filter)
 
 		// This is more general than required. The incoming HSM query
 		// parameters can limit the categories returned.
@@ -861,15 +862,58 @@ func (d *CapmcD) GetComponentStatus(query HSMQuery, filter uint) (capmc.XnameSta
 		}
 	}
 
-	flags := len(csFlags.Alert) + len(csFlags.Locked) + len(csFlags.OK) +
-		len(csFlags.Unknown) + len(csFlags.Warning)
-	if flags > 0 {
-		cs.Flags = &csFlags
-	}
+	setStatusFlags(&cs, csFlags)
 
 	return cs, err
 }
 
+// addStatusFlags records the HSM flag and enabled state of the component id
+// in flags, as selected by filter.
+func addStatusFlags(flags *capmc.XnameStatusFlags, id, flag string, enabled bool, filter uint) {
+	switch flag {
+	case string(base.FlagAlert):
+		if filter&capmc.FilterShowAlertBit != 0 {
+			flags.Alert = append(flags.Alert, id)
+		}
+	case string(base.FlagLocked):
+		if filter&capmc.FilterShowLockedBit != 0 {
+			flags.Locked = append(flags.Locked, id)
+		}
+	case string(base.FlagOK), "":
+		if filter&capmc.FilterShowOKBit != 0 {
+			flags.OK = append(flags.OK, id)
+		}
+	case string(base.FlagUnknown):
+		if filter&capmc.FilterShowUnknownBit != 0 {
+			flags.Unknown = append(flags.Unknown, id)
+		}
+	case string(base.FlagWarning):
+		if filter&capmc.FilterShowWarningBit != 0 {
+			flags.Warning = append(flags.Warning, id)
+		}
+	default:
+		// This indicates that a new HMSFlag was added and
+		// CAPMC is out of sync with HSM
+		log.Printf("Error: unknown flag '%s'; skipping\n", flag)
+	}
+
+	if !enabled {
+		// count as a 'flag'
+		if filter&capmc.FilterShowDisabledBit != 0 {
+			flags.Disabled = append(flags.Disabled, id)
+		}
+	}
+}
+
+// setStatusFlags adds flags to cs if any component was flagged.
+func setStatusFlags(cs *capmc.XnameStatusResponse, flags capmc.XnameStatusFlags) {
+	n := len(flags.Alert) + len(flags.Locked) + len(flags.OK) +
+		len(flags.Unknown) + len(flags.Warning)
+	if n > 0 {
+		cs.Flags = &flags
+	}
+}
+
 // NOTE: This could be done using GetNodesByNID but there really is no
 // need do all the work (2 HSM API calls, a Vault access, and simulated
 // table join) as all the information required is in Components.
@@ -889,7 +933,7 @@ func (d *CapmcD) GetNidStatus(query HSMQuery, filter uint) (capmc.NodeStatusResp
 	}
 	restrict := getRestrictStr(query)
 
-	nodes, err := d.GetComponents(restrict)
+	nodes, err := d.GetComponents(query.Context(), restrict)
 	if err != nil {
 		return ns, err
 	}
@@ -1097,7 +1141,24 @@ func validateNIDs(dupsOK bool, nids []int) ([]int, []int) {
 }
 
 // doRequest sends a HTTP request
-func (d *CapmcD) doRequest(req *http.Request) ([]byte, error) {
+func (d *CapmcD) doRequest(req *http.Request) (body []byte, err error) {
+
+	service := d.dependencyName(req)
+	ctx, sp := startClientSpan(req.Context(), strings.ToUpper(service)+" "+req.Method)
+	if sp != nil {
+		req = req.WithContext(ctx)
+		sp.setAttr("http.request.method", req.Method)
+		sp.setAttr("url.full", req.URL.String())
+	}
+	injectTraceContext(req.Context(), req)
+	injectRequestID(req.Context(), req)
+
+	start := time.Now()
+	defer func() {
+		metrics.observeDependency(service, start, err)
+		sp.setError(err)
+		sp.finish()
+	}()
 
 	//This func is only for HSM access, so use the non-cert transport.
 	rsp, err := d.smClient.Do(req)
@@ -1105,8 +1166,9 @@ func (d *CapmcD) doRequest(req *http.Request) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	sp.setAttr("http.response.status_code", rsp.StatusCode)
 
-	body, err := ioutil.ReadAll(rsp.Body)
+	body, err = ioutil.ReadAll(rsp.Body)
 	if err != nil {
 		return nil, err
 	}
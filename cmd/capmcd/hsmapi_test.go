@@ -495,6 +495,7 @@ func TestGetNodes(t *testing.T) {
 				Nid:          1232,
 				Role:         "Compute",
 				State:        "Ready",
+				Flag:         "OK",
 				Enabled:      true,
 				BmcFQDN:      "10.100.107.181",
 				BmcPath:      "/redfish/v1/Systems/Node1",
@@ -536,6 +537,7 @@ func TestGetNodes(t *testing.T) {
 				Nid:          0,
 				Role:         "",
 				State:        "On",
+				Flag:         "OK",
 				Enabled:      true,
 				BmcFQDN:      "x0m0:8082",
 				BmcPath:      "/redfish/v1/PowerEquipment/RackPDUs/A/Outlets/AA26",
@@ -571,6 +573,7 @@ func TestGetNodes(t *testing.T) {
 				Nid:          0,
 				Role:         "",
 				State:        "On",
+				Flag:         "OK",
 				Enabled:      true,
 				BmcFQDN:      "x0m0:8082",
 				BmcPath:      "/redfish/v1/PowerEquipment/RackPDUs/A/Outlets/AA26",
@@ -620,6 +623,7 @@ var testNodeInfoDisabledList1 = []NodeInfo{
 		Nid:          1230,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.180",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -637,6 +641,7 @@ var testNodeInfoDisabledList1 = []NodeInfo{
 		Nid:          1231,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.181",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -654,6 +659,7 @@ var testNodeInfoDisabledList1 = []NodeInfo{
 		Nid:          1232,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      false,
 		BmcFQDN:      "10.100.107.182",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -671,6 +677,7 @@ var testNodeInfoDisabledList1 = []NodeInfo{
 		Nid:          1233,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.183",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -691,6 +698,7 @@ var testNodeInfoDisabledList2 = []NodeInfo{
 		Nid:          1230,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.180",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -708,6 +716,7 @@ var testNodeInfoDisabledList2 = []NodeInfo{
 		Nid:          1231,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.181",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -725,6 +734,7 @@ var testNodeInfoDisabledList2 = []NodeInfo{
 		Nid:          1232,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.182",
 		BmcPath:      "/redfish/v1/Systems/Node1",
@@ -742,6 +752,7 @@ var testNodeInfoDisabledList2 = []NodeInfo{
 		Nid:          1233,
 		Role:         "Compute",
 		State:        "Ready",
+		Flag:         "OK",
 		Enabled:      true,
 		BmcFQDN:      "10.100.107.183",
 		BmcPath:      "/redfish/v1/Systems/Node1",
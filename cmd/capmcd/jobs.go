@@ -26,7 +26,7 @@ package main
 
 import (
 	"errors"
-	"log"
+	"fmt"
 
 	base "github.com/Cray-HPE/hms-base/v2"
 )
@@ -54,7 +54,6 @@ type JobBmcPwr struct {
 	Status base.JobStatus
 	Err    error
 	d      *CapmcD
-	Logger *log.Logger
 	bmcCall
 }
 
@@ -71,15 +70,15 @@ func NewJobBmcPwr(bCall bmcCall, d *CapmcD) base.Job {
 }
 
 ///////////////////////////////////////////////////////////////////////////////
-// Log function for BmcPwr jobs. Note that for now this is just a simple
-// log call, but may be expanded in the future.
+// Log function for BmcPwr jobs. The message is logged with the request ID of
+// the request the job is run for, at the level given by its "Level:" prefix.
 //
 // format(in):  Printf-like format string.
 // a(in):       Printf-like argument list.
 // Return:      None.
 ///////////////////////////////////////////////////////////////////////////////
 func (j *JobBmcPwr) Log(format string, a ...interface{}) {
-	log.Printf(format, a...)
+	logLine(requestLog(j.ctx), fmt.Sprintf(format, a...))
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,285 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+// CAPMC logs leveled JSON through logrus, as the other HMS services do. The
+// log.Printf calls throughout the service are passed on to it, the "Error:",
+// "Notice:", "Info:" and similar prefixes of their messages giving their
+// level. Work done for a request is logged through requestLog so all of the
+// lines for a request can be found by its request ID.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// requestIDHeader carries the request ID to and from CAPMC.
+	requestIDHeader = "X-Request-ID"
+	// Request IDs given by callers which are longer than this, or which
+	// aren't printable ASCII, are replaced.
+	maxRequestIDLength = 128
+)
+
+// logger is the service logger. Its level can be changed while CAPMC runs
+// through the log_level API.
+var logger = newLogger(os.Stderr)
+
+// newLogger creates a JSON logger writing to w at the info level.
+func newLogger(w io.Writer) *logrus.Logger {
+	l := logrus.New()
+	l.SetOutput(w)
+	l.SetLevel(logrus.InfoLevel)
+	l.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+
+	return l
+}
+
+// logLevels are the levels the service can log at, from the least to the
+// most verbose.
+var logLevels = []logrus.Level{
+	logrus.ErrorLevel,
+	logrus.WarnLevel,
+	logrus.InfoLevel,
+	logrus.DebugLevel,
+	logrus.TraceLevel,
+}
+
+// parseLogLevel parses the name of one of the logLevels.
+func parseLogLevel(name string) (logrus.Level, error) {
+	level, err := logrus.ParseLevel(name)
+	if err == nil {
+		for _, l := range logLevels {
+			if level == l {
+				return level, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("invalid log level '%s', must be one of %v",
+		name, logLevels)
+}
+
+// debugLogLevel returns the log level given the deprecated -debug and
+// -debug-level flags: debug, or trace above debug level 1 where they logged
+// request and response bodies. Without -debug level is returned.
+func debugLogLevel(level string, debug bool, debugLevel int) string {
+	switch {
+	case !debug:
+		return level
+	case debugLevel > 1:
+		return logrus.TraceLevel.String()
+	default:
+		return logrus.DebugLevel.String()
+	}
+}
+
+// logLinePattern matches the file name and line number log.Lshortfile adds
+// to a log line, and the level the message starts with.
+var logLinePattern = regexp.MustCompile(
+	`^(?:([\w.-]+\.go:\d+): )?(?i:(trace|debug|info|notice|warning|warn|error|fatal)\b(:?)\s*)?`)
+
+// logLevelNames gives the level of each message prefix. Notices are reported
+// for problems CAPMC works around.
+var logLevelNames = map[string]logrus.Level{
+	"trace":   logrus.TraceLevel,
+	"debug":   logrus.DebugLevel,
+	"info":    logrus.InfoLevel,
+	"notice":  logrus.WarnLevel,
+	"warning": logrus.WarnLevel,
+	"warn":    logrus.WarnLevel,
+	"error":   logrus.ErrorLevel,
+	"fatal":   logrus.FatalLevel,
+}
+
+// parseLogLine splits a line written through the log package into the file
+// and line it was logged from, if known, its level and its message. A
+// "Level:" prefix is removed from the message; a message which just starts
+// with the name of a level, such as "Error getting hostname", is kept whole.
+func parseLogLine(line string) (file string, level logrus.Level, msg string) {
+	line = strings.TrimRight(line, "\n")
+	m := logLinePattern.FindStringSubmatchIndex(line)
+
+	level = logrus.InfoLevel
+	msg = line[m[1]:]
+	if m[2] >= 0 {
+		file = line[m[2]:m[3]]
+	}
+	if m[4] >= 0 {
+		level = logLevelNames[strings.ToLower(line[m[4]:m[5]])]
+		if m[6] == m[7] {
+			msg = line[m[4]:]
+		}
+	}
+
+	return file, level, strings.TrimRight(msg, "\n")
+}
+
+// stdLogWriter passes the lines written through the log package on to the
+// service logger.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	logLine(logrus.NewEntry(logger), string(p))
+
+	return len(p), nil
+}
+
+// logLine logs a log package style line, "Level: message", to entry.
+func logLine(entry *logrus.Entry, line string) {
+	file, level, msg := parseLogLine(line)
+	if file != "" {
+		entry = entry.WithField("file", file)
+	}
+	entry.Log(level, msg)
+}
+
+type requestIDKey struct{}
+
+// newRequestID returns a random identifier for a request.
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks a request ID given by a caller can be logged and
+// returned as it is.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// withRequestID returns a copy of ctx carrying the request ID id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestIDFrom returns the request ID carried by ctx, if any.
+func requestIDFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+
+	return id
+}
+
+// startRequest gives r the request ID its caller sent, or a new one if it
+// didn't send a usable one, and returns the ID to the caller with the
+// response.
+func startRequest(w http.ResponseWriter, r *http.Request) *http.Request {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	return r.WithContext(withRequestID(r.Context(), id))
+}
+
+// requestLog returns the logger for the work done for the request in ctx,
+// which adds the ID of the request, the token subject of its caller if
+// authenticated, and the ID of its trace if it is traced, to each line.
+func requestLog(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logger)
+	if id := requestIDFrom(ctx); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+	if p := principalFrom(ctx); p != nil {
+		entry = entry.WithField("subject", p.subject)
+	}
+	if sc, ok := spanContextFrom(ctx); ok {
+		entry = entry.WithField("trace_id", hex.EncodeToString(sc.traceID[:]))
+	}
+
+	return entry
+}
+
+// injectRequestID passes the request ID of ctx on with req.
+func injectRequestID(ctx context.Context, req *http.Request) {
+	if id := requestIDFrom(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+}
+
+// doLogLevel - returns or changes the level the service logs at
+func (d *CapmcD) doLogLevel(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var args capmc.LogLevel
+
+		if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+			sendJsonError(w, http.StatusBadRequest,
+				"Bad Request: JSON: "+err.Error())
+			return
+		}
+
+		level, err := parseLogLevel(args.Level)
+		if err != nil {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		requestLog(r.Context()).Infof("Changing log level from %s to %s",
+			logger.GetLevel(), level)
+		logger.SetLevel(level)
+	default:
+		w.Header().Set("Allow", "GET,PUT")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	SendResponseJSON(w, http.StatusOK,
+		capmc.LogLevel{Level: logger.GetLevel().String()})
+}
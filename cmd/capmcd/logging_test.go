@@ -0,0 +1,295 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/sirupsen/logrus"
+)
+
+// captureLog sends the service log to a buffer at level until the returned
+// function is called.
+func captureLog(level logrus.Level) (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+
+	out, prevLevel := logger.Out, logger.GetLevel()
+	logger.SetOutput(&buf)
+	logger.SetLevel(level)
+
+	return &buf, func() {
+		logger.SetOutput(out)
+		logger.SetLevel(prevLevel)
+	}
+}
+
+// logEntries decodes the JSON log lines in buf.
+func logEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var entry map[string]interface{}
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatalf("log isn't JSON: %s", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		file  string
+		level logrus.Level
+		msg   string
+	}{
+		{"Info: CAPMC Set Power Cap - [1]\n", "", logrus.InfoLevel, "CAPMC Set Power Cap - [1]"},
+		{"capmcd.go:42: Error: bad thing\n", "capmcd.go:42", logrus.ErrorLevel, "bad thing"},
+		{"Notice: PCS unavailable", "", logrus.WarnLevel, "PCS unavailable"},
+		{"WARNING: can't get name", "", logrus.WarnLevel, "can't get name"},
+		{"DEBUG: Undecoded: keys", "", logrus.DebugLevel, "Undecoded: keys"},
+		{"ERROR setting up transport", "", logrus.ErrorLevel, "ERROR setting up transport"},
+		{"Service name/instance: 'x'", "", logrus.InfoLevel, "Service name/instance: 'x'"},
+		{"Information only", "", logrus.InfoLevel, "Information only"},
+		{"SIMULATION_ONLY: POST", "", logrus.InfoLevel, "SIMULATION_ONLY: POST"},
+	}
+
+	for _, test := range tests {
+		file, level, msg := parseLogLine(test.line)
+		if file != test.file || level != test.level || msg != test.msg {
+			t.Errorf("%q: expected %q %s %q, got %q %s %q", test.line,
+				test.file, test.level, test.msg, file, level, msg)
+		}
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for _, name := range []string{"error", "warning", "warn", "info", "debug", "trace", "DEBUG"} {
+		if _, err := parseLogLevel(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	for _, name := range []string{"", "panic", "fatal", "verbose"} {
+		if _, err := parseLogLevel(name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestDebugLogLevel(t *testing.T) {
+	tests := []struct {
+		level      string
+		debug      bool
+		debugLevel int
+		want       string
+	}{
+		{"info", false, 0, "info"},
+		{"warning", false, 4, "warning"},
+		{"info", true, 0, "debug"},
+		{"info", true, 1, "debug"},
+		{"info", true, 2, "trace"},
+	}
+
+	for _, test := range tests {
+		got := debugLogLevel(test.level, test.debug, test.debugLevel)
+		if got != test.want {
+			t.Errorf("debugLogLevel(%s, %t, %d): got %s want %s",
+				test.level, test.debug, test.debugLevel, got, test.want)
+		}
+	}
+}
+
+func TestStdLogWriter(t *testing.T) {
+	buf, restore := captureLog(logrus.InfoLevel)
+	defer restore()
+
+	stdLogWriter{}.Write([]byte("hsmapi.go:10: Error: HSM is down\n"))
+	stdLogWriter{}.Write([]byte("Debug: not logged at info\n"))
+
+	entries := logEntries(t, buf)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	if entries[0]["level"] != "error" || entries[0]["msg"] != "HSM is down" ||
+		entries[0]["file"] != "hsmapi.go:10" {
+		t.Errorf("unexpected log entry %v", entries[0])
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	long := strings.Repeat("a", maxRequestIDLength+1)
+
+	tests := []struct {
+		sent     string
+		expected string
+	}{
+		{"abc-123", "abc-123"},
+		{"", ""},
+		{"has space", ""},
+		{long, ""},
+	}
+
+	for _, test := range tests {
+		var seen string
+		handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = requestIDFrom(r.Context())
+		}))
+
+		r := httptest.NewRequest(http.MethodGet, capmc.XnameStatusV1, nil)
+		if test.sent != "" {
+			r.Header.Set(requestIDHeader, test.sent)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		returned := w.Header().Get(requestIDHeader)
+		if returned != seen {
+			t.Errorf("%q: returned request ID %q, handler saw %q",
+				test.sent, returned, seen)
+		}
+		if test.expected != "" && returned != test.expected {
+			t.Errorf("%q: expected request ID %q, got %q",
+				test.sent, test.expected, returned)
+		}
+		if test.expected == "" && (returned == test.sent || len(returned) != 32) {
+			t.Errorf("%q: expected a new request ID, got %q", test.sent, returned)
+		}
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	buf, restore := captureLog(logrus.DebugLevel)
+	defer restore()
+
+	ctx := withRequestID(context.Background(), "req-1")
+	requestLog(ctx).Debugf("power %s", "on")
+
+	// Work done by the worker pool is logged for the request too.
+	job := NewJobBmcPwr(bmcCall{ctx: ctx}, &CapmcD{})
+	job.Log("Notice: %s unreachable", "x0c0s0b0")
+
+	// Work done outside of a request has no request ID.
+	requestLog(nil).Info("background")
+
+	entries := logEntries(t, buf)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 log entries, got %d", len(entries))
+	}
+	expected := []map[string]interface{}{
+		{"level": "debug", "msg": "power on", "request_id": "req-1"},
+		{"level": "warning", "msg": "x0c0s0b0 unreachable", "request_id": "req-1"},
+		{"level": "info", "msg": "background", "request_id": nil},
+	}
+	for i, fields := range expected {
+		for key, value := range fields {
+			if entries[i][key] != value {
+				t.Errorf("entry %d: expected %s %v, got %v",
+					i, key, value, entries[i][key])
+			}
+		}
+	}
+}
+
+func TestRequestIDSentToHSM(t *testing.T) {
+	var sent string
+	client := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		sent = req.Header.Get(requestIDHeader)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			Header:     make(http.Header),
+		}, nil
+	})
+	svc := CapmcD{rfClient: client, smClient: client, config: loadConfig("")}
+	svc.hsmURL, _ = url.Parse("http://localhost:27779/hsm/v2")
+
+	ctx := withRequestID(context.Background(), "req-2")
+	if err := svc.GetFromHSM(ctx, "/State/Components", "", &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if sent != "req-2" {
+		t.Errorf("expected request ID req-2 sent to HSM, got %q", sent)
+	}
+}
+
+func TestDoLogLevel(t *testing.T) {
+	_, restore := captureLog(logrus.InfoLevel)
+	defer restore()
+
+	tests := []struct {
+		method   string
+		body     string
+		code     int
+		expected logrus.Level
+	}{
+		{http.MethodGet, "", http.StatusOK, logrus.InfoLevel},
+		{http.MethodPut, `{"level":"debug"}`, http.StatusOK, logrus.DebugLevel},
+		{http.MethodPut, `{"level":"verbose"}`, http.StatusBadRequest, logrus.DebugLevel},
+		{http.MethodPut, `{"level":`, http.StatusBadRequest, logrus.DebugLevel},
+		{http.MethodPost, `{"level":"error"}`, http.StatusMethodNotAllowed, logrus.DebugLevel},
+		{http.MethodGet, "", http.StatusOK, logrus.DebugLevel},
+	}
+
+	svc := &CapmcD{}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, capmc.LogLevelV1,
+			strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		svc.doLogLevel(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected status %d, got %d",
+				test.method, test.body, test.code, w.Code)
+		}
+		if level := logger.GetLevel(); level != test.expected {
+			t.Errorf("%s %s: expected level %s, got %s",
+				test.method, test.body, test.expected, level)
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+
+		var rsp capmc.LogLevel
+		if err := json.Unmarshal(w.Body.Bytes(), &rsp); err != nil {
+			t.Fatal(err)
+		}
+		if rsp.Level != test.expected.String() {
+			t.Errorf("%s %s: expected level %s in response, got %s",
+				test.method, test.body, test.expected, rsp.Level)
+		}
+	}
+}
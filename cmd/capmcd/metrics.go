@@ -0,0 +1,351 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+// CAPMC exposes its metrics in the Prometheus text exposition format. Only
+// counters, histograms and gauges read when scraped are needed, which are
+// simple enough not to warrant vendoring the Prometheus client library.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+// metricsContentType is the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// defaultLatencyBuckets are the upper bounds, in seconds, of the latency
+// histogram buckets.
+var defaultLatencyBuckets = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 180,
+}
+
+// counterVec is a set of counters partitioned by label values.
+type counterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*counterValue),
+	}
+}
+
+// inc adds one to the counter for labelValues.
+func (c *counterVec) inc(labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.Lock()
+	defer c.Unlock()
+
+	v, ok := c.values[key]
+	if !ok {
+		v = &counterValue{labelValues: labelValues}
+		c.values[key] = v
+	}
+	v.value++
+}
+
+// get returns the counter for labelValues.
+func (c *counterVec) get(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+
+	return 0
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.name,
+			formatLabels(c.labels, v.labelValues), formatFloat(v.value))
+	}
+}
+
+// histogramVec is a set of histograms partitioned by label values.
+type histogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	sum         float64
+	count       uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogramValue),
+	}
+}
+
+// observe records v in the histogram for labelValues.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.Lock()
+	defer h.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{
+			labelValues: labelValues,
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = hv
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// since observes the seconds elapsed since start.
+func (h *histogramVec) since(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hv.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+				formatLabels(labels, append(append([]string(nil),
+					hv.labelValues...), formatFloat(le))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name,
+			formatLabels(labels, append(append([]string(nil),
+				hv.labelValues...), "+Inf")), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name,
+			formatLabels(h.labels, hv.labelValues), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name,
+			formatLabels(h.labels, hv.labelValues), hv.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+		name, help, name, name, formatFloat(value))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// capmcMetrics are the metrics collected by CAPMC.
+type capmcMetrics struct {
+	requests            *counterVec
+	requestDuration     *histogramVec
+	powerOperations     *counterVec
+	dependencyDuration  *histogramVec
+	dependencyErrors    *counterVec
+	bmcDuration         *histogramVec
+	bmcErrors           *counterVec
+	reservationFailures *counterVec
+}
+
+func newCapmcMetrics() *capmcMetrics {
+	return &capmcMetrics{
+		requests: newCounterVec("capmc_http_requests_total",
+			"HTTP requests by API and status code.", "api", "code"),
+		requestDuration: newHistogramVec("capmc_http_request_duration_seconds",
+			"HTTP request latency by API.", defaultLatencyBuckets, "api"),
+		powerOperations: newCounterVec("capmc_power_operations_total",
+			"Power operations by command and outcome.", "command", "outcome"),
+		dependencyDuration: newHistogramVec("capmc_dependency_request_duration_seconds",
+			"Latency of calls to PCS, HSM and Vault.", defaultLatencyBuckets, "service"),
+		dependencyErrors: newCounterVec("capmc_dependency_request_errors_total",
+			"Failed calls to PCS, HSM and Vault.", "service"),
+		bmcDuration: newHistogramVec("capmc_bmc_request_duration_seconds",
+			"Latency of Redfish calls to BMCs by BMC type.", defaultLatencyBuckets, "bmc_type"),
+		bmcErrors: newCounterVec("capmc_bmc_request_errors_total",
+			"Redfish calls to BMCs which could not be made, by BMC type.", "bmc_type"),
+		reservationFailures: newCounterVec("capmc_reservation_acquire_failures_total",
+			"Failures to acquire HSM reservations for power operations."),
+	}
+}
+
+var metrics = newCapmcMetrics()
+
+// apiLabel returns the API label for a request path. Paths which are not
+// CAPMC APIs share one label so they can't flood the metrics.
+func apiLabel(path string) string {
+	for _, vers := range capmcAPIs {
+		for _, api := range vers {
+			if api.pattern == path {
+				return path
+			}
+		}
+	}
+
+	return "other"
+}
+
+// observeRequest records a handled HTTP request.
+func (m *capmcMetrics) observeRequest(path string, status int, start time.Time) {
+	api := apiLabel(path)
+	m.requests.inc(api, strconv.Itoa(status))
+	m.requestDuration.since(start, api)
+}
+
+// observeDependency records a call to service, PCS, HSM or Vault.
+func (m *capmcMetrics) observeDependency(service string, start time.Time, err error) {
+	m.dependencyDuration.since(start, service)
+	if err != nil {
+		m.dependencyErrors.inc(service)
+	}
+}
+
+// dependencyName returns the service, PCS or HSM, which req is sent to.
+func (d *CapmcD) dependencyName(req *http.Request) string {
+	if d.pcsURL != nil && req.URL.Host == d.pcsURL.Host &&
+		strings.HasPrefix(req.URL.Path, d.pcsURL.Path) {
+		return "pcs"
+	}
+
+	return "hsm"
+}
+
+// observeBmc records a Redfish call to a BMC of bmcType.
+func (m *capmcMetrics) observeBmc(bmcType string, start time.Time, err error) {
+	m.bmcDuration.since(start, bmcType)
+	if err != nil {
+		m.bmcErrors.inc(bmcType)
+	}
+}
+
+// observePowerOperation records the outcome of a power operation.
+func (m *capmcMetrics) observePowerOperation(command string, e int) {
+	outcome := "success"
+	if e != 0 {
+		outcome = "failure"
+	}
+	m.powerOperations.inc(command, outcome)
+}
+
+// doMetrics is the HTTP handler for the Prometheus metrics API.
+func (d *CapmcD) doMetrics(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+
+	metrics.requests.write(w)
+	metrics.requestDuration.write(w)
+	metrics.powerOperations.write(w)
+	metrics.dependencyDuration.write(w)
+	metrics.dependencyErrors.write(w)
+	metrics.bmcDuration.write(w)
+	metrics.bmcErrors.write(w)
+	metrics.reservationFailures.write(w)
+
+	queued, active := d.workerPoolStats()
+	writeGauge(w, "capmc_worker_pool_queued_jobs",
+		"Jobs waiting in the worker pool queue.", float64(queued))
+	writeGauge(w, "capmc_worker_pool_active_jobs",
+		"Jobs being run by the worker pool.", float64(active))
+}
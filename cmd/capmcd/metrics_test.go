@@ -0,0 +1,156 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestCounterVecWrite(t *testing.T) {
+	c := newCounterVec("test_total", "Test counter.", "api", "code")
+	c.inc("/b", "200")
+	c.inc("/a", "500")
+	c.inc("/b", "200")
+	c.inc(`"q"`, "200")
+
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{api="\"q\"",code="200"} 1
+test_total{api="/a",code="500"} 1
+test_total{api="/b",code="200"} 2
+`
+	var buf bytes.Buffer
+	c.write(&buf)
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+
+	// Counters without labels are reported before their first increment.
+	buf.Reset()
+	newCounterVec("unlabelled_total", "Unlabelled.").write(&buf)
+	if !strings.HasSuffix(buf.String(), "\nunlabelled_total 0\n") {
+		t.Errorf("expected a zero counter, got:\n%s", buf.String())
+	}
+}
+
+func TestHistogramVecWrite(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test histogram.",
+		[]float64{0.1, 1}, "service")
+	h.observe(0.05, "hsm")
+	h.observe(0.5, "hsm")
+	h.observe(0.1, "hsm")
+	h.observe(2, "hsm")
+
+	expected := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{service="hsm",le="0.1"} 2
+test_seconds_bucket{service="hsm",le="1"} 3
+test_seconds_bucket{service="hsm",le="+Inf"} 4
+test_seconds_sum{service="hsm"} 2.65
+test_seconds_count{service="hsm"} 4
+`
+	var buf bytes.Buffer
+	h.write(&buf)
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestAPILabel(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{capmc.XnameOnV1, capmc.XnameOnV1},
+		{capmc.Metrics, capmc.Metrics},
+		{"/capmc/v1/bogus", "other"},
+	}
+
+	for _, test := range tests {
+		if label := apiLabel(test.path); label != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.path, test.expected, label)
+		}
+	}
+}
+
+func TestDependencyName(t *testing.T) {
+	svc := &CapmcD{}
+	svc.pcsURL, _ = url.Parse("http://cray-power-control/v1")
+
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"http://cray-power-control/v1/power-status", "pcs"},
+		{"http://cray-smd/hsm/v2/State/Components", "hsm"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+		if name := svc.dependencyName(req); name != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.url, test.expected, name)
+		}
+	}
+}
+
+func TestDoMetrics(t *testing.T) {
+	svc := &CapmcD{WPool: base.NewWorkerPool(4, 40)}
+	metrics.observePowerOperation(bmcCmdPowerOn, 0)
+
+	req := httptest.NewRequest(http.MethodGet, capmc.Metrics, nil)
+	w := httptest.NewRecorder()
+	svc.doMetrics(w, req)
+
+	if ct := w.Header().Get("Content-Type"); ct != metricsContentType {
+		t.Errorf("expected content type %s, got %s", metricsContentType, ct)
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		`capmc_power_operations_total{command="On",outcome="success"} `,
+		"capmc_reservation_acquire_failures_total ",
+		"capmc_worker_pool_queued_jobs 0\n",
+		// The pool hasn't been run so none of its workers are idle.
+		"capmc_worker_pool_active_jobs 4\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %q in:\n%s", expected, body)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, capmc.Metrics, nil)
+	w = httptest.NewRecorder()
+	svc.doMetrics(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
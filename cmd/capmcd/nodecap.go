@@ -25,6 +25,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,7 +34,9 @@ import (
 	"math"
 	"net/http"
 	"path"
+	"sort"
 	"strings"
+	"time"
 
 	base "github.com/Cray-HPE/hms-base/v2"
 	"github.com/Cray-HPE/hms-capmc/internal/capmc"
@@ -85,7 +88,7 @@ func (d *CapmcD) doPowerCapCapabilities(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("Info: CAPMC Get Power Cap Capabilities - %v", args.Nids)
+	requestLog(r.Context()).Infof("CAPMC Get Power Cap Capabilities - %v", args.Nids)
 
 	// The incoming NID list could be invalid. Do simple validation
 	// before contacting Hardware State Manager.
@@ -123,7 +126,7 @@ func (d *CapmcD) doPowerCapCapabilities(w http.ResponseWriter, r *http.Request)
 
 		// unknown error - just bail
 		status := http.StatusInternalServerError
-		log.Printf("Error: CAPMC Get Power Cap Capabilities: %s\n", err.Error())
+		requestLog(r.Context()).Errorf("CAPMC Get Power Cap Capabilities: %s", err.Error())
 		sendJsonError(w, status, err.Error())
 		return
 	}
@@ -145,9 +148,9 @@ func (d *CapmcD) doPowerCapCapabilities(w http.ResponseWriter, r *http.Request)
 	restrict := getRestrictStr(ceQuery)
 
 	var componentEndpoints []*sm.ComponentEndpoint
-	componentEndpoints, err = d.GetComponentEndpoints(restrict)
+	componentEndpoints, err = d.GetComponentEndpoints(r.Context(), restrict)
 	if err != nil {
-		log.Printf("Error: CAPMC Get Power Cap Capabilities: %s\n", err.Error())
+		requestLog(r.Context()).Errorf("CAPMC Get Power Cap Capabilities: %s", err.Error())
 		sendJsonError(w, http.StatusBadRequest,
 			fmt.Sprintf("Bad Request: JSON: %s", err))
 		return
@@ -160,51 +163,35 @@ func (d *CapmcD) doPowerCapCapabilities(w http.ResponseWriter, r *http.Request)
 		xnameComponentLookup[componentEndpoint.ID] = componentEndpoint
 	}
 
-	//Get the full SystemHWInventory
-	//At this time, only the “all” and “s0” xname values are accepted by HSM Hardware Inventory queries
-	//The HSM plan is to expand this to accept any xname, group, or partition as described in CASMHMS-2285.
-	hwInventory, err := d.GetHWInventoryQuery("all")
-	if err != nil {
-		log.Printf("Error: CAPMC GetHWInventoryQuery failed: %s\n", err.Error())
-		sendJsonError(w, http.StatusBadRequest,
-			fmt.Sprintf("Bad Request: JSON: %s", err))
-		return
-	}
-	//filter hwInventory.Nodes according to NidlistRequest
-	//Per Manny III, the HSM HWInventory Query API currently only supports getting the whole SystemHWInventory
-	//so it is necessary to prune the resulting HWInventory list here
+	// Only the inventory of the requested nodes is needed. Without a NID
+	// list the whole inventory is used. HSM returns ComponentEndpoints in
+	// the same order as the hardware inventory, so list the nodes in
+	// that order to keep the groups and their NIDs in inventory order.
+	var xnames []string
 	if len(args.Nids) > 0 {
-		var prunedNodeArray []*sm.HWInvByLoc
-		nodeArray := hwInventory.Nodes
-		for _, node := range *nodeArray {
-			if _, ok := xnameNidInfoLookup[node.ID]; ok {
-				prunedNodeArray = append(prunedNodeArray, node)
+		listed := make(map[string]bool)
+		for _, componentEndpoint := range componentEndpoints {
+			if _, ok := xnameNidInfoLookup[componentEndpoint.ID]; ok && !listed[componentEndpoint.ID] {
+				listed[componentEndpoint.ID] = true
+				xnames = append(xnames, componentEndpoint.ID)
 			}
 		}
-		//reset Nodes array with pruned list
-		if len(prunedNodeArray) > 0 {
-			hwInventory.Nodes = &prunedNodeArray
+		var unlisted []string
+		for xname := range xnameNidInfoLookup {
+			if !listed[xname] {
+				unlisted = append(unlisted, xname)
+			}
 		}
+		sort.Strings(unlisted)
+		xnames = append(xnames, unlisted...)
 	}
 
-	var powerCapGroups []capmc.PowerCapGroup
-	//get the monikerGroups from the SystemHWInventory
-	uniqueMonikerGroups := convertSystemHWInventoryToUniqueMonikerGroups(hwInventory)
-	for _, uniqueMonikerGroup := range uniqueMonikerGroups {
-		//create the Nids array in this moniker group from the Xnames list
-		for _, xname := range uniqueMonikerGroup.Xnames {
-			if nidInfo, ok := xnameNidInfoLookup[xname]; ok {
-				uniqueMonikerGroup.Nids = append(uniqueMonikerGroup.Nids, int(nidInfo.Nid))
-			}
-		}
-		powerCapGroup, err := buildPowerCapCapabilitiesGroup(uniqueMonikerGroup, xnameComponentLookup)
-		if err != nil {
-			log.Printf("Error: CAPMC Get Power Cap Capabilities failed: %s\n", err.Error())
-			sendJsonError(w, http.StatusBadRequest,
-				fmt.Sprintf("Bad Request: JSON: %s", err))
-			return
-		}
-		powerCapGroups = append(powerCapGroups, powerCapGroup)
+	powerCapGroups, err := d.powerCapCapabilitiesGroups(r.Context(), xnames,
+		xnameNidInfoLookup, xnameComponentLookup)
+	if err != nil {
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad Request: JSON: %s", err))
+		return
 	}
 
 	var data capmc.GetPowerCapCapabilitiesResponse
@@ -217,7 +204,7 @@ func (d *CapmcD) doPowerCapCapabilities(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusOK)
 	err = json.NewEncoder(w).Encode(data)
 	if err != nil {
-		log.Printf("Error: CAPMC Get Power Cap Capabilities encoding JSON response: %s\n", err)
+		requestLog(r.Context()).Errorf("CAPMC Get Power Cap Capabilities encoding JSON response: %s", err)
 	}
 	return
 }
@@ -235,7 +222,7 @@ func (d *CapmcD) doPowerCapGet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var (
-		args  capmc.NidlistRequest
+		args  capmc.GetPowerCapRequest
 		query HSMQuery
 	)
 
@@ -263,7 +250,7 @@ func (d *CapmcD) doPowerCapGet(w http.ResponseWriter, r *http.Request) {
 		query.Enabled = append(query.Enabled, true)
 	}
 
-	log.Printf("Info: CAPMC Get Power Cap - %v", args.Nids)
+	requestLog(r.Context()).Infof("CAPMC Get Power Cap - %v", args.Nids)
 
 	var data capmc.PowerCapResponse
 
@@ -290,7 +277,7 @@ func (d *CapmcD) doPowerCapGet(w http.ResponseWriter, r *http.Request) {
 			data.E = 22 // EINVAL
 			data.ErrMsg = "Invalid argument"
 		} else {
-			log.Printf("Error: %s", err)
+			requestLog(r.Context()).Errorf("%s", err)
 			sendJsonError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
@@ -318,10 +305,14 @@ func (d *CapmcD) doPowerCapGet(w http.ResponseWriter, r *http.Request) {
 	// Only get power caps if all the NIDs were 'good'.
 	if data.E == 0 {
 		var failed int
+		var apollo map[string]*capmc.PowerCapReadings
+		if args.IncludeReadings {
+			apollo = d.apolloPowerReadings(r.Context(), nodes)
+		}
 		// Expand nodes list for new power control structure
 		nodes = expandNodeListForControlStruct(nodes)
 		cmd := bmcCmd{cmd: bmcCmdGetPowerCap}
-		waitNum, waitChan := d.queueBmcCmd(cmd, nodes)
+		waitNum, waitChan := d.queueBmcCmd(r.Context(), cmd, nodes)
 		var controlMap = make(map[int][]capmc.PowerCapControl)
 		for i := 0; i < waitNum; i++ {
 			result := <-waitChan
@@ -330,137 +321,25 @@ func (d *CapmcD) doPowerCapGet(w http.ResponseWriter, r *http.Request) {
 					newPowerCapNidError(result.ni.Nid,
 						result.rc,
 						"Error getting power cap from NID"))
-				log.Printf("Notice: get power cap failed: %s", result.msg)
+				requestLog(r.Context()).Warnf("get power cap failed: %s", result.msg)
 				failed++
 				continue
 			}
 
-			var rfPower capmc.Power
-			err := json.Unmarshal([]byte(result.msg), &rfPower)
-			if err != nil {
+			controls, ecode, emsg := d.powerCapControls(r.Context(), result, "NID",
+				args.IncludeReadings)
+			if ecode != 0 {
 				data.Nids = append(data.Nids,
-					newPowerCapNidError(result.ni.Nid,
-						74, // EBADMSG (Linux)
-						fmt.Sprintf("Error decoding Redfish Power data for NID: %s", err)))
-				log.Printf("Notice: Unmarshal failed: %s", err)
+					newPowerCapNidError(result.ni.Nid, ecode, emsg))
 				failed++
 				continue
 			}
+			addPowerReadings(controls, apollo[result.ni.Hostname])
 
-			// Convert PowerConsumedWatts to an int if not already (it's an interface{}
-			// type that can support ints and floats) - Needed for Foxconn Paradise,
-			// perhaps others in the future
-			for _, pwrCtl := range rfPower.PowerCtl {
-				if pwrCtl.PowerConsumedWatts != nil {
-					switch v := (*pwrCtl.PowerConsumedWatts).(type) {
-					case float64:	// Convert to int
-						*pwrCtl.PowerConsumedWatts = int(math.Round(v))
-					case int:		// noop - no conversion needed
-					default:		// unexpected type, set to zero
-						*pwrCtl.PowerConsumedWatts = int(0)
-						log.Printf("ERROR: unexpected type/value '%T'/'%v' detected for PowerConsumedWatts, setting to 0\n", *pwrCtl.PowerConsumedWatts, *pwrCtl.PowerConsumedWatts)
-					}
-				}
-			}
-
-			// This would be nice to use but not all versions
-			// of the schema support PowerControl@odata.count.
-			// Looking at you Intel...
-			if d.debug {
-				log.Printf("Debug: PowerControl Count %d",
-					rfPower.PowerCtlCnt)
-			}
-
-			if rfPower.Error != nil {
-				log.Printf("Notice: %s %s: Invalid license for power capping for NID %d (%s)",
-					result.ni.BmcType, result.ni.BmcFQDN,
-					result.ni.Nid, result.ni.Hostname)
-				data.Nids = append(data.Nids,
-					newPowerCapNidError(result.ni.Nid,
-						-1, "Invalid license"))
-				failed++
-				continue
-			}
-
-			pctlLen := len(rfPower.PowerCtl)
-			hpePctlLen := len(rfPower.ActualPowerLimits) +
-				len(rfPower.PowerLimitRanges) +
-				len(rfPower.PowerLimits)
-			ctlLen := result.ni.RfControlsCnt
-
-			if pctlLen < 1 && hpePctlLen < 1 && ctlLen < 1 {
-				log.Printf("Notice: %s %s: No Redfish power control data for NID %d (%s)",
-					result.ni.BmcType, result.ni.BmcFQDN,
-					result.ni.Nid, result.ni.Hostname)
-				data.Nids = append(data.Nids,
-					newPowerCapNidError(result.ni.Nid,
-						66, // ENODATA (Linux)
-						"No Redfish Power data for NID"))
-				failed++
-				continue
-			}
-
-			var val *int
-			var controls []capmc.PowerCapControl
-			if ctlLen > 0 {
-				if rfPower.SetPoint != nil {
-					val = rfPower.SetPoint
-				} else {
-					var unconstrained int
-					val = &unconstrained
-				}
+			if result.ni.RfControlsCnt > 0 {
 				controlMap[result.ni.Nid] = append(controlMap[result.ni.Nid],
-					capmc.PowerCapControl{Name: rfPower.Name, Val: val})
-			} else if hpePctlLen > 0 {
-				// Handle Apollo 6500 AccPowerService power cap query
-				for _, pl := range rfPower.PowerLimits {
-					name := "Node Power Limit"
-					if pl.PowerLimitInWatts != nil {
-						val = pl.PowerLimitInWatts
-					} else {
-						var unconstrained int
-						// Per Cascade 0 is unconstrained.
-						// So if there isn't a control it
-						// must be by definition unconstrained.
-						val = &unconstrained
-					}
-					controls = append(controls,
-						capmc.PowerCapControl{Name: name, Val: val})
-				}
+					controls...)
 			} else {
-				// Handle standard Redfish PowerControl power cap query
-				for _, pc := range rfPower.PowerCtl {
-					var name string
-					if isHpeServer(result.ni) {
-						name = "Node Power Limit"
-					} else {
-						name = pc.Name
-					}
-
-					if pc.PowerLimit != nil {
-						val = pc.PowerLimit.LimitInWatts
-					} else {
-						var unconstrained int
-						// Per Cascade 0 is unconstrained.
-						// So if there isn't a control it
-						// must be by definition unconstrained.
-						val = &unconstrained
-					}
-					controls = append(controls,
-						capmc.PowerCapControl{Name: name, Val: val})
-				}
-			}
-
-			// need to find at least one known power cap control
-			if len(controls) < 1 && len(controlMap[result.ni.Nid]) < 1 {
-				data.Nids = append(data.Nids,
-					newPowerCapNidError(result.ni.Nid,
-						66, // ENODATA (Linux)
-						"No Redfish power cap controls found for NID"))
-				failed++
-				continue
-			}
-			if ctlLen < 1 {
 				data.Nids = append(data.Nids,
 					capmc.PowerCapNid{Nid: result.ni.Nid, Controls: controls})
 			}
@@ -480,7 +359,7 @@ func (d *CapmcD) doPowerCapGet(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(data)
 	if err != nil {
-		log.Printf("Error: encoding JSON response: %s\n", err)
+		requestLog(r.Context()).Errorf("encoding JSON response: %s", err)
 	}
 }
 
@@ -537,10 +416,12 @@ func (d *CapmcD) doPowerCapSet(w http.ResponseWriter, r *http.Request) {
 
 	// NOTE Use the post duplicate check NID list rather than the full
 	// input args here as the later could get very ugly (large) in the log.
-	log.Printf("Info: CAPMC Set Power Cap - %v", nids)
+	requestLog(r.Context()).Infof("CAPMC Set Power Cap - %v", nids)
+	start := time.Now()
 
 	var query = HSMQuery{
 		NIDs: nids,
+		ctx:  r.Context(),
 	}
 	nodes, err = d.GetNodesByNID(query)
 	if err != nil {
@@ -559,15 +440,21 @@ func (d *CapmcD) doPowerCapSet(w http.ResponseWriter, r *http.Request) {
 			data.E = 22 // EINVAL
 			data.ErrMsg = "Invalid argument"
 		} else {
-			log.Printf("Error: %s", err)
+			requestLog(r.Context()).Errorf("%s", err)
 			sendJsonError(w, http.StatusInternalServerError,
 				err.Error())
 			return
 		}
 	}
 
+	if args.ValidateOnly {
+		d.validatePowerCapSet(w, args, nidsMap, nodes, data)
+		return
+	}
+	targets := nodes
+
 	bmcCmds := make(map[*NodeInfo]bmcCmd)
-	var newNodes []*NodeInfo
+	var newNodes, capNodes []*NodeInfo
 	for _, node := range nodes {
 		if !node.Enabled || node.State != string(base.StateReady) {
 			data.Nids = append(data.Nids,
@@ -583,53 +470,21 @@ func (d *CapmcD) doPowerCapSet(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		controls := args.Nids[nidsMap[node.Nid]].Controls
-		if len(controls) < 1 {
-			data.Nids = append(data.Nids,
-				newPowerCapNidError(node.Nid, 22,
-					"Invalid command, 'control' is not an object"))
-			continue
-		}
-
-		// Loop through all the controls and generate a powerGen structure
-		// that will be used to generate the payload later
-		pGen, err := generateControls(node, controls)
-
+		cmds, err := d.powerCapSetCmds(node,
+			args.Nids[nidsMap[node.Nid]].Controls, "NID")
 		if err != nil {
 			data.Nids = append(data.Nids,
 				newPowerCapNidError(node.Nid, 22, err.Error()))
 			continue
 		}
 
-		if len(pGen) == 0 {
-			data.Nids = append(data.Nids,
-				newPowerCapNidError(node.Nid, 22,
-					"No NID supported controls specified"))
-			continue
-		}
-
-		// Loop through each of the controls that need their own action to
-		// generate a json payload to add to the bmcCmds map. The index to the
-		// bmcCmds map is the address of a NodeInfo structure.
-		var payload []byte
-		for n, pg := range pGen {
-			payload, err = generatePayload(n, pg)
-
-			if err != nil {
-				log.Printf("Error: %s", err)
-				continue
-			}
-
-			if d.debug {
-				log.Printf("Debug: payload=%s", payload)
-			}
-
+		// The index to the bmcCmds map is the address of a NodeInfo
+		// structure.
+		for n, cmd := range cmds {
 			newNodes = append(newNodes, n)
-			bmcCmds[n] = bmcCmd{
-				cmd:     bmcCmdSetPowerCap,
-				payload: payload,
-			}
+			bmcCmds[n] = cmd
 		}
+		capNodes = append(capNodes, node)
 	}
 
 	// The request contained invalid NIDs, controls, and/or values.
@@ -642,18 +497,20 @@ func (d *CapmcD) doPowerCapSet(w http.ResponseWriter, r *http.Request) {
 
 	// There were no supported PowerControls
 	if len(bmcCmds) <= 0 {
-		log.Printf("Info: no supported power capping controls for request")
+		requestLog(r.Context()).Infof("no supported power capping controls for request")
 		data.E = 22 // EINVAL
 		data.ErrMsg = "No supported power capping controls"
 	}
 
 	// Only set power caps if all the NIDs, controls, and values were 'good'
-	if data.E == 0 {
+	changed := data.E == 0
+	if changed {
 		var failed int
 		if len(newNodes) > 0 {
 			nodes = newNodes
 		}
-		waitNum, waitChan := d.queueBmcCmds(bmcCmds, nodes)
+		failedNids := make(map[int]bool)
+		waitNum, waitChan := d.queueBmcCmds(r.Context(), bmcCmds, nodes)
 		for i := 0; i < waitNum; i++ {
 			result := <-waitChan
 			if result.rc != 0 {
@@ -661,18 +518,34 @@ func (d *CapmcD) doPowerCapSet(w http.ResponseWriter, r *http.Request) {
 					newPowerCapNidError(result.ni.Nid,
 						result.rc,
 						"Error setting power cap for NID"))
-				log.Printf("Notice: set power cap failed: %s", result.msg)
+				requestLog(r.Context()).Warnf("set power cap failed: %s", result.msg)
+				failedNids[result.ni.Nid] = true
 				failed++
 				continue
 			}
 		}
 
+		// Remember the caps so they can be reapplied if they drift.
+		for _, node := range capNodes {
+			if !failedNids[node.Nid] {
+				d.powerCaps.record(node,
+					args.Nids[nidsMap[node.Nid]].Controls)
+			}
+		}
+
 		if failed > 0 {
 			data.E = 52 // EBADE ?
 			data.ErrMsg = "Invalid exchange"
 		}
 	}
 
+	rec := newAuditRecord(r, newOperationID(), bmcCmdSetPowerCap, start,
+		time.Now())
+	rec.ErrResponse = data.ErrResponse
+	rec.Nids = nids
+	rec.Xnames = nidAuditResults(targets, data.Nids, changed)
+	d.audit.record(r.Context(), rec)
+
 	w.Header().Set("Content-Type", "application/json")
 	err = json.NewEncoder(w).Encode(data)
 	if err != nil {
@@ -680,6 +553,389 @@ func (d *CapmcD) doPowerCapSet(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// validatePowerCapSet is the validate_only form of set_power_cap. For every
+// requested NID it reports the range checks of each control, the node
+// control each resolved to, and the Redfish requests that would be sent,
+// without contacting any BMC. data holds the errors found so far.
+func (d *CapmcD) validatePowerCapSet(w http.ResponseWriter, args capmc.SetPowerCapRequest, nidsMap map[int]int, nodes []*NodeInfo, data capmc.PowerCapResponse) {
+	resp := capmc.PowerCapValidateResponse{
+		Nids: []capmc.PowerCapValidateNid{},
+	}
+
+	for _, nid := range data.Nids {
+		resp.Nids = append(resp.Nids, capmc.PowerCapValidateNid{
+			Nid:    nid.Nid,
+			E:      nid.E,
+			ErrMsg: nid.ErrMsg,
+		})
+	}
+
+	for _, node := range nodes {
+		controls := args.Nids[nidsMap[node.Nid]].Controls
+		vn := capmc.PowerCapValidateNid{
+			Nid:   node.Nid,
+			Xname: node.Hostname,
+		}
+
+		seen := make(map[string]bool)
+		for _, control := range controls {
+			vc := capmc.PowerCapValidateControl{
+				Name: control.Name,
+				Val:  control.Val,
+				Min:  -1,
+				Max:  -1,
+			}
+
+			pc, ok := node.PowerCaps[control.Name]
+			switch {
+			case !ok:
+				vc.ErrMsg = "Undefined control, skipped"
+			case seen[control.Name]:
+				vc.E = 22
+				vc.ErrMsg = fmt.Sprintf("Duplicate control specified: %s",
+					control.Name)
+			default:
+				vc.Resolved = true
+				vc.Path = pc.Path
+				vc.Min = pc.Min
+				vc.Max = pc.Max
+				if err := checkPowerCapControl(control, pc); err != nil {
+					vc.E = 22
+					vc.ErrMsg = err.Error()
+				}
+			}
+			seen[control.Name] = true
+
+			vn.Controls = append(vn.Controls, vc)
+		}
+
+		switch {
+		case !node.Enabled || node.State != string(base.StateReady):
+			vn.E = 22
+			vn.ErrMsg = "Invalid state, NID is not 'ready'"
+		case node.Role != string(base.RoleCompute):
+			vn.E = 22
+			vn.ErrMsg = "Invalid type, not a compute node"
+		default:
+			cmds, err := d.powerCapSetCmds(node, controls, "NID")
+			if err != nil {
+				vn.E = 22
+				vn.ErrMsg = err.Error()
+				break
+			}
+			for n, cmd := range cmds {
+				vn.Payloads = append(vn.Payloads, powerCapPayload(n, cmd))
+			}
+			sort.Slice(vn.Payloads, func(i, j int) bool {
+				return vn.Payloads[i].URL < vn.Payloads[j].URL
+			})
+		}
+
+		resp.Nids = append(resp.Nids, vn)
+	}
+
+	sort.Slice(resp.Nids, func(i, j int) bool {
+		return resp.Nids[i].Nid < resp.Nids[j].Nid
+	})
+
+	for _, vn := range resp.Nids {
+		if vn.E != 0 {
+			resp.E = 22 // EINVAL
+			resp.ErrMsg = "Invalid Argument"
+			break
+		}
+	}
+
+	SendResponseJSON(w, http.StatusOK, resp)
+}
+
+// powerCapPayload describes the Redfish request doBmcCall would make to
+// carry out the bmcCmdSetPowerCap cmd on node.
+func powerCapPayload(node *NodeInfo, cmd bmcCmd) capmc.PowerCapPayload {
+	method, oid := http.MethodPatch, node.RfPowerURL
+	if isHpeApollo6500(node) {
+		method, oid = http.MethodPost, node.RfPowerTarget
+	} else if oid == "" {
+		oid = warRedfishPowerOID(node)
+	}
+
+	return capmc.PowerCapPayload{
+		Method:  method,
+		URL:     "https://" + node.BmcFQDN + oid,
+		Payload: json.RawMessage(cmd.payload),
+	}
+}
+
+// powerCapControls decodes the Redfish power data returned by a
+// bmcCmdGetPowerCap command into CAPMC power cap controls. On failure a
+// non-zero error code and a message naming the kind of target ("NID" or
+// "xname") are returned instead. If readings is set, any power readings the
+// BMC reported with a control are returned with it. Problems are logged for
+// the request in ctx.
+func (d *CapmcD) powerCapControls(ctx context.Context, result bmcPowerRc, kind string, readings bool) ([]capmc.PowerCapControl, int, string) {
+	var rfPower capmc.Power
+	err := json.Unmarshal([]byte(result.msg), &rfPower)
+	if err != nil {
+		requestLog(ctx).Warnf("Unmarshal failed: %s", err)
+		return nil, 74, // EBADMSG (Linux)
+			fmt.Sprintf("Error decoding Redfish Power data for %s: %s", kind, err)
+	}
+
+	// Convert PowerConsumedWatts to an int if not already (it's an interface{}
+	// type that can support ints and floats) - Needed for Foxconn Paradise,
+	// perhaps others in the future
+	for _, pwrCtl := range rfPower.PowerCtl {
+		if pwrCtl.PowerConsumedWatts != nil {
+			switch v := (*pwrCtl.PowerConsumedWatts).(type) {
+			case float64: // Convert to int
+				*pwrCtl.PowerConsumedWatts = int(math.Round(v))
+			case int: // noop - no conversion needed
+			default: // unexpected type, set to zero
+				*pwrCtl.PowerConsumedWatts = int(0)
+				requestLog(ctx).Errorf("unexpected type/value '%T'/'%v' detected for PowerConsumedWatts, setting to 0", *pwrCtl.PowerConsumedWatts, *pwrCtl.PowerConsumedWatts)
+			}
+		}
+	}
+
+	// This would be nice to use but not all versions
+	// of the schema support PowerControl@odata.count.
+	// Looking at you Intel...
+	requestLog(ctx).Debugf("PowerControl Count %d", rfPower.PowerCtlCnt)
+
+	if rfPower.Error != nil {
+		requestLog(ctx).Warnf("%s %s: Invalid license for power capping for NID %d (%s)",
+			result.ni.BmcType, result.ni.BmcFQDN,
+			result.ni.Nid, result.ni.Hostname)
+		return nil, -1, "Invalid license"
+	}
+
+	pctlLen := len(rfPower.PowerCtl)
+	hpePctlLen := len(rfPower.ActualPowerLimits) +
+		len(rfPower.PowerLimitRanges) +
+		len(rfPower.PowerLimits)
+	ctlLen := result.ni.RfControlsCnt
+
+	if pctlLen < 1 && hpePctlLen < 1 && ctlLen < 1 {
+		requestLog(ctx).Warnf("%s %s: No Redfish power control data for NID %d (%s)",
+			result.ni.BmcType, result.ni.BmcFQDN,
+			result.ni.Nid, result.ni.Hostname)
+		return nil, 66, // ENODATA (Linux)
+			fmt.Sprintf("No Redfish Power data for %s", kind)
+	}
+
+	var val *int
+	var controls []capmc.PowerCapControl
+	if ctlLen > 0 {
+		if rfPower.SetPoint != nil {
+			val = rfPower.SetPoint
+		} else {
+			var unconstrained int
+			val = &unconstrained
+		}
+		control := capmc.PowerCapControl{Name: rfPower.Name, Val: val}
+		if readings {
+			control.Readings = controlReadings(rfPower.RFControl)
+		}
+		controls = append(controls, control)
+	} else if hpePctlLen > 0 {
+		// Handle Apollo 6500 AccPowerService power cap query
+		for _, pl := range rfPower.PowerLimits {
+			name := "Node Power Limit"
+			if pl.PowerLimitInWatts != nil {
+				val = pl.PowerLimitInWatts
+			} else {
+				var unconstrained int
+				// Per Cascade 0 is unconstrained.
+				// So if there isn't a control it
+				// must be by definition unconstrained.
+				val = &unconstrained
+			}
+			controls = append(controls,
+				capmc.PowerCapControl{Name: name, Val: val})
+		}
+	} else {
+		// Handle standard Redfish PowerControl power cap query
+		for _, pc := range rfPower.PowerCtl {
+			var name string
+			if isHpeServer(result.ni) {
+				name = "Node Power Limit"
+			} else {
+				name = pc.Name
+			}
+
+			if pc.PowerLimit != nil {
+				val = pc.PowerLimit.LimitInWatts
+			} else {
+				var unconstrained int
+				// Per Cascade 0 is unconstrained.
+				// So if there isn't a control it
+				// must be by definition unconstrained.
+				val = &unconstrained
+			}
+			control := capmc.PowerCapControl{Name: name, Val: val}
+			if readings {
+				control.Readings = powerCapReadings(pc)
+			}
+			controls = append(controls, control)
+		}
+	}
+
+	// need to find at least one known power cap control
+	if len(controls) < 1 {
+		return nil, 66, // ENODATA (Linux)
+			fmt.Sprintf("No Redfish power cap controls found for %s", kind)
+	}
+
+	return controls, 0, ""
+}
+
+// powerCapReadings collects the power readings reported in a Redfish
+// PowerControl. It returns nil if there are none. PowerConsumedWatts must
+// already have been converted to an int.
+func powerCapReadings(pc capmc.PowerControl) *capmc.PowerCapReadings {
+	var r capmc.PowerCapReadings
+
+	if pc.PowerConsumedWatts != nil {
+		if v, ok := (*pc.PowerConsumedWatts).(int); ok {
+			r.ConsumedWatts = &v
+		}
+	}
+
+	if pm := pc.PowerMetrics; pm != nil {
+		r.AverageWatts = pm.AverageConsumedWatts
+		r.MinWatts = pm.MinConsumedWatts
+		r.MaxWatts = pm.MaxConsumedWatts
+		r.IntervalInMin = pm.IntervalInMin
+	}
+
+	if pc.OEM != nil && pc.OEM.Cray != nil {
+		r.IdleWatts = pc.OEM.Cray.PowerIdleWatts
+	}
+
+	if r == (capmc.PowerCapReadings{}) {
+		return nil
+	}
+
+	return &r
+}
+
+// controlReadings collects the power reading of the sensor a Redfish Control
+// acts on. It returns nil if there is none.
+func controlReadings(ctl capmc.RFControl) *capmc.PowerCapReadings {
+	if ctl.Sensor == nil || ctl.Sensor.Reading == nil {
+		return nil
+	}
+
+	consumed := int(math.Round(*ctl.Sensor.Reading))
+
+	return &capmc.PowerCapReadings{ConsumedWatts: &consumed}
+}
+
+// apolloPowerReadings reads the power readings of the HPE Apollo 6500 nodes
+// in nodes from their chassis Power resource, as the AccPowerService power
+// limit read for their caps carries none. The readings are returned by
+// xname; nodes whose readings could not be read are left out.
+func (d *CapmcD) apolloPowerReadings(ctx context.Context, nodes []*NodeInfo) map[string]*capmc.PowerCapReadings {
+	readings := make(map[string]*capmc.PowerCapReadings)
+
+	var chassis []*NodeInfo
+	for _, node := range nodes {
+		if !isHpeApollo6500(node) {
+			continue
+		}
+		c := *node
+		c.RfPowerURL = node.RfPowerURL[:strings.Index(node.RfPowerURL, "/AccPowerService")]
+		chassis = append(chassis, &c)
+	}
+	if len(chassis) == 0 {
+		return readings
+	}
+
+	waitNum, waitChan := d.queueBmcCmd(ctx, bmcCmd{cmd: bmcCmdGetPowerCap}, chassis)
+	for i := 0; i < waitNum; i++ {
+		result := <-waitChan
+		if result.rc != 0 {
+			requestLog(ctx).Warnf("get power readings of %s failed: %s",
+				result.ni.Hostname, result.msg)
+			continue
+		}
+
+		var rfPower capmc.Power
+		err := json.Unmarshal([]byte(result.msg), &rfPower)
+		if err != nil || len(rfPower.PowerCtl) == 0 {
+			requestLog(ctx).Warnf("no power readings for %s", result.ni.Hostname)
+			continue
+		}
+
+		pc := rfPower.PowerCtl[0]
+		if pc.PowerConsumedWatts != nil {
+			if v, ok := (*pc.PowerConsumedWatts).(float64); ok {
+				*pc.PowerConsumedWatts = int(math.Round(v))
+			}
+		}
+		if r := powerCapReadings(pc); r != nil {
+			readings[result.ni.Hostname] = r
+		}
+	}
+
+	return readings
+}
+
+// addPowerReadings sets the readings of controls read through the
+// AccPowerService power limit, which carries none, to readings.
+func addPowerReadings(controls []capmc.PowerCapControl, readings *capmc.PowerCapReadings) {
+	if readings == nil {
+		return
+	}
+
+	for i := range controls {
+		if controls[i].Readings == nil {
+			controls[i].Readings = readings
+		}
+	}
+}
+
+// powerCapSetCmds generates the bmcCmdSetPowerCap commands which apply
+// controls to node. The commands are keyed by the NodeInfo they target as
+// some nodes need a separate command per control. kind ("NID" or "xname")
+// is used in the returned error.
+func (d *CapmcD) powerCapSetCmds(node *NodeInfo, controls []capmc.PowerCapControl, kind string) (map[*NodeInfo]bmcCmd, error) {
+	if len(controls) < 1 {
+		return nil, errors.New("Invalid command, 'control' is not an object")
+	}
+
+	// Loop through all the controls and generate a powerGen structure
+	// that will be used to generate the payload later
+	pGen, err := generateControls(node, controls)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pGen) == 0 {
+		return nil, fmt.Errorf("No %s supported controls specified", kind)
+	}
+
+	// Loop through each of the controls that need their own action to
+	// generate a json payload.
+	cmds := make(map[*NodeInfo]bmcCmd)
+	for n, pg := range pGen {
+		payload, err := generatePayload(n, pg)
+		if err != nil {
+			log.Printf("Error: %s", err)
+			continue
+		}
+
+		log.Printf("Debug: payload=%s", payload)
+
+		cmds[n] = bmcCmd{
+			cmd:     bmcCmdSetPowerCap,
+			payload: payload,
+		}
+	}
+
+	return cmds, nil
+}
+
 func generateControls(node *NodeInfo, controls []capmc.PowerCapControl) (map[*NodeInfo]powerGen, error) {
 	powerCtl := make([]capmc.PowerControl, node.RfPwrCtlCnt)
 	seen := make(map[string]bool)
@@ -688,9 +944,8 @@ func generateControls(node *NodeInfo, controls []capmc.PowerCapControl) (map[*No
 
 	for _, control := range controls {
 		var (
-			min, max int = -1, -1
-			ok       bool
-			pc       PowerCap
+			ok bool
+			pc PowerCap
 		)
 
 		if pc, ok = node.PowerCaps[control.Name]; !ok {
@@ -705,23 +960,12 @@ func generateControls(node *NodeInfo, controls []capmc.PowerCapControl) (map[*No
 
 		seen[control.Name] = true
 
-		min = pc.Min
-		max = pc.Max
 		// Trick the marshaller to put a 0 into a json payload by using the
 		// address of a variable that contains a 0.
 		zero := 0
 
-		// The vaule of Zero is used by most vendors as a method of turning off
-		// power capping so it is a valid option.
-		if (min != -1) && (*control.Val < min) && (*control.Val != 0) {
-			errStr := fmt.Sprintf("Control (%s) value (%d) is less than minimum (%d)",
-				control.Name, *control.Val, min)
-			return nil, errors.New(errStr)
-		}
-		if (max != -1) && (*control.Val > max) {
-			errStr := fmt.Sprintf("Control (%s) value (%d) is greater than maximum (%d)",
-				control.Name, *control.Val, max)
-			return nil, errors.New(errStr)
+		if err := checkPowerCapControl(control, pc); err != nil {
+			return nil, err
 		}
 
 		if node.RfControlsCnt > 0 {
@@ -780,6 +1024,27 @@ func generateControls(node *NodeInfo, controls []capmc.PowerCapControl) (map[*No
 	return pControls, nil
 }
 
+// checkPowerCapControl checks the value of control is within the range of
+// the node control pc.
+func checkPowerCapControl(control capmc.PowerCapControl, pc PowerCap) error {
+	if control.Val == nil {
+		return fmt.Errorf("Control (%s) has no value", control.Name)
+	}
+
+	// The vaule of Zero is used by most vendors as a method of turning off
+	// power capping so it is a valid option.
+	if (pc.Min != -1) && (*control.Val < pc.Min) && (*control.Val != 0) {
+		return fmt.Errorf("Control (%s) value (%d) is less than minimum (%d)",
+			control.Name, *control.Val, pc.Min)
+	}
+	if (pc.Max != -1) && (*control.Val > pc.Max) {
+		return fmt.Errorf("Control (%s) value (%d) is greater than maximum (%d)",
+			control.Name, *control.Val, pc.Max)
+	}
+
+	return nil
+}
+
 type powerGen struct {
 	powerCtl   []capmc.PowerControl
 	powerLimit capmc.HpeConfigurePowerLimit
@@ -857,7 +1122,7 @@ func buildPowerCapCapabilitiesGroup(monikerGroup PowerCapCapabilityMonikerGroup,
 		group.Desc = monikerGroup.Desc
 
 		powerCtlArray := componentEndpoint.RedfishSystemInfo.PowerCtlInfo.PowerCtl
-		//TODO: this value requires completion of CASMHMS-2297, so this will need to be defered for now
+		//Redfish does not report static power, it comes from the config file PowerProfile table
 		group.Static = 0
 		var controls []capmc.PowerCapCapabilityControl
 		if powerCtlArray != nil && len(powerCtlArray) > 0 {
@@ -941,6 +1206,76 @@ func buildPowerCapCapabilitiesGroup(monikerGroup PowerCapCapabilityMonikerGroup,
 	return group, err
 }
 
+//monikerFieldMatches - check a PowerProfile field against a moniker field,
+//an empty profile field matches anything
+func monikerFieldMatches(profileField, monikerField string) bool {
+	return profileField == "" || profileField == strings.TrimSuffix(monikerField, "_")
+}
+
+//findPowerProfile - find the most specific PowerProfile matching monikerType
+func findPowerProfile(monikerType PowerCapCapabilityMonikerType, profiles []PowerProfile) *PowerProfile {
+	var (
+		best      *PowerProfile
+		bestScore = -1
+	)
+
+	for i := range profiles {
+		p := profiles[i].PowerCapCapabilityMonikerType
+		pairs := [][2]string{
+			{p.Version, monikerType.Version},
+			{p.SSD, monikerType.SSD},
+			{p.BaseBoardType, monikerType.BaseBoardType},
+			{p.BaseBoardSubType, monikerType.BaseBoardSubType},
+			{p.CPUID, monikerType.CPUID},
+			{p.TDP, monikerType.TDP},
+			{p.NumCores, monikerType.NumCores},
+			{p.MemSizeGiB, monikerType.MemSizeGiB},
+			{p.MemSpeedMHZ, monikerType.MemSpeedMHZ},
+			{p.Accelerator, monikerType.Accelerator},
+		}
+
+		score := 0
+		for _, pair := range pairs {
+			if !monikerFieldMatches(pair[0], pair[1]) {
+				score = -1
+				break
+			}
+			if pair[0] != "" {
+				score++
+			}
+		}
+
+		//on a tie the first profile in the config file wins
+		if score > bestScore {
+			best = &profiles[i]
+			bestScore = score
+		}
+	}
+
+	return best
+}
+
+//applyPowerProfile - fill in the PowerCapGroup values Redfish did not
+//report from the PowerProfile matching monikerType. Values reported by
+//Redfish take precedence over the profile.
+func applyPowerProfile(group *capmc.PowerCapGroup, monikerType PowerCapCapabilityMonikerType, profiles []PowerProfile) {
+	profile := findPowerProfile(monikerType, profiles)
+	if profile == nil {
+		return
+	}
+
+	fill := func(val *int, profileVal int) {
+		if *val == 0 {
+			*val = profileVal
+		}
+	}
+	fill(&group.Static, profile.Static)
+	fill(&group.Supply, profile.Supply)
+	fill(&group.Powerup, profile.Powerup)
+	fill(&group.HostLimitMax, profile.HostLimitMax)
+	fill(&group.HostLimitMin, profile.HostLimitMin)
+}
+
 //get the set of uniqueMonikerGroups contained in the provided SystemHWInventory
 func convertSystemHWInventoryToUniqueMonikerGroups(hwInventory sm.SystemHWInventory) (uniqueMonikerGroups []PowerCapCapabilityMonikerGroup) {
 	//iterate across the nodes in hwInventory list of nodes, and prune any node not in the NidlistRequest
@@ -1017,7 +1352,7 @@ func convertSystemHWInventoryToUniqueMonikerGroups(hwInventory sm.SystemHWInvent
 			mGroup.Xnames = append(mGroup.Xnames, node.ID)
 			monikerMap[name] = mGroup
 		} else {
-			monikerGroup := PowerCapCapabilityMonikerGroup{Name: name, Desc: name, Xnames: []string{node.ID}}
+			monikerGroup := PowerCapCapabilityMonikerGroup{Name: name, Desc: name, Xnames: []string{node.ID}, MonikerType: monikerType}
 			monikerMap[name] = monikerGroup
 		}
 	}
@@ -26,6 +26,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -35,8 +36,11 @@ import (
 	"net/url"
 	"path"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 
+	"github.com/BurntSushi/toml"
 	base "github.com/Cray-HPE/hms-base/v2"
 	"github.com/Cray-HPE/hms-capmc/internal/capmc"
 	compcreds "github.com/Cray-HPE/hms-compcredentials"
@@ -494,6 +498,33 @@ func rfTestMock(m *rfMock) RoundTripFunc {
 	}
 }
 
+// nodeHWInventoryTestData returns the hardware inventory of a single node
+// from the full system test inventory.
+func nodeHWInventoryTestData(t *testing.T, xname string) []byte {
+	var hwInventory sm.SystemHWInventory
+	err := json.Unmarshal(loadTestDataBytes(t, "system-hw-inventory-all.input"),
+		&hwInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := []*sm.HWInvByLoc{}
+	for _, node := range *hwInventory.Nodes {
+		if node.ID == xname {
+			nodes = append(nodes, node)
+		}
+	}
+
+	nodeInventory := sm.SystemHWInventory{XName: xname, Format: hwInventory.Format}
+	nodeInventory.Nodes = &nodes
+	data, err := json.Marshal(nodeInventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
 func DoPowerCapCapabilitiesTestFunc(t *testing.T) RoundTripFunc {
 	return func(req *http.Request) (*http.Response, error) {
 		switch req.URL.String() {
@@ -601,6 +632,20 @@ func DoPowerCapCapabilitiesTestFunc(t *testing.T) RoundTripFunc {
 				Request:    req,
 			}, nil
 		default:
+			// Per node hardware inventory queries
+			if path.Dir(req.URL.Path) == "/Inventory/Hardware/Query" {
+				return &http.Response{
+					Status: fmt.Sprintf("%d %s",
+						http.StatusOK,
+						http.StatusText(http.StatusOK)),
+					StatusCode: http.StatusOK,
+					Body: ioutil.NopCloser(bytes.NewReader(
+						nodeHWInventoryTestData(t, path.Base(req.URL.Path)))),
+					Header:  make(http.Header),
+					Request: req,
+				}, nil
+			}
+
 			//fmt.Printf("handling default case %s\n", req.URL.String())
 			return &http.Response{
 				Status: fmt.Sprintf("%d %s",
@@ -1381,7 +1426,6 @@ func TestDoPowerCapGet(t *testing.T) {
 				ss:       ss,
 				ccs:      ccs,
 				WPool:    base.NewWorkerPool(100, 100*10),
-				debug:    debug,
 			}
 			svc.WPool.Run()
 			svc.hsmURL, _ = url.Parse("http://localhost")
@@ -1519,7 +1563,6 @@ func TestDoPowerCapSet(t *testing.T) {
 				ss:       ss,
 				ccs:      ccs,
 				WPool:    base.NewWorkerPool(100, 100*10),
-				debug:    debug,
 			}
 			svc.WPool.Run()
 			svc.hsmURL, _ = url.Parse("http://localhost")
@@ -1579,6 +1622,106 @@ func TestBuildPowerCapCapabilitiesGroup(t *testing.T) {
 	}
 }
 
+func TestApplyPowerProfile(t *testing.T) {
+	const profilesTOML = `
+[[PowerProfile]]
+Static = 10
+Supply = 1000
+Powerup = 100
+HostLimitMax = 800
+HostLimitMin = 300
+
+[[PowerProfile]]
+CPUID = "Intel(R)Xeon(R)Gold5115CPU@2.40GHz"
+NumCores = "10c"
+Static = 50
+Supply = 900
+Powerup = 425
+HostLimitMax = 850
+HostLimitMin = 350
+
+[[PowerProfile]]
+NumCores = "10c"
+Accelerator = "NoAccel"
+Static = 60
+`
+	var conf Config
+	if _, err := toml.Decode(profilesTOML, &conf); err != nil {
+		t.Fatal(err)
+	}
+
+	gold := PowerCapCapabilityMonikerType{
+		Version:     "3_",
+		CPUID:       "Intel(R)Xeon(R)Gold5115CPU@2.40GHz_",
+		NumCores:    "10c_",
+		MemSizeGiB:  "64GiB_",
+		MemSpeedMHZ: "2400MHz_",
+		Accelerator: "NoAccel",
+	}
+	other := gold
+	other.CPUID = "AMDEPYC7702_"
+	other.NumCores = "64c_"
+
+	tests := []struct {
+		name        string
+		monikerType PowerCapCapabilityMonikerType
+		profiles    []PowerProfile
+		group       capmc.PowerCapGroup
+		want        capmc.PowerCapGroup
+	}{
+		{
+			name:        "No profiles",
+			monikerType: gold,
+			group:       capmc.PowerCapGroup{Supply: 1200},
+			want:        capmc.PowerCapGroup{Supply: 1200},
+		}, {
+			name:        "Most specific",
+			monikerType: gold,
+			profiles:    conf.PowerProfiles,
+			want: capmc.PowerCapGroup{
+				Static: 50, Supply: 900, Powerup: 425,
+				HostLimitMax: 850, HostLimitMin: 350,
+			},
+		}, {
+			name:        "Default",
+			monikerType: other,
+			profiles:    conf.PowerProfiles,
+			want: capmc.PowerCapGroup{
+				Static: 10, Supply: 1000, Powerup: 100,
+				HostLimitMax: 800, HostLimitMin: 300,
+			},
+		}, {
+			name:        "Redfish values kept",
+			monikerType: gold,
+			profiles:    conf.PowerProfiles,
+			group: capmc.PowerCapGroup{
+				Supply: 1200, HostLimitMax: 900, HostLimitMin: 400,
+			},
+			want: capmc.PowerCapGroup{
+				Static: 50, Supply: 1200, Powerup: 425,
+				HostLimitMax: 900, HostLimitMin: 400,
+			},
+		}, {
+			name:        "No match",
+			monikerType: other,
+			profiles:    conf.PowerProfiles[1:],
+			group:       capmc.PowerCapGroup{Supply: 1200},
+			want:        capmc.PowerCapGroup{Supply: 1200},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := test.group
+			applyPowerProfile(&group, test.monikerType, test.profiles)
+			if !reflect.DeepEqual(group, test.want) {
+				t.Errorf("Wrong power cap group: got %+v want %+v",
+					group, test.want)
+			}
+		})
+	}
+}
+
 func TestConvertSystemHWInventoryToUniqueMonikerGroups(t *testing.T) {
 	var testHWInventory sm.SystemHWInventory
 
@@ -2282,3 +2425,314 @@ func TestGenerateControls(t *testing.T) {
 		})
 	}
 }
+
+func TestDoPowerCapSetValidateOnly(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+
+	oneHundred, threeHundred, fiveHundred := 100, 300, 500
+
+	tests := []struct {
+		name string
+		body string
+		e    int
+		nids []capmc.PowerCapValidateNid
+	}{
+		{
+			name: "Valid",
+			body: `{"validate_only":true,"nids":[{"nid":1008,"controls":[{"name":"Node Power Limit","val":500},{"name":"accel","val":300}]}]}`,
+			nids: []capmc.PowerCapValidateNid{
+				{
+					Nid:   1008,
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapValidateControl{
+						{
+							Name:     "Node Power Limit",
+							Val:      &fiveHundred,
+							Resolved: true,
+							Path:     "/redfish/v1/Chassis/Node0/Controls/NodePowerLimit",
+							Min:      400,
+							Max:      1200,
+						}, {
+							Name:   "accel",
+							Val:    &threeHundred,
+							Min:    -1,
+							Max:    -1,
+							ErrMsg: "Undefined control, skipped",
+						},
+					},
+					Payloads: []capmc.PowerCapPayload{
+						{
+							Method:  http.MethodPatch,
+							URL:     "https://x9000c1s2b0/redfish/v1/Chassis/Node0/Controls.Deep",
+							Payload: json.RawMessage(`{"Members":[{"@odata.id":"/redfish/v1/Chassis/Node0/Controls/NodePowerLimit","ControlMode":"Automatic","SetPoint":500}]}`),
+						},
+					},
+				},
+			},
+		}, {
+			name: "Out of range and undefined",
+			body: `{"validate_only":true,"nids":[{"nid":1008,"controls":[{"name":"Node Power Limit","val":100}]},{"nid":1009,"controls":[{"name":"node","val":100}]}]}`,
+			e:    22,
+			nids: []capmc.PowerCapValidateNid{
+				{
+					Nid:   1008,
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapValidateControl{
+						{
+							Name:     "Node Power Limit",
+							Val:      &oneHundred,
+							Resolved: true,
+							Path:     "/redfish/v1/Chassis/Node0/Controls/NodePowerLimit",
+							Min:      400,
+							Max:      1200,
+							E:        22,
+							ErrMsg:   "Control (Node Power Limit) value (100) is less than minimum (400)",
+						},
+					},
+					E:      22,
+					ErrMsg: "Control (Node Power Limit) value (100) is less than minimum (400)",
+				}, {
+					Nid:    1009,
+					E:      22,
+					ErrMsg: "Undefined NID",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// No BMC may be contacted.
+			svc := newXnamePowerCapTestSvc(olympusHSM,
+				func(r *http.Request) (*http.Response, error) {
+					t.Errorf("Unexpected BMC request: %s %s", r.Method, r.URL)
+					return rfStatusMock(http.StatusOK)(r)
+				})
+
+			req, err := http.NewRequest(http.MethodPost,
+				capmc.PowerCapSetV1, bytes.NewBufferString(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			svc.doPowerCapSet(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Returned wrong status code: got %v want %v",
+					w.Code, http.StatusOK)
+			}
+
+			var response capmc.PowerCapValidateResponse
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.E != test.e {
+				t.Errorf("Returned wrong error: got %d (%s) want %d",
+					response.E, response.ErrMsg, test.e)
+			}
+
+			got, _ := json.Marshal(response.Nids)
+			want, _ := json.Marshal(test.nids)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Returned wrong nids:\ngot  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPowerCapControlsReadings(t *testing.T) {
+	var (
+		four, forty, ninetyFive, oneHundred = 4, 40, 95, 100
+		twoFifty, threeHundred, fiveHundred = 250, 300, 500
+		sixHundredTwo, zero                 = 602, 0
+		fourEightyFive                      = 485
+	)
+
+	node := &NodeInfo{
+		Hostname: "x5000c0s0b0n0",
+		BmcFQDN:  "x5000c0s0b0",
+	}
+	controlsNode := &NodeInfo{
+		Hostname:      "x9000c1s2b0n0",
+		BmcFQDN:       "x9000c1s2b0",
+		RfControlsCnt: 1,
+	}
+
+	tests := []struct {
+		name     string
+		ni       *NodeInfo
+		msg      string
+		readings bool
+		want     []capmc.PowerCapControl
+	}{
+		{
+			name: "Cray without readings",
+			msg:  testBmcGetPowerCapCall,
+			want: []capmc.PowerCapControl{
+				{Name: "Node Power Control", Val: &fiveHundred},
+				{Name: "Accelerator0 Power Control", Val: &threeHundred},
+			},
+		}, {
+			name:     "Cray with readings",
+			msg:      testBmcGetPowerCapCall,
+			readings: true,
+			want: []capmc.PowerCapControl{
+				{
+					Name:     "Node Power Control",
+					Val:      &fiveHundred,
+					Readings: &capmc.PowerCapReadings{IdleWatts: &twoFifty},
+				}, {
+					Name:     "Accelerator0 Power Control",
+					Val:      &threeHundred,
+					Readings: &capmc.PowerCapReadings{IdleWatts: &oneHundred},
+				},
+			},
+		}, {
+			name:     "Gigabyte with readings",
+			msg:      testGBBmcGetPowerCapCall,
+			readings: true,
+			want: []capmc.PowerCapControl{
+				{
+					Name: "Chassis Power Control",
+					Val:  &fiveHundred,
+					Readings: &capmc.PowerCapReadings{
+						ConsumedWatts: &ninetyFive,
+						AverageWatts:  &forty,
+						MinWatts:      &four,
+						MaxWatts:      &sixHundredTwo,
+						IntervalInMin: &zero,
+					},
+				},
+			},
+		}, {
+			name: "Olympus without readings",
+			ni:   controlsNode,
+			msg:  olympusPowerControl,
+			want: []capmc.PowerCapControl{
+				{Name: "Node Power Limit", Val: &sevenFifty},
+			},
+		}, {
+			name:     "Olympus with readings",
+			ni:       controlsNode,
+			msg:      olympusPowerControl,
+			readings: true,
+			want: []capmc.PowerCapControl{
+				{
+					Name:     "Node Power Limit",
+					Val:      &sevenFifty,
+					Readings: &capmc.PowerCapReadings{ConsumedWatts: &fourEightyFive},
+				},
+			},
+		},
+	}
+
+	svc := &CapmcD{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ni := test.ni
+			if ni == nil {
+				ni = node
+			}
+			result := bmcPowerRc{ni: ni, msg: test.msg}
+			got, ecode, emsg := svc.powerCapControls(context.Background(), result, "NID",
+				test.readings)
+			if ecode != 0 {
+				t.Fatalf("Unexpected error: %d (%s)", ecode, emsg)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				g, _ := json.Marshal(got)
+				w, _ := json.Marshal(test.want)
+				t.Errorf("Wrong controls:\ngot  %s\nwant %s", g, w)
+			}
+		})
+	}
+}
+
+func TestApolloPowerReadings(t *testing.T) {
+	var (
+		four, forty, ninetyFive = 4, 40, 95
+		sixHundredTwo, zero     = 602, 0
+	)
+
+	nodes := []*NodeInfo{
+		{
+			Hostname:   "x3000c0s19b1n0",
+			BmcFQDN:    "x3000c0s19b1",
+			RfPowerURL: "/redfish/v1/Chassis/1/Power/AccPowerService/PowerLimit",
+		}, {
+			Hostname:   "x3000c0s19b2n0",
+			BmcFQDN:    "x3000c0s19b2",
+			RfPowerURL: "/redfish/v1/Chassis/1/Power/AccPowerService/PowerLimit",
+		}, {
+			Hostname:   "x3000c0s21b0n0",
+			BmcFQDN:    "x3000c0s21b0",
+			RfPowerURL: "/redfish/v1/Chassis/Self/Power",
+		},
+	}
+
+	var (
+		mu   sync.Mutex
+		uris []string
+	)
+	svc := newXnamePowerCapTestSvc(nil, func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		uris = append(uris, r.URL.String())
+		mu.Unlock()
+
+		if r.URL.Host != "x3000c0s19b1" {
+			return &http.Response{
+				StatusCode: http.StatusServiceUnavailable,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+			}, nil
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(bytes.NewBufferString(testGBBmcGetPowerCapCall)),
+		}, nil
+	})
+
+	got := svc.apolloPowerReadings(context.Background(), nodes)
+	want := map[string]*capmc.PowerCapReadings{
+		"x3000c0s19b1n0": {
+			ConsumedWatts: &ninetyFive,
+			AverageWatts:  &forty,
+			MinWatts:      &four,
+			MaxWatts:      &sixHundredTwo,
+			IntervalInMin: &zero,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		g, _ := json.Marshal(got)
+		w, _ := json.Marshal(want)
+		t.Errorf("Wrong readings:\ngot  %s\nwant %s", g, w)
+	}
+
+	sort.Strings(uris)
+	wantURIs := []string{
+		"https://x3000c0s19b1/redfish/v1/Chassis/1/Power",
+		"https://x3000c0s19b2/redfish/v1/Chassis/1/Power",
+	}
+	if !reflect.DeepEqual(uris, wantURIs) {
+		t.Errorf("Wrong BMC requests: got %v want %v", uris, wantURIs)
+	}
+
+	controls := []capmc.PowerCapControl{{Name: "Node Power Limit"}}
+	addPowerReadings(controls, got["x3000c0s19b1n0"])
+	if controls[0].Readings != got["x3000c0s19b1n0"] {
+		t.Errorf("Readings not added to the controls")
+	}
+}
@@ -0,0 +1,278 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+// offTimeTracker records when components were last powered off by CAPMC so
+// the NodeRules MinOffTime and MaxOffTime values can be enforced. The state
+// is kept in memory and, when a file is configured, persisted so it
+// survives a restart of the service.
+type offTimeTracker struct {
+	sync.Mutex
+	offTimes  map[string]time.Time
+	stateFile string
+}
+
+// newOffTimeTracker creates a tracker, loading any previously persisted
+// state from stateFile. An empty stateFile keeps the state in memory only.
+func newOffTimeTracker(stateFile string) *offTimeTracker {
+	t := &offTimeTracker{
+		offTimes:  make(map[string]time.Time),
+		stateFile: stateFile,
+	}
+
+	if stateFile == "" {
+		return t
+	}
+
+	buf, err := os.ReadFile(stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: %s: %s", stateFile, err)
+		}
+		return t
+	}
+
+	if err = json.Unmarshal(buf, &t.offTimes); err != nil {
+		log.Printf("Warning: %s: ignoring off time state: %s", stateFile, err)
+		t.offTimes = make(map[string]time.Time)
+	}
+
+	return t
+}
+
+// save writes the current state to the state file, if there is one. The
+// caller must hold the lock.
+func (t *offTimeTracker) save() {
+	if t.stateFile == "" {
+		return
+	}
+
+	buf, err := json.Marshal(t.offTimes)
+	if err != nil {
+		log.Printf("Error: failed to marshal off time state: %s", err)
+		return
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a
+	// partially written state file behind.
+	tmp := filepath.Join(filepath.Dir(t.stateFile),
+		"."+filepath.Base(t.stateFile)+".tmp")
+	if err = os.WriteFile(tmp, buf, 0644); err != nil {
+		log.Printf("Error: %s: %s", tmp, err)
+		return
+	}
+	if err = os.Rename(tmp, t.stateFile); err != nil {
+		log.Printf("Error: %s: %s", t.stateFile, err)
+	}
+}
+
+// recordOff marks the xnames as powered off at time when.
+func (t *offTimeTracker) recordOff(xnames []string, when time.Time) {
+	if t == nil || len(xnames) == 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for _, x := range xnames {
+		t.offTimes[x] = when
+	}
+	t.save()
+}
+
+// recordOn forgets the off time of xnames now that they are powered on.
+func (t *offTimeTracker) recordOn(xnames []string) {
+	if t == nil || len(xnames) == 0 {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	var changed bool
+	for _, x := range xnames {
+		if _, ok := t.offTimes[x]; ok {
+			delete(t.offTimes, x)
+			changed = true
+		}
+	}
+	if changed {
+		t.save()
+	}
+}
+
+// minOffRemaining returns how much longer xname must remain off to satisfy
+// minOffTime (in seconds). Zero means the component may be powered on.
+func (t *offTimeTracker) minOffRemaining(xname string, minOffTime int, now time.Time) time.Duration {
+	if t == nil || minOffTime <= 0 {
+		return 0
+	}
+
+	t.Lock()
+	offTime, ok := t.offTimes[xname]
+	t.Unlock()
+	if !ok {
+		return 0
+	}
+
+	remaining := offTime.Add(time.Duration(minOffTime) * time.Second).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+
+	return remaining
+}
+
+// maxOffExceeded returns the sorted subset of xnames which have been off
+// longer than maxOffTime (in seconds).
+func (t *offTimeTracker) maxOffExceeded(xnames []string, maxOffTime int, now time.Time) []string {
+	if t == nil || maxOffTime == unlimited || maxOffTime < 0 {
+		return nil
+	}
+
+	limit := time.Duration(maxOffTime) * time.Second
+	var exceeded []string
+
+	t.Lock()
+	for _, x := range xnames {
+		if offTime, ok := t.offTimes[x]; ok && now.Sub(offTime) > limit {
+			exceeded = append(exceeded, x)
+		}
+	}
+	t.Unlock()
+
+	sort.Strings(exceeded)
+
+	return exceeded
+}
+
+// transitionedXnames returns the xnames in locs without a per-xname error in
+// errs, i.e. those which PCS transitioned successfully.
+func transitionedXnames(locs []PCSLocation, errs []*capmc.XnameControlErr) []string {
+	failed := make(map[string]bool, len(errs))
+	for _, e := range errs {
+		failed[e.Xname] = true
+	}
+
+	var xnames []string
+	for _, l := range locs {
+		if !failed[l.Xname] {
+			xnames = append(xnames, l.Xname)
+		}
+	}
+
+	return xnames
+}
+
+// recordTransition records the components the tReq power transition, with
+// outcome data, powered off or on. A failure of the whole request leaves no
+// per-xname errors in data, so nothing is recorded for it.
+func (d *CapmcD) recordTransition(tReq PCSTransition, data capmc.XnameControlResponse) {
+	if data.E != 0 {
+		return
+	}
+
+	xnames := transitionedXnames(tReq.Location, data.Xnames)
+	if tReq.Operation == "on" {
+		d.offTimes.recordOn(xnames)
+	} else {
+		d.offTimes.recordOff(xnames, time.Now())
+	}
+}
+
+// enforceMinOffTime checks the NodeRules MinOffTime for each location that
+// is about to be powered on. When wait is true it sleeps until the last of
+// them may be powered on, as long as that is within MaxMinOffWait; locations
+// that are too early, or would need a longer wait, are removed and reported
+// as per-xname errors. The remaining locations and the number rejected are
+// returned. Nothing is allowed if ctx is done while waiting, and the
+// locations which were waiting are reported as cancelled. The caller keeps
+// its reservations while waiting.
+func (d *CapmcD) enforceMinOffTime(ctx context.Context, locs []PCSLocation, data capmc.XnameControlResponse, wait bool) ([]PCSLocation, int, capmc.XnameControlResponse) {
+	if d.config == nil || d.config.NodeRules.MinOffTime <= 0 {
+		return locs, 0, data
+	}
+
+	minOffTime := d.config.NodeRules.MinOffTime
+	maxWait := time.Duration(d.config.CapmcConf.MaxMinOffWait) * time.Second
+	now := time.Now()
+
+	var (
+		allowed  []PCSLocation
+		rejected int
+		longest  time.Duration
+	)
+	for _, l := range locs {
+		remaining := d.offTimes.minOffRemaining(l.Xname, minOffTime, now)
+		switch {
+		case remaining == 0:
+			allowed = append(allowed, l)
+		case wait && remaining <= maxWait:
+			allowed = append(allowed, l)
+			if remaining > longest {
+				longest = remaining
+			}
+		default:
+			rejected++
+			msg := fmt.Sprintf("MinOffTime of %ds not satisfied, %s remaining",
+				minOffTime, remaining.Round(time.Second))
+			if wait {
+				msg += fmt.Sprintf(", more than the MaxMinOffWait of %ds",
+					d.config.CapmcConf.MaxMinOffWait)
+			}
+			log.Printf("Notice: Skipping %s: %s", l.Xname, msg)
+			data.Xnames = append(data.Xnames,
+				capmc.MakeXnameError(l.Xname, 11, msg)) // EAGAIN
+		}
+	}
+
+	if longest > 0 {
+		log.Printf("Info: Waiting %s for MinOffTime before power on",
+			longest.Round(time.Second))
+		if !sleepCtx(ctx, longest) {
+			for _, l := range allowed {
+				data.Xnames = append(data.Xnames,
+					capmc.MakeXnameError(l.Xname, 125, // ECANCELED
+						"Cancelled waiting for MinOffTime"))
+			}
+			return nil, rejected + len(allowed), data
+		}
+	}
+
+	return allowed, rejected, data
+}
@@ -0,0 +1,211 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestOffTimeTracker(t *testing.T) {
+	now := time.Now()
+	file := filepath.Join(t.TempDir(), "offtimes.json")
+
+	tr := newOffTimeTracker(file)
+	tr.recordOff([]string{"x0c0s0b0n0", "x0c0s0b0n1"}, now.Add(-90*time.Second))
+	tr.recordOff([]string{"x0c0s1b0n0"}, now.Add(-10*time.Second))
+
+	// A new tracker must pick up the persisted state
+	tr = newOffTimeTracker(file)
+	tr.recordOn([]string{"x0c0s0b0n1"})
+
+	var tests = []struct {
+		xname     string
+		minOff    int
+		remaining time.Duration
+	}{
+		{"x0c0s0b0n0", 60, 0},
+		{"x0c0s0b0n1", 60, 0},
+		{"x0c0s1b0n0", 60, 50 * time.Second},
+		{"x0c0s1b0n0", unlimited, 0},
+		{"x0c0s9b0n0", 60, 0},
+	}
+
+	for n, test := range tests {
+		r := tr.minOffRemaining(test.xname, test.minOff, now)
+		if r.Round(time.Second) != test.remaining {
+			t.Errorf("minOffRemaining Test Case %d: FAIL: Expected %v but got %v", n, test.remaining, r)
+		}
+	}
+
+	xnames := []string{"x0c0s1b0n0", "x0c0s0b0n0", "x0c0s0b0n1"}
+	r := tr.maxOffExceeded(xnames, 30, now)
+	if !reflect.DeepEqual(r, []string{"x0c0s0b0n0"}) {
+		t.Errorf("maxOffExceeded: FAIL: Expected [x0c0s0b0n0] but got %v", r)
+	}
+	if r = tr.maxOffExceeded(xnames, unlimited, now); r != nil {
+		t.Errorf("maxOffExceeded unlimited: FAIL: Expected nil but got %v", r)
+	}
+}
+
+func TestEnforceMinOffTime(t *testing.T) {
+	var tSvc CapmcD
+	tSvc.config = &Config{NodeRules: PowerOpRules{MinOffTime: 60}}
+	tSvc.offTimes = newOffTimeTracker("")
+	tSvc.offTimes.recordOff([]string{"x0c0s0b0n1"}, time.Now())
+
+	locs := []PCSLocation{{Xname: "x0c0s0b0n0"}, {Xname: "x0c0s0b0n1"}}
+
+	var data capmc.XnameControlResponse
+	allowed, rejected, data := tSvc.enforceMinOffTime(context.Background(), locs, data, false)
+	if rejected != 1 || len(allowed) != 1 || allowed[0].Xname != "x0c0s0b0n0" {
+		t.Errorf("enforceMinOffTime: FAIL: Expected x0c0s0b0n0 allowed but got %v (%d rejected)", allowed, rejected)
+	}
+	if len(data.Xnames) != 1 || data.Xnames[0].Xname != "x0c0s0b0n1" || data.Xnames[0].E != 11 {
+		t.Errorf("enforceMinOffTime: FAIL: Expected EAGAIN for x0c0s0b0n1 but got %+v", data.Xnames)
+	}
+
+	done := transitionedXnames(locs, data.Xnames)
+	if !reflect.DeepEqual(done, []string{"x0c0s0b0n0"}) {
+		t.Errorf("transitionedXnames: FAIL: Expected [x0c0s0b0n0] but got %v", done)
+	}
+}
+
+func TestEnforceMinOffTimeMaxWait(t *testing.T) {
+	var tSvc CapmcD
+	tSvc.config = &Config{
+		NodeRules: PowerOpRules{MinOffTime: 600},
+		CapmcConf: CapmcConfiguration{MaxMinOffWait: 300},
+	}
+	tSvc.offTimes = newOffTimeTracker("")
+	tSvc.offTimes.recordOff([]string{"x0c0s0b0n1"}, time.Now())
+	tSvc.offTimes.recordOff([]string{"x0c0s0b0n2"}, time.Now().Add(-599*time.Second))
+
+	locs := []PCSLocation{{Xname: "x0c0s0b0n1"}, {Xname: "x0c0s0b0n2"}}
+
+	// x0c0s0b0n1 needs longer than MaxMinOffWait, so it is rejected
+	// rather than waited for.
+	var data capmc.XnameControlResponse
+	allowed, rejected, data := tSvc.enforceMinOffTime(context.Background(), locs, data, true)
+	if rejected != 1 || len(allowed) != 1 || allowed[0].Xname != "x0c0s0b0n2" {
+		t.Errorf("enforceMinOffTime: FAIL: Expected x0c0s0b0n2 allowed but got %v (%d rejected)", allowed, rejected)
+	}
+	if len(data.Xnames) != 1 || data.Xnames[0].Xname != "x0c0s0b0n1" || data.Xnames[0].E != 11 ||
+		!strings.Contains(data.Xnames[0].ErrMsg, "MaxMinOffWait") {
+		t.Errorf("enforceMinOffTime: FAIL: Expected EAGAIN for x0c0s0b0n1 but got %+v", data.Xnames)
+	}
+}
+
+func TestEnforceMinOffTimeCancelled(t *testing.T) {
+	var tSvc CapmcD
+	tSvc.config = &Config{
+		NodeRules: PowerOpRules{MinOffTime: 60},
+		CapmcConf: CapmcConfiguration{MaxMinOffWait: 300},
+	}
+	tSvc.offTimes = newOffTimeTracker("")
+	tSvc.offTimes.recordOff([]string{"x0c0s0b0n1"}, time.Now())
+
+	locs := []PCSLocation{{Xname: "x0c0s0b0n0"}, {Xname: "x0c0s0b0n1"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var data capmc.XnameControlResponse
+	allowed, rejected, data := tSvc.enforceMinOffTime(ctx, locs, data, true)
+	if len(allowed) != 0 || rejected != 2 {
+		t.Errorf("enforceMinOffTime: FAIL: Expected nothing allowed but got %v (%d rejected)", allowed, rejected)
+	}
+
+	var xnames []string
+	for _, e := range data.Xnames {
+		if e.E != 125 {
+			t.Errorf("enforceMinOffTime: FAIL: Expected ECANCELED for %s but got %d", e.Xname, e.E)
+		}
+		xnames = append(xnames, e.Xname)
+	}
+	if !reflect.DeepEqual(xnames, []string{"x0c0s0b0n0", "x0c0s0b0n1"}) {
+		t.Errorf("enforceMinOffTime: FAIL: Expected errors for both xnames but got %v", xnames)
+	}
+}
+
+func TestRecordTransition(t *testing.T) {
+	locs := []PCSLocation{{Xname: "x0c0s0b0n0"}, {Xname: "x0c0s0b0n1"}}
+
+	tests := []struct {
+		name string
+		data capmc.XnameControlResponse
+		off  []string
+	}{
+		{
+			"All off",
+			capmc.XnameControlResponse{},
+			[]string{"x0c0s0b0n0", "x0c0s0b0n1"},
+		},
+		{
+			"One failed",
+			capmc.XnameControlResponse{
+				Xnames: []*capmc.XnameControlErr{
+					capmc.MakeXnameError("x0c0s0b0n1", -1, "failed"),
+				},
+			},
+			[]string{"x0c0s0b0n0"},
+		},
+		{
+			"Whole request failed",
+			capmc.XnameControlResponse{
+				ErrResponse: capmc.ErrResponse{E: 500, ErrMsg: "PCS error"},
+			},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tSvc CapmcD
+			tSvc.offTimes = newOffTimeTracker("")
+			tSvc.recordTransition(PCSTransition{Operation: "off", Location: locs}, tt.data)
+
+			off := tSvc.offTimes.maxOffExceeded(
+				[]string{"x0c0s0b0n0", "x0c0s0b0n1"}, 0, time.Now().Add(time.Second))
+			if !reflect.DeepEqual(off, tt.off) {
+				t.Errorf("Expected %v recorded off but got %v", tt.off, off)
+			}
+
+			// Powering on forgets the off times it recorded.
+			tSvc.recordTransition(PCSTransition{Operation: "on", Location: locs}, tt.data)
+			off = tSvc.offTimes.maxOffExceeded(
+				[]string{"x0c0s0b0n0", "x0c0s0b0n1"}, 0, time.Now().Add(time.Second))
+			if len(off) != 0 {
+				t.Errorf("Expected off times forgotten but got %v", off)
+			}
+		})
+	}
+}
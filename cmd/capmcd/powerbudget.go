@@ -0,0 +1,358 @@
+//
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+// nodePowerCapNames lists, in order of preference, the names of the node
+// level power capping controls reported by the supported BMCs.
+var nodePowerCapNames = []string{
+	"Node Power Limit",
+	CrayNodePCName,
+	HPENodePCName,
+	GenericNodePCName,
+	GigaByteNodePCName,
+	IntelNodePCName,
+	HPEApolloPCName,
+}
+
+// nodePowerCap returns the node level power capping control of node.
+func nodePowerCap(node *NodeInfo) (PowerCap, bool) {
+	for _, name := range nodePowerCapNames {
+		if pc, ok := node.PowerCaps[name]; ok {
+			return pc, true
+		}
+	}
+
+	// A single control must be the node control.
+	if len(node.PowerCaps) == 1 {
+		for _, pc := range node.PowerCaps {
+			return pc, true
+		}
+	}
+
+	return PowerCap{}, false
+}
+
+// budgetNode is a node taking part in a system power budget distribution.
+type budgetNode struct {
+	node   *NodeInfo
+	pc     PowerCap
+	weight float64
+	val    int
+}
+
+// distributePowerBudget sets the val of each node to its share of the
+// available watts. Every node receives at least its minimum cap. What
+// remains is shared in proportion to the node weights, with the share of
+// any node that would exceed its maximum cap going to the others.
+func distributePowerBudget(available int, nodes []*budgetNode) error {
+	var minTotal int
+	for _, bn := range nodes {
+		minTotal += bn.pc.Min
+	}
+
+	if minTotal > available {
+		return fmt.Errorf("Power budget of %dW is less than the %dW minimum of the nodes",
+			available, minTotal)
+	}
+
+	shares := make([]float64, len(nodes))
+	var active []int
+	for i, bn := range nodes {
+		shares[i] = float64(bn.pc.Min)
+		if bn.pc.Max > bn.pc.Min {
+			active = append(active, i)
+		}
+	}
+
+	remaining := float64(available - minTotal)
+	for remaining >= 1 && len(active) > 0 {
+		var weights, given float64
+		for _, i := range active {
+			weights += nodes[i].weight
+		}
+
+		var unsaturated []int
+		for _, i := range active {
+			share := remaining * nodes[i].weight / weights
+			if room := float64(nodes[i].pc.Max) - shares[i]; share >= room {
+				share = room
+			} else {
+				unsaturated = append(unsaturated, i)
+			}
+			shares[i] += share
+			given += share
+		}
+
+		remaining -= given
+		active = unsaturated
+	}
+
+	// Rounding down keeps the total within the budget.
+	for i, bn := range nodes {
+		bn.val = int(math.Floor(shares[i]))
+	}
+
+	return nil
+}
+
+// doSystemPowerBudgetSet is the HTTP handler for the set_system_power_budget
+// API. It turns a system wide power budget into power caps on the ready
+// compute nodes.
+func (d *CapmcD) doSystemPowerBudgetSet(w http.ResponseWriter, r *http.Request) {
+
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	var args capmc.SetSystemPowerBudgetRequest
+
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&args)
+	if err != nil {
+		if err == io.EOF {
+			sendJsonError(w, http.StatusBadRequest, "no request")
+		} else {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	params := d.config.SystemParams
+
+	budget := args.PowerBudget
+	if budget == 0 {
+		budget = params.PowerCapTarget
+	}
+
+	switch {
+	case budget <= 0:
+		sendJsonError(w, http.StatusBadRequest,
+			"no power budget and no PowerCapTarget configured")
+		return
+	case params.PowerBandMin > 0 && budget < params.PowerBandMin:
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("power budget %d is below PowerBandMin %d",
+				budget, params.PowerBandMin))
+		return
+	case params.PowerBandMax > 0 && budget > params.PowerBandMax:
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("power budget %d is above PowerBandMax %d",
+				budget, params.PowerBandMax))
+		return
+	case budget <= params.StaticPower:
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("power budget %d does not exceed StaticPower %d",
+				budget, params.StaticPower))
+		return
+	}
+
+	weights := make(map[int]float64)
+	for _, b := range args.Bias {
+		if b.PowerBias <= 0 {
+			sendJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("invalid power bias %g for NID %d",
+					b.PowerBias, b.Nid))
+			return
+		}
+		weights[b.Nid] = b.PowerBias
+	}
+
+	requestLog(r.Context()).Infof("CAPMC Set System Power Budget - %dW, static %dW",
+		budget, params.StaticPower)
+
+	data := capmc.SetSystemPowerBudgetResponse{
+		PowerBudget: budget,
+		StaticPower: params.StaticPower,
+		Nids:        []capmc.PowerCapNid{},
+	}
+
+	// All enabled ready compute nodes share the budget.
+	query := HSMQuery{
+		Roles:   []string{string(base.RoleCompute)},
+		States:  []string{string(base.StateReady)},
+		Enabled: []bool{true},
+		ctx:     r.Context(),
+	}
+	start := time.Now()
+	nodes, err := d.GetNodesByNID(query)
+	if err != nil {
+		requestLog(r.Context()).Errorf("%s", err)
+		sendJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Audit the budget whether or not it could be applied.
+	var changed bool
+	defer func() {
+		rec := newAuditRecord(r, newOperationID(), bmcCmdSetPowerCap,
+			start, time.Now())
+		rec.ErrResponse = data.ErrResponse
+		rec.Xnames = nidAuditResults(nodes, data.Nids, changed)
+		d.audit.record(r.Context(), rec)
+	}()
+
+	if len(nodes) == 0 {
+		data.E = 22 // EINVAL
+		data.ErrMsg = "No ready compute nodes"
+		SendResponseJSON(w, http.StatusOK, data)
+		return
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Nid < nodes[j].Nid
+	})
+
+	var bnodes []*budgetNode
+	for _, node := range nodes {
+		pc, ok := nodePowerCap(node)
+		if !ok {
+			data.Nids = append(data.Nids,
+				newPowerCapNidError(node.Nid, 22,
+					"No node power cap control"))
+			continue
+		}
+
+		if pc.Min < 0 || pc.Max <= 0 || pc.Min > pc.Max {
+			data.Nids = append(data.Nids,
+				newPowerCapNidError(node.Nid, 22,
+					fmt.Sprintf("No power cap range for control %s", pc.Name)))
+			continue
+		}
+
+		weight := 1.0
+		if wt, ok := weights[node.Nid]; ok {
+			weight = wt
+			delete(weights, node.Nid)
+		}
+
+		bnodes = append(bnodes,
+			&budgetNode{node: node, pc: pc, weight: weight})
+	}
+
+	for nid := range weights {
+		requestLog(r.Context()).Warnf("ignoring power bias for NID %d, not a ready compute node", nid)
+	}
+
+	// Every node must be capped for the budget to hold.
+	if len(data.Nids) > 0 {
+		data.E = 22 // EINVAL
+		data.ErrMsg = "Invalid argument"
+		SendResponseJSON(w, http.StatusOK, data)
+		return
+	}
+
+	err = distributePowerBudget(budget-params.StaticPower, bnodes)
+	if err != nil {
+		data.E = 22 // EINVAL
+		data.ErrMsg = err.Error()
+		SendResponseJSON(w, http.StatusOK, data)
+		return
+	}
+
+	results := make(map[int]*capmc.PowerCapNid)
+	bmcCmds := make(map[*NodeInfo]bmcCmd)
+	var (
+		cmdNodes []*NodeInfo
+		invalid  bool
+	)
+	for _, bn := range bnodes {
+		val := bn.val
+		controls := []capmc.PowerCapControl{{Name: bn.pc.Name, Val: &val}}
+		data.Nids = append(data.Nids,
+			capmc.PowerCapNid{Nid: bn.node.Nid, Controls: controls})
+		data.Allocated += val
+
+		cmds, err := d.powerCapSetCmds(bn.node, controls, "NID")
+		if err != nil {
+			data.Nids[len(data.Nids)-1].E = 22
+			data.Nids[len(data.Nids)-1].ErrMsg = err.Error()
+			invalid = true
+			continue
+		}
+
+		for n, cmd := range cmds {
+			cmdNodes = append(cmdNodes, n)
+			bmcCmds[n] = cmd
+		}
+	}
+
+	for i := range data.Nids {
+		results[data.Nids[i].Nid] = &data.Nids[i]
+	}
+
+	if invalid {
+		data.E = 22 // EINVAL
+		data.ErrMsg = "Invalid argument"
+		SendResponseJSON(w, http.StatusOK, data)
+		return
+	}
+
+	var failed int
+	changed = true
+	waitNum, waitChan := d.queueBmcCmds(r.Context(), bmcCmds, cmdNodes)
+	for i := 0; i < waitNum; i++ {
+		result := <-waitChan
+		if result.rc != 0 {
+			requestLog(r.Context()).Warnf("set power cap failed: %s", result.msg)
+			if res, ok := results[result.ni.Nid]; ok {
+				res.E = result.rc
+				res.ErrMsg = "Error setting power cap for NID"
+			}
+			failed++
+		}
+	}
+
+	// Remember the caps so they can be reapplied if they drift.
+	for _, bn := range bnodes {
+		if res := results[bn.node.Nid]; res != nil && res.E == 0 {
+			d.powerCaps.record(bn.node, res.Controls)
+		}
+	}
+
+	if failed > 0 {
+		data.E = 52 // EBADE ?
+		data.ErrMsg = "Invalid exchange"
+	}
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
@@ -0,0 +1,268 @@
+//
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestDistributePowerBudget(t *testing.T) {
+	type node struct {
+		min, max int
+		weight   float64
+	}
+
+	tests := []struct {
+		name      string
+		available int
+		nodes     []node
+		want      []int
+		wantErr   bool
+	}{
+		{
+			name:      "Even split",
+			available: 1500,
+			nodes:     []node{{400, 1000, 1}, {400, 1000, 1}},
+			want:      []int{750, 750},
+		}, {
+			name:      "Below minimum",
+			available: 700,
+			nodes:     []node{{400, 1000, 1}, {400, 1000, 1}},
+			wantErr:   true,
+		}, {
+			name:      "Exactly minimum",
+			available: 800,
+			nodes:     []node{{400, 1000, 1}, {400, 1000, 1}},
+			want:      []int{400, 400},
+		}, {
+			name:      "Above maximum",
+			available: 5000,
+			nodes:     []node{{400, 1000, 1}, {400, 1000, 1}},
+			want:      []int{1000, 1000},
+		}, {
+			name:      "Weighted",
+			available: 1400,
+			nodes:     []node{{400, 1000, 1}, {400, 1000, 2}},
+			want:      []int{600, 800},
+		}, {
+			name:      "Saturated share redistributed",
+			available: 2000,
+			nodes:     []node{{400, 600, 1}, {400, 1000, 1}, {400, 1000, 1}},
+			want:      []int{600, 700, 700},
+		}, {
+			name:      "Fixed range",
+			available: 1500,
+			nodes:     []node{{500, 500, 1}, {400, 1200, 1}},
+			want:      []int{500, 1000},
+		}, {
+			name:      "Rounded down",
+			available: 1000,
+			nodes:     []node{{0, 1000, 1}, {0, 1000, 1}, {0, 1000, 1}},
+			want:      []int{333, 333, 333},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var bnodes []*budgetNode
+			for _, n := range test.nodes {
+				bnodes = append(bnodes, &budgetNode{
+					pc:     PowerCap{Min: n.min, Max: n.max},
+					weight: n.weight,
+				})
+			}
+
+			err := distributePowerBudget(test.available, bnodes)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			var got []int
+			for _, bn := range bnodes {
+				got = append(got, bn.val)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Wrong distribution: got %v want %v",
+					got, test.want)
+			}
+		})
+	}
+}
+
+func TestDoSystemPowerBudgetSet(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		body        io.Reader
+		params      SystemParameters
+		ret         int
+		e           int
+		allocated   int
+		rfStatus    int
+		nidControls int
+	}{
+		{
+			name:   "Get",
+			method: http.MethodGet,
+			ret:    http.StatusMethodNotAllowed,
+		}, {
+			name:   "Post empty",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(""),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "No budget",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{}`),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Above PowerBandMax",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{"power_budget":5000}`),
+			params: SystemParameters{PowerBandMax: 4000},
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Static power",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{"power_budget":500}`),
+			params: SystemParameters{StaticPower: 500},
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Invalid bias",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{"power_budget":1000,"bias":[{"nid":1008,"power-bias":0}]}`),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:        "PowerCapTarget",
+			method:      http.MethodPost,
+			body:        bytes.NewBufferString(`{}`),
+			params:      SystemParameters{PowerCapTarget: 1000, StaticPower: 100},
+			ret:         http.StatusOK,
+			rfStatus:    http.StatusOK,
+			allocated:   900,
+			nidControls: 1,
+		}, {
+			name:        "Above node maximum",
+			method:      http.MethodPost,
+			body:        bytes.NewBufferString(`{"power_budget":5000}`),
+			ret:         http.StatusOK,
+			rfStatus:    http.StatusOK,
+			allocated:   1200,
+			nidControls: 1,
+		}, {
+			name:   "Below node minimum",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{"power_budget":300}`),
+			ret:    http.StatusOK,
+			e:      22,
+		}, {
+			name:        "BMC failure",
+			method:      http.MethodPost,
+			body:        bytes.NewBufferString(`{"power_budget":1000}`),
+			ret:         http.StatusOK,
+			rfStatus:    http.StatusInternalServerError,
+			e:           52,
+			allocated:   1000,
+			nidControls: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newXnamePowerCapTestSvc(olympusHSM,
+				rfStatusMock(test.rfStatus))
+			// loadConfig returns the global config; don't modify it.
+			conf := *svc.config
+			conf.SystemParams = test.params
+			svc.config = &conf
+
+			req, err := http.NewRequest(test.method,
+				capmc.SystemPowerBudgetSetV1, test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			svc.doSystemPowerBudgetSet(w, req)
+
+			if test.ret != w.Code {
+				t.Fatalf("Returned wrong status code: got %v want %v",
+					w.Code, test.ret)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response capmc.SetSystemPowerBudgetResponse
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.E != test.e {
+				t.Errorf("Returned wrong error: got %d (%s) want %d",
+					response.E, response.ErrMsg, test.e)
+			}
+			if response.Allocated != test.allocated {
+				t.Errorf("Returned wrong allocation: got %d want %d",
+					response.Allocated, test.allocated)
+			}
+
+			var controls int
+			for _, nid := range response.Nids {
+				controls += len(nid.Controls)
+			}
+			if controls != test.nidControls {
+				t.Errorf("Returned wrong number of controls: got %d want %d",
+					controls, test.nidControls)
+			}
+		})
+	}
+}
@@ -24,7 +24,86 @@
 
 package main
 
-func (d *CapmcD) reserveComponents(xnames []string, cmd string) ([]string, error) {
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	reservation "github.com/Cray-HPE/hms-smd/v2/pkg/service-reservations"
+	"github.com/Cray-HPE/hms-smd/v2/pkg/sm"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// reservationOwner identifies the power operation holding a reservation.
+type reservationOwner struct {
+	operation string
+	command   string
+	acquired  time.Time
+}
+
+// reservationOwners maps the xnames CAPMC holds reservations for to the
+// operation which acquired them.
+type reservationOwners struct {
+	sync.Mutex
+	owners map[string]reservationOwner
+}
+
+func newReservationOwners() *reservationOwners {
+	return &reservationOwners{owners: make(map[string]reservationOwner)}
+}
+
+// set records owner as holding the reservations for xnames.
+func (o *reservationOwners) set(xnames []string, owner reservationOwner) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	for _, x := range xnames {
+		o.owners[x] = owner
+	}
+}
+
+// clear forgets the owner of the reservations for xnames.
+func (o *reservationOwners) clear(xnames []string) {
+	if o == nil {
+		return
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	for _, x := range xnames {
+		delete(o.owners, x)
+	}
+}
+
+// get returns the owner of the reservation for xname, if known.
+func (o *reservationOwners) get(xname string) (reservationOwner, bool) {
+	if o == nil {
+		return reservationOwner{}, false
+	}
+
+	o.Lock()
+	defer o.Unlock()
+	owner, ok := o.owners[xname]
+	return owner, ok
+}
+
+// reserveComponents acquires reservations for xnames, and their descendants
+// when cmd powers them off. Components the caller already holds a
+// reservation for, as indicated by a deputy key in held, are targeted but
+// not reserved again.
+func (d *CapmcD) reserveComponents(xnames []string, cmd string, held map[string]string) ([]string, error) {
 	if !d.reservationsEnabled {
 		return nil, nil
 	}
@@ -60,15 +139,73 @@ func (d *CapmcD) reserveComponents(xnames []string, cmd string) ([]string, error
 		targetMap[child] = true
 	}
 
-	//create a final list of targets
+	//create a final list of targets, only reserving those not already held
+	var reserveXnames []string
 	for xname, _ := range targetMap {
 		targetedXnames = append(targetedXnames, xname)
+		if _, ok := held[xname]; !ok {
+			reserveXnames = append(reserveXnames, xname)
+		}
 	}
 
-	err = d.reservation.Aquire(targetedXnames)
+	if len(reserveXnames) > 0 {
+		err = d.reservation.Aquire(reserveXnames)
+		if err != nil {
+			metrics.reservationFailures.inc()
+		}
+	}
 	return targetedXnames, err
 }
 
+// checkDeputyKeys validates caller supplied deputy keys, keyed by xname,
+// against the HSM. Keys which HSM rejects are returned as per-xname errors.
+func (d *CapmcD) checkDeputyKeys(ctx context.Context, deputyKeys map[string]string) ([]*capmc.XnameControlErr, error) {
+	if len(deputyKeys) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]reservation.Key, 0, len(deputyKeys))
+	for xname, key := range deputyKeys {
+		keys = append(keys, reservation.Key{ID: xname, Key: key})
+	}
+
+	rsp, err := d.reservation.ValidateDeputyKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var xnameErrs []*capmc.XnameControlErr
+	for _, f := range rsp.Failure {
+		requestLog(ctx).Warnf("Invalid deputy key for %s: %s", f.ID, f.Reason)
+		xnameErrs = append(xnameErrs, capmc.MakeXnameError(f.ID, 37, // ENOLCK
+			fmt.Sprintf("Invalid deputy key: %s", f.Reason)))
+	}
+	sort.Slice(xnameErrs, func(i, j int) bool {
+		return xnameErrs[i].Xname < xnameErrs[j].Xname
+	})
+
+	return xnameErrs, nil
+}
+
+// normalizeDeputyKeys returns deputyKeys keyed by normalized xname so they
+// match the normalized targets. Two keys for the same component are an error.
+func normalizeDeputyKeys(deputyKeys map[string]string) (map[string]string, error) {
+	if len(deputyKeys) == 0 {
+		return deputyKeys, nil
+	}
+
+	keys := make(map[string]string, len(deputyKeys))
+	for xname, key := range deputyKeys {
+		norm := xnametypes.NormalizeHMSCompID(xname)
+		if _, ok := keys[norm]; ok {
+			return nil, fmt.Errorf("duplicate deputy key for %s", norm)
+		}
+		keys[norm] = key
+	}
+
+	return keys, nil
+}
+
 func (d *CapmcD) releaseComponents(xnames []string) error {
 	if !d.reservationsEnabled {
 		return nil
@@ -81,6 +218,7 @@ func (d *CapmcD) releaseComponents(xnames []string) error {
 		}
 	}
 	error = d.reservation.Release(clearList)
+	d.resOwners.clear(xnames)
 	return error
 }
 
@@ -96,4 +234,266 @@ func (d *CapmcD) removeAllActiveReservations() {
 		targetedXnames = append(targetedXnames, xname)
 	}
 	_ = d.reservation.Release(targetedXnames)
+	d.resOwners.clear(targetedXnames)
+}
+
+// reservationWatcher watches the reservations held by a single power
+// operation for as long as the operation runs. The service reservation
+// package renews reservations on its own but silently drops those it fails
+// to renew; the watcher records such losses so they can be reported to the
+// caller.
+type reservationWatcher struct {
+	sync.Mutex
+	d        *CapmcD
+	xnames   []string
+	failures map[string]string
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// startReservationWatcher starts checking the reservations for xnames are
+// still held every CapmcConfiguration ReservationCheckInterval seconds until
+// stop is called or ctx is done.
+func (d *CapmcD) startReservationWatcher(ctx context.Context, xnames []string) *reservationWatcher {
+	interval := defaultReservationCheckInterval
+	if d.config != nil && d.config.CapmcConf.ReservationCheckInterval > 0 {
+		interval = d.config.CapmcConf.ReservationCheckInterval
+	}
+
+	r := &reservationWatcher{
+		d:        d,
+		xnames:   xnames,
+		failures: make(map[string]string),
+		done:     make(chan struct{}),
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+
+	if !d.reservationsEnabled || len(xnames) == 0 {
+		close(r.done)
+		return r
+	}
+
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				r.check()
+			}
+		}
+	}()
+
+	return r
+}
+
+// check records every reservation of the operation that the service
+// reservation package no longer holds, having failed to renew it.
+func (r *reservationWatcher) check() {
+	held := r.d.reservation.Status()
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, x := range r.xnames {
+		if _, failed := r.failures[x]; failed {
+			continue
+		}
+		if _, ok := held[x]; !ok {
+			log.Printf("Notice: Lost reservation for %s", x)
+			r.failures[x] = "lost or expired"
+		}
+	}
+}
+
+// stop ends the checks and returns a per-xname error for each reservation
+// that could not be kept for the length of the operation. It is safe to call
+// more than once.
+func (r *reservationWatcher) stop() []*capmc.XnameControlErr {
+	r.stopOnce.Do(r.cancel)
+	<-r.done
+
+	r.Lock()
+	defer r.Unlock()
+
+	var xnameErrs []*capmc.XnameControlErr
+	for x, reason := range r.failures {
+		xnameErrs = append(xnameErrs, capmc.MakeXnameError(x, 37, // ENOLCK
+			fmt.Sprintf("Reservation %s", reason)))
+	}
+	sort.Slice(xnameErrs, func(i, j int) bool {
+		return xnameErrs[i].Xname < xnameErrs[j].Xname
+	})
+
+	return xnameErrs
+}
+
+// doReservations lists the HSM reservations held by this instance of CAPMC
+// (GET) or forcibly releases the reservations for a list of xnames (DELETE).
+// Reservations held by some other instance, e.g. one that crashed, are
+// removed through the HSM administrative interface.
+func (d *CapmcD) doReservations(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	switch r.Method {
+	case http.MethodGet:
+		d.doReservationsList(w)
+	case http.MethodDelete:
+		d.doReservationsRelease(w, r)
+	default:
+		w.Header().Set("Allow", "GET,DELETE")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+	}
+}
+
+func (d *CapmcD) doReservationsList(w http.ResponseWriter) {
+	data := capmc.ReservationsResponse{
+		Reservations: make([]capmc.ReservationInfo, 0),
+	}
+
+	if d.reservationsEnabled {
+		for xname, res := range d.reservation.Status() {
+			info := capmc.ReservationInfo{
+				Xname:      xname,
+				Expiration: res.Expiration.Format(time.RFC3339),
+			}
+			if owner, ok := d.resOwners.get(xname); ok {
+				info.Operation = owner.operation
+				info.Command = owner.command
+				info.Acquired = owner.acquired.Format(time.RFC3339)
+			}
+			data.Reservations = append(data.Reservations, info)
+		}
+	}
+
+	sort.Slice(data.Reservations, func(i, j int) bool {
+		return data.Reservations[i].Xname < data.Reservations[j].Xname
+	})
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
+
+func (d *CapmcD) doReservationsRelease(w http.ResponseWriter, r *http.Request) {
+	var args capmc.ReservationRelease
+
+	dec := json.NewDecoder(r.Body)
+	if err := dec.Decode(&args); err != nil {
+		if err == io.EOF {
+			sendJsonError(w, http.StatusBadRequest, "no request")
+		} else {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if len(args.Xnames) == 0 {
+		sendJsonError(w, http.StatusBadRequest,
+			"Bad Request: Required xnames list is empty")
+		return
+	}
+
+	xnames, badXnames := xnametypes.ValidateCompIDs(args.Xnames, true)
+	if len(badXnames) > 0 {
+		sendJsonError(w, http.StatusBadRequest,
+			fmt.Sprintf("Bad Request: invalid xnames: %v", badXnames))
+		return
+	}
+
+	requestLog(r.Context()).Warnf("Force release of reservations for %v, reason: %s",
+		xnames, args.Reason)
+
+	// Split the xnames into those this instance holds and those held by
+	// someone else
+	var own, others []string
+	held := make(map[string]reservation.Reservation)
+	if d.reservationsEnabled {
+		held = d.reservation.Status()
+	}
+	for _, x := range xnames {
+		if _, ok := held[x]; ok {
+			own = append(own, x)
+		} else {
+			others = append(others, x)
+		}
+	}
+
+	var data capmc.XnameControlResponse
+	data.Xnames = make([]*capmc.XnameControlErr, 0, 1)
+
+	if len(own) > 0 {
+		rsp, err := d.reservation.FlexRelease(own)
+		if err != nil {
+			sendJsonError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Failed to release reservations: %s", err))
+			return
+		}
+		for _, f := range rsp.Failure {
+			data.Xnames = append(data.Xnames,
+				capmc.MakeXnameError(f.ID, 37, f.Reason)) // ENOLCK
+		}
+		d.resOwners.clear(rsp.Success.ComponentIDs)
+	}
+
+	if len(others) > 0 {
+		failures, err := d.removeHSMReservations(r.Context(), others)
+		if err != nil {
+			sendJsonError(w, http.StatusInternalServerError,
+				fmt.Sprintf("Failed to remove reservations: %s", err))
+			return
+		}
+		data.Xnames = append(data.Xnames, failures...)
+	}
+
+	if len(data.Xnames) > 0 {
+		data.ErrResponse.E = -1
+		data.ErrResponse.ErrMsg = fmt.Sprintf("Errors encountered releasing %d/%d reservations",
+			len(data.Xnames), len(xnames))
+	}
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
+
+// removeHSMReservations removes the reservations for xnames regardless of
+// who holds them using the HSM administrative locks interface.
+func (d *CapmcD) removeHSMReservations(ctx context.Context, xnames []string) ([]*capmc.XnameControlErr, error) {
+	filter := sm.CompLockV2Filter{
+		ID:              xnames,
+		ProcessingModel: "flexible",
+	}
+
+	payload, err := json.Marshal(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	url := d.hsmURL.String() + "/locks/reservations/remove"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	body, err := d.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var rsp sm.CompLockV2UpdateResult
+	if err = json.Unmarshal(body, &rsp); err != nil {
+		return nil, err
+	}
+
+	var xnameErrs []*capmc.XnameControlErr
+	for _, f := range rsp.Failure {
+		xnameErrs = append(xnameErrs, capmc.MakeXnameError(f.ID, 37, f.Reason)) // ENOLCK
+	}
+
+	return xnameErrs, nil
 }
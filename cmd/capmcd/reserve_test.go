@@ -0,0 +1,384 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestCheckDeputyKeys(t *testing.T) {
+	checkInit()
+	tSvc := CapmcD{reservation: prod, reservationsEnabled: true}
+
+	tests := []struct {
+		keys   map[string]string
+		failed []string
+	}{
+		{
+			keys:   nil,
+			failed: nil,
+		},
+		{
+			keys: map[string]string{
+				"x0c0s0b0n0": heldDeputyKeyPrefix + "0",
+				"x0c0s0b0n1": heldDeputyKeyPrefix + "1",
+			},
+			failed: nil,
+		},
+		{
+			keys: map[string]string{
+				"x0c0s0b0n0": heldDeputyKeyPrefix + "0",
+				"x0c0s0b0n1": "bogus",
+				"x0c0s0b1n0": "",
+			},
+			failed: []string{"x0c0s0b0n1", "x0c0s0b1n0"},
+		},
+	}
+
+	for n, test := range tests {
+		r, err := tSvc.checkDeputyKeys(context.Background(), test.keys)
+		if err != nil {
+			t.Errorf("checkDeputyKeys Test Case %d: FAIL: unexpected error %s", n, err)
+			continue
+		}
+		if len(r) != len(test.failed) {
+			t.Errorf("checkDeputyKeys Test Case %d: FAIL: Expected %v but got %d failures", n, test.failed, len(r))
+			continue
+		}
+		for i, x := range test.failed {
+			if r[i].Xname != x || r[i].E != 37 {
+				t.Errorf("checkDeputyKeys Test Case %d: FAIL: Expected ENOLCK for %s but got %+v", n, x, r[i])
+			}
+		}
+	}
+}
+
+func TestNormalizeDeputyKeys(t *testing.T) {
+	tests := []struct {
+		keys     map[string]string
+		expected map[string]string
+		dup      bool
+	}{
+		{
+			keys:     nil,
+			expected: nil,
+		},
+		{
+			keys: map[string]string{
+				"X0C0S0B0N0":  "k0",
+				"x0c0s0b0n01": "k1",
+			},
+			expected: map[string]string{
+				"x0c0s0b0n0": "k0",
+				"x0c0s0b0n1": "k1",
+			},
+		},
+		{
+			keys: map[string]string{
+				"x0c0s0b0n0": "k0",
+				"X0c0s0b0N0": "k1",
+			},
+			dup: true,
+		},
+	}
+
+	for n, test := range tests {
+		r, err := normalizeDeputyKeys(test.keys)
+		if test.dup {
+			if err == nil {
+				t.Errorf("normalizeDeputyKeys Test Case %d: FAIL: Expected duplicate error but got %v", n, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeDeputyKeys Test Case %d: FAIL: unexpected error %s", n, err)
+			continue
+		}
+		if len(r) != len(test.expected) {
+			t.Errorf("normalizeDeputyKeys Test Case %d: FAIL: Expected %v but got %v", n, test.expected, r)
+			continue
+		}
+		for x, key := range test.expected {
+			if r[x] != key {
+				t.Errorf("normalizeDeputyKeys Test Case %d: FAIL: Expected %s for %s but got %q", n, key, x, r[x])
+			}
+		}
+	}
+}
+
+func TestReserveComponentsHeldMixedCase(t *testing.T) {
+	checkInit()
+	tSvc := CapmcD{reservation: prod, reservationsEnabled: true}
+
+	xnames := []string{"x0c0s2b0n0", "x0c0s2b0n1"}
+	held, err := normalizeDeputyKeys(map[string]string{
+		"X0C0S2B0N1": heldDeputyKeyPrefix + "1",
+	})
+	if err != nil {
+		t.Fatalf("normalizeDeputyKeys: FAIL: unexpected error %s", err)
+	}
+
+	keyErrs, err := tSvc.checkDeputyKeys(context.Background(), held)
+	if err != nil || len(keyErrs) != 0 {
+		t.Fatalf("checkDeputyKeys: FAIL: unexpected failure %v %v", keyErrs, err)
+	}
+
+	targeted, err := tSvc.reserveComponents(xnames, bmcCmdPowerOn, held)
+	defer tSvc.releaseComponents(targeted)
+	if err != nil {
+		t.Fatalf("reserveComponents: FAIL: unexpected error %s", err)
+	}
+
+	if tSvc.reservation.Check([]string{"x0c0s2b0n1"}) {
+		t.Errorf("reserveComponents: FAIL: Expected held X0C0S2B0N1 not to be reserved")
+	}
+}
+
+func TestReserveComponentsHeld(t *testing.T) {
+	checkInit()
+	tSvc := CapmcD{reservation: prod, reservationsEnabled: true}
+
+	xnames := []string{"x0c0s2b0n0", "x0c0s2b0n1"}
+	held := map[string]string{"x0c0s2b0n1": heldDeputyKeyPrefix + "1"}
+
+	targeted, err := tSvc.reserveComponents(xnames, bmcCmdPowerOn, held)
+	defer tSvc.releaseComponents(targeted)
+	if err != nil {
+		t.Fatalf("reserveComponents: FAIL: unexpected error %s", err)
+	}
+
+	sort.Strings(targeted)
+	if len(targeted) != 2 || targeted[0] != xnames[0] || targeted[1] != xnames[1] {
+		t.Errorf("reserveComponents: FAIL: Expected %v targeted but got %v", xnames, targeted)
+	}
+
+	if !tSvc.reservation.Check([]string{"x0c0s2b0n0"}) {
+		t.Errorf("reserveComponents: FAIL: Expected x0c0s2b0n0 to be reserved")
+	}
+	if tSvc.reservation.Check([]string{"x0c0s2b0n1"}) {
+		t.Errorf("reserveComponents: FAIL: Expected held x0c0s2b0n1 not to be reserved")
+	}
+}
+
+func TestReservationWatcher(t *testing.T) {
+	checkInit()
+	tSvc := CapmcD{reservation: prod, reservationsEnabled: true}
+	tSvc.config = &Config{CapmcConf: CapmcConfiguration{ReservationCheckInterval: 1}}
+
+	xnames := []string{"x0c0s3b0n0"}
+	if err := tSvc.reservation.Aquire(xnames); err != nil {
+		t.Fatalf("Aquire: FAIL: unexpected error %s", err)
+	}
+	defer tSvc.releaseComponents(xnames)
+
+	// x0c0s3b0n1 was never reserved so its loss must be reported
+	r := tSvc.startReservationWatcher(context.Background(),
+		[]string{"x0c0s3b0n0", "x0c0s3b0n1"})
+	time.Sleep(1500 * time.Millisecond)
+	errs := r.stop()
+
+	if len(errs) != 1 || errs[0].Xname != "x0c0s3b0n1" || errs[0].E != 37 {
+		t.Errorf("reservationWatcher: FAIL: Expected ENOLCK for x0c0s3b0n1 but got %+v", errs)
+	}
+	if !tSvc.reservation.Check(xnames) {
+		t.Errorf("reservationWatcher: FAIL: Expected x0c0s3b0n0 to still be reserved")
+	}
+
+	// A second stop must not block or change the result
+	if errs = r.stop(); len(errs) != 1 {
+		t.Errorf("reservationWatcher: FAIL: Expected 1 error from second stop but got %d", len(errs))
+	}
+}
+
+// hsmReservationRemoveFunc simulates the HSM administrative reservation
+// removal, failing any component whose xname ends in n7.
+func hsmReservationRemoveFunc() RoundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodPost ||
+			req.URL.String() != "http://localhost:27779/hsm/v2/locks/reservations/remove" {
+			return &http.Response{
+				StatusCode: 404,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("")),
+				Header:     make(http.Header),
+			}, nil
+		}
+
+		var filter struct {
+			ComponentIDs []string
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		json.Unmarshal(body, &filter)
+
+		var rsp struct {
+			Success struct{ ComponentIDs []string }
+			Failure []struct{ ID, Reason string }
+		}
+		for _, x := range filter.ComponentIDs {
+			if strings.HasSuffix(x, "n7") {
+				rsp.Failure = append(rsp.Failure, struct{ ID, Reason string }{x, "Component not found"})
+			} else {
+				rsp.Success.ComponentIDs = append(rsp.Success.ComponentIDs, x)
+			}
+		}
+		out, _ := json.Marshal(rsp)
+
+		return &http.Response{
+			StatusCode: 200,
+			Body:       ioutil.NopCloser(bytes.NewBuffer(out)),
+			Header:     make(http.Header),
+		}, nil
+	}
+}
+
+func TestDoReservations(t *testing.T) {
+	checkInit()
+	var err error
+	tSvc := CapmcD{reservation: prod, reservationsEnabled: true}
+	tSvc.resOwners = newReservationOwners()
+	tSvc.smClient = NewTestClient(hsmReservationRemoveFunc())
+	tSvc.hsmURL, err = url.Parse("http://localhost:27779/hsm/v2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := http.HandlerFunc(tSvc.doReservations)
+
+	xnames := []string{"x0c0s4b0n1", "x0c0s4b0n0"}
+	if err = tSvc.reservation.Aquire(xnames); err != nil {
+		t.Fatalf("Aquire: FAIL: unexpected error %s", err)
+	}
+	defer tSvc.releaseComponents(xnames)
+	tSvc.resOwners.set(xnames[:1], reservationOwner{
+		operation: "op1",
+		command:   bmcCmdPowerOff,
+		acquired:  time.Now(),
+	})
+
+	// List
+	req, _ := http.NewRequest(http.MethodGet, capmc.ReservationsV1, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET: FAIL: Expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	var list capmc.ReservationsResponse
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	found := make(map[string]capmc.ReservationInfo)
+	for _, res := range list.Reservations {
+		found[res.Xname] = res
+	}
+	if res, ok := found["x0c0s4b0n1"]; !ok || res.Operation != "op1" || res.Command != bmcCmdPowerOff {
+		t.Errorf("GET: FAIL: Expected x0c0s4b0n1 owned by op1 but got %+v", res)
+	}
+	if res, ok := found["x0c0s4b0n0"]; !ok || res.Operation != "" || res.Expiration == "" {
+		t.Errorf("GET: FAIL: Expected x0c0s4b0n0 without an owner but got %+v", res)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		code     int
+		failures []string
+	}{
+		{
+			"Not allowed",
+			http.MethodPost,
+			"",
+			http.StatusMethodNotAllowed,
+			nil,
+		},
+		{
+			"Empty xnames",
+			http.MethodDelete,
+			`{"xnames":[]}`,
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"Invalid xnames",
+			http.MethodDelete,
+			`{"xnames":["foo"]}`,
+			http.StatusBadRequest,
+			nil,
+		},
+		{
+			"Release own and foreign",
+			http.MethodDelete,
+			`{"xnames":["x0c0s4b0n1","x0c0s5b0n0","x0c0s5b0n7"],"reason":"stuck"}`,
+			http.StatusOK,
+			[]string{"x0c0s5b0n7"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, capmc.ReservationsV1,
+				bytes.NewBufferString(tc.body))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tc.code {
+				t.Fatalf("handler returned wrong status code: want %v but got %v",
+					tc.code, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			var rsp capmc.XnameControlResponse
+			json.Unmarshal(rr.Body.Bytes(), &rsp)
+			if len(rsp.Xnames) != len(tc.failures) {
+				t.Fatalf("handler returned unexpected failures: want %v but got %+v",
+					tc.failures, rsp.Xnames)
+			}
+			for i, x := range tc.failures {
+				if rsp.Xnames[i].Xname != x {
+					t.Errorf("handler returned unexpected failure: want %s but got %s",
+						x, rsp.Xnames[i].Xname)
+				}
+			}
+		})
+	}
+
+	if tSvc.reservation.Check([]string{"x0c0s4b0n1"}) {
+		t.Errorf("DELETE: FAIL: Expected x0c0s4b0n1 to be released")
+	}
+	if _, ok := tSvc.resOwners.get("x0c0s4b0n1"); ok {
+		t.Errorf("DELETE: FAIL: Expected x0c0s4b0n1 owner to be cleared")
+	}
+}
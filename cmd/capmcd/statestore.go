@@ -0,0 +1,631 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+const (
+	// stateStoreTimeout bounds each request to the shared state store.
+	stateStoreTimeout = 10 * time.Second
+	// stateStoreTxnOps is the most operations sent in one etcd
+	// transaction, under the etcd default limit of 128.
+	stateStoreTxnOps = 100
+	// leaderKey is the state store key held by the replica running the
+	// background work which must only run once, such as reapplying power
+	// caps.
+	leaderKey = "leader"
+)
+
+// stateStore holds JSON values under string keys. CAPMC runs several
+// replicas, so state which outlives a request is kept in an etcd backed
+// store shared by all of them; without one it is kept by each replica in
+// memory, and optionally in a local file.
+type stateStore interface {
+	// get returns the value of key and whether it exists.
+	get(ctx context.Context, key string) ([]byte, bool, error)
+	// list returns the values of the keys starting with prefix.
+	list(ctx context.Context, prefix string) (map[string][]byte, error)
+	// keys returns the sorted keys starting with prefix.
+	keys(ctx context.Context, prefix string) ([]string, error)
+	// put sets the value of key.
+	put(ctx context.Context, key string, val []byte) error
+	// remove deletes keys, ignoring those which don't exist.
+	remove(ctx context.Context, keys ...string) error
+}
+
+// memStateStore is a stateStore kept in memory, and persisted as a JSON
+// object of the values by key when a file is configured.
+type memStateStore struct {
+	sync.Mutex
+	values map[string]json.RawMessage
+	file   string
+}
+
+// newMemStateStore creates a store, loading any values previously persisted
+// in file. An empty file keeps the values in memory only.
+func newMemStateStore(file string) *memStateStore {
+	s := &memStateStore{
+		values: make(map[string]json.RawMessage),
+		file:   file,
+	}
+
+	if file == "" {
+		return s
+	}
+
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: %s: %s", file, err)
+		}
+		return s
+	}
+
+	if err = json.Unmarshal(buf, &s.values); err != nil {
+		log.Printf("Warning: %s: ignoring state: %s", file, err)
+		s.values = make(map[string]json.RawMessage)
+	}
+
+	return s
+}
+
+// save writes the values to the file, if there is one. The caller must
+// hold the lock.
+func (s *memStateStore) save() error {
+	if s.file == "" {
+		return nil
+	}
+
+	buf, err := json.Marshal(s.values)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename so a crash never leaves a
+	// partially written state file behind.
+	tmp := filepath.Join(filepath.Dir(s.file), "."+filepath.Base(s.file)+".tmp")
+	if err = os.WriteFile(tmp, buf, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.file)
+}
+
+func (s *memStateStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	val, ok := s.values[key]
+
+	return append([]byte(nil), val...), ok, nil
+}
+
+func (s *memStateStore) list(ctx context.Context, prefix string) (map[string][]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	vals := make(map[string][]byte)
+	for key, val := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			vals[key] = append([]byte(nil), val...)
+		}
+	}
+
+	return vals, nil
+}
+
+func (s *memStateStore) keys(ctx context.Context, prefix string) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+func (s *memStateStore) put(ctx context.Context, key string, val []byte) error {
+	if !json.Valid(val) {
+		return fmt.Errorf("invalid JSON value for %s", key)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.values[key] = append(json.RawMessage(nil), val...)
+
+	return s.save()
+}
+
+func (s *memStateStore) remove(ctx context.Context, keys ...string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var changed bool
+	for _, key := range keys {
+		if _, ok := s.values[key]; ok {
+			delete(s.values, key)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return s.save()
+}
+
+// etcdStateStore is a stateStore kept in etcd under a key prefix, accessed
+// through the etcd v3 JSON gateway.
+type etcdStateStore struct {
+	url    string
+	prefix string
+	client *http.Client
+}
+
+// newEtcdStateStore creates a store for the keys under prefix in the etcd
+// cluster at url, e.g. "http://cray-capmc-etcd-client:2379".
+func newEtcdStateStore(url, prefix string) *etcdStateStore {
+	return &etcdStateStore{
+		url:    strings.TrimSuffix(url, "/"),
+		prefix: prefix,
+		client: &http.Client{Timeout: stateStoreTimeout},
+	}
+}
+
+// sub returns a store for the keys under prefix within s.
+func (s *etcdStateStore) sub(prefix string) *etcdStateStore {
+	return &etcdStateStore{
+		url:    s.url,
+		prefix: s.prefix + prefix,
+		client: s.client,
+	}
+}
+
+// etcdKeyValue is a key and value as returned by the etcd JSON gateway,
+// which base64 encodes bytes.
+type etcdKeyValue struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// etcdRangeRequest reads the key, or the keys from key up to RangeEnd.
+type etcdRangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type etcdRangeResponse struct {
+	Kvs []etcdKeyValue `json:"kvs"`
+}
+
+type etcdPutRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease string `json:"lease,omitempty"`
+}
+
+type etcdDeleteRequest struct {
+	Key []byte `json:"key"`
+}
+
+// etcdCompare is a condition of a transaction, comparing the Target of Key
+// with the value given.
+type etcdCompare struct {
+	Key            []byte `json:"key"`
+	Target         string `json:"target"`
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          []byte `json:"value,omitempty"`
+	Lease          string `json:"lease,omitempty"`
+}
+
+type etcdRequestOp struct {
+	RequestRange       *etcdRangeRequest  `json:"request_range,omitempty"`
+	RequestPut         *etcdPutRequest    `json:"request_put,omitempty"`
+	RequestDeleteRange *etcdDeleteRequest `json:"request_delete_range,omitempty"`
+}
+
+type etcdTxnRequest struct {
+	Compare []etcdCompare   `json:"compare,omitempty"`
+	Success []etcdRequestOp `json:"success,omitempty"`
+	Failure []etcdRequestOp `json:"failure,omitempty"`
+}
+
+type etcdTxnResponse struct {
+	Succeeded bool `json:"succeeded"`
+	Responses []struct {
+		ResponseRange *etcdRangeResponse `json:"response_range"`
+	} `json:"responses"`
+}
+
+type etcdLeaseGrantRequest struct {
+	TTL int64 `json:"TTL"`
+}
+
+type etcdLeaseGrantResponse struct {
+	ID    string `json:"ID"`
+	Error string `json:"error"`
+}
+
+// etcdLeaseRequest refers to the lease ID, to keep it alive or revoke it.
+type etcdLeaseRequest struct {
+	ID string `json:"ID"`
+}
+
+// etcdLeaseKeepAliveResponse is a keepalive stream response, whose TTL is
+// zero once the lease has expired.
+type etcdLeaseKeepAliveResponse struct {
+	Result struct {
+		ID  string `json:"ID"`
+		TTL string `json:"TTL"`
+	} `json:"result"`
+}
+
+// rangeEnd returns the end of the range of keys starting with prefix.
+func rangeEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// Every key
+	return []byte{0}
+}
+
+// call sends the etcd JSON gateway request req to path, decoding the
+// response into rsp.
+func (s *etcdStateStore) call(ctx context.Context, path string, req, rsp interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		s.url+path, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hrsp, err := s.client.Do(hreq)
+	defer base.DrainAndCloseResponseBody(hrsp)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(hrsp.Body)
+	if err != nil {
+		return err
+	}
+	if hrsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("state store %s: %s: %s", path, hrsp.Status,
+			strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, rsp)
+}
+
+// key returns the etcd key of key.
+func (s *etcdStateStore) key(key string) []byte {
+	return []byte(s.prefix + key)
+}
+
+func (s *etcdStateStore) get(ctx context.Context, key string) ([]byte, bool, error) {
+	var rsp etcdRangeResponse
+	err := s.call(ctx, "/v3/kv/range", etcdRangeRequest{Key: s.key(key)}, &rsp)
+	if err != nil || len(rsp.Kvs) == 0 {
+		return nil, false, err
+	}
+
+	return rsp.Kvs[0].Value, true, nil
+}
+
+// rangeKeys reads the keys starting with prefix, with their values unless
+// keysOnly is set, returning them without the store prefix.
+func (s *etcdStateStore) rangeKeys(ctx context.Context, prefix string, keysOnly bool) ([]etcdKeyValue, error) {
+	start := s.key(prefix)
+	req := etcdRangeRequest{
+		Key:      start,
+		RangeEnd: rangeEnd(start),
+		KeysOnly: keysOnly,
+	}
+
+	var rsp etcdRangeResponse
+	if err := s.call(ctx, "/v3/kv/range", req, &rsp); err != nil {
+		return nil, err
+	}
+	for i := range rsp.Kvs {
+		rsp.Kvs[i].Key = rsp.Kvs[i].Key[len(s.prefix):]
+	}
+
+	return rsp.Kvs, nil
+}
+
+func (s *etcdStateStore) list(ctx context.Context, prefix string) (map[string][]byte, error) {
+	kvs, err := s.rangeKeys(ctx, prefix, false)
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make(map[string][]byte, len(kvs))
+	for _, kv := range kvs {
+		vals[string(kv.Key)] = kv.Value
+	}
+
+	return vals, nil
+}
+
+func (s *etcdStateStore) keys(ctx context.Context, prefix string) ([]string, error) {
+	kvs, err := s.rangeKeys(ctx, prefix, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// etcd returns the keys in order.
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, string(kv.Key))
+	}
+
+	return keys, nil
+}
+
+func (s *etcdStateStore) put(ctx context.Context, key string, val []byte) error {
+	var rsp struct{}
+
+	return s.call(ctx, "/v3/kv/put",
+		etcdPutRequest{Key: s.key(key), Value: val}, &rsp)
+}
+
+func (s *etcdStateStore) remove(ctx context.Context, keys ...string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > stateStoreTxnOps {
+			n = stateStoreTxnOps
+		}
+
+		var txn etcdTxnRequest
+		for _, key := range keys[:n] {
+			txn.Success = append(txn.Success, etcdRequestOp{
+				RequestDeleteRange: &etcdDeleteRequest{Key: s.key(key)},
+			})
+		}
+
+		var rsp etcdTxnResponse
+		if err := s.call(ctx, "/v3/kv/txn", txn, &rsp); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// leaderElection elects one of the CAPMC replicas sharing an etcd state
+// store to run the background work which must only run once. Each replica
+// keeps a single etcd lease alive while it runs, and the leader holds a key
+// attached to it, so another replica takes over within the lease TTL if the
+// leader goes away, or straight away if it shuts down.
+type leaderElection struct {
+	sync.Mutex
+	store *etcdStateStore
+	id    string
+	ttl   time.Duration
+	lease string        // ID of the lease kept alive, if any
+	until time.Time     // when the leadership held expires
+	done  chan struct{} // closed when run returns
+}
+
+// newLeaderElection creates an election through store for this replica,
+// whose leadership lasts ttl unless its lease is kept alive.
+func newLeaderElection(store *etcdStateStore, ttl time.Duration) *leaderElection {
+	id := make([]byte, 4)
+	rand.Read(id)
+
+	host, _ := os.Hostname()
+
+	return &leaderElection{
+		store: store,
+		id:    host + "-" + hex.EncodeToString(id),
+		ttl:   ttl,
+		done:  make(chan struct{}),
+	}
+}
+
+// leading reports whether this replica is the leader. Without an election
+// there is only one replica, which always leads.
+func (l *leaderElection) leading() bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	return time.Now().Before(l.until)
+}
+
+// keepAlive refreshes the lease of this replica, granting a new one if it
+// has none or the last one expired, and returns its ID and TTL.
+func (l *leaderElection) keepAlive(ctx context.Context) (string, time.Duration, error) {
+	l.Lock()
+	lease := l.lease
+	l.Unlock()
+
+	if lease != "" {
+		var rsp etcdLeaseKeepAliveResponse
+		err := l.store.call(ctx, "/v3/lease/keepalive",
+			etcdLeaseRequest{ID: lease}, &rsp)
+		if err != nil {
+			return "", 0, err
+		}
+		if ttl, _ := strconv.ParseInt(rsp.Result.TTL, 10, 64); ttl > 0 {
+			return lease, time.Duration(ttl) * time.Second, nil
+		}
+		log.Printf("Info: leader election lease %s expired", lease)
+	}
+
+	var grant etcdLeaseGrantResponse
+	err := l.store.call(ctx, "/v3/lease/grant",
+		etcdLeaseGrantRequest{TTL: int64(l.ttl / time.Second)}, &grant)
+	if err != nil {
+		return "", 0, err
+	}
+	if grant.Error != "" {
+		return "", 0, fmt.Errorf("lease grant: %s", grant.Error)
+	}
+
+	l.Lock()
+	l.lease = grant.ID
+	l.Unlock()
+
+	return grant.ID, l.ttl, nil
+}
+
+// campaign takes the leadership if no other replica holds it, or keeps it
+// if this replica does.
+func (l *leaderElection) campaign(ctx context.Context) error {
+	start := time.Now()
+
+	lease, ttl, err := l.keepAlive(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Take the key if nobody holds it, otherwise check whether it is
+	// attached to our lease.
+	key := l.store.key(leaderKey)
+	var rsp etcdTxnResponse
+	err = l.store.call(ctx, "/v3/kv/txn", etcdTxnRequest{
+		Compare: []etcdCompare{{Key: key, Target: "CREATE", CreateRevision: "0"}},
+		Success: []etcdRequestOp{{
+			RequestPut: &etcdPutRequest{Key: key, Value: []byte(l.id), Lease: lease},
+		}},
+	}, &rsp)
+	if err == nil && !rsp.Succeeded {
+		err = l.store.call(ctx, "/v3/kv/txn", etcdTxnRequest{
+			Compare: []etcdCompare{{Key: key, Target: "LEASE", Lease: lease}},
+		}, &rsp)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	wasLeader := start.Before(l.until)
+	if rsp.Succeeded {
+		l.until = start.Add(ttl)
+		if !wasLeader {
+			log.Printf("Info: %s is now the leader", l.id)
+		}
+	} else if wasLeader {
+		log.Printf("Info: %s is no longer the leader", l.id)
+		l.until = time.Time{}
+	}
+
+	return nil
+}
+
+// resign revokes the lease of this replica, giving up the leadership so
+// another replica can take over without waiting for the lease to expire.
+func (l *leaderElection) resign() {
+	l.Lock()
+	lease := l.lease
+	l.lease = ""
+	l.until = time.Time{}
+	l.Unlock()
+
+	if lease == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+	defer cancel()
+
+	var rsp struct{}
+	err := l.store.call(ctx, "/v3/lease/revoke", etcdLeaseRequest{ID: lease}, &rsp)
+	if err != nil {
+		log.Printf("Warning: leader election: revoking lease %s: %s", lease, err)
+	}
+}
+
+// run campaigns for the leadership every interval until ctx is done, then
+// resigns. The interval must be well within the lease TTL for the leader to
+// keep it.
+func (l *leaderElection) run(ctx context.Context, interval time.Duration) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := l.campaign(ctx); err != nil {
+			log.Printf("Warning: leader election: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			l.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// leading reports whether this replica runs the background work which
+// must only run once across the replicas.
+func (d *CapmcD) leading() bool {
+	return d.leader.leading()
+}
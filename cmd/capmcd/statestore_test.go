@@ -0,0 +1,363 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd implements enough of the etcd v3 JSON gateway for the state
+// store.
+type fakeEtcd struct {
+	sync.Mutex
+	kvs     map[string][]byte
+	leases  map[string]string // key -> lease ID
+	granted map[string]bool   // live lease IDs
+	nextID  int
+}
+
+func newFakeEtcd(t *testing.T) (*fakeEtcd, string) {
+	f := &fakeEtcd{
+		kvs:     make(map[string][]byte),
+		leases:  make(map[string]string),
+		granted: make(map[string]bool),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	return f, srv.URL
+}
+
+// expire drops every lease and the keys attached to them, as etcd does
+// when they expire.
+func (f *fakeEtcd) expire() {
+	f.Lock()
+	defer f.Unlock()
+
+	for id := range f.granted {
+		f.revoke(id)
+	}
+}
+
+// revoke drops lease id and the keys attached to it. The caller must hold
+// the lock.
+func (f *fakeEtcd) revoke(id string) {
+	delete(f.granted, id)
+	for key, lease := range f.leases {
+		if lease == id {
+			delete(f.kvs, key)
+			delete(f.leases, key)
+		}
+	}
+}
+
+// liveLeases returns the number of leases granted and not yet expired or
+// revoked.
+func (f *fakeEtcd) liveLeases() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.granted)
+}
+
+// rangeKVs returns the key values matching req. The caller must hold the
+// lock.
+func (f *fakeEtcd) rangeKVs(req etcdRangeRequest) etcdRangeResponse {
+	rsp := etcdRangeResponse{Kvs: []etcdKeyValue{}}
+	for key, val := range f.kvs {
+		k := []byte(key)
+		if (req.RangeEnd == nil && bytes.Equal(k, req.Key)) ||
+			(req.RangeEnd != nil && bytes.Compare(k, req.Key) >= 0 &&
+				bytes.Compare(k, req.RangeEnd) < 0) {
+			kv := etcdKeyValue{Key: k}
+			if !req.KeysOnly {
+				kv.Value = val
+			}
+			rsp.Kvs = append(rsp.Kvs, kv)
+		}
+	}
+	sort.Slice(rsp.Kvs, func(i, j int) bool {
+		return bytes.Compare(rsp.Kvs[i].Key, rsp.Kvs[j].Key) < 0
+	})
+
+	return rsp
+}
+
+// apply runs op. The caller must hold the lock.
+func (f *fakeEtcd) apply(op etcdRequestOp) interface{} {
+	switch {
+	case op.RequestPut != nil:
+		f.kvs[string(op.RequestPut.Key)] = op.RequestPut.Value
+		if op.RequestPut.Lease != "" {
+			f.leases[string(op.RequestPut.Key)] = op.RequestPut.Lease
+		} else {
+			delete(f.leases, string(op.RequestPut.Key))
+		}
+		return map[string]interface{}{}
+	case op.RequestDeleteRange != nil:
+		delete(f.kvs, string(op.RequestDeleteRange.Key))
+		delete(f.leases, string(op.RequestDeleteRange.Key))
+		return map[string]interface{}{}
+	default:
+		return f.rangeKVs(*op.RequestRange)
+	}
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	var rsp interface{}
+	dec := json.NewDecoder(r.Body)
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var req etcdRangeRequest
+		dec.Decode(&req)
+		rsp = f.rangeKVs(req)
+	case "/v3/kv/put":
+		var req etcdPutRequest
+		dec.Decode(&req)
+		rsp = f.apply(etcdRequestOp{RequestPut: &req})
+	case "/v3/kv/txn":
+		var req etcdTxnRequest
+		dec.Decode(&req)
+		succeeded := true
+		for _, c := range req.Compare {
+			val, ok := f.kvs[string(c.Key)]
+			switch c.Target {
+			case "CREATE":
+				succeeded = succeeded && !ok
+			case "VALUE":
+				succeeded = succeeded && ok && bytes.Equal(val, c.Value)
+			case "LEASE":
+				succeeded = succeeded && ok && f.leases[string(c.Key)] == c.Lease
+			}
+		}
+		ops := req.Success
+		if !succeeded {
+			ops = req.Failure
+		}
+		var responses []interface{}
+		for _, op := range ops {
+			responses = append(responses, f.apply(op))
+		}
+		rsp = map[string]interface{}{"succeeded": succeeded, "responses": responses}
+	case "/v3/lease/grant":
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.granted[id] = true
+		rsp = map[string]string{"ID": id, "TTL": "30"}
+	case "/v3/lease/keepalive":
+		var req etcdLeaseRequest
+		dec.Decode(&req)
+		result := map[string]string{"ID": req.ID}
+		if f.granted[req.ID] {
+			result["TTL"] = "30"
+		}
+		rsp = map[string]interface{}{"result": result}
+	case "/v3/lease/revoke":
+		var req etcdLeaseRequest
+		dec.Decode(&req)
+		if !f.granted[req.ID] {
+			http.NotFound(w, r)
+			return
+		}
+		f.revoke(req.ID)
+		rsp = map[string]interface{}{}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	json.NewEncoder(w).Encode(rsp)
+}
+
+// testStateStore checks the basic operations of s.
+func testStateStore(t *testing.T, s stateStore) {
+	ctx := context.Background()
+	for key, val := range map[string]string{
+		"a/1": `{"v":1}`,
+		"a/2": `{"v":2}`,
+		"b/1": `{"v":3}`,
+	} {
+		if err := s.put(ctx, key, []byte(val)); err != nil {
+			t.Fatalf("put %s: %s", key, err)
+		}
+	}
+
+	val, ok, err := s.get(ctx, "a/2")
+	if err != nil || !ok || string(val) != `{"v":2}` {
+		t.Errorf("get a/2 = %s, %t, %v", val, ok, err)
+	}
+	if _, ok, err = s.get(ctx, "a/3"); err != nil || ok {
+		t.Errorf("get a/3 = %t, %v", ok, err)
+	}
+
+	vals, err := s.list(ctx, "a/")
+	want := map[string][]byte{"a/1": []byte(`{"v":1}`), "a/2": []byte(`{"v":2}`)}
+	if err != nil || !reflect.DeepEqual(vals, want) {
+		t.Errorf("list a/ = %s, %v", vals, err)
+	}
+
+	if err = s.remove(ctx, "a/1", "a/3"); err != nil {
+		t.Errorf("remove: %s", err)
+	}
+	keys, err := s.keys(ctx, "")
+	if err != nil || !reflect.DeepEqual(keys, []string{"a/2", "b/1"}) {
+		t.Errorf("keys = %v, %v", keys, err)
+	}
+}
+
+func TestMemStateStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "state.json")
+	testStateStore(t, newMemStateStore(file))
+
+	// The values survive a restart.
+	keys, _ := newMemStateStore(file).keys(context.Background(), "")
+	if !reflect.DeepEqual(keys, []string{"a/2", "b/1"}) {
+		t.Errorf("Wrong persisted keys: %v", keys)
+	}
+
+	if err := newMemStateStore("").put(context.Background(), "a", []byte("{")); err == nil {
+		t.Errorf("Invalid JSON value stored")
+	}
+}
+
+func TestEtcdStateStore(t *testing.T) {
+	f, url := newFakeEtcd(t)
+	root := newEtcdStateStore(url, "/capmc/")
+	testStateStore(t, root.sub("test/"))
+
+	var keys []string
+	f.Lock()
+	for key := range f.kvs {
+		keys = append(keys, key)
+	}
+	f.Unlock()
+	sort.Strings(keys)
+	if want := []string{"/capmc/test/a/2", "/capmc/test/b/1"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Wrong etcd keys: got %v want %v", keys, want)
+	}
+
+	// Other prefixes are separate.
+	if vals, err := root.sub("other/").list(context.Background(), ""); err != nil || len(vals) != 0 {
+		t.Errorf("Unexpected values: %v, %v", vals, err)
+	}
+
+	// Removals are batched into transactions.
+	var many []string
+	for i := 0; i < stateStoreTxnOps+5; i++ {
+		many = append(many, "test/x"+strconv.Itoa(i))
+	}
+	for _, key := range many {
+		root.put(context.Background(), key, []byte("{}"))
+	}
+	if err := root.remove(context.Background(), many...); err != nil {
+		t.Errorf("remove: %s", err)
+	}
+	if keys, _ := root.keys(context.Background(), "test/x"); len(keys) != 0 {
+		t.Errorf("Keys not removed: %v", keys)
+	}
+
+	bad := newEtcdStateStore(url+"/bad", "/capmc/")
+	if _, _, err := bad.get(context.Background(), "a"); err == nil ||
+		!strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected a 404 error, got %v", err)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	f, url := newFakeEtcd(t)
+	store := newEtcdStateStore(url, "/capmc/")
+	ctx := context.Background()
+
+	one := newLeaderElection(store, time.Minute)
+	two := newLeaderElection(store, time.Minute)
+	if one.id == two.id {
+		t.Fatalf("Replicas share the ID %s", one.id)
+	}
+
+	var none *leaderElection
+	if !none.leading() {
+		t.Errorf("A lone replica is not the leader")
+	}
+
+	for i, step := range []struct {
+		l      *leaderElection
+		expire bool
+		one    bool
+		two    bool
+	}{
+		{l: one, one: true},
+		{l: two, one: true},
+		{l: one, one: true},               // kept
+		{l: two, expire: true, two: true}, // one went away
+		{l: one, two: true},
+		{l: two, two: true},
+	} {
+		if step.expire {
+			f.expire()
+			one.until = time.Time{}
+		}
+		if err := step.l.campaign(ctx); err != nil {
+			t.Fatalf("%d: campaign: %s", i, err)
+		}
+		if one.leading() != step.one || two.leading() != step.two {
+			t.Errorf("%d: leading one %t two %t, want %t %t", i,
+				one.leading(), two.leading(), step.one, step.two)
+		}
+		// Each replica keeps alive a single lease.
+		if n := f.liveLeases(); n > 2 {
+			t.Errorf("%d: %d leases live, want at most 2", i, n)
+		}
+	}
+
+	// A leader which shuts down revokes its lease, so the other replica
+	// takes over on its next campaign.
+	runCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	two.run(runCtx, time.Minute)
+	if two.leading() {
+		t.Errorf("Resigned replica is still the leader")
+	}
+	if err := one.campaign(ctx); err != nil || !one.leading() {
+		t.Errorf("Leadership not taken over after resigning: %v", err)
+	}
+	if n := f.liveLeases(); n != 1 {
+		t.Errorf("%d leases live after resigning, want 1", n)
+	}
+}
@@ -0,0 +1,405 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// statusStreamFilter is the power states the xname_status stream reports.
+const statusStreamFilter = capmc.FilterShowOnBit | capmc.FilterShowOffBit |
+	capmc.FilterShowUndefinedBit
+
+// statusStream shares one power status poll between the subscribers of the
+// xname_status stream, so however many clients are watching, each component
+// is only asked for its power state once per interval.
+type statusStream struct {
+	sync.Mutex
+	subs      map[*statusSubscriber]struct{}
+	heartbeat time.Duration
+	wake      chan struct{}
+	done      chan struct{}
+}
+
+// statusSubscriber is a client of the xname_status stream. After each poll
+// it is sent the power states of its components.
+type statusSubscriber struct {
+	nodes  []*NodeInfo
+	filter uint
+	states chan map[string]string
+}
+
+// newStatusStream creates a stream whose subscribers are sent a heartbeat
+// whenever they have seen no events for the heartbeat interval.
+func newStatusStream(heartbeat time.Duration) *statusStream {
+	return &statusStream{
+		subs:      make(map[*statusSubscriber]struct{}),
+		heartbeat: heartbeat,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// subscribe adds a subscriber for the power states of nodes which are
+// included by filter.
+func (s *statusStream) subscribe(nodes []*NodeInfo, filter uint) *statusSubscriber {
+	sub := &statusSubscriber{
+		nodes:  nodes,
+		filter: filter,
+		states: make(chan map[string]string, 1),
+	}
+
+	s.Lock()
+	s.subs[sub] = struct{}{}
+	s.Unlock()
+
+	// Poll now rather than leave the new subscriber waiting for its
+	// initial states.
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return sub
+}
+
+// unsubscribe removes a subscriber.
+func (s *statusStream) unsubscribe(sub *statusSubscriber) {
+	s.Lock()
+	delete(s.subs, sub)
+	s.Unlock()
+}
+
+// subscribers returns the current subscribers and the nodes they are
+// watching, each node only once.
+func (s *statusStream) subscribers() ([]*statusSubscriber, []*NodeInfo) {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		subs  []*statusSubscriber
+		nodes []*NodeInfo
+	)
+	seen := make(map[string]bool)
+	for sub := range s.subs {
+		subs = append(subs, sub)
+		for _, ni := range sub.nodes {
+			if !seen[ni.Hostname] {
+				seen[ni.Hostname] = true
+				nodes = append(nodes, ni)
+			}
+		}
+	}
+
+	return subs, nodes
+}
+
+// send passes the power states of the subscriber's nodes to it. A slow
+// subscriber skips straight to the latest states rather than hold up the
+// poll. Only the poller sends, so after emptying the channel the send
+// cannot block.
+func (sub *statusSubscriber) send(states map[string]string) {
+	m := make(map[string]string)
+	for _, ni := range sub.nodes {
+		if state, ok := states[ni.Hostname]; ok {
+			m[ni.Hostname] = state
+		}
+	}
+
+	select {
+	case <-sub.states:
+	default:
+	}
+	sub.states <- m
+}
+
+// statusEvents returns the events for the states which differ from those
+// already sent, in xname order, and records them as sent. Changes to states
+// excluded by filter are recorded but not returned.
+func statusEvents(sent, states map[string]string, filter uint, now time.Time) []capmc.XnameStatusEvent {
+	var xnames []string
+	for xname, state := range states {
+		if sent[xname] != state {
+			xnames = append(xnames, xname)
+		}
+	}
+	sort.Strings(xnames)
+
+	var events []capmc.XnameStatusEvent
+	for _, xname := range xnames {
+		state := states[xname]
+		previous := sent[xname]
+		sent[xname] = state
+
+		var bit uint
+		switch state {
+		case "on":
+			bit = capmc.FilterShowOnBit
+		case "off":
+			bit = capmc.FilterShowOffBit
+		default:
+			bit = capmc.FilterShowUndefinedBit
+		}
+		if filter&bit == 0 {
+			continue
+		}
+
+		events = append(events, capmc.XnameStatusEvent{
+			Xname:              xname,
+			PowerState:         state,
+			PreviousPowerState: previous,
+			Timestamp:          now.UTC().Format(time.RFC3339),
+		})
+	}
+
+	return events
+}
+
+// pollStatusStream reads the power state of every component with a
+// subscriber and passes the states on to the subscribers. Components
+// missing from the status, because it could not be read, keep their
+// previous state.
+func (d *CapmcD) pollStatusStream() {
+	subs, nl := d.statusStream.subscribers()
+	if len(nl) == 0 {
+		return
+	}
+
+	data := d.doCompStatus(context.Background(), nl, bmcCmdPowerStatus, statusStreamFilter)
+	if data.E != 0 {
+		log.Printf("Notice: status stream poll: %s", data.ErrMsg)
+	}
+
+	states := make(map[string]string)
+	for _, xname := range data.On {
+		states[xname] = "on"
+	}
+	for _, xname := range data.Off {
+		states[xname] = "off"
+	}
+	for _, xname := range data.Undefined {
+		states[xname] = "undefined"
+	}
+
+	for _, sub := range subs {
+		sub.send(states)
+	}
+}
+
+// statusStreamPoller runs pollStatusStream every interval, and whenever a
+// subscriber is added, until ctx is done. It then ends the open streams so
+// they do not hold up the server shutting down.
+func (d *CapmcD) statusStreamPoller(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	defer close(d.statusStream.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.statusStream.wake:
+		}
+		d.pollStatusStream()
+	}
+}
+
+// splitQueryList returns the comma separated values of a repeatable query
+// parameter.
+func splitQueryList(values []string) []string {
+	var list []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				list = append(list, s)
+			}
+		}
+	}
+
+	return list
+}
+
+// doXnameStatusStream is the HTTP handler for the xname_status stream API.
+// It pushes the power state changes of the selected components to the
+// client as Server-Sent Events.
+func (d *CapmcD) doXnameStatusStream(w http.ResponseWriter, r *http.Request) {
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	params := r.URL.Query()
+	xnames := splitQueryList(params["xname"])
+	groups := splitQueryList(params["group"])
+
+	if len(xnames) > 0 && len(groups) > 0 {
+		sendJsonError(w, http.StatusBadRequest,
+			"xname and group can not be used together")
+		return
+	}
+
+	filter := uint(statusStreamFilter)
+	if f := params.Get("filter"); f != "" {
+		bits, err := capmc.StatusFilterParse(f)
+		if err != nil {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		filter = bits & statusStreamFilter
+		if filter == 0 {
+			sendJsonError(w, http.StatusBadRequest,
+				"filter must include show_on, show_off or show_undefined")
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok || d.statusStream == nil {
+		sendJsonError(w, http.StatusInternalServerError,
+			"streaming is not supported")
+		return
+	}
+
+	query := HSMQuery{ctx: r.Context()}
+
+	if len(xnames) > 0 {
+		var bad []string
+
+		query.ComponentIDs, bad = xnametypes.ValidateCompIDs(xnames, false)
+		if len(bad) > 0 {
+			sendJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("invalid/duplicate xnames: %v", bad))
+			return
+		}
+	}
+
+	// As for get_xname_status only watch the hardware CAPMC can control
+	// the power of.
+	if d.config != nil {
+		if pc, ok := d.config.PowerControls["On"]; ok {
+			query.Types = append(query.Types, pc.CompSeq...)
+		}
+	}
+
+	var (
+		nl  []*NodeInfo
+		err error
+	)
+	if len(groups) > 0 {
+		query.Groups = groups
+		nl, err = d.GetNodesByGroup(query)
+	} else {
+		nl, err = d.GetNodesByXname(query)
+	}
+	if err != nil {
+		var (
+			status      int
+			compIDsErr  *InvalidCompIDsError
+			groupsError *InvalidGroupsError
+		)
+
+		if errors.As(err, &compIDsErr) || errors.As(err, &groupsError) {
+			status = http.StatusBadRequest
+		} else {
+			log.Printf("Error: %s", err)
+			status = http.StatusInternalServerError
+		}
+
+		sendJsonError(w, status, err.Error())
+		return
+	}
+
+	if len(nl) == 0 {
+		sendJsonError(w, http.StatusNotFound, "No matching components found")
+		return
+	}
+
+	log.Printf("Info: Xname status stream opened for %d components", len(nl))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	sub := d.statusStream.subscribe(nl, filter)
+	defer d.statusStream.unsubscribe(sub)
+
+	heartbeat := time.NewTicker(d.statusStream.heartbeat)
+	defer heartbeat.Stop()
+
+	sent := make(map[string]string)
+	var id int
+
+	for {
+		select {
+		case <-r.Context().Done():
+			log.Printf("Info: Xname status stream closed by client")
+			return
+		case <-d.statusStream.done:
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case states := <-sub.states:
+			events := statusEvents(sent, states, sub.filter, time.Now())
+			if len(events) == 0 {
+				continue
+			}
+			for _, event := range events {
+				buf, _ := json.Marshal(event)
+				id++
+				_, err := fmt.Fprintf(w, "id: %d\nevent: power_state\ndata: %s\n\n",
+					id, buf)
+				if err != nil {
+					return
+				}
+			}
+			// Events count as a sign of life.
+			heartbeat.Reset(d.statusStream.heartbeat)
+		}
+		flusher.Flush()
+	}
+}
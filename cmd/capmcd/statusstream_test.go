@@ -0,0 +1,341 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+// statesBackend is a PowerBackend reporting the power states in states.
+type statesBackend struct {
+	stubBackend
+	sync.Mutex
+	states map[string]string
+	polled [][]string
+}
+
+func (b *statesBackend) set(xname, state string) {
+	b.Lock()
+	b.states[xname] = state
+	b.Unlock()
+}
+
+func (b *statesBackend) Status(ctx context.Context, nl []*NodeInfo, command string, filter uint) capmc.XnameStatusResponse {
+	b.Lock()
+	defer b.Unlock()
+
+	var (
+		data   capmc.XnameStatusResponse
+		xnames []string
+	)
+	for _, ni := range nl {
+		xnames = append(xnames, ni.Hostname)
+		switch b.states[ni.Hostname] {
+		case "on":
+			data.On = append(data.On, ni.Hostname)
+		case "off":
+			data.Off = append(data.Off, ni.Hostname)
+		case "undefined":
+			data.Undefined = append(data.Undefined, ni.Hostname)
+		}
+	}
+	b.polled = append(b.polled, xnames)
+
+	return data
+}
+
+func TestStatusEvents(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	ts := "2026-10-19T12:00:00Z"
+	all := uint(statusStreamFilter)
+
+	tests := []struct {
+		name     string
+		sent     map[string]string
+		states   map[string]string
+		filter   uint
+		expected []capmc.XnameStatusEvent
+		sentNow  map[string]string
+	}{
+		{
+			name:   "Initial states",
+			sent:   map[string]string{},
+			states: map[string]string{"x0c0s2b0n0": "off", "x0c0s1b0n0": "on"},
+			filter: all,
+			expected: []capmc.XnameStatusEvent{
+				{Xname: "x0c0s1b0n0", PowerState: "on", Timestamp: ts},
+				{Xname: "x0c0s2b0n0", PowerState: "off", Timestamp: ts},
+			},
+			sentNow: map[string]string{"x0c0s1b0n0": "on", "x0c0s2b0n0": "off"},
+		},
+		{
+			name:     "Unchanged",
+			sent:     map[string]string{"x0c0s1b0n0": "on"},
+			states:   map[string]string{"x0c0s1b0n0": "on"},
+			filter:   all,
+			expected: nil,
+			sentNow:  map[string]string{"x0c0s1b0n0": "on"},
+		},
+		{
+			name:   "Changed",
+			sent:   map[string]string{"x0c0s1b0n0": "on", "x0c0s2b0n0": "on"},
+			states: map[string]string{"x0c0s1b0n0": "off", "x0c0s2b0n0": "on"},
+			filter: all,
+			expected: []capmc.XnameStatusEvent{
+				{Xname: "x0c0s1b0n0", PowerState: "off",
+					PreviousPowerState: "on", Timestamp: ts},
+			},
+			sentNow: map[string]string{"x0c0s1b0n0": "off", "x0c0s2b0n0": "on"},
+		},
+		{
+			name:     "Filtered",
+			sent:     map[string]string{"x0c0s1b0n0": "on"},
+			states:   map[string]string{"x0c0s1b0n0": "undefined"},
+			filter:   capmc.FilterShowOnBit | capmc.FilterShowOffBit,
+			expected: nil,
+			sentNow:  map[string]string{"x0c0s1b0n0": "undefined"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events := statusEvents(test.sent, test.states, test.filter, now)
+			if !reflect.DeepEqual(events, test.expected) {
+				t.Errorf("expected events %v, got %v", test.expected, events)
+			}
+			if !reflect.DeepEqual(test.sent, test.sentNow) {
+				t.Errorf("expected sent %v, got %v", test.sentNow, test.sent)
+			}
+		})
+	}
+}
+
+func TestPollStatusStream(t *testing.T) {
+	n1 := &NodeInfo{Hostname: "x0c0s1b0n0"}
+	n2 := &NodeInfo{Hostname: "x0c0s2b0n0"}
+	b := &statesBackend{states: map[string]string{
+		"x0c0s1b0n0": "on",
+		"x0c0s2b0n0": "off",
+	}}
+	svc := &CapmcD{backend: b, statusStream: newStatusStream(time.Minute)}
+
+	// Nothing is polled without subscribers.
+	svc.pollStatusStream()
+	if len(b.polled) != 0 {
+		t.Fatalf("expected no polls, got %v", b.polled)
+	}
+
+	sub1 := svc.statusStream.subscribe([]*NodeInfo{n1, n2}, statusStreamFilter)
+	sub2 := svc.statusStream.subscribe([]*NodeInfo{n2}, statusStreamFilter)
+
+	svc.pollStatusStream()
+	if len(b.polled) != 1 || len(b.polled[0]) != 2 {
+		t.Fatalf("expected one poll of 2 components, got %v", b.polled)
+	}
+	if got := <-sub2.states; !reflect.DeepEqual(got,
+		map[string]string{"x0c0s2b0n0": "off"}) {
+		t.Errorf("unexpected subscriber states %v", got)
+	}
+
+	// A subscriber which has not kept up only sees the latest states.
+	b.set("x0c0s1b0n0", "off")
+	svc.pollStatusStream()
+	expected := map[string]string{"x0c0s1b0n0": "off", "x0c0s2b0n0": "off"}
+	if got := <-sub1.states; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected subscriber states %v, got %v", expected, got)
+	}
+	select {
+	case got := <-sub1.states:
+		t.Errorf("unexpected stale states %v", got)
+	default:
+	}
+
+	svc.statusStream.unsubscribe(sub1)
+	svc.statusStream.unsubscribe(sub2)
+	svc.pollStatusStream()
+	if len(b.polled) != 2 {
+		t.Errorf("expected no poll after unsubscribing, got %v", b.polled)
+	}
+}
+
+func TestDoXnameStatusStreamErrors(t *testing.T) {
+	svc := &CapmcD{statusStream: newStatusStream(time.Minute)}
+
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		code     int
+		expected string
+	}{
+		{
+			name:     "Bad method",
+			method:   http.MethodPost,
+			code:     http.StatusMethodNotAllowed,
+			expected: `{"e":405,"err_msg":"(POST) Not Allowed"}`,
+		},
+		{
+			name:     "Xname and group",
+			method:   http.MethodGet,
+			query:    "?xname=x0c0s1b0n0&group=blue",
+			code:     http.StatusBadRequest,
+			expected: `{"e":400,"err_msg":"xname and group can not be used together"}`,
+		},
+		{
+			name:     "Unknown filter",
+			method:   http.MethodGet,
+			query:    "?filter=show_bogus",
+			code:     http.StatusBadRequest,
+			expected: `{"e":400,"err_msg":"invalid filter string: show_bogus"}`,
+		},
+		{
+			name:     "No power state filter",
+			method:   http.MethodGet,
+			query:    "?filter=show_ready",
+			code:     http.StatusBadRequest,
+			expected: `{"e":400,"err_msg":"filter must include show_on, show_off or show_undefined"}`,
+		},
+		{
+			name:     "Bad xname",
+			method:   http.MethodGet,
+			query:    "?xname=x0c0s1b0n0,bogus",
+			code:     http.StatusBadRequest,
+			expected: `{"e":400,"err_msg":"invalid/duplicate xnames: [bogus]"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method,
+				capmc.XnameStatusStreamV1+test.query, nil)
+			w := httptest.NewRecorder()
+
+			svc.doXnameStatusStream(w, req)
+
+			if w.Code != test.code {
+				t.Errorf("expected status %d, got %d", test.code, w.Code)
+			}
+			if body := strings.TrimSpace(w.Body.String()); body != test.expected {
+				t.Errorf("expected body %s, got %s", test.expected, body)
+			}
+		})
+	}
+}
+
+func TestDoXnameStatusStream(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+	b := &statesBackend{states: map[string]string{"x9000c1s2b0n0": "on"}}
+	svc := newXnamePowerCapTestSvc(olympusHSM, rfStatusMock(http.StatusOK))
+	svc.backend = b
+	svc.statusStream = newStatusStream(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.statusStreamPoller(ctx, 10*time.Millisecond)
+
+	ts := httptest.NewServer(http.HandlerFunc(svc.doXnameStatusStream))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + capmc.XnameStatusStreamV1 +
+		"?xname=x9000c1s2b0n0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected an event stream, got %s", ct)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		for lines.Scan() {
+			line := lines.Text()
+			if line == "" || strings.HasPrefix(line, "id: ") ||
+				strings.HasPrefix(line, "event: ") {
+				continue
+			}
+			return line
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return ""
+	}
+	event := func(line string) capmc.XnameStatusEvent {
+		var e capmc.XnameStatusEvent
+		if !strings.HasPrefix(line, "data: ") {
+			t.Fatalf("expected an event, got %q", line)
+		}
+		if err := json.Unmarshal([]byte(line[len("data: "):]), &e); err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	e := event(next())
+	if e.Xname != "x9000c1s2b0n0" || e.PowerState != "on" ||
+		e.PreviousPowerState != "" {
+		t.Errorf("unexpected initial event %+v", e)
+	}
+
+	// The repeated polls of an unchanged state only produce heartbeats.
+	if line := next(); line != ": heartbeat" {
+		t.Errorf("expected a heartbeat, got %q", line)
+	}
+
+	b.set("x9000c1s2b0n0", "off")
+	line := next()
+	for line == ": heartbeat" {
+		line = next()
+	}
+	e = event(line)
+	if e.PowerState != "off" || e.PreviousPowerState != "on" {
+		t.Errorf("unexpected change event %+v", e)
+	}
+
+	// Stopping the poller ends the stream.
+	cancel()
+	for lines.Scan() {
+	}
+}
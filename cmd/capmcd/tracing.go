@@ -0,0 +1,410 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+// CAPMC traces its requests with OpenTelemetry. W3C Trace Context is read
+// from incoming requests and passed on to PCS and HSM, and the finished
+// spans are exported to an OTLP/HTTP collector in the OTLP JSON encoding.
+// As with the metrics, the little of the OpenTelemetry SDK this needs is
+// implemented here rather than vendored. Tracing is off, and every span a
+// no-op, unless an endpoint is configured.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+
+	spanStatusError = 2
+)
+
+const (
+	// traceparentHeader carries the W3C Trace Context.
+	traceparentHeader = "traceparent"
+	// Spans are exported in batches of up to traceBatchSize, at least
+	// every traceFlushInterval. Spans finished while traceQueueSize are
+	// waiting to be exported are dropped.
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+	traceExportTimeout = 10 * time.Second
+)
+
+// spanContext identifies a span within its trace.
+type spanContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+type spanContextKey struct{}
+
+// parseTraceparent decodes a W3C traceparent header value.
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		(parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return sc, false
+	}
+	if sc.traceID == ([16]byte{}) || sc.spanID == ([8]byte{}) {
+		return sc, false
+	}
+	sc.sampled = flags&1 != 0
+
+	return sc, true
+}
+
+// traceparent encodes sc as a W3C traceparent header value.
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.sampled {
+		flags = "01"
+	}
+
+	return fmt.Sprintf("00-%x-%x-%s", sc.traceID, sc.spanID, flags)
+}
+
+// spanContextFrom returns the span context carried by ctx, if any.
+func spanContextFrom(ctx context.Context) (spanContext, bool) {
+	if ctx == nil {
+		return spanContext{}, false
+	}
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+
+	return sc, ok
+}
+
+// injectTraceContext passes the trace context of ctx on with req.
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	if sc, ok := spanContextFrom(ctx); ok {
+		req.Header.Set(traceparentHeader, sc.traceparent())
+	}
+}
+
+// otlpAttribute is a span attribute in the OTLP JSON encoding.
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+// span is an operation being traced. A nil span, used when tracing is off,
+// ignores its method calls.
+type span struct {
+	tracer   *tracer
+	name     string
+	kind     int
+	sc       spanContext
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    []otlpAttribute
+	errMsg   string
+}
+
+// setAttr sets a string, integer or boolean attribute of the span.
+func (s *span) setAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+
+	var v map[string]string
+	switch value := value.(type) {
+	case int:
+		// OTLP JSON encodes 64 bit integers as strings.
+		v = map[string]string{"intValue": strconv.Itoa(value)}
+	case bool:
+		v = map[string]string{"boolValue": strconv.FormatBool(value)}
+	default:
+		v = map[string]string{"stringValue": fmt.Sprint(value)}
+	}
+	s.attrs = append(s.attrs, otlpAttribute{Key: key, Value: v})
+}
+
+// setError marks the span as failed with err.
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.errMsg = err.Error()
+}
+
+// finish ends the span, queueing it for export if it is sampled.
+func (s *span) finish() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if s.sc.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// tracer creates spans and exports them to an OTLP/HTTP endpoint.
+type tracer struct {
+	endpoint string
+	service  string
+	ratio    float64
+	client   *http.Client
+	queue    chan *span
+	flushed  chan struct{}
+}
+
+// tracing is the service tracer, nil when tracing is off.
+var tracing *tracer
+
+// newTracer creates a tracer exporting to endpoint, sampling ratio of the
+// traces started by CAPMC. Traces started by callers are sampled as the
+// caller decided.
+func newTracer(endpoint, service string, ratio float64) *tracer {
+	return &tracer{
+		endpoint: endpoint,
+		service:  service,
+		ratio:    ratio,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		queue:    make(chan *span, traceQueueSize),
+		flushed:  make(chan struct{}),
+	}
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		binary.BigEndian.PutUint64(b[len(b)-8:], uint64(time.Now().UnixNano()))
+	}
+}
+
+// startSpan starts a span named name as a child of parent.
+func (t *tracer) startSpan(ctx context.Context, name string, kind int, parent spanContext) (context.Context, *span) {
+	s := &span{
+		tracer:   t,
+		name:     name,
+		kind:     kind,
+		sc:       parent,
+		parentID: parent.spanID,
+		start:    time.Now(),
+	}
+	randomID(s.sc.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s.sc), s
+}
+
+// startServerSpan starts the span of an incoming request, continuing the
+// trace of the caller when it sent one.
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	t := tracing
+	if t == nil {
+		return r.Context(), nil
+	}
+
+	parent, ok := parseTraceparent(r.Header.Get(traceparentHeader))
+	if !ok {
+		randomID(parent.traceID[:])
+		parent.spanID = [8]byte{}
+		parent.sampled = sampleTrace(parent.traceID, t.ratio)
+	}
+
+	return t.startSpan(r.Context(), name, spanKindServer, parent)
+}
+
+// startClientSpan starts the span of a call to another service made on
+// behalf of the trace in ctx. Calls made outside of a trace, such as by
+// the background tasks, are not traced.
+func startClientSpan(ctx context.Context, name string) (context.Context, *span) {
+	t := tracing
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent, ok := spanContextFrom(ctx)
+	if !ok {
+		return ctx, nil
+	}
+
+	return t.startSpan(ctx, name, spanKindClient, parent)
+}
+
+// sampleTrace decides from its ID whether a trace is sampled, keeping
+// ratio of the traces.
+func sampleTrace(traceID [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	if ratio <= 0 {
+		return false
+	}
+
+	return float64(binary.BigEndian.Uint64(traceID[8:])>>11)/(1<<53) < ratio
+}
+
+// enqueue queues a finished span for export, dropping it when the queue is
+// full rather than hold up the request.
+func (t *tracer) enqueue(s *span) {
+	select {
+	case t.queue <- s:
+	default:
+	}
+}
+
+// run exports the queued spans until ctx is done, then exports those left.
+func (t *tracer) run(ctx context.Context) {
+	defer close(t.flushed)
+
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// otlpRequest encodes spans as an OTLP ExportTraceServiceRequest.
+func (t *tracer) otlpRequest(spans []*span) map[string]interface{} {
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, s := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.sc.traceID[:]),
+			"spanId":            hex.EncodeToString(s.sc.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != ([8]byte{}) {
+			otlpSpan["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if len(s.attrs) > 0 {
+			otlpSpan["attributes"] = s.attrs
+		}
+		if s.errMsg != "" {
+			otlpSpan["status"] = map[string]interface{}{
+				"code":    spanStatusError,
+				"message": s.errMsg,
+			}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{{
+						Key:   "service.name",
+						Value: map[string]string{"stringValue": t.service},
+					}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "capmcd"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+// export sends spans to the collector. Spans which can't be exported are
+// dropped; tracing must not get in the way of power control.
+func (t *tracer) export(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.otlpRequest(spans))
+	if err != nil {
+		log.Printf("Error: can't encode trace spans: %s", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error: can't export trace spans: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	base.SetHTTPUserAgent(req, serviceName)
+
+	rsp, err := t.client.Do(req)
+	defer base.DrainAndCloseResponseBody(rsp)
+	if err != nil {
+		log.Printf("Notice: failed to export %d trace spans: %s", len(spans), err)
+		return
+	}
+	if rsp.StatusCode >= http.StatusMultipleChoices {
+		log.Printf("Notice: failed to export %d trace spans: %s",
+			len(spans), rsp.Status)
+	}
+}
@@ -0,0 +1,304 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{testTraceparent, true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		// Later versions may add fields.
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01", false, false},
+		{"", false, false},
+	}
+
+	for _, test := range tests {
+		sc, ok := parseTraceparent(test.value)
+		if ok != test.ok {
+			t.Errorf("%q: expected ok %t, got %t", test.value, test.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if sc.sampled != test.sampled {
+			t.Errorf("%q: expected sampled %t, got %t",
+				test.value, test.sampled, sc.sampled)
+		}
+		if hex.EncodeToString(sc.traceID[:]) != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+			hex.EncodeToString(sc.spanID[:]) != "00f067aa0ba902b7" {
+			t.Errorf("%q: wrong IDs %x %x", test.value, sc.traceID, sc.spanID)
+		}
+	}
+
+	sc, _ := parseTraceparent(testTraceparent)
+	if value := sc.traceparent(); value != testTraceparent {
+		t.Errorf("expected %s, got %s", testTraceparent, value)
+	}
+}
+
+func TestSampleTrace(t *testing.T) {
+	var low, high [16]byte
+	high[8] = 0xff
+
+	tests := []struct {
+		traceID  [16]byte
+		ratio    float64
+		expected bool
+	}{
+		{high, 1, true},
+		{low, 0, false},
+		{low, 0.5, true},
+		{high, 0.5, false},
+	}
+
+	for _, test := range tests {
+		if sampled := sampleTrace(test.traceID, test.ratio); sampled != test.expected {
+			t.Errorf("%x at %g: expected %t, got %t",
+				test.traceID, test.ratio, test.expected, sampled)
+		}
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	tracing = nil
+
+	r := httptest.NewRequest(http.MethodGet, capmc.XnameStatusV1, nil)
+	r.Header.Set(traceparentHeader, testTraceparent)
+	ctx, sp := startServerSpan(r, "GET")
+	if sp != nil {
+		t.Errorf("expected no span with tracing off")
+	}
+	if _, ok := spanContextFrom(ctx); ok {
+		t.Errorf("expected no span context with tracing off")
+	}
+
+	// A nil span ignores its method calls.
+	sp.setAttr("key", "value")
+	sp.setError(context.Canceled)
+	sp.finish()
+}
+
+// takeSpans returns the spans queued for export by tr.
+func takeSpans(tr *tracer) map[string]*span {
+	spans := make(map[string]*span)
+	for {
+		select {
+		case s := <-tr.queue:
+			spans[s.name] = s
+		default:
+			return spans
+		}
+	}
+}
+
+func TestTracePropagation(t *testing.T) {
+	tracing = newTracer("http://localhost/v1/traces", "capmc", 0)
+	defer func() { tracing = nil }()
+
+	var sent http.Header
+	client := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		sent = req.Header.Clone()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			Header:     make(http.Header),
+		}, nil
+	})
+	svc := CapmcD{rfClient: client, smClient: client, config: loadConfig("")}
+	svc.hsmURL, _ = url.Parse("http://localhost:27779/hsm/v2")
+
+	handler := logRequest(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := svc.GetFromHSM(r.Context(), "/State/Components", "", &struct{}{}); err != nil {
+			t.Error(err)
+		}
+		ni := &NodeInfo{Hostname: "x0c0s0b0n0", BmcType: "NodeBMC"}
+		req, _ := http.NewRequest(http.MethodGet, "https://x0c0s0b0/redfish/v1", nil)
+		rsp, err := svc.doBmcRequest(r.Context(), ni, req)
+		if err != nil {
+			t.Error(err)
+		} else {
+			rsp.Body.Close()
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// The caller's sampling decision is followed whatever the ratio.
+	r := httptest.NewRequest(http.MethodGet, capmc.XnameStatusV1, nil)
+	r.Header.Set(traceparentHeader, testTraceparent)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := takeSpans(tracing)
+	server := spans["GET "+capmc.XnameStatusV1]
+	hsm := spans["HSM GET"]
+	bmc := spans["BMC GET"]
+	if server == nil || hsm == nil || bmc == nil {
+		t.Fatalf("expected server, HSM and BMC spans, got %v", spans)
+	}
+
+	incoming, _ := parseTraceparent(testTraceparent)
+	if server.kind != spanKindServer || server.parentID != incoming.spanID {
+		t.Errorf("server span isn't a child of the caller's span")
+	}
+	for _, client := range []*span{hsm, bmc} {
+		if client.kind != spanKindClient || client.parentID != server.sc.spanID ||
+			client.sc.traceID != incoming.traceID {
+			t.Errorf("%s span isn't a child of the server span", client.name)
+		}
+	}
+
+	// The last request sent was to the BMC, which isn't passed the trace.
+	if tp := sent.Get(traceparentHeader); tp != "" {
+		t.Errorf("expected no traceparent sent to the BMC, got %s", tp)
+	}
+
+	// Requests without a trace start one, sampled by the ratio.
+	r = httptest.NewRequest(http.MethodGet, capmc.XnameStatusV1, nil)
+	r.Header.Set(traceparentHeader, "")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if spans := takeSpans(tracing); len(spans) != 0 {
+		t.Errorf("expected no spans sampled, got %v", spans)
+	}
+}
+
+func TestTraceparentSentToHSM(t *testing.T) {
+	tracing = newTracer("http://localhost/v1/traces", "capmc", 1)
+	defer func() { tracing = nil }()
+
+	var traceparent string
+	client := NewTestClient(func(req *http.Request) (*http.Response, error) {
+		traceparent = req.Header.Get(traceparentHeader)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader("{}")),
+			Header:     make(http.Header),
+		}, nil
+	})
+	svc := CapmcD{rfClient: client, smClient: client, config: loadConfig("")}
+	svc.hsmURL, _ = url.Parse("http://localhost:27779/hsm/v2")
+
+	r := httptest.NewRequest(http.MethodGet, capmc.XnameStatusV1, nil)
+	ctx, server := startServerSpan(r, "GET")
+	if err := svc.GetFromHSM(ctx, "/State/Components", "", &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	server.finish()
+
+	spans := takeSpans(tracing)
+	hsm := spans["HSM GET"]
+	if hsm == nil {
+		t.Fatalf("expected an HSM span, got %v", spans)
+	}
+	if expected := hsm.sc.traceparent(); traceparent != expected {
+		t.Errorf("expected traceparent %s, got %s", expected, traceparent)
+	}
+
+	// Calls made outside of a request aren't traced.
+	traceparent = ""
+	if err := svc.GetFromHSM(context.Background(), "/State/Components", "", &struct{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if traceparent != "" || len(takeSpans(tracing)) != 0 {
+		t.Errorf("expected no trace of a call made outside of a request")
+	}
+}
+
+func TestTracerExport(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- body
+	}))
+	defer collector.Close()
+
+	tr := newTracer(collector.URL, "capmc", 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go tr.run(ctx)
+
+	parent, _ := parseTraceparent(testTraceparent)
+	_, sp := tr.startSpan(context.Background(), "PCS POST", spanKindClient, parent)
+	sp.setAttr("http.response.status_code", 503)
+	sp.setError(context.DeadlineExceeded)
+	sp.finish()
+
+	// Stopping the tracer exports the spans still queued.
+	cancel()
+	select {
+	case <-tr.flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracer didn't stop")
+	}
+
+	var body map[string]interface{}
+	select {
+	case body = <-received:
+	default:
+		t.Fatal("no spans exported")
+	}
+
+	encoded, _ := json.Marshal(body)
+	for _, expected := range []string{
+		`"key":"service.name","value":{"stringValue":"capmc"}`,
+		`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`,
+		`"parentSpanId":"00f067aa0ba902b7"`,
+		`"name":"PCS POST"`,
+		`"kind":3`,
+		`"key":"http.response.status_code","value":{"intValue":"503"}`,
+		`"status":{"code":2,"message":"context deadline exceeded"}`,
+	} {
+		if !strings.Contains(string(encoded), expected) {
+			t.Errorf("expected %s in %s", expected, encoded)
+		}
+	}
+}
@@ -25,10 +25,23 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 )
 
+// newOperationID returns a random identifier for a power operation.
+func newOperationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(b)
+}
+
 // stringInSlice checks the slice a contains the string s
 // TODO - not a core CAPMC function, move
 func stringInSlice(s string, a []string) bool {
@@ -0,0 +1,324 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+const (
+	// webhookTimeout bounds each attempt to deliver a webhook.
+	webhookTimeout = 30 * time.Second
+	// webhookSignatureHeader carries "sha256=" followed by the hex encoded
+	// HMAC-SHA256 of the body, keyed by the webhook secret.
+	webhookSignatureHeader = "X-CAPMC-Signature"
+)
+
+// webhookNotifier sends the summaries of finished power operations to the
+// configured webhooks and the callback URLs given with the operations.
+type webhookNotifier struct {
+	client    *http.Client
+	webhooks  []Webhook
+	allowlist []string // callback URL hosts and prefixes
+	secret    string
+	retries   int
+	delay     time.Duration
+	wg        sync.WaitGroup
+}
+
+// newWebhookNotifier creates a notifier for webhooks, ignoring those with an
+// invalid URL. Callback URLs must be allowed by allowlist. Webhooks without
+// their own secret, and callback URLs, are signed with secret. Failed
+// deliveries are retried up to retries times, waiting delay before the first
+// retry and doubling it for each further one. Redirects are not followed, so
+// a receiver can't send the summaries on to somewhere else.
+func newWebhookNotifier(webhooks []Webhook, allowlist []string, secret string, retries int, delay time.Duration) *webhookNotifier {
+	var valid []Webhook
+	for _, wh := range webhooks {
+		if err := checkCallbackURL(wh.URL); err != nil {
+			log.Printf("Warning: ignoring webhook: %s", err)
+			continue
+		}
+		valid = append(valid, wh)
+	}
+
+	for _, entry := range allowlist {
+		if !strings.Contains(entry, "://") {
+			continue
+		}
+		if err := checkCallbackURL(entry); err != nil {
+			log.Printf("Warning: ignoring callback allowlist entry: %s", err)
+		}
+	}
+
+	return &webhookNotifier{
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		webhooks:  valid,
+		allowlist: allowlist,
+		secret:    secret,
+		retries:   retries,
+		delay:     delay,
+	}
+}
+
+// checkCallbackURL checks callback is an absolute http or https URL.
+func checkCallbackURL(callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid callback_url '%s'", callback)
+	}
+
+	return nil
+}
+
+// callbackAllowed reports whether callback is allowed by an entry of
+// allowlist. An entry is either a host, allowing http and https URLs on it,
+// or a URL prefix, allowing URLs with the same scheme and host whose path is
+// the prefix path or below it. A host without a port allows any port.
+func callbackAllowed(callback string, allowlist []string) bool {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range allowlist {
+		if !strings.Contains(entry, "://") {
+			host := u.Host
+			if !strings.Contains(entry, ":") {
+				host = u.Hostname()
+			}
+			if strings.EqualFold(host, entry) {
+				return true
+			}
+			continue
+		}
+
+		prefix, err := url.Parse(entry)
+		if err != nil || prefix.Host == "" ||
+			!strings.EqualFold(prefix.Scheme, u.Scheme) ||
+			!strings.EqualFold(prefix.Host, u.Host) {
+			continue
+		}
+		path := strings.TrimSuffix(prefix.Path, "/")
+		if u.Path == path || strings.HasPrefix(u.Path, path+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkCallback checks callback is a valid URL allowed by the callback
+// allowlist.
+func (n *webhookNotifier) checkCallback(callback string) error {
+	if err := checkCallbackURL(callback); err != nil {
+		return err
+	}
+	if n == nil || !callbackAllowed(callback, n.allowlist) {
+		return fmt.Errorf("callback_url '%s' is not allowed", callback)
+	}
+
+	return nil
+}
+
+// requester identifies the client making a request, by the subject of its
+// token when authenticated, otherwise by the address it connected from.
+// Headers set by the client, such as its User-Agent, are not trusted.
+func requester(r *http.Request) string {
+	if p := principalFrom(r.Context()); p != nil {
+		return p.subject
+	}
+
+	return sourceIP(r)
+}
+
+// newPowerOperationEvent summarizes the outcome data of a power operation
+// on the components nl. Components in data which are not in nl, such as
+// invalid xnames skipped with continue, are reported as failures.
+func newPowerOperationEvent(operation, command, reason, requester string, start, end time.Time, nl []*NodeInfo, data capmc.XnameControlResponse) capmc.PowerOperationEvent {
+	event := capmc.PowerOperationEvent{
+		ErrResponse: data.ErrResponse,
+		Operation:   operation,
+		Command:     command,
+		Reason:      reason,
+		Requester:   requester,
+		StartTime:   start.UTC().Format(time.RFC3339),
+		EndTime:     end.UTC().Format(time.RFC3339),
+		Duration:    end.Sub(start).Seconds(),
+	}
+
+	failed := make(map[string]*capmc.XnameControlErr)
+	for _, xe := range data.Xnames {
+		failed[xe.Xname] = xe
+	}
+
+	for _, ni := range nl {
+		result := capmc.PowerOperationResult{
+			Xname:  ni.Hostname,
+			Result: "success",
+		}
+		if xe, ok := failed[ni.Hostname]; ok {
+			result.Result = "failure"
+			result.E = xe.E
+			result.ErrMsg = xe.ErrMsg
+			delete(failed, ni.Hostname)
+		}
+		event.Xnames = append(event.Xnames, result)
+	}
+
+	for _, xe := range failed {
+		event.Xnames = append(event.Xnames, capmc.PowerOperationResult{
+			Xname:  xe.Xname,
+			Result: "failure",
+			E:      xe.E,
+			ErrMsg: xe.ErrMsg,
+		})
+	}
+
+	sort.Slice(event.Xnames, func(i, j int) bool {
+		return event.Xnames[i].Xname < event.Xnames[j].Xname
+	})
+
+	return event
+}
+
+// signWebhook returns the signature header value of body for secret.
+func signWebhook(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notify sends event to every webhook, and to callbackURL when set, in the
+// background.
+func (n *webhookNotifier) notify(event capmc.PowerOperationEvent, callbackURL string) {
+	if n == nil {
+		return
+	}
+
+	targets := append([]Webhook(nil), n.webhooks...)
+	if callbackURL != "" {
+		targets = append(targets, Webhook{URL: callbackURL})
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error: can't encode webhook for operation %s: %s",
+			event.Operation, err)
+		return
+	}
+
+	for _, wh := range targets {
+		secret := wh.Secret
+		if secret == "" {
+			secret = n.secret
+		}
+
+		n.wg.Add(1)
+		go func(target, secret string) {
+			defer n.wg.Done()
+			n.deliver(target, secret, body, event.Operation)
+		}(wh.URL, secret)
+	}
+}
+
+// deliver POSTs body to target, retrying with exponential backoff when the
+// URL can't be reached or it answers 429 or 5xx.
+func (n *webhookNotifier) deliver(target, secret string, body []byte, operation string) {
+	delay := n.delay
+
+	for attempt := 0; ; attempt++ {
+		retry, err := n.post(target, secret, body)
+		if err == nil {
+			return
+		}
+
+		if !retry || attempt >= n.retries {
+			log.Printf("Error: webhook %s for operation %s failed: %s",
+				target, operation, err)
+			return
+		}
+
+		log.Printf("Notice: webhook %s for operation %s failed, retrying in %s: %s",
+			target, operation, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes a single attempt to deliver body to target, returning whether a
+// failure is worth retrying.
+func (n *webhookNotifier) post(target, secret string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	base.SetHTTPUserAgent(req, serviceName)
+	if secret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(body, secret))
+	}
+
+	rsp, err := n.client.Do(req)
+	defer base.DrainAndCloseResponseBody(rsp)
+	if err != nil {
+		return true, err
+	}
+
+	if rsp.StatusCode >= 200 && rsp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry := rsp.StatusCode == http.StatusTooManyRequests ||
+		rsp.StatusCode >= 500
+
+	return retry, fmt.Errorf("%s", rsp.Status)
+}
@@ -0,0 +1,326 @@
+/*
+ * MIT License
+ *
+ * (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a
+ * copy of this software and associated documentation files (the "Software"),
+ * to deal in the Software without restriction, including without limitation
+ * the rights to use, copy, modify, merge, publish, distribute, sublicense,
+ * and/or sell copies of the Software, and to permit persons to whom the
+ * Software is furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included
+ * in all copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+ * THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+ * OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+ * ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+ * OTHER DEALINGS IN THE SOFTWARE.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+)
+
+func TestSignWebhook(t *testing.T) {
+	expected := "sha256=bee4d80bdd2a2995597b1cc407137a940cdbbfb5c54f2b05a70cc850e2bf16c8"
+	if sig := signWebhook([]byte(`{"operation":"x"}`), "s3cret"); sig != expected {
+		t.Errorf("expected signature %s, got %s", expected, sig)
+	}
+}
+
+func TestCheckCallbackURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://tickets.example.com/capmc", true},
+		{"http://10.1.1.1:8080/hook", true},
+		{"ftp://tickets.example.com/capmc", false},
+		{"/capmc", false},
+		{"https://", false},
+		{"://bad", false},
+	}
+
+	for _, test := range tests {
+		err := checkCallbackURL(test.url)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: expected ok %t, got %v", test.url, test.ok, err)
+		}
+	}
+}
+
+func TestRequester(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, capmc.XnameOnV1, nil)
+	req.Header.Set("User-Agent", "cray-power")
+
+	// The User-Agent is set by the client so it doesn't identify it.
+	if got := requester(req); got != "192.0.2.1" {
+		t.Errorf("Unauthenticated requester: got %q want %q", got, "192.0.2.1")
+	}
+
+	req = req.WithContext(withPrincipal(req.Context(), &principal{subject: "alice"}))
+	if got := requester(req); got != "alice" {
+		t.Errorf("Authenticated requester: got %q want %q", got, "alice")
+	}
+}
+
+func TestNewPowerOperationEvent(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	end := start.Add(90 * time.Second)
+	nl := []*NodeInfo{{Hostname: "x0c0s2b0n0"}, {Hostname: "x0c0s1b0n0"}}
+	data := capmc.XnameControlResponse{
+		ErrResponse: capmc.ErrResponse{E: -1, ErrMsg: "Errors encountered"},
+		Xnames: []*capmc.XnameControlErr{
+			capmc.MakeXnameError("x0c0s2b0n0", -1, "Timed out"),
+			capmc.MakeXnameError("x0c0s9b0n0", 22, "Invalid xname"),
+		},
+	}
+
+	expected := capmc.PowerOperationEvent{
+		ErrResponse: data.ErrResponse,
+		Operation:   "0123456789abcdef",
+		Command:     bmcCmdPowerOff,
+		Reason:      "maintenance",
+		Requester:   "cray-power",
+		StartTime:   "2026-10-19T12:00:00Z",
+		EndTime:     "2026-10-19T12:01:30Z",
+		Duration:    90,
+		Xnames: []capmc.PowerOperationResult{
+			{Xname: "x0c0s1b0n0", Result: "success"},
+			{Xname: "x0c0s2b0n0", Result: "failure", E: -1, ErrMsg: "Timed out"},
+			{Xname: "x0c0s9b0n0", Result: "failure", E: 22, ErrMsg: "Invalid xname"},
+		},
+	}
+
+	event := newPowerOperationEvent("0123456789abcdef", bmcCmdPowerOff,
+		"maintenance", "cray-power", start, end, nl, data)
+	if !reflect.DeepEqual(event, expected) {
+		t.Errorf("expected event %+v, got %+v", expected, event)
+	}
+}
+
+// webhookReceiver records the webhooks it receives, answering with codes
+// in turn and then 200.
+type webhookReceiver struct {
+	sync.Mutex
+	codes      []int
+	bodies     []string
+	signatures []string
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	wr.Lock()
+	defer wr.Unlock()
+
+	wr.bodies = append(wr.bodies, string(body))
+	wr.signatures = append(wr.signatures, r.Header.Get(webhookSignatureHeader))
+
+	code := http.StatusOK
+	if len(wr.codes) > 0 {
+		code, wr.codes = wr.codes[0], wr.codes[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	event := capmc.PowerOperationEvent{Operation: "0123456789abcdef"}
+	body, _ := json.Marshal(event)
+
+	tests := []struct {
+		name      string
+		codes     []int
+		secret    string
+		callback  bool
+		attempts  int
+		signature string
+	}{
+		{
+			name:      "Webhook",
+			secret:    "webhook",
+			attempts:  1,
+			signature: signWebhook(body, "webhook"),
+		},
+		{
+			name:      "Callback uses the default secret",
+			callback:  true,
+			attempts:  1,
+			signature: signWebhook(body, "default"),
+		},
+		{
+			name:      "Retried",
+			codes:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests},
+			attempts:  3,
+			signature: signWebhook(body, "default"),
+		},
+		{
+			name:      "Retries exhausted",
+			codes:     []int{500, 500, 500, 500},
+			attempts:  3,
+			signature: signWebhook(body, "default"),
+		},
+		{
+			name:      "Client error not retried",
+			codes:     []int{http.StatusBadRequest},
+			attempts:  1,
+			signature: signWebhook(body, "default"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wr := &webhookReceiver{codes: test.codes}
+			ts := httptest.NewServer(wr)
+			defer ts.Close()
+
+			var (
+				webhooks []Webhook
+				callback string
+			)
+			if test.callback {
+				callback = ts.URL
+			} else {
+				webhooks = []Webhook{{URL: ts.URL, Secret: test.secret}}
+			}
+
+			n := newWebhookNotifier(webhooks, nil, "default", 2, time.Millisecond)
+			n.notify(event, callback)
+			n.wg.Wait()
+
+			if len(wr.bodies) != test.attempts {
+				t.Fatalf("expected %d attempts, got %d",
+					test.attempts, len(wr.bodies))
+			}
+			for i := range wr.bodies {
+				if wr.bodies[i] != string(body) {
+					t.Errorf("expected body %s, got %s", body, wr.bodies[i])
+				}
+				if wr.signatures[i] != test.signature {
+					t.Errorf("expected signature %s, got %s",
+						test.signature, wr.signatures[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookNotifierRedirect(t *testing.T) {
+	elsewhere := &webhookReceiver{}
+	ts2 := httptest.NewServer(elsewhere)
+	defer ts2.Close()
+
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		http.Redirect(w, r, ts2.URL, http.StatusTemporaryRedirect)
+	}))
+	defer ts.Close()
+
+	n := newWebhookNotifier([]Webhook{{URL: ts.URL}}, nil, "", 2, time.Millisecond)
+	n.notify(capmc.PowerOperationEvent{Operation: "0123456789abcdef"}, "")
+	n.wg.Wait()
+
+	if attempts != 1 || len(elsewhere.bodies) != 0 {
+		t.Errorf("expected one attempt and no redirect, got %d attempts and %d redirected",
+			attempts, len(elsewhere.bodies))
+	}
+}
+
+func TestCallbackAllowed(t *testing.T) {
+	allowlist := []string{
+		"tickets.example.com",
+		"hooks.example.com:8443",
+		"https://ci.example.com/capmc/",
+	}
+
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://tickets.example.com/capmc", true},
+		{"http://TICKETS.example.com:8080/hook", true},
+		{"https://tickets.example.com.evil.com/capmc", false},
+		{"https://hooks.example.com:8443/", true},
+		{"https://hooks.example.com/", false},
+		{"https://ci.example.com/capmc", true},
+		{"https://ci.example.com/capmc/jobs/1", true},
+		{"https://ci.example.com/capmcx", false},
+		{"http://ci.example.com/capmc", false},
+		{"https://ci.example.com/other", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+	}
+
+	for _, test := range tests {
+		if ok := callbackAllowed(test.url, allowlist); ok != test.ok {
+			t.Errorf("%s: expected allowed %t, got %t", test.url, test.ok, ok)
+		}
+	}
+	if callbackAllowed("https://tickets.example.com/capmc", nil) {
+		t.Errorf("expected no callback allowed by an empty allowlist")
+	}
+}
+
+func TestWebhookNotifierIgnoresInvalidWebhooks(t *testing.T) {
+	n := newWebhookNotifier([]Webhook{
+		{URL: "https://tickets.example.com/capmc"},
+		{URL: "tickets"},
+	}, nil, "", 0, 0)
+
+	if len(n.webhooks) != 1 || n.webhooks[0].URL != "https://tickets.example.com/capmc" {
+		t.Errorf("expected only the valid webhook, got %v", n.webhooks)
+	}
+}
+
+func TestDoXnameOnBadCallbackURL(t *testing.T) {
+	svc := &CapmcD{
+		config: loadConfig(""),
+		webhooks: newWebhookNotifier(nil, []string{"tickets.example.com"},
+			"", 0, 0),
+	}
+
+	tests := []struct {
+		callback string
+		expected string
+	}{
+		{
+			callback: "tickets",
+			expected: `{"e":400,"err_msg":"Bad Request: invalid callback_url 'tickets'"}`,
+		}, {
+			callback: "http://169.254.169.254/latest",
+			expected: `{"e":400,"err_msg":"Bad Request: callback_url 'http://169.254.169.254/latest' is not allowed"}`,
+		},
+	}
+
+	for _, test := range tests {
+		body := `{"xnames":["x0c0s1b0n0"],"callback_url":"` + test.callback + `"}`
+		req := httptest.NewRequest(http.MethodPost, capmc.XnameOnV1,
+			bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+
+		svc.doXnameOn(w, req)
+
+		if w.Code != http.StatusBadRequest ||
+			strings.TrimSpace(w.Body.String()) != test.expected {
+			t.Errorf("expected %s, got %d %s", test.expected, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,448 @@
+//
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	"github.com/Cray-HPE/hms-xname/xnametypes"
+)
+
+// The xname power cap APIs are the xname and HSM group addressed
+// equivalents of get_power_cap and set_power_cap. Unlike the NID APIs they
+// can cap nodes without a NID, such as UANs, and are not restricted to
+// compute nodes.
+
+// newPowerCapXnameError creates a new PowerCapXname structure initialized as
+// an error response for the xname power cap APIs.
+func newPowerCapXnameError(xname string, ecode int, emsg string) capmc.PowerCapXname {
+	return capmc.PowerCapXname{Xname: xname, E: ecode, ErrMsg: emsg}
+}
+
+// sortPowerCapXnames sorts the per-xname results of the xname power cap APIs.
+func sortPowerCapXnames(xnames []capmc.PowerCapXname) {
+	sort.Slice(xnames, func(i, j int) bool {
+		return xnames[i].Xname < xnames[j].Xname
+	})
+}
+
+// getXnamePowerCapNodes resolves the requested xnames to nodes. Xnames which
+// are malformed, duplicated, or unknown to HSM are returned as per-xname
+// errors rather than as an error.
+func (d *CapmcD) getXnamePowerCapNodes(ctx context.Context, xnames []string) ([]*NodeInfo, []capmc.PowerCapXname, error) {
+	var xerrs []capmc.PowerCapXname
+
+	if len(xnames) == 0 {
+		return nil, nil, nil
+	}
+
+	xnames = stringSliceMap(xnames, xnametypes.NormalizeHMSCompID)
+	valid, bad := xnametypes.ValidateCompIDs(xnames, false)
+	for _, xname := range bad {
+		xerrs = append(xerrs,
+			newPowerCapXnameError(xname, 22, "Invalid or duplicate xname"))
+	}
+
+	if len(valid) == 0 {
+		return nil, xerrs, nil
+	}
+
+	query := HSMQuery{
+		ComponentIDs: valid,
+		Types:        []string{"node"},
+		ctx:          ctx,
+	}
+	nodes, err := d.GetNodesByXname(query)
+	if err != nil {
+		var compIDError *InvalidCompIDsError
+
+		if !errors.As(err, &compIDError) {
+			return nil, nil, err
+		}
+
+		for _, xname := range compIDError.CompIDs {
+			xerrs = append(xerrs,
+				newPowerCapXnameError(xname, 22, "Undefined xname"))
+		}
+	}
+
+	return nodes, xerrs, nil
+}
+
+// getGroupPowerCapNodes resolves HSM groups to their member nodes.
+func (d *CapmcD) getGroupPowerCapNodes(ctx context.Context, groups []string) ([]*NodeInfo, error) {
+	if len(groups) == 0 {
+		return nil, nil
+	}
+
+	query := HSMQuery{
+		Groups: groups,
+		Types:  []string{"node"},
+		ctx:    ctx,
+	}
+
+	return d.GetNodesByGroup(query)
+}
+
+// sendXnamePowerCapError sends the response for a failure to resolve the
+// targets of the xname power cap request r.
+func sendXnamePowerCapError(w http.ResponseWriter, r *http.Request, err error) {
+	var groupError *InvalidGroupsError
+
+	if errors.As(err, &groupError) {
+		sendJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	requestLog(r.Context()).Errorf("%s", err)
+	sendJsonError(w, http.StatusInternalServerError, err.Error())
+}
+
+// doXnamePowerCapGet is the HTTP handler for the get_xname_power_cap API
+func (d *CapmcD) doXnamePowerCapGet(w http.ResponseWriter, r *http.Request) {
+
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	var args capmc.XnamePowerCapRequest
+
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&args)
+	if err != nil {
+		if err == io.EOF {
+			sendJsonError(w, http.StatusBadRequest, "no request")
+		} else {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if len(args.Xnames) == 0 && len(args.Groups) == 0 {
+		sendJsonError(w, http.StatusBadRequest, "no xnames or groups")
+		return
+	}
+
+	requestLog(r.Context()).Infof("CAPMC Get Xname Power Cap - xnames: %v, groups: %v",
+		args.Xnames, args.Groups)
+
+	var data capmc.XnamePowerCapResponse
+
+	nodes, xerrs, err := d.getXnamePowerCapNodes(r.Context(), args.Xnames)
+	if err != nil {
+		sendXnamePowerCapError(w, r, err)
+		return
+	}
+	data.Xnames = append(data.Xnames, xerrs...)
+
+	groupNodes, err := d.getGroupPowerCapNodes(r.Context(), args.Groups)
+	if err != nil {
+		sendXnamePowerCapError(w, r, err)
+		return
+	}
+
+	// Nodes may be named both directly and through one or more groups.
+	seen := make(map[string]bool)
+	targets := []*NodeInfo{}
+	for _, node := range append(nodes, groupNodes...) {
+		if seen[node.Hostname] {
+			continue
+		}
+		seen[node.Hostname] = true
+
+		if !node.Enabled || node.State != string(base.StateReady) {
+			data.Xnames = append(data.Xnames,
+				newPowerCapXnameError(node.Hostname, 22,
+					"Invalid state, xname is not 'ready'"))
+			continue
+		}
+
+		targets = append(targets, node)
+	}
+
+	// The request contains undefined xnames or nodes that aren't ready.
+	if len(data.Xnames) > 0 {
+		data.E = 22 // EINVAL
+		data.ErrMsg = "Invalid argument"
+	}
+
+	// Only get power caps if all the xnames were 'good'.
+	if data.E == 0 {
+		var failed int
+		var apollo map[string]*capmc.PowerCapReadings
+		if args.IncludeReadings {
+			apollo = d.apolloPowerReadings(r.Context(), targets)
+		}
+		// Expand nodes list for new power control structure
+		targets = expandNodeListForControlStruct(targets)
+		cmd := bmcCmd{cmd: bmcCmdGetPowerCap}
+		waitNum, waitChan := d.queueBmcCmd(r.Context(), cmd, targets)
+		controlMap := make(map[string][]capmc.PowerCapControl)
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 {
+				data.Xnames = append(data.Xnames,
+					newPowerCapXnameError(result.ni.Hostname,
+						result.rc,
+						"Error getting power cap from xname"))
+				requestLog(r.Context()).Warnf("get power cap failed: %s", result.msg)
+				failed++
+				continue
+			}
+
+			controls, ecode, emsg := d.powerCapControls(r.Context(), result, "xname",
+				args.IncludeReadings)
+			if ecode != 0 {
+				data.Xnames = append(data.Xnames,
+					newPowerCapXnameError(result.ni.Hostname, ecode, emsg))
+				failed++
+				continue
+			}
+			addPowerReadings(controls, apollo[result.ni.Hostname])
+
+			controlMap[result.ni.Hostname] =
+				append(controlMap[result.ni.Hostname], controls...)
+		}
+
+		for xname, controls := range controlMap {
+			data.Xnames = append(data.Xnames,
+				capmc.PowerCapXname{Xname: xname, Controls: controls})
+		}
+
+		if failed > 0 {
+			data.E = 52 // EBADE ?
+			data.ErrMsg = "Invalid exchange"
+		}
+	}
+
+	if data.Xnames == nil {
+		data.Xnames = []capmc.PowerCapXname{}
+	}
+	sortPowerCapXnames(data.Xnames)
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
+
+// doXnamePowerCapSet is the HTTP handler for the set_xname_power_cap API
+func (d *CapmcD) doXnamePowerCapSet(w http.ResponseWriter, r *http.Request) {
+
+	defer base.DrainAndCloseRequestBody(r)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		sendJsonError(w, http.StatusMethodNotAllowed,
+			fmt.Sprintf("(%s) Not Allowed", r.Method))
+		return
+	}
+
+	var args capmc.SetXnamePowerCapRequest
+
+	dec := json.NewDecoder(r.Body)
+	err := dec.Decode(&args)
+	if err != nil {
+		if err == io.EOF {
+			sendJsonError(w, http.StatusBadRequest, "no request")
+		} else {
+			sendJsonError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	if len(args.Xnames) == 0 && len(args.Groups) == 0 {
+		sendJsonError(w, http.StatusBadRequest, "no xnames or groups")
+		return
+	}
+
+	var data capmc.XnamePowerCapResponse
+
+	// Map each xname to the controls requested for it. Controls given for
+	// an xname directly take precedence over those given for its groups.
+	var xnames []string
+	xnameControls := make(map[string][]capmc.PowerCapControl)
+	for _, x := range args.Xnames {
+		xname := xnametypes.NormalizeHMSCompID(x.Xname)
+		if _, ok := xnameControls[xname]; ok {
+			data.Xnames = append(data.Xnames,
+				newPowerCapXnameError(x.Xname, 22, "Duplicate xname"))
+			continue
+		}
+		xnameControls[xname] = x.Controls
+		xnames = append(xnames, xname)
+	}
+
+	var groups []string
+	for _, g := range args.Groups {
+		groups = append(groups, g.Group)
+	}
+
+	requestLog(r.Context()).Infof("CAPMC Set Xname Power Cap - xnames: %v, groups: %v",
+		xnames, groups)
+	start := time.Now()
+
+	nodes, xerrs, err := d.getXnamePowerCapNodes(r.Context(), xnames)
+	if err != nil {
+		sendXnamePowerCapError(w, r, err)
+		return
+	}
+	data.Xnames = append(data.Xnames, xerrs...)
+
+	targets := make(map[string]*NodeInfo)
+	for _, node := range nodes {
+		targets[node.Hostname] = node
+	}
+
+	fromGroup := make(map[string]string)
+	for _, g := range args.Groups {
+		groupNodes, err := d.getGroupPowerCapNodes(r.Context(), []string{g.Group})
+		if err != nil {
+			sendXnamePowerCapError(w, r, err)
+			return
+		}
+
+		for _, node := range groupNodes {
+			if _, ok := xnameControls[node.Hostname]; ok {
+				if group, ok := fromGroup[node.Hostname]; ok {
+					data.Xnames = append(data.Xnames,
+						newPowerCapXnameError(node.Hostname, 22,
+							fmt.Sprintf("Duplicate xname, member of groups %s and %s",
+								group, g.Group)))
+				}
+				continue
+			}
+			xnameControls[node.Hostname] = g.Controls
+			fromGroup[node.Hostname] = g.Group
+			targets[node.Hostname] = node
+		}
+	}
+
+	bmcCmds := make(map[*NodeInfo]bmcCmd)
+	var cmdNodes, capNodes []*NodeInfo
+	for xname, node := range targets {
+		if !node.Enabled || node.State != string(base.StateReady) {
+			data.Xnames = append(data.Xnames,
+				newPowerCapXnameError(xname, 22,
+					"Invalid state, xname is not 'ready'"))
+			continue
+		}
+
+		cmds, err := d.powerCapSetCmds(node, xnameControls[xname], "xname")
+		if err != nil {
+			data.Xnames = append(data.Xnames,
+				newPowerCapXnameError(xname, 22, err.Error()))
+			continue
+		}
+
+		for n, cmd := range cmds {
+			cmdNodes = append(cmdNodes, n)
+			bmcCmds[n] = cmd
+		}
+		capNodes = append(capNodes, node)
+	}
+
+	// The request contained invalid xnames, controls, and/or values.
+	if len(data.Xnames) > 0 {
+		data.E = 22 // EINVAL
+		data.ErrMsg = "Invalid Argument"
+	}
+
+	// There were no supported PowerControls
+	if len(bmcCmds) <= 0 {
+		requestLog(r.Context()).Infof("no supported power capping controls for request")
+		data.E = 22 // EINVAL
+		data.ErrMsg = "No supported power capping controls"
+	}
+
+	// Only set power caps if all the xnames, controls, and values were 'good'
+	changed := data.E == 0
+	if changed {
+		var failed int
+		failedXnames := make(map[string]bool)
+		waitNum, waitChan := d.queueBmcCmds(r.Context(), bmcCmds, cmdNodes)
+		for i := 0; i < waitNum; i++ {
+			result := <-waitChan
+			if result.rc != 0 {
+				data.Xnames = append(data.Xnames,
+					newPowerCapXnameError(result.ni.Hostname,
+						result.rc,
+						"Error setting power cap for xname"))
+				requestLog(r.Context()).Warnf("set power cap failed: %s", result.msg)
+				failedXnames[result.ni.Hostname] = true
+				failed++
+			}
+		}
+
+		// Remember the caps so they can be reapplied if they drift.
+		for _, node := range capNodes {
+			if !failedXnames[node.Hostname] {
+				d.powerCaps.record(node, xnameControls[node.Hostname])
+			}
+		}
+
+		if failed > 0 {
+			data.E = 52 // EBADE ?
+			data.ErrMsg = "Invalid exchange"
+		}
+	}
+
+	var capped []string
+	for xname := range targets {
+		capped = append(capped, xname)
+	}
+	failed := make(map[string]capmc.ErrResponse)
+	for _, x := range data.Xnames {
+		if x.E != 0 {
+			failed[x.Xname] = capmc.ErrResponse{E: x.E, ErrMsg: x.ErrMsg}
+		}
+	}
+
+	rec := newAuditRecord(r, newOperationID(), bmcCmdSetPowerCap, start,
+		time.Now())
+	rec.ErrResponse = data.ErrResponse
+	rec.Targets = xnames
+	rec.Groups = groups
+	rec.Xnames = auditResults(capped, failed, changed)
+	d.audit.record(r.Context(), rec)
+
+	if data.Xnames == nil {
+		data.Xnames = []capmc.PowerCapXname{}
+	}
+	sortPowerCapXnames(data.Xnames)
+
+	SendResponseJSON(w, http.StatusOK, data)
+}
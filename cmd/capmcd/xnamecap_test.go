@@ -0,0 +1,355 @@
+//
+// MIT License
+//
+// (C) Copyright [2026] Hewlett Packard Enterprise Development LP
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL
+// THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR
+// OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE,
+// ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR
+// OTHER DEALINGS IN THE SOFTWARE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	base "github.com/Cray-HPE/hms-base/v2"
+	"github.com/Cray-HPE/hms-capmc/internal/capmc"
+	compcreds "github.com/Cray-HPE/hms-compcredentials"
+	sstorage "github.com/Cray-HPE/hms-securestorage"
+)
+
+// rfStatusMock is a RoundTripper that answers every Redfish call with
+// statusCode and an empty body.
+func rfStatusMock(statusCode int) RoundTripFunc {
+	return func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			Status: fmt.Sprintf("%d %s",
+				statusCode,
+				http.StatusText(statusCode)),
+			StatusCode: statusCode,
+			Body:       ioutil.NopCloser(bytes.NewBuffer([]byte{})),
+			Header:     make(http.Header),
+			Request:    r,
+		}, nil
+	}
+}
+
+func newXnamePowerCapTestSvc(hsm *hsmMock, rf RoundTripFunc) *CapmcD {
+	ss, adapter := sstorage.NewMockAdapter()
+	ccs := compcreds.NewCompCredStore("secret/hms-cred", ss)
+	adapter.LookupData = vaultData
+	adapter.LookupNum = -1 // use mockAdapter "search" mode
+
+	svc := &CapmcD{
+		smClient: NewTestClient(hsmTestMock(hsm)),
+		rfClient: NewTestClient(rf),
+		config:   loadConfig(""),
+		ss:       ss,
+		ccs:      ccs,
+		WPool:    base.NewWorkerPool(100, 100*10),
+	}
+	svc.WPool.Run()
+	svc.hsmURL, _ = url.Parse("http://localhost")
+
+	return svc
+}
+
+func TestDoXnamePowerCapGet(t *testing.T) {
+	fourEightyFive := 485
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+	olympusRF := &rfMock{
+		PowerControl: []clientMock{
+			{
+				Body:       []byte(olympusPowerControl),
+				StatusCode: http.StatusOK,
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   io.Reader
+		ret    int
+		*hsmMock
+		*rfMock
+		e      int
+		xnames []capmc.PowerCapXname
+	}{
+		{
+			name:   "Get",
+			method: http.MethodGet,
+			ret:    http.StatusMethodNotAllowed,
+		}, {
+			name:   "Post empty",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(""),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Post no targets",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{"xnames":[]}`),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:    "Olympus",
+			method:  http.MethodPost,
+			body:    bytes.NewBufferString(`{"xnames":["x9000c1s2b0n0"]}`),
+			ret:     http.StatusOK,
+			hsmMock: olympusHSM,
+			rfMock:  olympusRF,
+			xnames: []capmc.PowerCapXname{
+				{
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapControl{
+						{Name: "Node Power Limit", Val: &sevenFifty},
+					},
+				},
+			},
+		}, {
+			name:    "Olympus with readings",
+			method:  http.MethodPost,
+			body:    bytes.NewBufferString(`{"xnames":["x9000c1s2b0n0"],"include_readings":true}`),
+			ret:     http.StatusOK,
+			hsmMock: olympusHSM,
+			rfMock:  olympusRF,
+			xnames: []capmc.PowerCapXname{
+				{
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapControl{
+						{
+							Name:     "Node Power Limit",
+							Val:      &sevenFifty,
+							Readings: &capmc.PowerCapReadings{ConsumedWatts: &fourEightyFive},
+						},
+					},
+				},
+			},
+		}, {
+			name:    "Olympus normalized",
+			method:  http.MethodPost,
+			body:    bytes.NewBufferString(`{"xnames":["X9000C1S2B0N0"]}`),
+			ret:     http.StatusOK,
+			hsmMock: olympusHSM,
+			rfMock:  olympusRF,
+			xnames: []capmc.PowerCapXname{
+				{
+					Xname: "x9000c1s2b0n0",
+					Controls: []capmc.PowerCapControl{
+						{Name: "Node Power Limit", Val: &sevenFifty},
+					},
+				},
+			},
+		}, {
+			name:    "Undefined and invalid",
+			method:  http.MethodPost,
+			body:    bytes.NewBufferString(`{"xnames":["x9000c1s2b0n0","x9000c1s2b0n1","foo"]}`),
+			ret:     http.StatusOK,
+			hsmMock: olympusHSM,
+			rfMock:  olympusRF,
+			e:       22,
+			xnames: []capmc.PowerCapXname{
+				{Xname: "foo", E: 22, ErrMsg: "Invalid or duplicate xname"},
+				{Xname: "x9000c1s2b0n1", E: 22, ErrMsg: "Undefined xname"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newXnamePowerCapTestSvc(test.hsmMock, rfTestMock(test.rfMock))
+
+			req, err := http.NewRequest(test.method,
+				capmc.XnamePowerCapGetV1, test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			svc.doXnamePowerCapGet(w, req)
+
+			if test.ret != w.Code {
+				t.Fatalf("Returned wrong status code: got %v want %v",
+					w.Code, test.ret)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response capmc.XnamePowerCapResponse
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.E != test.e {
+				t.Errorf("Returned wrong error: got %d (%s) want %d",
+					response.E, response.ErrMsg, test.e)
+			}
+
+			got, _ := json.Marshal(response.Xnames)
+			want, _ := json.Marshal(test.xnames)
+			if !bytes.Equal(got, want) {
+				t.Errorf("Returned wrong xnames: got %s want %s",
+					got, want)
+			}
+		})
+	}
+}
+
+func TestDoXnamePowerCapSet(t *testing.T) {
+	olympusHSM := &hsmMock{
+		Components: clientMock{
+			Body:       []byte(olympusComponent),
+			StatusCode: http.StatusOK,
+		},
+		ComponentEndpoints: clientMock{
+			Body:       []byte(olympusComponentEndpoint),
+			StatusCode: http.StatusOK,
+		},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   io.Reader
+		ret    int
+		*hsmMock
+		rfStatus int
+		e        int
+		xnames   []capmc.PowerCapXname
+	}{
+		{
+			name:   "Put",
+			method: http.MethodPut,
+			ret:    http.StatusMethodNotAllowed,
+		}, {
+			name:   "Post empty",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(""),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:   "Post no targets",
+			method: http.MethodPost,
+			body:   bytes.NewBufferString(`{}`),
+			ret:    http.StatusBadRequest,
+		}, {
+			name:     "Olympus",
+			method:   http.MethodPost,
+			body:     bytes.NewBufferString(`{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":500}]}]}`),
+			ret:      http.StatusOK,
+			hsmMock:  olympusHSM,
+			rfStatus: http.StatusOK,
+			xnames:   []capmc.PowerCapXname{},
+		}, {
+			name:     "Olympus BMC failure",
+			method:   http.MethodPost,
+			body:     bytes.NewBufferString(`{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":500}]}]}`),
+			ret:      http.StatusOK,
+			hsmMock:  olympusHSM,
+			rfStatus: http.StatusInternalServerError,
+			e:        52,
+		}, {
+			name:     "Out of range",
+			method:   http.MethodPost,
+			body:     bytes.NewBufferString(`{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":100}]}]}`),
+			ret:      http.StatusOK,
+			hsmMock:  olympusHSM,
+			rfStatus: http.StatusOK,
+			e:        22,
+			xnames: []capmc.PowerCapXname{
+				{
+					Xname:  "x9000c1s2b0n0",
+					E:      22,
+					ErrMsg: "Control (Node Power Limit) value (100) is less than minimum (400)",
+				},
+			},
+		}, {
+			name:     "Duplicate",
+			method:   http.MethodPost,
+			body:     bytes.NewBufferString(`{"xnames":[{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":500}]},{"xname":"x9000c1s2b0n0","controls":[{"name":"Node Power Limit","val":600}]}]}`),
+			ret:      http.StatusOK,
+			hsmMock:  olympusHSM,
+			rfStatus: http.StatusOK,
+			e:        22,
+			xnames: []capmc.PowerCapXname{
+				{Xname: "x9000c1s2b0n0", E: 22, ErrMsg: "Duplicate xname"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			svc := newXnamePowerCapTestSvc(test.hsmMock,
+				rfStatusMock(test.rfStatus))
+
+			req, err := http.NewRequest(test.method,
+				capmc.XnamePowerCapSetV1, test.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			svc.doXnamePowerCapSet(w, req)
+
+			if test.ret != w.Code {
+				t.Fatalf("Returned wrong status code: got %v want %v",
+					w.Code, test.ret)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var response capmc.XnamePowerCapResponse
+			err = json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if response.E != test.e {
+				t.Errorf("Returned wrong error: got %d (%s) want %d",
+					response.E, response.ErrMsg, test.e)
+			}
+
+			if test.xnames != nil {
+				got, _ := json.Marshal(response.Xnames)
+				want, _ := json.Marshal(test.xnames)
+				if !bytes.Equal(got, want) {
+					t.Errorf("Returned wrong xnames: got %s want %s",
+						got, want)
+				}
+			}
+		})
+	}
+}
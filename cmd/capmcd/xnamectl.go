@@ -25,6 +25,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -33,6 +34,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	base "github.com/Cray-HPE/hms-base/v2"
 	"github.com/Cray-HPE/hms-capmc/internal/capmc"
@@ -46,7 +48,7 @@ func (d *CapmcD) getCabinetType(xname string) base.HMSClass {
 
 	params := url.Values{}
 	params.Add("id", xname)
-	components, err := d.GetComponents(params.Encode())
+	components, err := d.GetComponents(context.Background(), params.Encode())
 
 	if len(components) == 1 && err == nil {
 		for _, comp := range components {
@@ -146,7 +148,7 @@ func (d *CapmcD) GenerateXnameDescendantList(query HSMQuery) ([]string, error) {
 			} else {
 				// Retrieve a list of component structures
 				// including for the xname itself on Mountain.
-				components, err := d.GetComponentsQuery(xname,
+				components, err := d.GetComponentsQuery(query.Context(), xname,
 					getRestrictStr(squery))
 				if err != nil {
 					return nil, err
@@ -187,7 +189,7 @@ func (d *CapmcD) GenerateXnamePrereqList(query HSMQuery) ([]string, error) {
 	)
 
 	xmap := make(map[string]bool)
-	compList, err := d.GetComponents(getRestrictStr(squery))
+	compList, err := d.GetComponents(query.Context(), getRestrictStr(squery))
 	if err != nil {
 		return nil, err
 	}
@@ -308,7 +310,7 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if args.Source == "" {
-		log.Printf("Info: no status source specified using Redfish")
+		requestLog(r.Context()).Infof("no status source specified using Redfish")
 		args.Source = "redfish"
 	}
 
@@ -324,7 +326,14 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var query HSMQuery
+	// Only the hardware has the details of the power status
+	if args.Verbose && useHSM {
+		sendJsonError(w, http.StatusBadRequest,
+			"verbose is only supported with the redfish status source")
+		return
+	}
+
+	query := HSMQuery{ctx: r.Context()}
 
 	if len(args.Xnames) > 0 {
 		var bad []string
@@ -355,21 +364,24 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 	// The different States are OR'd together. The Enabled flag is
 	// AND'd with the States.
 	if len(args.Filter) > 0 {
-		if filter&capmc.FilterShowHaltBit != 0 {
+		// When using Redfish the hardware reports on and off, which
+		// can't be narrowed by HSM state. Otherwise HSM states select
+		// the components wanted.
+		hwPower := !useHSM &&
+			filter&(capmc.FilterShowOffBit|capmc.FilterShowOnBit) != 0
+		if filter&capmc.FilterShowHaltBit != 0 && !hwPower {
 			query.States = append(query.States, "Halt")
 		}
-		// When using Redfish we always want the actual power states, not the
-		// ones from HSM.
-		if filter&capmc.FilterShowOffBit != 0 || useHSM == false {
+		if filter&capmc.FilterShowOffBit != 0 && useHSM {
 			query.States = append(query.States, "Off")
 		}
-		if filter&capmc.FilterShowOnBit != 0 || useHSM == false {
+		if filter&capmc.FilterShowOnBit != 0 && useHSM {
 			query.States = append(query.States, "On")
 		}
-		if filter&capmc.FilterShowReadyBit != 0 {
+		if filter&capmc.FilterShowReadyBit != 0 && !hwPower {
 			query.States = append(query.States, "Ready")
 		}
-		if filter&capmc.FilterShowStandbyBit != 0 {
+		if filter&capmc.FilterShowStandbyBit != 0 && !hwPower {
 			query.States = append(query.States, "Standby")
 		}
 		// Need to set the enabled bit if show_disabled wasn't used
@@ -393,7 +405,7 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 		compIDStr = "[all]"
 	}
 
-	log.Printf("Info: Xname power command: status, filter: %s, xnames: %v\n",
+	requestLog(r.Context()).Infof("Xname power command: status, filter: %s, xnames: %v",
 		args.Filter, compIDStr)
 
 	var data capmc.XnameStatusResponse
@@ -406,7 +418,7 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 			if _, ok := err.(*InvalidCompIDsError); ok {
 				status = http.StatusBadRequest
 			} else {
-				log.Printf("Error: %s\n", err)
+				requestLog(r.Context()).Errorf("%s", err)
 				status = http.StatusInternalServerError
 			}
 
@@ -422,7 +434,7 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 			if _, ok := err.(*InvalidCompIDsError); ok {
 				status = http.StatusBadRequest
 			} else {
-				log.Printf("Error: %s", err)
+				requestLog(r.Context()).Errorf("%s", err)
 				status = http.StatusInternalServerError
 			}
 
@@ -436,14 +448,23 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Since the hardware power state is either On or Off, be sure at least
-		// one of those filters is set so the query returns meaningful data.
-		if filter&capmc.FilterShowOffBit == 0 &&
-			filter&capmc.FilterShowOnBit == 0 {
-			filter |= capmc.FilterShowOffBit
-			filter |= capmc.FilterShowOnBit
-		}
-		data = d.doCompStatus(nl, bmcCmdPowerStatus, filter)
+		// The HSM states of powered on components are merged with the
+		// hardware power states, so get both on and off whatever the
+		// filter.
+		hwFilter := filter | capmc.FilterShowOffBit | capmc.FilterShowOnBit
+		data = d.doCompStatus(r.Context(), nl, bmcCmdPowerStatus, hwFilter)
+		mergeHSMStatus(&data, nl, filter)
+	}
+
+	if !args.Verbose {
+		data.Details = nil
+	}
+
+	// Components seen On no longer count towards MaxOffTime
+	d.offTimes.recordOn(data.On)
+	if d.config != nil {
+		data.MaxOffExceeded = d.offTimes.maxOffExceeded(data.Off,
+			d.config.NodeRules.MaxOffTime, time.Now())
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -456,9 +477,7 @@ func (d *CapmcD) doXnameStatus(w http.ResponseWriter, r *http.Request) {
 // handlers with the command filled in.
 func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, command string) {
 
-	if d.debug {
-		log.Printf("Debug: doNodeOnOffCtrl command = %s\n", command)
-	}
+	requestLog(r.Context()).Debugf("doNodeOnOffCtrl command = %s", command)
 
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", "POST")
@@ -491,6 +510,14 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 		return
 	}
 
+	if args.CallbackURL != "" {
+		if err := d.webhooks.checkCallback(args.CallbackURL); err != nil {
+			sendJsonError(w, http.StatusBadRequest,
+				fmt.Sprintf("Bad Request: %s", err))
+			return
+		}
+	}
+
 	if args.Force {
 		command, err = d.getForceOption(command)
 		if err != nil {
@@ -511,14 +538,14 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 				MakeXnameErrors(compIDError)...)
 
 			if args.Continue {
-				log.Printf("Notice: ignoring bad component ids %s\n",
+				requestLog(r.Context()).Warnf("ignoring bad component ids %s",
 					compIDError.Error())
 			} else {
 				status = http.StatusBadRequest
 				eData.ErrResponse = capmc.ErrResponseEINVAL
 			}
 		} else {
-			log.Printf("Error: %s\n", err)
+			requestLog(r.Context()).Errorf("%s", err)
 			status = http.StatusInternalServerError
 			eData.ErrResponse.E = status
 			eData.ErrResponse.ErrMsg = err.Error()
@@ -546,6 +573,23 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 		}
 	}
 
+	args.DeputyKeys, err = normalizeDeputyKeys(args.DeputyKeys)
+	if err != nil {
+		requestLog(r.Context()).Warnf("%s", err)
+		sendJsonError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Powering anything but nodes needs more than node power permission.
+	perm := xnamePowerPermission(xnames, args.Recurse, args.Prereq)
+	if !authorized(r.Context(), perm) {
+		requestLog(r.Context()).Warnf("Forbidden %s of %v, no %s permission",
+			command, xnames, perm)
+		sendJsonError(w, http.StatusForbidden,
+			fmt.Sprintf("Forbidden: %s permission required", perm))
+		return
+	}
+
 	// Some components need special cases to prevent errors and failures
 	xnames = d.handleDependentComponents(xnames, command)
 
@@ -558,7 +602,7 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 		}
 	}
 
-	var query HSMQuery
+	query := HSMQuery{ctx: r.Context()}
 
 	// A role block prevents command from working on the component. The
 	// HSM will do the filtering based on a negated role.
@@ -572,6 +616,7 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 			ComponentIDs: xnames,
 			Roles:        query.Roles,
 			States:       []string{"!Empty"},
+			ctx:          query.ctx,
 		}
 
 		switch {
@@ -618,10 +663,19 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 		return
 	}
 
-	log.Printf("Info: Xname power command: %s, xnames: %v, reason: %s\n",
-		command, xnames, args.Reason)
+	operation := newOperationID()
+	requestLog(r.Context()).Infof("Xname power command: %s, operation: %s, xnames: %v, reason: %s",
+		command, operation, xnames, args.Reason)
 
-	data := d.doCompOnOffCtrl(nl, command)
+	start := time.Now()
+	opCtx, cancel := d.operationContext(r.Context())
+	defer cancel()
+	ctx, transitions := withTransitionIDs(opCtx)
+	data := d.doCompOnOffCtrl(ctx, nl, command, compCtrlOpts{
+		waitMinOff: args.WaitMinOff,
+		deputyKeys: args.DeputyKeys,
+		operation:  operation,
+	})
 
 	// add accumulated ignored errors if any
 	if len(eData.Xnames) > 0 {
@@ -633,6 +687,26 @@ func (d *CapmcD) doXnameOnOffCtrl(w http.ResponseWriter, r *http.Request, comman
 			len(data.Xnames), len(args.Xnames), command)
 	}
 
+	end := time.Now()
+	event := newPowerOperationEvent(operation, command, args.Reason,
+		requester(r), start, end, nl, data)
+
+	rec := newAuditRecord(r, operation, command, start, end)
+	rec.ErrResponse = data.ErrResponse
+	rec.Reason = args.Reason
+	rec.Force = args.Force
+	rec.Recursive = args.Recurse
+	rec.Prereq = args.Prereq
+	rec.Targets = args.Xnames
+	rec.Xnames = event.Xnames
+	d.audit.record(r.Context(), rec)
+
+	d.history.record(newOperation(operation, command, requester(r), args,
+		start, end, nl, transitions.list(), event))
+
+	metrics.observePowerOperation(command, data.E)
+	d.webhooks.notify(event, args.CallbackURL)
+
 	SendResponseJSON(w, http.StatusOK, data)
 
 	return
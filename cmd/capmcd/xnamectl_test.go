@@ -26,6 +26,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -38,6 +39,7 @@ import (
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	base "github.com/Cray-HPE/hms-base/v2"
 	"github.com/Cray-HPE/hms-capmc/internal/capmc"
@@ -302,7 +304,7 @@ func StatusFunc() RoundTripFunc {
 	return func(req *http.Request) (*http.Response, error) {
 		//fmt.Printf("StatusFunc %s\n", req.URL.String())
 		switch req.URL.String() {
-		case "http://localhost:27779/State/Components?enabled=true&state=Off&state=On&state=Ready&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
+		case "http://localhost:27779/State/Components?enabled=true&state=Ready&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(compStatusEnabledReadyOK)),
@@ -314,7 +316,7 @@ func StatusFunc() RoundTripFunc {
 				Body:       ioutil.NopCloser(bytes.NewBufferString(x1002c0s0b0n0CompEndpoint)),
 				Header:     make(http.Header),
 			}, nil
-		case "http://localhost:27779/State/Components?enabled=true&state=Off&state=On&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
+		case "http://localhost:27779/State/Components?enabled=true&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(compStatusEnabledOnOK)),
@@ -332,7 +334,7 @@ func StatusFunc() RoundTripFunc {
 				Body:       ioutil.NopCloser(bytes.NewBufferString(x1002c0s0b1n0CompEndpoint)),
 				Header:     make(http.Header),
 			}, nil
-		case "http://localhost:27779/State/Components?enabled=true&state=Off&state=On&state=Standby&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
+		case "http://localhost:27779/State/Components?enabled=true&state=Standby&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(compStatusEnabledStandbyOK)),
@@ -344,7 +346,7 @@ func StatusFunc() RoundTripFunc {
 				Body:       ioutil.NopCloser(bytes.NewBufferString(x1002c0s0b1n1CompEndpoint)),
 				Header:     make(http.Header),
 			}, nil
-		case "http://localhost:27779/State/Components?enabled=false&state=Off&state=On&state=Ready&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
+		case "http://localhost:27779/State/Components?enabled=false&state=Ready&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(compStatusNotEnabledReadyOK)),
@@ -356,7 +358,7 @@ func StatusFunc() RoundTripFunc {
 				Body:       ioutil.NopCloser(bytes.NewBufferString(x1002c0s1b0n0CompEndpoint)),
 				Header:     make(http.Header),
 			}, nil
-		case "http://localhost:27779/State/Components?enabled=false&state=Off&state=On&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
+		case "http://localhost:27779/State/Components?enabled=false&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(compStatusNotEnabledOnOK)),
@@ -374,7 +376,7 @@ func StatusFunc() RoundTripFunc {
 				Body:       ioutil.NopCloser(bytes.NewBufferString(x1002c0s1b1n0CompEndpoint)),
 				Header:     make(http.Header),
 			}, nil
-		case "http://localhost:27779/State/Components?enabled=false&state=Off&state=On&state=Standby&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
+		case "http://localhost:27779/State/Components?enabled=false&state=Standby&type=CabinetPDUPowerConnector&type=CabinetPDUOutlet&type=Chassis&type=RouterModule&type=HSNBoard&type=ComputeModule&type=Node":
 			return &http.Response{
 				StatusCode: 200,
 				Body:       ioutil.NopCloser(bytes.NewBufferString(compStatusNotEnabledStandbyOK)),
@@ -528,7 +530,7 @@ func TestDoXnameStatus(t *testing.T) {
 			http.MethodPost,
 			bytes.NewBuffer(json.RawMessage(`{"filter":"show_ready"}`)),
 			http.StatusOK,
-			"{\"e\":0,\"err_msg\":\"\",\"on\":[\"x1002c0s0b0n0\"]}\n",
+			"{\"e\":0,\"err_msg\":\"\",\"ready\":[\"x1002c0s0b0n0\"]}\n",
 		},
 		{
 			"Enabled On OK",
@@ -542,14 +544,15 @@ func TestDoXnameStatus(t *testing.T) {
 			http.MethodPost,
 			bytes.NewBuffer(json.RawMessage(`{"filter":"show_standby"}`)),
 			http.StatusOK,
-			"{\"e\":0,\"err_msg\":\"\",\"off\":[\"x1002c0s0b1n1\"]}\n",
+			// Powered off, so not in standby whatever HSM says
+			"{\"e\":0,\"err_msg\":\"\"}\n",
 		},
 		{
 			"Not Enabled Ready OK",
 			http.MethodPost,
 			bytes.NewBuffer(json.RawMessage(`{"filter":"show_ready|show_disabled"}`)),
 			http.StatusOK,
-			"{\"e\":0,\"err_msg\":\"\",\"on\":[\"x1002c0s1b0n0\"]}\n",
+			"{\"e\":0,\"err_msg\":\"\",\"ready\":[\"x1002c0s1b0n0\"]}\n",
 		},
 		{
 			"Not Enabled On OK",
@@ -563,7 +566,21 @@ func TestDoXnameStatus(t *testing.T) {
 			http.MethodPost,
 			bytes.NewBuffer(json.RawMessage(`{"filter":"show_standby|show_disabled"}`)),
 			http.StatusOK,
-			"{\"e\":0,\"err_msg\":\"\",\"off\":[\"x1002c0s1b1n1\"]}\n",
+			"{\"e\":0,\"err_msg\":\"\"}\n",
+		},
+		{
+			"Verbose OK",
+			http.MethodPost,
+			bytes.NewBuffer(json.RawMessage(`{"filter":"show_on","verbose":true}`)),
+			http.StatusOK,
+			"{\"e\":0,\"err_msg\":\"\",\"on\":[\"x1002c0s0b0n1\"],\"details\":[{\"xname\":\"x1002c0s0b0n1\",\"power_state\":\"on\",\"management_state\":\"available\",\"supported_power_transitions\":[\"on\",\"off\"],\"last_updated\":\"2022-08-24T16:45:53.953811137Z\"}]}\n",
+		},
+		{
+			"Verbose HSM source",
+			http.MethodPost,
+			bytes.NewBuffer(json.RawMessage(`{"source":"hsm","verbose":true}`)),
+			http.StatusBadRequest,
+			"{\"e\":400,\"err_msg\":\"verbose is only supported with the redfish status source\"}\n",
 		},
 	}
 
@@ -719,3 +736,113 @@ func TestHandleDependentComponents(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeHSMStatus(t *testing.T) {
+	nl := []*NodeInfo{
+		{Hostname: "x0c0s0b0n0", State: "Ready", Flag: "OK", Enabled: true},
+		{Hostname: "x0c0s0b0n1", State: "Standby", Flag: "Alert", Enabled: true},
+		{Hostname: "x0c0s1b0n0", State: "Halt", Flag: "OK", Enabled: true},
+		{Hostname: "x0c0s1b0n1", State: "On", Flag: "Warning", Enabled: false},
+		{Hostname: "x0c0s2b0n0", State: "Ready", Flag: "OK", Enabled: true},
+		{Hostname: "x0c0s2b0n1", State: "Off", Flag: "OK", Enabled: true},
+	}
+	hardware := func() capmc.XnameStatusResponse {
+		return capmc.XnameStatusResponse{
+			On:        []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s1b0n0", "x0c0s1b0n1"},
+			Off:       []string{"x0c0s2b0n0"},
+			Undefined: []string{"x0c0s2b0n1"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter string
+		want   capmc.XnameStatusResponse
+	}{
+		{
+			name:   "Show all",
+			filter: "show_all",
+			want: capmc.XnameStatusResponse{
+				On:        []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s1b0n0", "x0c0s1b0n1"},
+				Off:       []string{"x0c0s2b0n0"},
+				Undefined: []string{"x0c0s2b0n1"},
+				Ready:     []string{"x0c0s0b0n0"},
+				Standby:   []string{"x0c0s0b0n1"},
+				Halt:      []string{"x0c0s1b0n0"},
+				Flags: &capmc.XnameStatusFlags{
+					Alert:    []string{"x0c0s0b0n1"},
+					Warning:  []string{"x0c0s1b0n1"},
+					Disabled: []string{"x0c0s1b0n1"},
+				},
+			},
+		}, {
+			name:   "Ready only",
+			filter: "show_ready",
+			want: capmc.XnameStatusResponse{
+				On:        []string{},
+				Off:       []string{},
+				Undefined: []string{"x0c0s2b0n1"},
+				Ready:     []string{"x0c0s0b0n0"},
+			},
+		}, {
+			name:   "Off and standby",
+			filter: "show_off|show_standby",
+			want: capmc.XnameStatusResponse{
+				On:        []string{},
+				Off:       []string{"x0c0s2b0n0"},
+				Undefined: []string{"x0c0s2b0n1"},
+				Standby:   []string{"x0c0s0b0n1"},
+			},
+		}, {
+			name:   "Flags",
+			filter: "show_on|show_alert",
+			want: capmc.XnameStatusResponse{
+				On:        []string{"x0c0s0b0n0", "x0c0s0b0n1", "x0c0s1b0n0", "x0c0s1b0n1"},
+				Off:       []string{},
+				Undefined: []string{"x0c0s2b0n1"},
+				Flags: &capmc.XnameStatusFlags{
+					Alert: []string{"x0c0s0b0n1"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := capmc.StatusFilterParse(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := hardware()
+			mergeHSMStatus(&got, nl, filter)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeHSMStatus() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestOperationContext(t *testing.T) {
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	d := &CapmcD{shutdown: shutdownCtx}
+
+	reqCtx, cancelReq := context.WithCancel(withRequestID(context.Background(), "req-1"))
+	opCtx, cancel := d.operationContext(reqCtx)
+	defer cancel()
+
+	cancelReq()
+	if err := opCtx.Err(); err != nil {
+		t.Fatalf("operation cancelled with its request: %s", err)
+	}
+	if id := requestIDFrom(opCtx); id != "req-1" {
+		t.Errorf("operation request ID = %q, want %q", id, "req-1")
+	}
+
+	shutdown()
+	select {
+	case <-opCtx.Done():
+	case <-time.After(time.Second):
+		t.Errorf("operation not cancelled at shutdown")
+	}
+}
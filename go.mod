@@ -10,13 +10,13 @@ require (
 	github.com/Cray-HPE/hms-securestorage v1.17.0
 	github.com/Cray-HPE/hms-smd/v2 v2.43.0
 	github.com/Cray-HPE/hms-xname v1.4.0
+	github.com/go-jose/go-jose/v4 v4.1.0
 	github.com/sirupsen/logrus v1.9.3
 )
 
 require (
 	github.com/cenkalti/backoff/v4 v4.3.0 // indirect
 	github.com/fsnotify/fsnotify v1.9.0 // indirect
-	github.com/go-jose/go-jose/v4 v4.1.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-cleanhttp v0.5.2 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
@@ -25,6 +25,7 @@
 package capmc
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strconv"
@@ -111,9 +112,10 @@ type NodeStatusResponse struct {
 
 // XnameStatusRequest is the API POST body for a get_xname_status request.
 type XnameStatusRequest struct {
-	Filter string   `json:"filter,omitempty"`
-	Source string   `json:"source,omitempty"`
-	Xnames []string `json:"xnames,omitempty"`
+	Filter  string   `json:"filter,omitempty"`
+	Source  string   `json:"source,omitempty"`
+	Xnames  []string `json:"xnames,omitempty"`
+	Verbose bool     `json:"verbose,omitempty"`
 }
 
 // XnameStatusRequest contains arrays of the possible HMSFlags.
@@ -154,6 +156,46 @@ type XnameStatusResponse struct {
 	Unknown      []string          `json:"unknown,omitempty"`
 	Unresponsive []string          `json:"unresponsive,omitempty"`
 	Flags        *XnameStatusFlags `json:"flags,omitempty"`
+	// MaxOffExceeded lists components which have been off longer than
+	// the NodeRules MaxOffTime.
+	MaxOffExceeded []string `json:"max_off_exceeded,omitempty"`
+	// Backends maps each component to the backend, pcs or redfish, which
+	// reported its state when CAPMC can fail over from PCS.
+	Backends map[string]string `json:"backends,omitempty"`
+	// Details holds the power status of each component in verbose mode.
+	Details []XnamePowerStatus `json:"details,omitempty"`
+}
+
+// XnamePowerStatus is the power status of a component as reported by the
+// hardware, returned by get_xname_status in verbose mode.
+type XnamePowerStatus struct {
+	Xname string `json:"xname"`
+	// PowerState is on, off or undefined.
+	PowerState string `json:"power_state"`
+	// ManagementState is available or unavailable, depending on whether
+	// the component's BMC could be reached.
+	ManagementState           string   `json:"management_state,omitempty"`
+	SupportedPowerTransitions []string `json:"supported_power_transitions,omitempty"`
+	// LastUpdated is when the power state was last read from the BMC.
+	LastUpdated string `json:"last_updated,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// XnameStatusEvent is a change in the power state of a component, pushed to
+// the subscribers of the xname_status stream.
+type XnameStatusEvent struct {
+	Xname      string `json:"xname"`
+	PowerState string `json:"power_state"`
+	// PreviousPowerState is omitted from the first event for a component,
+	// which carries its power state when the subscription started.
+	PreviousPowerState string `json:"previous_power_state,omitempty"`
+	Timestamp          string `json:"timestamp"`
+}
+
+// LogLevel is the level the service logs at: error, warning, info, debug or
+// trace.
+type LogLevel struct {
+	Level string `json:"level"`
 }
 
 // The original node status API uses a pipe delimited string to pass
@@ -368,6 +410,9 @@ func MakeXnameError(xname string, err int, msg string) *XnameControlErr {
 type XnameControlResponse struct {
 	ErrResponse
 	Xnames []*XnameControlErr `json:"xnames,omitempty"`
+	// Backends maps each component to the backend, pcs or redfish, which
+	// performed its power operation when CAPMC can fail over from PCS.
+	Backends map[string]string `json:"backends,omitempty"`
 }
 
 // Node Capabilities and Power Control
@@ -381,6 +426,11 @@ type NidlistRequest struct {
 	Nids []int `json:"nids"`
 }
 
+type GetPowerCapRequest struct {
+	Nids            []int `json:"nids"`
+	IncludeReadings bool  `json:"include_readings,omitempty"`
+}
+
 type PowerCapCapabilityControl struct {
 	Name string `json:"name"`
 	Desc string `json:"desc"`
@@ -407,8 +457,20 @@ type GetPowerCapCapabilitiesResponse struct {
 }
 
 type PowerCapControl struct {
-	Name string `json:"name"`
-	Val  *int   `json:"val"`
+	Name     string            `json:"name"`
+	Val      *int              `json:"val"`
+	Readings *PowerCapReadings `json:"readings,omitempty"`
+}
+
+// PowerCapReadings are the power readings a BMC reports alongside a power
+// cap control. Readings the BMC does not report are omitted.
+type PowerCapReadings struct {
+	ConsumedWatts *int `json:"consumed_watts,omitempty"`
+	AverageWatts  *int `json:"average_watts,omitempty"`
+	MinWatts      *int `json:"min_watts,omitempty"`
+	MaxWatts      *int `json:"max_watts,omitempty"`
+	IntervalInMin *int `json:"interval_in_min,omitempty"`
+	IdleWatts     *int `json:"idle_watts,omitempty"`
 }
 
 // On error, this struct contains Nid, E, and ErrMsg. Otherwise, it contains
@@ -427,7 +489,146 @@ type PowerCapResponse struct {
 }
 
 type SetPowerCapRequest struct {
-	Nids []PowerCapNid `json:"nids"`
+	Nids         []PowerCapNid `json:"nids"`
+	ValidateOnly bool          `json:"validate_only,omitempty"`
+}
+
+// PowerCapValidateControl reports how a requested control resolved against
+// the power capping controls of a node and whether its value is in range.
+type PowerCapValidateControl struct {
+	Name     string `json:"name"`
+	Val      *int   `json:"val"`
+	Resolved bool   `json:"resolved"`
+	Path     string `json:"path,omitempty"`
+	Min      int    `json:"min"`
+	Max      int    `json:"max"`
+	E        int    `json:"e,omitempty"` // Error code
+	ErrMsg   string `json:"err_msg,omitempty"`
+}
+
+// PowerCapPayload is a Redfish request that would be sent to a BMC.
+type PowerCapPayload struct {
+	Method  string          `json:"method"`
+	URL     string          `json:"url"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+type PowerCapValidateNid struct {
+	Nid      int                       `json:"nid"`
+	Xname    string                    `json:"xname,omitempty"`
+	Controls []PowerCapValidateControl `json:"controls,omitempty"`
+	Payloads []PowerCapPayload         `json:"payloads,omitempty"`
+	E        int                       `json:"e,omitempty"` // Error code
+	ErrMsg   string                    `json:"err_msg,omitempty"`
+}
+
+// set_power_cap with validate_only
+type PowerCapValidateResponse struct {
+	ErrResponse
+	Nids []PowerCapValidateNid `json:"nids"`
+}
+
+// Same for get_xname_power_cap
+type XnamePowerCapRequest struct {
+	Xnames          []string `json:"xnames,omitempty"`
+	Groups          []string `json:"groups,omitempty"`
+	IncludeReadings bool     `json:"include_readings,omitempty"`
+}
+
+// On error, this struct contains Xname, E, and ErrMsg. Otherwise, it contains
+// Xname and Controls.
+type PowerCapXname struct {
+	Xname    string            `json:"xname"`
+	Controls []PowerCapControl `json:"controls,omitempty"`
+	E        int               `json:"e,omitempty"` // Error code
+	ErrMsg   string            `json:"err_msg,omitempty"`
+}
+
+// Same for get_xname_power_cap, set_xname_power_cap
+type XnamePowerCapResponse struct {
+	ErrResponse
+	Xnames []PowerCapXname `json:"xnames"`
+}
+
+// PowerCapDriftControl is a power cap control whose value on the BMC no
+// longer matches the value last set through CAPMC.
+type PowerCapDriftControl struct {
+	Name    string `json:"name"`
+	Desired int    `json:"desired"`
+	Actual  int    `json:"actual"`
+}
+
+// PowerCapDriftXname describes the power cap drift detected on a node. E and
+// ErrMsg are set if the desired caps could not be reapplied.
+type PowerCapDriftXname struct {
+	Xname     string                 `json:"xname"`
+	Controls  []PowerCapDriftControl `json:"controls"`
+	FirstSeen string                 `json:"first_seen"`
+	LastSeen  string                 `json:"last_seen"`
+	Reapplied bool                   `json:"reapplied"`
+	E         int                    `json:"e,omitempty"` // Error code
+	ErrMsg    string                 `json:"err_msg,omitempty"`
+}
+
+type PowerCapDriftResponse struct {
+	ErrResponse
+	LastCheck string               `json:"last_check,omitempty"`
+	Xnames    []PowerCapDriftXname `json:"xnames"`
+}
+
+// PowerCapGroupControls applies the same controls to every node in an HSM
+// group.
+type PowerCapGroupControls struct {
+	Group    string            `json:"group"`
+	Controls []PowerCapControl `json:"controls"`
+}
+
+type SetXnamePowerCapRequest struct {
+	Xnames []PowerCapXname         `json:"xnames,omitempty"`
+	Groups []PowerCapGroupControls `json:"groups,omitempty"`
+}
+
+// PowerCapScheduleWindow is a daily window during which a power cap
+// schedule applies, e.g. peak tariff hours. Start and End are "HH:MM" in the
+// Timezone of the schedule, UTC unless given; a window whose End is not
+// after its Start ends the next day. Days restricts the window to the days it starts on
+// ("Mon", "Tue", ...), every day if empty.
+type PowerCapScheduleWindow struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// PowerCapSchedule applies power cap controls to a set of nodes between its
+// Start and End times (RFC3339), or during a recurring Window bounded by
+// them, restoring the previous caps afterwards. The Window is in the IANA
+// Timezone given, or UTC. ID and State are assigned by CAPMC.
+type PowerCapSchedule struct {
+	ID       string                  `json:"id,omitempty"`
+	Desc     string                  `json:"desc,omitempty"`
+	Nids     []int                   `json:"nids,omitempty"`
+	Xnames   []string                `json:"xnames,omitempty"`
+	Groups   []string                `json:"groups,omitempty"`
+	Controls []PowerCapControl       `json:"controls"`
+	Start    string                  `json:"start,omitempty"`
+	End      string                  `json:"end,omitempty"`
+	Window   *PowerCapScheduleWindow `json:"window,omitempty"`
+	Timezone string                  `json:"timezone,omitempty"`
+	State    string                  `json:"state,omitempty"`
+	E        int                     `json:"e,omitempty"` // Error code
+	ErrMsg   string                  `json:"err_msg,omitempty"`
+}
+
+// PowerCapSchedulesResponse is returned by power_cap_schedules requests.
+type PowerCapSchedulesResponse struct {
+	ErrResponse
+	Schedules []PowerCapSchedule `json:"schedules"`
+}
+
+// PowerCapScheduleDelete is the body of a power_cap_schedules DELETE
+// request.
+type PowerCapScheduleDelete struct {
+	IDs []string `json:"ids"`
 }
 
 type PowerBiasNid struct {
@@ -707,6 +908,23 @@ type GetSystemParametersResponse struct {
 	PowerBandMax   int  `json:"power_band_max"`
 }
 
+// SetSystemPowerBudgetRequest distributes a system wide power budget, in
+// watts, across the ready compute nodes. A PowerBudget of zero uses the
+// configured PowerCapTarget. Bias optionally weights the share of the
+// budget given to individual NIDs; the default weight is 1.
+type SetSystemPowerBudgetRequest struct {
+	PowerBudget int            `json:"power_budget"`
+	Bias        []PowerBiasNid `json:"bias,omitempty"`
+}
+
+type SetSystemPowerBudgetResponse struct {
+	ErrResponse
+	PowerBudget int           `json:"power_budget"`
+	StaticPower int           `json:"static_power"`
+	Allocated   int           `json:"allocated"`
+	Nids        []PowerCapNid `json:"nids"`
+}
+
 // Same for get_system_power_request, get_system_power_details
 type TimeWindowRequest struct {
 	StartTime string `json:"start_time"`
@@ -749,6 +967,113 @@ type XnameControl struct {
 	Recurse  bool     `json:"recursive,omitempty"`
 	Prereq   bool     `json:"prereq,omitempty"`
 	Continue bool     `json:"continue,omitempty"`
+	// WaitMinOff delays, rather than rejects, powering on components
+	// that have not yet been off for the NodeRules MinOffTime.
+	WaitMinOff bool `json:"wait_min_off,omitempty"`
+	// DeputyKeys are HSM reservation deputy keys, keyed by xname, for
+	// components the caller has already reserved.
+	DeputyKeys map[string]string `json:"deputy_keys,omitempty"`
+	// CallbackURL is sent a PowerOperationEvent when the operation
+	// finishes.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// PowerOperationEvent summarizes a finished power operation. It is POSTed
+// to the operation's callback URL and the configured webhooks.
+type PowerOperationEvent struct {
+	ErrResponse
+	Operation string `json:"operation"`
+	Command   string `json:"command"`
+	Reason    string `json:"reason,omitempty"`
+	Requester string `json:"requester,omitempty"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	// Duration is the length of the operation in seconds.
+	Duration float64                `json:"duration"`
+	Xnames   []PowerOperationResult `json:"xnames"`
+}
+
+// PowerOperationResult is the outcome of a power operation for a component.
+type PowerOperationResult struct {
+	Xname string `json:"xname"`
+	// Result is success or failure. Audit records also use skipped, for
+	// components left unchanged because the call failed before they were
+	// changed.
+	Result string `json:"result"`
+	E      int    `json:"e,omitempty"`
+	ErrMsg string `json:"err_msg,omitempty"`
+}
+
+// Audit Log
+// --------------------------------------------------------
+
+// AuditRecord records a call which changed, or tried to change, the power
+// of components. E and ErrMsg are the outcome of the call.
+type AuditRecord struct {
+	ErrResponse
+	// ID is the operation ID of the call.
+	ID        string `json:"id"`
+	RequestID string `json:"request_id,omitempty"`
+	// API is the API called, e.g. xname_off or set_power_cap.
+	API string `json:"api"`
+	// Command is the power command, e.g. On, ForceOff or SetPowerCap.
+	Command  string `json:"command"`
+	Caller   string `json:"caller"`
+	SourceIP string `json:"source_ip"`
+	// ForwardedFor is the X-Forwarded-For header of the call, as given.
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	// UserAgent is the User-Agent header of the call, as given.
+	UserAgent string `json:"user_agent,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	Force     bool   `json:"force"`
+	Recursive bool   `json:"recursive"`
+	Prereq    bool   `json:"prereq"`
+	// Targets, Groups and Nids are the components as requested by the
+	// caller, Xnames the components they expanded to with the outcome
+	// for each.
+	Targets   []string               `json:"targets,omitempty"`
+	Groups    []string               `json:"groups,omitempty"`
+	Nids      []int                  `json:"nids,omitempty"`
+	StartTime string                 `json:"start_time"`
+	EndTime   string                 `json:"end_time"`
+	Xnames    []PowerOperationResult `json:"xnames"`
+}
+
+// AuditResponse is the response to the audit API, the matching records
+// oldest first.
+type AuditResponse struct {
+	ErrResponse
+	Records []AuditRecord `json:"records"`
+}
+
+// Operation History
+// --------------------------------------------------------
+
+// Operation is the history of a finished xname power operation. E and
+// ErrMsg are its outcome.
+type Operation struct {
+	ErrResponse
+	ID        string `json:"id"`
+	Command   string `json:"command"`
+	Requester string `json:"requester,omitempty"`
+	// Request is the request which started the operation, without its
+	// deputy keys and callback URL.
+	Request XnameControl `json:"request"`
+	// Targets are the components the requested xnames expanded to.
+	Targets []string `json:"targets"`
+	// TransitionIDs are the IDs of the PCS transitions made by the
+	// operation.
+	TransitionIDs []string               `json:"transition_ids,omitempty"`
+	StartTime     string                 `json:"start_time"`
+	EndTime       string                 `json:"end_time"`
+	Xnames        []PowerOperationResult `json:"xnames"`
+}
+
+// OperationsResponse is the response to the operations API, the matching
+// operations oldest first.
+type OperationsResponse struct {
+	ErrResponse
+	Operations []Operation `json:"operations"`
 }
 
 // Group Component Capabilities and Control
@@ -762,6 +1087,32 @@ type GroupControl struct {
 	Reason string   `json:"reason,omitempty"`
 }
 
+// Reservations
+// --------------------------------------------------------
+
+// ReservationInfo describes an HSM reservation held by CAPMC and the power
+// operation which acquired it.
+type ReservationInfo struct {
+	Xname      string `json:"xname"`
+	Expiration string `json:"expiration"`
+	Operation  string `json:"operation,omitempty"`
+	Command    string `json:"command,omitempty"`
+	Acquired   string `json:"acquired,omitempty"`
+}
+
+// ReservationsResponse is returned by a reservations GET request.
+type ReservationsResponse struct {
+	ErrResponse
+	Reservations []ReservationInfo `json:"reservations"`
+}
+
+// ReservationRelease is the body of a reservations DELETE request. The
+// response is an XnameControlResponse.
+type ReservationRelease struct {
+	Xnames []string `json:"xnames"`
+	Reason string   `json:"reason,omitempty"`
+}
+
 // Utility Functions
 // --------------------------------------------------------
 
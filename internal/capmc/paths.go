@@ -31,15 +31,29 @@ package capmc
 
 // The Shasta implementation of the Cascade CAPMC APIs
 const (
+	AuditV1                = "/capmc/v1/audit"
 	ComputeNodeControlV1   = "/capmc/v1/cnctl"
 	HealthV1               = "/capmc/v1/health"
 	LivenessV1             = "/capmc/v1/liveness"
+	LogLevelV1             = "/capmc/v1/log_level"
+	OperationsV1           = "/capmc/v1/operations"
 	PowerCapCapabilitiesV1 = "/capmc/v1/get_power_cap_capabilities"
+	PowerCapDriftV1        = "/capmc/v1/get_power_cap_drift"
 	PowerCapGetV1          = "/capmc/v1/get_power_cap"
+	PowerCapSchedulesV1    = "/capmc/v1/power_cap_schedules"
 	PowerCapSetV1          = "/capmc/v1/set_power_cap"
 	ReadinessV1            = "/capmc/v1/readiness"
+	ReservationsV1         = "/capmc/v1/reservations"
+	SystemPowerBudgetSetV1 = "/capmc/v1/set_system_power_budget"
 	XnameOffV1             = "/capmc/v1/xname_off"
 	XnameOnV1              = "/capmc/v1/xname_on"
+	XnamePowerCapGetV1     = "/capmc/v1/get_xname_power_cap"
+	XnamePowerCapSetV1     = "/capmc/v1/set_xname_power_cap"
 	XnameReinitV1          = "/capmc/v1/xname_reinit"
 	XnameStatusV1          = "/capmc/v1/get_xname_status"
+	XnameStatusStreamV1    = "/capmc/v1/xname_status/stream"
 )
+
+// Metrics is the Prometheus metrics API, at the path Prometheus scrapes by
+// default rather than under the versioned CAPMC paths.
+const Metrics = "/metrics"
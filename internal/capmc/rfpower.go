@@ -125,6 +125,14 @@ type RFControl struct {
 	SettingRangeMax     *int      `json:"SettingRangeMax,omitempty"`
 	SettingRangeMin     *int      `json:"SettingRangeMin,omitempty"`
 	Status              *StatusRF `json:"Status,omitempty"`
+	Sensor              *SensorRF `json:"Sensor,omitempty"`
+}
+
+// SensorRF struct used to unmarshal the reading of the sensor a Redfish
+// Control.v1_0_0 control acts on
+type SensorRF struct {
+	DataSourceUri string   `json:"DataSourceUri,omitempty"`
+	Reading       *float64 `json:"Reading,omitempty"`
 }
 
 // PowerControlOEM contains a pointer to the OEM specific information